@@ -0,0 +1,385 @@
+package FileSystem
+
+import (
+	"fmt"
+	"math/bits"
+	"sort"
+)
+
+// Block allocation policies
+// Which free block allocateNewBlock hands out is up to an Allocator. There are four built in:
+//
+//	first-fit - the lowest free block, what we always used to do
+//	next-fit  - the first free block after the last one handed out, going round to the start
+//	best-fit  - the first block of the smallest run of free blocks, so big runs stay big
+//	buddy     - a binary buddy allocator: the data blocks are split into power of two sized buddy
+//	            blocks, aligned to their size, and a block comes out of the smallest free buddy
+//	            block there is
+//
+// A file's blocks are asked for all at once (see placeFileBlocks), and with delayed allocation (see
+// DelayedAlloc.go) only once everything written to it so far is known, so the built in allocators can
+// hand out runs of blocks as well - each picks a run the way it would pick a block, one long enough if
+// there is one, and otherwise the longest run going so the request takes as few pieces as it can.
+//
+// None of them keep free lists of their own, they look at the free block bitmap every time, so blocks
+// freed by Unlink, fsck or anything else are there for them without being told. The buddy allocator
+// works out its buddy blocks from the bitmap the same way.
+//
+// Format saves one of the built in allocators in the superblock for every mount to use, and Mount can
+// use a different one for just that mount - including ones registered with RegisterAllocator.
+
+const (
+	ALLOC_FIRST_FIT = iota
+	ALLOC_NEXT_FIT
+	ALLOC_BEST_FIT
+	ALLOC_BUDDY
+)
+
+// allocatorNames are the built in allocators, in the order of their numbers in the superblock
+var allocatorNames = []string{"first-fit", "next-fit", "best-fit", "buddy"}
+
+// FreeSpace is the free block bitmap as an Allocator sees it
+type FreeSpace interface {
+	Start() int //where to start looking - the data blocks of the block group the block is wanted in
+	End() int   //one past the last block
+	IsFree(blockNum int) bool
+	NextFree(start int) int //the first free block at or after start, -1 if there isn't one
+	NextUsed(start int) int //the first block in use at or after start, End() if there isn't one
+}
+
+// Allocator picks the block allocateNewBlock hands out next. Pick is called with the free block
+// bitmap locked, so it only ever runs one at a time and mustn't call back into the file system
+type Allocator interface {
+	Pick(space FreeSpace) int //a free block, or -1 if there isn't one
+}
+
+// RunAllocator is an Allocator that can hand out runs of blocks. allocateBlocks uses PickRun when it is
+// there and calls Pick once a block when it isn't
+type RunAllocator interface {
+	Allocator
+	PickRun(space FreeSpace, count int) (start int, length int) //up to count free blocks from start, -1 and 0 if there aren't any
+}
+
+// allocators makes a new allocator of each kind for every mount, so they don't share any state
+var allocators = map[string]func() Allocator{
+	"first-fit": func() Allocator { return firstFit{} },
+	"next-fit":  func() Allocator { return &nextFit{} },
+	"best-fit":  func() Allocator { return bestFit{} },
+	"buddy":     func() Allocator { return buddy{} },
+}
+
+// blockAllocator is the mounted file system's allocator and allocatorName what it is called, they only
+// change while holding mountLock exclusively
+var (
+	blockAllocator Allocator = firstFit{}
+	allocatorName            = "first-fit"
+)
+
+// RegisterAllocator adds an allocator Mount can be asked to use by name
+func RegisterAllocator(name string, newAllocator func() Allocator) error {
+	defer lockExclusive()()
+	if _, ok := allocators[name]; ok {
+		return fmt.Errorf("there is already an allocator called %s", name)
+	}
+	allocators[name] = newAllocator
+	return nil
+}
+
+// Allocators lists the names of every allocator there is
+func Allocators() []string {
+	defer lockShared()()
+	names := []string{}
+	for name := range allocators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// allocatorNumber is what the superblock stores for one of the built in allocators
+func allocatorNumber(name string) (int, error) {
+	if name == "" {
+		return ALLOC_FIRST_FIT, nil
+	}
+	for num, builtIn := range allocatorNames {
+		if name == builtIn {
+			return num, nil
+		}
+	}
+	if _, ok := allocators[name]; ok {
+		return 0, fmt.Errorf("only the built in allocators can be saved with the file system, ask Mount for %s", name)
+	}
+	return 0, fmt.Errorf("there is no allocator called %s", name)
+}
+
+// useAllocator sets up the allocator for a mount, name overrides the one the superblock has
+func useAllocator(sblock SuperBlock, name string) error {
+	if name == "" {
+		if sblock.Allocator < 0 || sblock.Allocator >= len(allocatorNames) {
+			return fmt.Errorf("superblock asks for allocator %d which we don't have", sblock.Allocator)
+		}
+		name = allocatorNames[sblock.Allocator]
+	}
+	newAllocator, ok := allocators[name]
+	if !ok {
+		return fmt.Errorf("there is no allocator called %s", name)
+	}
+	blockAllocator, allocatorName = newAllocator(), name
+	return nil
+}
+
+type firstFit struct{}
+
+func (firstFit) Pick(space FreeSpace) int {
+	return space.NextFree(space.Start())
+}
+
+func (firstFit) PickRun(space FreeSpace, count int) (int, int) {
+	return firstRun(space, space.Start(), count)
+}
+
+// firstRun finds the first run of at least count free blocks at or after from, or if there isn't one
+// the longest run there is. The length is never more than count
+func firstRun(space FreeSpace, from int, count int) (int, int) {
+	longest, longestSize := -1, 0
+	for start := space.NextFree(from); start >= 0; {
+		end := space.NextUsed(start)
+		if end-start >= count {
+			return start, count
+		}
+		if end-start > longestSize {
+			longest, longestSize = start, end-start
+		}
+		if end >= space.End() {
+			break
+		}
+		start = space.NextFree(end)
+	}
+	return longest, longestSize
+}
+
+type nextFit struct {
+	next int
+}
+
+func (allocator *nextFit) Pick(space FreeSpace) int {
+	if allocator.next < space.Start() || allocator.next >= space.End() {
+		allocator.next = space.Start()
+	}
+	blockNum := space.NextFree(allocator.next)
+	if blockNum < 0 {
+		blockNum = space.NextFree(space.Start()) //go round
+	}
+	if blockNum >= 0 {
+		allocator.next = blockNum + 1
+	}
+	return blockNum
+}
+
+func (allocator *nextFit) PickRun(space FreeSpace, count int) (int, int) {
+	if allocator.next < space.Start() || allocator.next >= space.End() {
+		allocator.next = space.Start()
+	}
+	start, length := firstRun(space, allocator.next, count)
+	if length < count {
+		if wrapped, wrappedLength := firstRun(space, space.Start(), count); wrappedLength > length {
+			start, length = wrapped, wrappedLength //go round
+		}
+	}
+	if length > 0 {
+		allocator.next = start + length
+	}
+	return start, length
+}
+
+type bestFit struct{}
+
+func (bestFit) Pick(space FreeSpace) int {
+	best, bestSize := -1, 0
+	for start := space.NextFree(space.Start()); start >= 0; {
+		end := space.NextUsed(start)
+		if best < 0 || end-start < bestSize {
+			best, bestSize = start, end-start
+			if bestSize == 1 {
+				break //can't do better than an exact fit
+			}
+		}
+		if end >= space.End() {
+			break
+		}
+		start = space.NextFree(end)
+	}
+	return best
+}
+
+// PickRun takes the smallest run that is long enough, or the longest if none of them are
+func (bestFit) PickRun(space FreeSpace, count int) (int, int) {
+	best, bestSize := -1, 0
+	for start := space.NextFree(space.Start()); start >= 0; {
+		end := space.NextUsed(start)
+		size := end - start
+		if best < 0 || bestSize < count && size > bestSize || size >= count && size < bestSize {
+			best, bestSize = start, size
+			if bestSize == count {
+				break
+			}
+		}
+		if end >= space.End() {
+			break
+		}
+		start = space.NextFree(end)
+	}
+	return best, min(bestSize, count)
+}
+
+type buddy struct{}
+
+// Pick splits each run of free blocks into the biggest buddy blocks that fit in it and takes the first
+// block of the smallest one. In a buddy system that is the free list we would take from, and handing
+// out its first block leaves its other half (and the halves of that) free as buddies of each other
+func (buddy) Pick(space FreeSpace) int {
+	best, bestOrder := -1, 0
+	for start := space.NextFree(space.Start()); start >= 0; {
+		end := space.NextUsed(start)
+		for blockNum := start; blockNum < end; {
+			order := buddyOrder(blockNum-space.Start(), end-blockNum)
+			if best < 0 || order < bestOrder {
+				best, bestOrder = blockNum, order
+				if order == 0 {
+					return best
+				}
+			}
+			blockNum += 1 << order
+		}
+		if end >= space.End() {
+			break
+		}
+		start = space.NextFree(end)
+	}
+	return best
+}
+
+// PickRun takes the smallest buddy block that holds count blocks, or the biggest one there is if none
+// of them do
+func (buddy) PickRun(space FreeSpace, count int) (int, int) {
+	want := bits.Len(uint(count - 1)) //count rounded up to a power of two
+	best, bestOrder := -1, 0
+	for start := space.NextFree(space.Start()); start >= 0; {
+		end := space.NextUsed(start)
+		for blockNum := start; blockNum < end; {
+			order := buddyOrder(blockNum-space.Start(), end-blockNum)
+			if best < 0 || bestOrder < want && order > bestOrder || order >= want && order < bestOrder {
+				best, bestOrder = blockNum, order
+				if order == want {
+					return best, count
+				}
+			}
+			blockNum += 1 << order
+		}
+		if end >= space.End() {
+			break
+		}
+		start = space.NextFree(end)
+	}
+	if best < 0 {
+		return -1, 0
+	}
+	return best, min(1<<bestOrder, count)
+}
+
+// buddyOrder is the size, as a power of two, of the biggest buddy block starting offset blocks into
+// the data blocks that fits in room blocks
+func buddyOrder(offset int, room int) int {
+	order := bits.Len(uint(room)) - 1 //the biggest power of two that fits
+	if offset != 0 {
+		if aligned := bits.TrailingZeros(uint(offset)); aligned < order {
+			order = aligned //a buddy block has to start at a multiple of its size
+		}
+	}
+	return order
+}
+
+// bitmapSpace lets an Allocator look at a bitmap the caller already has locked
+type bitmapSpace struct {
+	bitmap *Bitmap
+	start  int
+}
+
+func (space bitmapSpace) Start() int               { return space.start }
+func (space bitmapSpace) End() int                 { return space.bitmap.numBits }
+func (space bitmapSpace) IsFree(blockNum int) bool { return !space.bitmap.isSet(blockNum) }
+func (space bitmapSpace) NextFree(start int) int   { return space.bitmap.findFree(start) }
+func (space bitmapSpace) NextUsed(start int) int   { return space.bitmap.findUsed(start) }
+
+// FragmentationStats says how broken up the free space and the files are, to compare allocators with
+type FragmentationStats struct {
+	Allocator         string
+	FreeBlocks        int
+	FreeExtents       int     //runs of free blocks
+	LargestFreeExtent int     //blocks in the longest run
+	FreeFragmentation float64 //0 when the free space is all one run, nearer 1 the more it is broken up
+	CopyOnWrite       bool    //the file counts are left at 0, see Fragmentation
+	Files             int
+	FragmentedFiles   int     //files whose blocks aren't all one after the other
+	FileExtents       int     //runs of blocks over all the files
+	ExtentsPerFile    float64 //1 is perfect
+}
+
+// fileExtents is how many runs of blocks one after the other a file's blocks make
+func fileExtents(blocks []int) int {
+	if len(blocks) == 0 {
+		return 0
+	}
+	extents := 1
+	for num := 1; num < len(blocks); num++ {
+		if blocks[num] != blocks[num-1]+1 {
+			extents++
+		}
+	}
+	return extents
+}
+
+// Fragmentation walks the free block bitmap and every file to see how fragmented things are, once the
+// writes waiting for their blocks have them (see DelayedAlloc.go). Only files
+// are counted, the same ones Defragment would move - directories stay where they are. On a copy on write
+// file system a file's block numbers are logical ones the map can put anywhere and Defragment refuses to
+// touch them, so only the free space is looked at and CopyOnWrite says the file counts were skipped
+func Fragmentation() (FragmentationStats, error) {
+	defer lockShared()()
+	if Disk == nil {
+		return FragmentationStats{}, fmt.Errorf("there is no file system mounted")
+	}
+	if err := writeDelayedWrites(); err != nil {
+		return FragmentationStats{}, err
+	}
+	sblock := ReadSuperBlock()
+	stats := FragmentationStats{Allocator: allocatorName}
+	stats.FreeBlocks, stats.FreeExtents, stats.LargestFreeExtent = ReadFreeBlockBitmap(sblock).freeExtents(sblock.DataBlockStart)
+	if stats.FreeBlocks > 0 {
+		stats.FreeFragmentation = 1 - float64(stats.LargestFreeExtent)/float64(stats.FreeBlocks)
+	}
+	if cow != nil {
+		stats.CopyOnWrite = true
+		return stats, nil
+	}
+	for inodeNum := 1; inodeNum < sblock.InodeCount; inodeNum++ {
+		inode := getInodeFromDisk(inodeNum)
+		if !inode.IsValid || inode.IsDirectory || inode.LinksCount == 0 {
+			continue //Defragment leaves directories alone and old versions aren't files of their own
+		}
+		blocks := fileBlocks(sblock, &inode)
+		if len(blocks) == 0 {
+			continue
+		}
+		extents := fileExtents(blocks)
+		stats.Files++
+		stats.FileExtents += extents
+		if extents > 1 {
+			stats.FragmentedFiles++
+		}
+	}
+	if stats.Files > 0 {
+		stats.ExtentsPerFile = float64(stats.FileExtents) / float64(stats.Files)
+	}
+	return stats, nil
+}
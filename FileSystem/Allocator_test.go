@@ -0,0 +1,209 @@
+package FileSystem
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testSpace is a FreeSpace over a slice, true is a block in use
+type testSpace []bool
+
+func newTestSpace(size int, free ...[2]int) testSpace {
+	space := make(testSpace, size)
+	for blockNum := range space {
+		space[blockNum] = true
+	}
+	for _, run := range free {
+		for blockNum := run[0]; blockNum < run[1]; blockNum++ {
+			space[blockNum] = false
+		}
+	}
+	return space
+}
+
+func (space testSpace) Start() int               { return 0 }
+func (space testSpace) End() int                 { return len(space) }
+func (space testSpace) IsFree(blockNum int) bool { return !space[blockNum] }
+
+func (space testSpace) NextFree(start int) int {
+	for blockNum := start; blockNum < len(space); blockNum++ {
+		if !space[blockNum] {
+			return blockNum
+		}
+	}
+	return -1
+}
+
+func (space testSpace) NextUsed(start int) int {
+	for blockNum := start; blockNum < len(space); blockNum++ {
+		if space[blockNum] {
+			return blockNum
+		}
+	}
+	return len(space)
+}
+
+// TestAllocatorPicks asks each built in allocator for blocks and runs out of the same free space:
+// block 1, blocks 4-5 and blocks 8-15 free
+func TestAllocatorPicks(t *testing.T) {
+	space := newTestSpace(16, [2]int{1, 2}, [2]int{4, 6}, [2]int{8, 16})
+	type run struct{ count, start, length int }
+	for _, test := range []struct {
+		name string
+		pick int
+		runs []run
+	}{
+		{"first-fit", 1, []run{{2, 4, 2}, {3, 8, 3}, {10, 8, 8}}},
+		{"best-fit", 1, []run{{2, 4, 2}, {3, 8, 3}, {10, 8, 8}}},
+		{"buddy", 1, []run{{2, 4, 2}, {3, 8, 3}, {10, 8, 8}}},
+	} {
+		allocator := allocators[test.name]().(RunAllocator)
+		if got := allocator.Pick(space); got != test.pick {
+			t.Errorf("%s picked block %d, wanted %d", test.name, got, test.pick)
+		}
+		for _, want := range test.runs {
+			if start, length := allocator.PickRun(space, want.count); start != want.start || length != want.length {
+				t.Errorf("%s picked %d blocks from %d for %d, wanted %d from %d", test.name, length, start, want.count, want.length, want.start)
+			}
+		}
+	}
+
+	//best-fit leaves the long run alone when a shorter one will do, first-fit takes the first that fits
+	space = newTestSpace(16, [2]int{0, 8}, [2]int{10, 12})
+	if start, _ := (firstFit{}).PickRun(space, 2); start != 0 {
+		t.Errorf("first-fit took 2 blocks from %d", start)
+	}
+	if start, _ := (bestFit{}).PickRun(space, 2); start != 10 {
+		t.Errorf("best-fit took 2 blocks from %d", start)
+	}
+	if got := (bestFit{}).Pick(space); got != 10 {
+		t.Errorf("best-fit picked block %d", got)
+	}
+
+	//buddy blocks are aligned to their size, so four blocks out of 2-7 start at 4
+	space = newTestSpace(16, [2]int{2, 8})
+	if start, length := (buddy{}).PickRun(space, 4); start != 4 || length != 4 {
+		t.Errorf("buddy took %d blocks from %d", length, start)
+	}
+	if got := (buddy{}).Pick(space); got != 2 {
+		t.Errorf("buddy picked block %d", got)
+	}
+
+	//next-fit carries on from the last block it handed out and goes round at the end
+	space = newTestSpace(8, [2]int{1, 3}, [2]int{5, 8})
+	next := &nextFit{}
+	for _, want := range []int{1, 2, 5, 6, 7} {
+		blockNum := next.Pick(space)
+		if blockNum != want {
+			t.Fatalf("next-fit picked block %d, wanted %d", blockNum, want)
+		}
+		space[blockNum] = true
+	}
+	space[2] = false
+	if got := next.Pick(space); got != 2 {
+		t.Errorf("next-fit picked block %d after going round", got)
+	}
+	space = newTestSpace(8, [2]int{0, 3}, [2]int{5, 7})
+	next = &nextFit{next: 6}
+	if start, length := next.PickRun(space, 3); start != 0 || length != 3 {
+		t.Errorf("next-fit took %d blocks from %d, it should have gone round", length, start)
+	}
+	if next.next != 3 {
+		t.Errorf("next-fit will carry on from %d", next.next)
+	}
+	if got := next.Pick(newTestSpace(8)); got != -1 {
+		t.Errorf("next-fit picked block %d with nothing free", got)
+	}
+}
+
+// lastFit hands out the highest free block, to check Mount can use a registered allocator
+type lastFit struct{}
+
+func (lastFit) Pick(space FreeSpace) int {
+	for blockNum := space.End() - 1; blockNum >= space.Start(); blockNum-- {
+		if space.IsFree(blockNum) {
+			return blockNum
+		}
+	}
+	return -1
+}
+
+var registerLastFit sync.Once
+
+// TestEachAllocator formats a file system with every allocator there is, pokes holes in it and writes
+// some more, then checks everything reads back and fsck and Fragmentation agree with what was done
+func TestEachAllocator(t *testing.T) {
+	registerLastFit.Do(func() {
+		if err := RegisterAllocator("last-fit", func() Allocator { return lastFit{} }); err != nil {
+			t.Fatalf("RegisterAllocator: %v", err)
+		}
+	})
+	if err := RegisterAllocator("first-fit", func() Allocator { return lastFit{} }); err == nil {
+		t.Fatalf("registered a second first-fit")
+	}
+	if err := Format(NewMemDevice(2<<20), Options{Allocator: "last-fit"}); err == nil {
+		t.Fatalf("saved a registered allocator in the superblock")
+	}
+
+	for _, name := range Allocators() {
+		t.Run(name, func(t *testing.T) {
+			device := newTestFileSystem(t, 2<<20, DefaultOptions())
+			if err := MountWithOptions(device, MountOptions{Allocator: name}); err != nil {
+				t.Fatalf("MountWithOptions: %v", err)
+			}
+			blockSize := ReadSuperBlock().BlockSize
+			contents := map[string]string{}
+			for num := 0; num < 20; num++ {
+				fileName := fmt.Sprint("small", num)
+				contents[fileName] = strings.Repeat(fmt.Sprint(num%10), 3*blockSize)
+				createTestFile(t, RootFolder, fileName, contents[fileName])
+			}
+			if err := Sync(); err != nil { //they get their blocks before any of them go
+				t.Fatalf("Sync: %v", err)
+			}
+			for num := 0; num < 20; num += 2 {
+				fileName := fmt.Sprint("small", num)
+				UnlinkName(fileName, RootFolder)
+				delete(contents, fileName)
+			}
+			stats, err := Fragmentation()
+			if err != nil {
+				t.Fatalf("Fragmentation: %v", err)
+			}
+			if stats.Allocator != name || stats.Files != 10 || stats.FreeExtents < 2 || stats.FreeFragmentation <= 0 {
+				t.Fatalf("with every other file unlinked Fragmentation says %+v", stats)
+			}
+			for num := 0; num < 5; num++ {
+				fileName := fmt.Sprint("more", num)
+				contents[fileName] = strings.Repeat(string(rune('a'+num)), (2+num*4)*blockSize)
+				createTestFile(t, RootFolder, fileName, contents[fileName])
+			}
+			remount(t, device)
+			for fileName, want := range contents {
+				if got, _ := readTestFile(RootFolder, fileName); got != want {
+					t.Fatalf("%s holds %.10q...", fileName, got)
+				}
+			}
+			checkFsck(t)
+		})
+	}
+}
+
+// TestFragmentationCopyOnWrite checks Fragmentation doesn't count files on copy on write, where their
+// blocks are logical ones Defragment won't move
+func TestFragmentationCopyOnWrite(t *testing.T) {
+	newCowTestFileSystem(t, 2<<20)
+	createTestFile(t, RootFolder, "file", strings.Repeat("c", 3*ReadSuperBlock().BlockSize))
+	stats, err := Fragmentation()
+	if err != nil {
+		t.Fatalf("Fragmentation: %v", err)
+	}
+	if !stats.CopyOnWrite || stats.Files != 0 || stats.FileExtents != 0 || stats.FreeBlocks == 0 {
+		t.Fatalf("Fragmentation on copy on write says %+v", stats)
+	}
+	if _, err := DefragmentAll(); err == nil {
+		t.Fatalf("defragmented a copy on write file system")
+	}
+}
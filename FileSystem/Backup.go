@@ -0,0 +1,144 @@
+package FileSystem
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Backup superblocks
+// Block 0 used to be the only copy of the superblock, so one bad write there lost the whole disk.
+// Now there are copies at the start of every backup group (groups of 8*BlockSize blocks, numbered 1
+// or a power of 3, 5 or 7 - the same sparse pattern ext2 uses) and in the very last block, so even a
+// disk smaller than one group has a copy. The locations only depend on the block size and how big the
+// disk is, which means Mount can find them when the primary is too broken to tell us anything.
+
+const FEATURE_ROCOMPAT_BACKUP_SUPERBLOCKS uint32 = 1 << 0
+
+// superBlockOffset is where the copy of the superblock we trust lives, 0 unless Mount had to fall back.
+// It belongs to transactionLock once the file system is mounted
+var superBlockOffset int64
+
+// sparseGroups returns group 1 and every power of 3, 5 and 7 below numGroups, in order
+func sparseGroups(numGroups int) []int {
+	groups := []int{}
+	if numGroups > 1 {
+		groups = append(groups, 1)
+	}
+	for _, base := range []int{3, 5, 7} {
+		for group := base; group < numGroups; group *= base {
+			groups = append(groups, group)
+		}
+	}
+	sort.Ints(groups)
+	return groups
+}
+
+// backupSuperBlockLocations is every block that should hold a copy of the superblock on a disk this size
+func backupSuperBlockLocations(blockSize int, blockCount int) []int {
+	groupSize := blockSize * 8
+	locations := []int{}
+	for _, group := range sparseGroups((blockCount + groupSize - 1) / groupSize) {
+		if group*groupSize < blockCount-1 {
+			locations = append(locations, group*groupSize)
+		}
+	}
+	return append(locations, blockCount-1)
+}
+
+// superBlockBackups is where this file system keeps its copies, spots that would land on the
+// bitmaps or inode table are skipped
+func superBlockBackups(sblock SuperBlock) []int {
+	if sblock.FeatureROCompat&FEATURE_ROCOMPAT_BACKUP_SUPERBLOCKS == 0 {
+		return nil
+	}
+	backups := []int{}
+	for _, location := range backupSuperBlockLocations(sblock.BlockSize, sblock.BlockCount) {
+		if location >= sblock.DataBlockStart {
+			backups = append(backups, location)
+		}
+	}
+	return backups
+}
+
+// enableSuperBlockBackups turns on the backups if all of their blocks are still free and claims them
+func enableSuperBlockBackups(sblock *SuperBlock) bool {
+	withBackups := *sblock
+	withBackups.FeatureROCompat |= FEATURE_ROCOMPAT_BACKUP_SUPERBLOCKS
+	freeBlocks := ReadFreeBlockBitmap(*sblock)
+	for _, location := range superBlockBackups(withBackups) {
+		if freeBlocks.IsSet(location) {
+			return false
+		}
+	}
+	for _, location := range superBlockBackups(withBackups) {
+		freeBlocks.Set(location)
+	}
+	*sblock = withBackups
+	return true
+}
+
+// readSuperBlockAt decodes the superblock copy at offset, returning false if it isn't a good copy
+func readSuperBlockAt(device BlockDevice, offset int64) (SuperBlock, bool) {
+	if offset < 0 || offset+SUPERBLOCK_SIZE > device.Size() {
+		return SuperBlock{}, false
+	}
+	superblockBytes := make([]byte, SUPERBLOCK_SIZE)
+	if _, err := device.ReadAt(superblockBytes, offset); err != nil {
+		return SuperBlock{}, false
+	}
+	sblock := decodeSuperBlock(superblockBytes)
+	if sblock.Magic != FS_MAGIC || !superBlockChecksumOK(superblockBytes) {
+		return SuperBlock{}, false
+	}
+	return sblock, true
+}
+
+// readPrimaryHeader decodes the superblock at the start of the device without checking it
+func readPrimaryHeader(device BlockDevice) (SuperBlock, bool) {
+	superblockBytes := make([]byte, SUPERBLOCK_SIZE)
+	if device.Size() < SUPERBLOCK_SIZE {
+		return SuperBlock{}, false
+	}
+	if _, err := device.ReadAt(superblockBytes, 0); err != nil {
+		return SuperBlock{}, false
+	}
+	return decodeSuperBlock(superblockBytes), true
+}
+
+// findBackupSuperBlock tries every place a backup could be for every block size we allow
+// and returns the first good copy along with its byte offset
+func findBackupSuperBlock(device BlockDevice) (SuperBlock, int64, error) {
+	for blockSize := MIN_BLOCK_SIZE; blockSize <= MAX_BLOCK_SIZE; blockSize *= 2 {
+		deviceBlocks := int(device.Size() / int64(blockSize))
+		if deviceBlocks < 2 {
+			break
+		}
+		for _, location := range backupSuperBlockLocations(blockSize, deviceBlocks) {
+			offset := int64(location) * int64(blockSize)
+			if sblock, ok := readSuperBlockAt(device, offset); ok && sblock.BlockSize == blockSize {
+				return sblock, offset, nil
+			}
+		}
+	}
+	return SuperBlock{}, 0, fmt.Errorf("%w and no backup superblock either", ErrNotAFileSystem)
+}
+
+// loadSuperBlockForMount reads the primary superblock, falling back to a backup if it is damaged.
+// It returns the superblock and the byte offset of the copy it came from.
+func loadSuperBlockForMount(device BlockDevice) (SuperBlock, int64, error) {
+	if sblock, ok := readSuperBlockAt(device, 0); ok {
+		return sblock, 0, nil
+	}
+	sblock, offset, err := findBackupSuperBlock(device)
+	if err != nil {
+		//a superblock from another format version doesn't have its checksum where we look for it,
+		//so say that instead of claiming there is no file system at all
+		if primary, ok := readPrimaryHeader(device); ok && primary.Magic == FS_MAGIC {
+			if versionErr := checkFormatVersion(primary.FormatVersion); versionErr != nil {
+				return SuperBlock{}, 0, versionErr
+			}
+		}
+		return SuperBlock{}, 0, err
+	}
+	return sblock, offset, nil //LastMount says which one it was
+}
@@ -0,0 +1,66 @@
+package FileSystem
+
+import (
+	"errors"
+	"testing"
+)
+
+// TestMountFallsBackToBackupSuperBlock wrecks the primary superblock and checks Mount carries on with
+// a backup and says so in LastMount, that RepairSuperBlock puts the primary back, and that with every
+// copy gone it gives up with ErrNotAFileSystem
+func TestMountFallsBackToBackupSuperBlock(t *testing.T) {
+	for _, blockSize := range []int{1024, 4096} {
+		options := DefaultOptions()
+		options.BlockSize = blockSize
+		device := newTestFileSystem(t, 8<<20, options)
+		createTestFile(t, RootFolder, "file", "still here")
+		if err := Sync(); err != nil {
+			t.Fatalf("Sync: %v", err)
+		}
+		sblock := ReadSuperBlock()
+		backups := superBlockBackups(sblock)
+		if len(backups) == 0 {
+			t.Fatalf("%d byte blocks got no backups", blockSize)
+		}
+		for num := range device.data[:SUPERBLOCK_SIZE] {
+			device.data[num] ^= 0xff
+		}
+
+		if err := MountWithOptions(device, MountOptions{ReadOnly: true}); err != nil {
+			t.Fatalf("read only mount with a broken primary: %v", err)
+		}
+		if got := LastMount().BackupSuperBlock; got != backups[0] {
+			t.Fatalf("mounted with the backup at %d, the first is at %d", got, backups[0])
+		}
+		if got, _ := readTestFile(RootFolder, "file"); got != "still here" {
+			t.Fatalf("file holds %q", got)
+		}
+		if err := Mount(device); err != nil {
+			t.Fatalf("mount with a broken primary: %v", err)
+		}
+		if LastMount().BackupSuperBlock == 0 {
+			t.Fatalf("a mount without RepairSuperBlock fixed the primary")
+		}
+		if err := MountWithOptions(device, MountOptions{RepairSuperBlock: true}); err != nil {
+			t.Fatalf("repairing mount: %v", err)
+		}
+		remount(t, device)
+		if got := LastMount().BackupSuperBlock; got != 0 {
+			t.Fatalf("still using the backup at %d after repairing the primary", got)
+		}
+		if ReadSuperBlock() != sblock {
+			t.Fatalf("the repaired superblock is\n%+v\nit was\n%+v", ReadSuperBlock(), sblock)
+		}
+		checkFsck(t)
+
+		if err := Sync(); err != nil {
+			t.Fatalf("Sync: %v", err)
+		}
+		for _, blockNum := range append([]int{0}, backups...) {
+			device.data[blockNum*blockSize] ^= 0xff //the magic number
+		}
+		if err := Mount(device); !errors.Is(err, ErrNotAFileSystem) {
+			t.Fatalf("mounting without any good superblock: %v", err)
+		}
+	}
+}
@@ -0,0 +1,497 @@
+package FileSystem
+
+import (
+	"math/bits"
+	"slices"
+	"sort"
+	"sync"
+)
+
+// Bitmap is a real packed bitmap - one bit per block (or inode) instead of the bool-per-byte I had before.
+// Bit n lives in byte n/8 of the bitmap at bit position n%8. The bytes are kept in blocks, each block
+// holding the bits from its start up to the next block's: without block groups that is consecutive
+// blocks and every one of them full, with them each group's block only holds that group's bits (see
+// BlockGroup.go), and the inode table's extra chunks each have a block of their own (see
+// InodeTable.go) that can start anywhere. In memory we keep it as
+// 64 bit words so we can skip over full words when looking for a free bit. Bits past numBits are
+// kept set so they never look free, and so are the inode numbers no inode has (see inodeHoles),
+// which don't have to be kept in any block.
+// Every method locks the bitmap, so it can be shared between goroutines (see Lock.go).
+type Bitmap struct {
+	lock      sync.Mutex
+	flushLock sync.Mutex //held for the whole of a flush so an older copy can't get written over a newer one
+	words     []uint64
+	numBits   int
+	blocks    []int      //where the bitmap is kept
+	starts    []int      //the first bit kept in each of blocks
+	sblock    SuperBlock //only here for the geometry, so flush knows how big the blocks are
+	setCount  int        //number of bits set (not counting padding), kept up to date by Set and Clear
+	dirty     bool       //true if the in memory copy has changed since it was last written to Disk
+	//which of blocks have changed, flush only writes those. Allocating a block used to mean writing
+	//out the whole bitmap
+	dirtyChunks []bool
+	//bits freed by the running transaction, clear on Disk but still set here so nothing gets them
+	//until it commits (see freeDataBlock)
+	held []int
+}
+
+const bitsPerWord = 64
+
+// the cached copies, loaded by Mount (or on first use) and written back by syncBitmaps
+var inodeBitmap *Bitmap
+var freeBlockBitmap *Bitmap
+
+// bitmapBlocks is the number of blocks needed to hold numBits bits
+func bitmapBlocks(blockSize int, numBits int) int {
+	bitsPerBlock := blockSize * 8
+	return (numBits + bitsPerBlock - 1) / bitsPerBlock
+}
+
+// evenStarts is the starts for count blocks of chunkBits bits each
+func evenStarts(count int, chunkBits int) []int {
+	starts := make([]int, count)
+	for chunk := range starts {
+		starts[chunk] = chunk * chunkBits
+	}
+	return starts
+}
+
+func newBitmap(sblock SuperBlock, numBits int, blocks []int, starts []int) *Bitmap {
+	bitmap := &Bitmap{
+		words:   make([]uint64, (numBits+bitsPerWord-1)/bitsPerWord),
+		numBits: numBits,
+		blocks:  blocks,
+		starts:  starts,
+		sblock:  sblock,
+	}
+	bitmap.dirtyChunks = make([]bool, len(blocks))
+	bitmap.markAllDirty()
+	bitmap.setPadding()
+	return bitmap
+}
+
+// loadBitmap reads a bitmap of numBits bits back from Disk
+func loadBitmap(sblock SuperBlock, numBits int, blocks []int, starts []int) *Bitmap {
+	bitmap := newBitmap(sblock, numBits, blocks, starts)
+	for chunk, blockNum := range blocks {
+		bitmapBytes := readBlock(sblock, blockNum)
+		start, end := bitmap.chunkRange(chunk)
+		if start%bitsPerWord == 0 {
+			for wordNum := start / bitsPerWord; wordNum < (end+bitsPerWord-1)/bitsPerWord; wordNum++ {
+				bitmap.words[wordNum] = byteOrder.Uint64(bitmapBytes[(wordNum-start/bitsPerWord)*8:])
+			}
+			continue
+		}
+		//a chunk that starts part way through a word has to go a bit at a time
+		for bit := start; bit < end; bit++ {
+			if bitmapBytes[(bit-start)/8]&(1<<((bit-start)%8)) != 0 {
+				bitmap.words[bit/bitsPerWord] |= 1 << (bit % bitsPerWord)
+			} else {
+				bitmap.words[bit/bitsPerWord] &^= 1 << (bit % bitsPerWord)
+			}
+		}
+	}
+	bitmap.setPadding()
+	bitmap.setCount = bitmap.countBits()
+	bitmap.dirty = false
+	clear(bitmap.dirtyChunks)
+	return bitmap
+}
+
+func (bitmap *Bitmap) markAllDirty() {
+	bitmap.dirty = true
+	for chunk := range bitmap.dirtyChunks {
+		bitmap.dirtyChunks[chunk] = true
+	}
+}
+
+// chunkRange is the bits kept in blocks[chunk], from start up to end. A block never holds more than
+// it has room for, the rest of the way to the next one is holes
+func (bitmap *Bitmap) chunkRange(chunk int) (int, int) {
+	start, end := bitmap.starts[chunk], bitmap.numBits
+	if chunk+1 < len(bitmap.starts) {
+		end = bitmap.starts[chunk+1]
+	}
+	return start, min(end, start+bitmap.sblock.BlockSize*8)
+}
+
+// markDirty notes that bit has changed
+func (bitmap *Bitmap) markDirty(bit int) {
+	bitmap.dirty = true
+	bitmap.dirtyChunks[sort.SearchInts(bitmap.starts, bit+1)-1] = true
+}
+
+// addChunk has count bits from start on kept in blockNum and clears them. They are either new bits
+// on the end or a hole being filled in
+func (bitmap *Bitmap) addChunk(start int, count int, blockNum int) {
+	bitmap.lock.Lock()
+	defer bitmap.lock.Unlock()
+	oldBits := bitmap.numBits
+	bitmap.numBits = max(bitmap.numBits, start+count)
+	for len(bitmap.words) < (bitmap.numBits+bitsPerWord-1)/bitsPerWord {
+		bitmap.words = append(bitmap.words, ^uint64(0))
+	}
+	for bit := start; bit < start+count; bit++ {
+		if bit < oldBits && bitmap.isSet(bit) {
+			bitmap.setCount-- //a hole, past oldBits it was padding
+		}
+		bitmap.words[bit/bitsPerWord] &^= 1 << (bit % bitsPerWord)
+	}
+	chunk := sort.SearchInts(bitmap.starts, start)
+	bitmap.blocks = slices.Insert(bitmap.blocks, chunk, blockNum)
+	bitmap.starts = slices.Insert(bitmap.starts, chunk, start)
+	bitmap.dirtyChunks = slices.Insert(bitmap.dirtyChunks, chunk, false)
+	bitmap.markDirty(start)
+	bitmap.setPadding()
+}
+
+// reserve sets the bits from start up to end without making anything dirty, they are holes that
+// stay set and don't need writing
+func (bitmap *Bitmap) reserve(start int, end int) {
+	bitmap.lock.Lock()
+	defer bitmap.lock.Unlock()
+	for bit := start; bit < min(end, bitmap.numBits); bit++ {
+		if !bitmap.isSet(bit) {
+			bitmap.setCount++
+			bitmap.words[bit/bitsPerWord] |= 1 << (bit % bitsPerWord)
+		}
+	}
+}
+
+// setPadding marks the unused bits at the end of the last word as in use
+func (bitmap *Bitmap) setPadding() {
+	if extra := bitmap.numBits % bitsPerWord; extra != 0 {
+		bitmap.words[len(bitmap.words)-1] |= ^uint64(0) << extra
+	}
+}
+
+func (bitmap *Bitmap) IsSet(bit int) bool {
+	bitmap.lock.Lock()
+	defer bitmap.lock.Unlock()
+	return bitmap.isSet(bit)
+}
+
+func (bitmap *Bitmap) isSet(bit int) bool {
+	return bitmap.words[bit/bitsPerWord]&(1<<(bit%bitsPerWord)) != 0
+}
+
+func (bitmap *Bitmap) Set(bit int) {
+	bitmap.lock.Lock()
+	defer bitmap.lock.Unlock()
+	bitmap.set(bit)
+}
+
+func (bitmap *Bitmap) set(bit int) {
+	if !bitmap.isSet(bit) {
+		bitmap.setCount++
+	}
+	bitmap.words[bit/bitsPerWord] |= 1 << (bit % bitsPerWord)
+	bitmap.markDirty(bit)
+}
+
+func (bitmap *Bitmap) Clear(bit int) {
+	bitmap.lock.Lock()
+	defer bitmap.lock.Unlock()
+	if bitmap.isSet(bit) {
+		bitmap.setCount--
+	}
+	bitmap.words[bit/bitsPerWord] &^= 1 << (bit % bitsPerWord)
+	bitmap.markDirty(bit)
+}
+
+// hold frees a bit on Disk but keeps it set in memory, so it counts as free but can't be handed out
+// until releaseHeld
+func (bitmap *Bitmap) hold(bit int) {
+	bitmap.lock.Lock()
+	defer bitmap.lock.Unlock()
+	if !bitmap.isSet(bit) || slices.Contains(bitmap.held, bit) {
+		return
+	}
+	bitmap.held = append(bitmap.held, bit)
+	bitmap.markDirty(bit)
+}
+
+// releaseHeld makes the held bits free for the allocator as well. Disk already has them clear
+func (bitmap *Bitmap) releaseHeld() {
+	bitmap.lock.Lock()
+	defer bitmap.lock.Unlock()
+	for _, bit := range bitmap.held {
+		bitmap.words[bit/bitsPerWord] &^= 1 << (bit % bitsPerWord)
+		bitmap.setCount--
+	}
+	bitmap.held = nil
+}
+
+// FindFree returns the first clear bit at or after start, or -1 if everything from there on is in use.
+// Full words are skipped in one comparison so this only looks at individual bits in the word that has room.
+// Someone else can take the bit before the caller sets it, claim finds and sets in one go
+func (bitmap *Bitmap) FindFree(start int) int {
+	bitmap.lock.Lock()
+	defer bitmap.lock.Unlock()
+	return bitmap.findFree(start)
+}
+
+// claim sets and returns the first clear bit at or after start, as long as that leaves more than keep
+// bits free. -1 if there isn't one
+func (bitmap *Bitmap) claim(start int, keep int) int {
+	bitmap.lock.Lock()
+	defer bitmap.lock.Unlock()
+	if bitmap.numBits-bitmap.setCount <= keep {
+		return -1
+	}
+	bit := bitmap.findFree(start)
+	if bit >= 0 {
+		bitmap.set(bit)
+	}
+	return bit
+}
+
+// allocateRun has the allocator pick up to count clear bits in a row at or after start and sets them,
+// as long as that leaves more than keep bits free. It returns the first bit and how many it set, -1
+// and 0 if there isn't one. Allocators that can't do runs just get asked for one bit
+func (bitmap *Bitmap) allocateRun(allocator Allocator, start int, count int, keep int) (int, int) {
+	bitmap.lock.Lock()
+	defer bitmap.lock.Unlock()
+	count = min(count, bitmap.numBits-bitmap.setCount-keep)
+	if count <= 0 {
+		return -1, 0
+	}
+	first, length := -1, 0
+	if runAllocator, ok := allocator.(RunAllocator); ok {
+		first, length = runAllocator.PickRun(bitmapSpace{bitmap, start}, count)
+	} else {
+		first, length = allocator.Pick(bitmapSpace{bitmap, start}), 1
+	}
+	if first < start || length <= 0 || length > count || first+length > bitmap.numBits || bitmap.findUsed(first) < first+length {
+		return -1, 0
+	}
+	for bit := first; bit < first+length; bit++ {
+		bitmap.set(bit)
+	}
+	return first, length
+}
+
+func (bitmap *Bitmap) findFree(start int) int {
+	if start >= bitmap.numBits {
+		return -1
+	}
+	wordNum := start / bitsPerWord
+	word := bitmap.words[wordNum] | (1<<(start%bitsPerWord) - 1) //pretend the bits before start are taken
+	for {
+		if word != ^uint64(0) {
+			return wordNum*bitsPerWord + bits.TrailingZeros64(^word)
+		}
+		wordNum++
+		if wordNum >= len(bitmap.words) {
+			return -1
+		}
+		word = bitmap.words[wordNum]
+	}
+}
+
+// findUsed returns the first set bit at or after start, or numBits if there isn't one
+func (bitmap *Bitmap) findUsed(start int) int {
+	if start >= bitmap.numBits {
+		return bitmap.numBits
+	}
+	wordNum := start / bitsPerWord
+	word := bitmap.words[wordNum] &^ (1<<(start%bitsPerWord) - 1) //pretend the bits before start are clear
+	for word == 0 {
+		wordNum++
+		if wordNum >= len(bitmap.words) {
+			return bitmap.numBits
+		}
+		word = bitmap.words[wordNum]
+	}
+	return min(wordNum*bitsPerWord+bits.TrailingZeros64(word), bitmap.numBits) //the padding counts as set
+}
+
+// freeExtents counts the clear bits from start on, the runs they make and the longest run
+func (bitmap *Bitmap) freeExtents(start int) (free int, extents int, largest int) {
+	bitmap.lock.Lock()
+	defer bitmap.lock.Unlock()
+	for runStart := bitmap.findFree(start); runStart >= 0; runStart = bitmap.findFree(runStart) {
+		runEnd := bitmap.findUsed(runStart)
+		free += runEnd - runStart
+		extents++
+		largest = max(largest, runEnd-runStart)
+		runStart = runEnd
+	}
+	return free, extents, largest
+}
+
+// countClaimable is the number of bits that can be set right now, held ones aren't
+func (bitmap *Bitmap) countClaimable() int {
+	bitmap.lock.Lock()
+	defer bitmap.lock.Unlock()
+	return bitmap.numBits - bitmap.setCount
+}
+
+// CountSet is the number of bits in use, not counting the padding
+func (bitmap *Bitmap) CountSet() int {
+	bitmap.lock.Lock()
+	defer bitmap.lock.Unlock()
+	return bitmap.setCount
+}
+
+// CountFree is the number of bits not in use, held ones included
+func (bitmap *Bitmap) CountFree() int {
+	bitmap.lock.Lock()
+	defer bitmap.lock.Unlock()
+	return bitmap.numBits - bitmap.setCount + len(bitmap.held)
+}
+
+// countRange is the number of bits in use from start up to end, not counting held ones
+func (bitmap *Bitmap) countRange(start int, end int) int {
+	bitmap.lock.Lock()
+	defer bitmap.lock.Unlock()
+	count := 0
+	for _, bit := range bitmap.held {
+		if bit >= start && bit < end {
+			count--
+		}
+	}
+	for bit := start; bit < end && bit < bitmap.numBits; {
+		if bit%bitsPerWord == 0 && bit+bitsPerWord <= min(end, bitmap.numBits) {
+			count += bits.OnesCount64(bitmap.words[bit/bitsPerWord])
+			bit += bitsPerWord
+			continue
+		}
+		if bitmap.isSet(bit) {
+			count++
+		}
+		bit++
+	}
+	return count
+}
+
+// countBits counts the set bits the slow way, by looking at every word
+func (bitmap *Bitmap) countBits() int {
+	count := 0
+	for _, word := range bitmap.words {
+		count += bits.OnesCount64(word)
+	}
+	return count - (len(bitmap.words)*bitsPerWord - bitmap.numBits)
+}
+
+// flush writes the bitmap back to its blocks, but only if something changed
+func (bitmap *Bitmap) flush() {
+	bitmap.flushLock.Lock()
+	defer bitmap.flushLock.Unlock()
+	bitmap.lock.Lock()
+	if !bitmap.dirty {
+		bitmap.lock.Unlock()
+		return
+	}
+	chunks := make([][]byte, len(bitmap.blocks))
+	for chunk := range chunks {
+		if !bitmap.dirtyChunks[chunk] {
+			continue
+		}
+		bitmap.dirtyChunks[chunk] = false
+		chunks[chunk] = make([]byte, bitmap.sblock.BlockSize)
+		start, end := bitmap.chunkRange(chunk)
+		if start%bitsPerWord == 0 {
+			for wordNum := start / bitsPerWord; wordNum < (end+bitsPerWord-1)/bitsPerWord; wordNum++ {
+				byteOrder.PutUint64(chunks[chunk][(wordNum-start/bitsPerWord)*8:], bitmap.words[wordNum])
+			}
+			continue
+		}
+		for bit := start; bit < end; bit++ {
+			if bitmap.isSet(bit) {
+				chunks[chunk][(bit-start)/8] |= 1 << ((bit - start) % 8)
+			}
+		}
+	}
+	for _, bit := range bitmap.held {
+		chunk := sort.SearchInts(bitmap.starts, bit+1) - 1
+		if start := bitmap.starts[chunk]; chunks[chunk] != nil {
+			chunks[chunk][(bit-start)/8] &^= 1 << ((bit - start) % 8)
+		}
+	}
+	bitmap.dirty = false //anything that changes from here on makes it dirty again and gets its own flush
+	bitmap.lock.Unlock()
+	for chunk, blockNum := range bitmap.blocks {
+		if chunks[chunk] != nil {
+			writeBlock(bitmap.sblock, blockNum, chunks[chunk])
+		}
+	}
+}
+
+// isDirty is whether the bitmap has changed since it was last flushed
+func (bitmap *Bitmap) isDirty() bool {
+	bitmap.lock.Lock()
+	defer bitmap.lock.Unlock()
+	return bitmap.dirty
+}
+
+// syncBitmaps writes any changed bitmaps back to Disk, along with the free counts in the superblock
+func syncBitmaps() {
+	changed := false
+	if inodeBitmap != nil && inodeBitmap.isDirty() {
+		inodeBitmap.flush()
+		changed = true
+	}
+	if freeBlockBitmap != nil && freeBlockBitmap.isDirty() {
+		freeBlockBitmap.flush()
+		changed = true
+	}
+	if changed {
+		updateFreeCounts()
+	}
+}
+
+// freeBlockCount is what the superblock's FreeBlocks should say, the free bits in the bitmap less
+// the blocks only snapshots are holding on to
+func freeBlockCount(sblock SuperBlock) int {
+	return max(ReadFreeBlockBitmap(sblock).CountFree()-snapshotHeldBlocks(), 0)
+}
+
+// updateFreeCounts copies the bitmap counts into the superblock if they have changed.
+// Only the copy we are using gets them - the counts change on nearly every operation and rewriting
+// every backup each time isn't worth it, so the backups just hold whatever they had at the last
+// writeSuperBlock and Mount fixes the counts up when they look wrong.
+func updateFreeCounts() {
+	superBlockLock.Lock()
+	defer superBlockLock.Unlock()
+	sblock := ReadSuperBlock()
+	freeBlocks := freeBlockCount(sblock)
+	freeInodes := ReadINodeBitmap(sblock).CountFree()
+	if sblock.FreeBlocks == freeBlocks && sblock.FreeInodes == freeInodes {
+		return
+	}
+	sblock.FreeBlocks = freeBlocks
+	sblock.FreeInodes = freeInodes
+	writeBlock(sblock, superBlockNum(sblock), EncodeToBytes(sblock))
+}
+
+// dropBitmapCache forgets the cached bitmaps and block reference counts, used when Disk gets replaced underneath us
+func dropBitmapCache() {
+	inodeBitmap = nil
+	freeBlockBitmap = nil
+	blockRefs = nil
+}
+
+// loadBitmaps reads both bitmaps in, Mount does it up front so nothing has to load them while other
+// goroutines are looking at them
+func loadBitmaps(sblock SuperBlock) {
+	ReadFreeBlockBitmap(sblock)
+	ReadINodeBitmap(sblock)
+}
+
+func ReadFreeBlockBitmap(sblock SuperBlock) *Bitmap {
+	if freeBlockBitmap == nil {
+		blocks, starts := freeBlockBitmapLayout(sblock)
+		freeBlockBitmap = loadBitmap(sblock, sblock.BlockCount, blocks, starts)
+	}
+	return freeBlockBitmap
+}
+
+func ReadINodeBitmap(sblock SuperBlock) *Bitmap {
+	if inodeBitmap == nil {
+		blocks, starts := inodeBitmapLayout(sblock)
+		inodeBitmap = loadBitmap(sblock, sblock.InodeCount, blocks, starts)
+		reserveInodeHoles(sblock, inodeBitmap)
+	}
+	return inodeBitmap
+}
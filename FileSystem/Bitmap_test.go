@@ -0,0 +1,72 @@
+package FileSystem
+
+import "testing"
+
+// TestBitmapRoundTrip sets bits either side of word and block boundaries in a bitmap kept in two
+// blocks, the second starting part way through a word, and checks the counts, the searches, the
+// packed bytes flush writes and what loadBitmap reads back
+func TestBitmapRoundTrip(t *testing.T) {
+	options := DefaultOptions()
+	options.NoJournal = true
+	newTestFileSystem(t, 1<<20, options)
+	sblock := ReadSuperBlock()
+	blocks := allocateBlocks(sblock, 0, 2, keptBlocks(sblock))
+	numBits := sblock.BlockSize*8 + 1000 //not a whole number of words either
+	starts := []int{0, sblock.BlockSize*8 - 3}
+	bitmap := newBitmap(sblock, numBits, blocks, starts)
+	if bitmap.CountFree() != numBits || bitmap.FindFree(0) != 0 {
+		t.Fatalf("a new bitmap has %d free, the first at %d", bitmap.CountFree(), bitmap.FindFree(0))
+	}
+	set := []int{0, 1, 63, 64, 65, 127, starts[1] - 1, starts[1], starts[1] + 1, numBits - 1}
+	for _, bit := range set {
+		bitmap.Set(bit)
+	}
+	bitmap.Set(64) //setting it twice doesn't count twice
+	if bitmap.CountSet() != len(set) || bitmap.CountFree() != numBits-len(set) {
+		t.Fatalf("%d set and %d free after setting %d bits", bitmap.CountSet(), bitmap.CountFree(), len(set))
+	}
+	for start, want := range map[int]int{0: 2, 63: 66, 127: 128, starts[1] - 1: starts[1] + 2, numBits - 1: -1} {
+		if got := bitmap.FindFree(start); got != want {
+			t.Fatalf("FindFree(%d) is %d, it should be %d", start, got, want)
+		}
+	}
+	if got := bitmap.findUsed(2); got != 63 {
+		t.Fatalf("findUsed(2) is %d, it should be 63", got)
+	}
+	bitmap.Clear(63)
+	bitmap.Clear(63)
+	if bitmap.IsSet(63) || bitmap.CountSet() != len(set)-1 || bitmap.FindFree(60) != 60 {
+		t.Fatalf("clearing bit 63 left it set %v with %d set", bitmap.IsSet(63), bitmap.CountSet())
+	}
+
+	bitmap.flush()
+	if bitmap.isDirty() {
+		t.Fatalf("the bitmap is still dirty after a flush")
+	}
+	first := readBlock(sblock, blocks[0])
+	if first[0] != 0x03 || first[7] != 0x00 || first[8] != 0x03 || first[15] != 0x80 {
+		t.Fatalf("bits 0 to 127 went to disk as % x", first[:16])
+	}
+	second := readBlock(sblock, blocks[1])
+	if second[0] != 0x03 { //bits starts[1] and starts[1]+1 are the first two of the second block
+		t.Fatalf("the second block starts % x", second[:2])
+	}
+	loaded := loadBitmap(sblock, numBits, blocks, starts)
+	for bit := 0; bit < numBits; bit++ {
+		if loaded.IsSet(bit) != bitmap.IsSet(bit) {
+			t.Fatalf("bit %d is %v after loading it back", bit, loaded.IsSet(bit))
+		}
+	}
+	if loaded.CountSet() != bitmap.CountSet() || loaded.isDirty() {
+		t.Fatalf("loaded bitmap has %d set and dirty %v", loaded.CountSet(), loaded.isDirty())
+	}
+
+	//a claim has to leave more than keep bits free
+	free := loaded.CountFree()
+	if bit := loaded.claim(0, free); bit != -1 {
+		t.Fatalf("claim took bit %d when keeping all %d free bits", bit, free)
+	}
+	if bit := loaded.claim(0, free-1); bit != 2 {
+		t.Fatalf("claim took bit %d, it should be 2", bit)
+	}
+}
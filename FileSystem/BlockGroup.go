@@ -0,0 +1,363 @@
+package FileSystem
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Block groups
+// The old layout put one inode bitmap, one free block bitmap and one inode table at the front of the
+// disk, so a file's inode and its data could be the whole disk apart. With block groups the disk is
+// cut into groups of BlocksPerGroup blocks (8*BlockSize, so one bitmap block covers a group - the same
+// groups the backup superblocks already use) and every group has its own bitmaps and its own slice of
+// the inode table, ext2 style:
+//
+//	group 0      superblock, inode bitmap, free block bitmap, inode table, journal, data blocks
+//	group g > 0  [backup superblock], inode bitmap, free block bitmap, inode table, data blocks
+//
+// The backup superblock block is only there in the sparse groups (see sparseGroups), and it is kept
+// even when the backups are turned off so the layout never moves. Where everything is only depends on
+// the superblock, so there is no group descriptor table - the free counts come from the bitmaps.
+//
+// Group g holds InodesPerGroup inodes from groupInodeBase on, which is g*InodesPerGroup for the groups
+// Format made and after the inode table's chunks for ones added since. New inodes go in the group of the
+// directory they are created in, a file's blocks go in the group its inode is in (or after the block
+// before them), and new directories get their block in whichever group has the most room, so their
+// files spread out over the disk instead of piling up at the front.
+//
+// File systems made before block groups (and ones made with NoBlockGroups) still work, they just look
+// like a single group.
+
+const FEATURE_INCOMPAT_BLOCK_GROUPS uint32 = 1 << 1
+
+// BlockGroupStats is how full one block group is
+type BlockGroupStats struct {
+	Group      int
+	FirstBlock int
+	Blocks     int
+	DataStart  int //first block after the group's metadata
+	FreeBlocks int
+	FreeInodes int
+}
+
+func blockGroupsEnabled(sblock SuperBlock) bool {
+	return sblock.FeatureIncompat&FEATURE_INCOMPAT_BLOCK_GROUPS != 0
+}
+
+func groupCount(sblock SuperBlock) int {
+	if !blockGroupsEnabled(sblock) {
+		return 1
+	}
+	return (sblock.BlockCount + sblock.BlocksPerGroup - 1) / sblock.BlocksPerGroup
+}
+
+// groupOfBlock is the group a block is in, blocks outside the disk count as group 0
+func groupOfBlock(sblock SuperBlock, blockNum int) int {
+	if !blockGroupsEnabled(sblock) || blockNum <= 0 || blockNum >= sblock.BlockCount {
+		return 0
+	}
+	return blockNum / sblock.BlocksPerGroup
+}
+
+// groupStart is the first block of a group
+func groupStart(sblock SuperBlock, group int) int {
+	if !blockGroupsEnabled(sblock) {
+		return 0
+	}
+	return group * sblock.BlocksPerGroup
+}
+
+// groupEnd is one past the last block of a group
+func groupEnd(sblock SuperBlock, group int) int {
+	if !blockGroupsEnabled(sblock) {
+		return sblock.BlockCount
+	}
+	return min((group+1)*sblock.BlocksPerGroup, sblock.BlockCount)
+}
+
+// groupHasBackupSlot is true for the groups that start with a backup superblock
+func groupHasBackupSlot(group int, blocksPerGroup int, blockCount int) bool {
+	if group <= 0 || group*blocksPerGroup >= blockCount-1 {
+		return false
+	}
+	if group == 1 {
+		return true
+	}
+	for _, base := range []int{3, 5, 7} {
+		power := base
+		for power < group {
+			power *= base
+		}
+		if power == group {
+			return true
+		}
+	}
+	return false
+}
+
+// groupInodeBitmap is the block holding a group's part of the inode bitmap, the free block bitmap
+// comes straight after it and then the inode table
+func groupInodeBitmap(sblock SuperBlock, group int) int {
+	if group == 0 {
+		return sblock.InodeBitmapStart
+	}
+	first := group * sblock.BlocksPerGroup
+	if groupHasBackupSlot(group, sblock.BlocksPerGroup, sblock.BlockCount) {
+		first++
+	}
+	return first
+}
+
+// groupInodeTable is the first block of a group's inode table
+func groupInodeTable(sblock SuperBlock, group int) int {
+	if group == 0 {
+		return sblock.INodeStart
+	}
+	return groupInodeBitmap(sblock, group) + 2
+}
+
+// inodeTableBlocks is how many blocks each group's inode table takes
+func inodeTableBlocks(sblock SuperBlock) int {
+	return groupInodes(sblock) * sblock.InodeSize / sblock.BlockSize
+}
+
+// groupInodes is how many inodes each group has, not counting the inode table's extra chunks
+func groupInodes(sblock SuperBlock) int {
+	if blockGroupsEnabled(sblock) {
+		return sblock.InodesPerGroup
+	}
+	if dynamicInodesEnabled(sblock) {
+		return sblock.InodeChunkBase
+	}
+	return sblock.InodeCount
+}
+
+// groupInodeBase is the number of a group's first inode. The groups Format made come before the
+// inode table's chunks and any added since come after them (see InodeTable.go)
+func groupInodeBase(sblock SuperBlock, group int) int {
+	first := group * groupInodes(sblock)
+	if dynamicInodesEnabled(sblock) && first >= sblock.InodeChunkBase {
+		first += chunkReserve(sblock)
+	}
+	return first
+}
+
+// groupOfInode is the group an inode is in, for an inode in one of the chunks the group the chunk is in
+func groupOfInode(sblock SuperBlock, inodeNum int) int {
+	if chunk := inodeChunk(sblock, inodeNum); chunk >= 0 {
+		return groupOfBlock(sblock, sblock.InodeMap[chunk])
+	}
+	if dynamicInodesEnabled(sblock) && inodeNum >= sblock.InodeChunkBase {
+		inodeNum -= chunkReserve(sblock)
+	}
+	return inodeNum / groupInodes(sblock)
+}
+
+// groupDataStart is the first block of a group that isn't metadata
+func groupDataStart(sblock SuperBlock, group int) int {
+	if group == 0 {
+		return sblock.DataBlockStart
+	}
+	return groupInodeTable(sblock, group) + inodeTableBlocks(sblock)
+}
+
+// groupFirstInode is the first inode a group hands out
+func groupFirstInode(sblock SuperBlock, group int) int {
+	if group == 0 {
+		return sblock.RootDirInode
+	}
+	return groupInodeBase(sblock, group)
+}
+
+// isMetadataBlock is true for the superblock, bitmap, inode table and journal blocks, and the blocks
+// kept for backup superblocks at the start of the sparse groups. The one in the last block is data
+// as far as this is concerned, superBlockBackups has that
+func isMetadataBlock(sblock SuperBlock, blockNum int) bool {
+	group := groupOfBlock(sblock, blockNum)
+	return blockNum >= groupStart(sblock, group) && blockNum < groupDataStart(sblock, group) || inodeChunkBlock(sblock, blockNum) >= 0
+}
+
+// inodeTableBlock says which inodes a block of the inode table holds, ok is false for any other block
+func inodeTableBlock(sblock SuperBlock, blockNum int) (firstInode int, ok bool) {
+	if chunk := inodeChunkBlock(sblock, blockNum); chunk >= 0 {
+		if blockNum == sblock.InodeMap[chunk] {
+			return 0, false //the chunk's bitmap
+		}
+		return sblock.InodeChunkBase + chunk*sblock.InodesPerChunk + (blockNum-sblock.InodeMap[chunk]-1)*(sblock.BlockSize/sblock.InodeSize), true
+	}
+	group := groupOfBlock(sblock, blockNum)
+	table := groupInodeTable(sblock, group)
+	if blockNum < table || blockNum >= table+inodeTableBlocks(sblock) {
+		return 0, false
+	}
+	return groupInodeBase(sblock, group) + (blockNum-table)*(sblock.BlockSize/sblock.InodeSize), true
+}
+
+// freeBlockBitmapLayout is the blocks the free block bitmap is kept in and the first bit in each of
+// them. Without block groups the bitmaps are in consecutive blocks, every one of them full
+func freeBlockBitmapLayout(sblock SuperBlock) ([]int, []int) {
+	if !blockGroupsEnabled(sblock) {
+		count := bitmapBlocks(sblock.BlockSize, sblock.BlockCount)
+		return consecutiveBlocks(sblock.FreeBlockStart, count), evenStarts(count, sblock.BlockSize*8)
+	}
+	blocks := make([]int, groupCount(sblock))
+	for group := range blocks {
+		blocks[group] = groupInodeBitmap(sblock, group) + 1
+	}
+	return blocks, evenStarts(len(blocks), sblock.BlocksPerGroup)
+}
+
+// inodeBitmapLayout is freeBlockBitmapLayout for the inode bitmap, with the inode table's extra chunks
+// wherever their numbers put them
+func inodeBitmapLayout(sblock SuperBlock) ([]int, []int) {
+	var blocks, starts []int
+	chunksAt := 0 //where the chunks go in the list, after the groups numbered before them
+	if !blockGroupsEnabled(sblock) {
+		count := bitmapBlocks(sblock.BlockSize, groupInodes(sblock))
+		blocks, starts = consecutiveBlocks(sblock.InodeBitmapStart, count), evenStarts(count, sblock.BlockSize*8)
+		chunksAt = count
+	} else {
+		for group := 0; group < groupCount(sblock); group++ {
+			blocks = append(blocks, groupInodeBitmap(sblock, group))
+			starts = append(starts, groupInodeBase(sblock, group))
+			if starts[group] < sblock.InodeChunkBase {
+				chunksAt = group + 1
+			}
+		}
+	}
+	for chunk := 0; chunk < sblock.InodeChunks; chunk++ {
+		blocks = slices.Insert(blocks, chunksAt+chunk, sblock.InodeMap[chunk])
+		starts = slices.Insert(starts, chunksAt+chunk, sblock.InodeChunkBase+chunk*sblock.InodesPerChunk)
+	}
+	return blocks, starts
+}
+
+func consecutiveBlocks(start int, count int) []int {
+	blocks := make([]int, count)
+	for num := range blocks {
+		blocks[num] = start + num
+	}
+	return blocks
+}
+
+// layoutBlockGroups fills in the group geometry for computeLayout. inodeCount is how many inodes were
+// asked for, they get shared out between the groups. The last group is dropped if there isn't room
+// in it for its metadata and a couple of data blocks
+func layoutBlockGroups(sblock *SuperBlock, inodeCount int) {
+	sblock.FeatureIncompat |= FEATURE_INCOMPAT_BLOCK_GROUPS
+	sblock.BlocksPerGroup = sblock.BlockSize * 8
+	inodesPerBlock := sblock.BlockSize / sblock.InodeSize
+	//a group's part of the inode bitmap gets written as whole 64 bit words, and its table fills its blocks
+	rounding := max(64, inodesPerBlock)
+	//the inode table can't take more than half the group, or the bitmap more than its one block
+	maxInodes := min(sblock.BlocksPerGroup/2*inodesPerBlock, sblock.BlockSize*8) / rounding * rounding
+	for {
+		groups := (sblock.BlockCount + sblock.BlocksPerGroup - 1) / sblock.BlocksPerGroup
+		perGroup := (inodeCount + groups - 1) / groups
+		perGroup = min((perGroup+rounding-1)/rounding*rounding, maxInodes)
+		sblock.InodesPerGroup = perGroup
+		sblock.InodeCount = groups * perGroup
+		last := groups - 1
+		if last == 0 {
+			return
+		}
+		lastBlocks := sblock.BlockCount - last*sblock.BlocksPerGroup
+		if lastBlocks >= groupDataStart(*sblock, last)-last*sblock.BlocksPerGroup+2 {
+			return
+		}
+		sblock.BlockCount = last * sblock.BlocksPerGroup //too small to be worth having
+	}
+}
+
+// checkBlockGroups makes sure the group geometry in a superblock adds up
+func checkBlockGroups(sblock SuperBlock) error {
+	if !blockGroupsEnabled(sblock) {
+		return nil
+	}
+	if sblock.BlocksPerGroup != sblock.BlockSize*8 || sblock.InodesPerGroup <= 0 || sblock.InodesPerGroup%64 != 0 ||
+		sblock.InodesPerGroup > sblock.BlockSize*8 || sblock.InodeCount != inodeSpan(sblock) {
+		return fmt.Errorf("block groups of %d blocks and %d inodes don't fit %d blocks and %d inodes",
+			sblock.BlocksPerGroup, sblock.InodesPerGroup, sblock.BlockCount, sblock.InodeCount)
+	}
+	if sblock.DataBlockStart > groupEnd(sblock, 0) {
+		return fmt.Errorf("the metadata of the first block group runs past its end")
+	}
+	return nil
+}
+
+// groupStats counts what is free in every group, the caller has the bitmaps loaded
+func groupStats(sblock SuperBlock) []BlockGroupStats {
+	freeBlocks, freeInodes := ReadFreeBlockBitmap(sblock), ReadINodeBitmap(sblock)
+	stats := make([]BlockGroupStats, groupCount(sblock))
+	for group := range stats {
+		start, end := groupStart(sblock, group), groupEnd(sblock, group)
+		firstInode := groupInodeBase(sblock, group)
+		stats[group] = BlockGroupStats{
+			Group:      group,
+			FirstBlock: start,
+			Blocks:     end - start,
+			DataStart:  groupDataStart(sblock, group),
+			FreeBlocks: (end - start) - freeBlocks.countRange(start, end),
+			FreeInodes: groupInodes(sblock) - freeInodes.countRange(firstInode, firstInode+groupInodes(sblock)),
+		}
+	}
+	return stats
+}
+
+// BlockGroups reports how full each block group is, a file system without block groups has just one.
+// The writes waiting for their blocks get them first, so they are counted where they end up
+func BlockGroups() ([]BlockGroupStats, error) {
+	defer lockShared()()
+	if Disk == nil {
+		return nil, fmt.Errorf("there is no file system mounted")
+	}
+	if err := writeDelayedWrites(); err != nil {
+		return nil, err
+	}
+	return groupStats(ReadSuperBlock()), nil
+}
+
+// allocationStart is where allocateNewBlock has the allocator start looking for a block near goal -
+// the start of goal's group, or of the data blocks when goal is 0
+func allocationStart(sblock SuperBlock, goal int) int {
+	if group := groupOfBlock(sblock, goal); group > 0 {
+		return groupDataStart(sblock, group)
+	}
+	return sblock.DataBlockStart
+}
+
+// fileBlockGoal is where we would like a new block of a file to go: the group of the block before it,
+// or for the first block the group of the file's inode
+func fileBlockGoal(sblock SuperBlock, inodeNum int, prevBlock int) int {
+	if prevBlock != 0 || !blockGroupsEnabled(sblock) {
+		return prevBlock
+	}
+	return groupDataStart(sblock, groupOfInode(sblock, inodeNum))
+}
+
+// directoryGoal picks the group a new directory's block goes in: out of the groups with at least
+// the average number of free inodes, the one with the most free blocks. The directory's files then
+// get their inodes and blocks there too
+func directoryGoal(sblock SuperBlock) int {
+	if !blockGroupsEnabled(sblock) {
+		return 0
+	}
+	stats := groupStats(sblock)
+	totalFreeInodes := 0
+	for _, group := range stats {
+		totalFreeInodes += group.FreeInodes
+	}
+	best := -1
+	for num, group := range stats {
+		if group.FreeInodes*len(stats) < totalFreeInodes || group.FreeBlocks == 0 {
+			continue
+		}
+		if best < 0 || group.FreeBlocks > stats[best].FreeBlocks {
+			best = num
+		}
+	}
+	if best < 0 {
+		return 0
+	}
+	return stats[best].DataStart
+}
@@ -0,0 +1,123 @@
+package FileSystem
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestBlockGroupLayout formats three groups' worth of disk and checks each group starts with its
+// bitmaps and inode table, backups only in the sparse groups, and a last group too small for its
+// metadata gets dropped
+func TestBlockGroupLayout(t *testing.T) {
+	for group, want := range map[int]bool{0: false, 1: true, 2: false, 3: true, 4: false, 5: true, 7: true, 9: true, 25: true, 27: true, 49: true, 50: false, 81: true} {
+		if got := groupHasBackupSlot(group, 8192, 100*8192); got != want {
+			t.Errorf("groupHasBackupSlot says %v for group %d", got, group)
+		}
+	}
+	if groupHasBackupSlot(3, 8192, 3*8192+1) {
+		t.Errorf("a group with nothing after its first block has a backup slot")
+	}
+
+	newTestFileSystem(t, 24<<20, DefaultOptions())
+	sblock := ReadSuperBlock()
+	groups, err := BlockGroups()
+	if err != nil {
+		t.Fatalf("BlockGroups: %v", err)
+	}
+	if len(groups) != 3 || sblock.BlocksPerGroup != 8*sblock.BlockSize {
+		t.Fatalf("24MB of 1K blocks made %d groups of %d blocks", len(groups), sblock.BlocksPerGroup)
+	}
+	blocks := 0
+	for num, group := range groups {
+		blocks += group.Blocks
+		if group.Group != num || group.FirstBlock != num*sblock.BlocksPerGroup {
+			t.Fatalf("group %d is %+v", num, group)
+		}
+		if num == 0 {
+			continue
+		}
+		first := group.FirstBlock
+		if groupHasBackupSlot(num, sblock.BlocksPerGroup, sblock.BlockCount) {
+			first++
+		}
+		if groupInodeBitmap(sblock, num) != first || groupDataStart(sblock, num) != first+2+inodeTableBlocks(sblock) || group.DataStart != groupDataStart(sblock, num) {
+			t.Fatalf("group %d's metadata isn't where it should be: %+v", num, group)
+		}
+		//nothing is in the group yet but its metadata, and the last block's backup superblock
+		if used := group.Blocks - group.FreeBlocks - (group.DataStart - group.FirstBlock); used < 0 || used > 1 {
+			t.Fatalf("group %d has %d blocks in use past its metadata: %+v", num, used, group)
+		}
+		if group.FreeInodes != sblock.InodesPerGroup {
+			t.Fatalf("group %d has %d free inodes out of %d", num, group.FreeInodes, sblock.InodesPerGroup)
+		}
+		for blockNum := group.FirstBlock; blockNum < group.FirstBlock+group.Blocks; blockNum++ {
+			if isMetadataBlock(sblock, blockNum) != (blockNum < group.DataStart) {
+				t.Fatalf("isMetadataBlock gets block %d of group %d wrong", blockNum, num)
+			}
+		}
+	}
+	if blocks != sblock.BlockCount {
+		t.Fatalf("the groups add up to %d blocks out of %d", blocks, sblock.BlockCount)
+	}
+	checkFsck(t)
+
+	newTestFileSystem(t, (2*8192+10)<<10, DefaultOptions())
+	if got := ReadSuperBlock().BlockCount; got != 2*8192 {
+		t.Fatalf("a ten block last group was kept, the file system has %d blocks", got)
+	}
+	checkFsck(t)
+
+	options := DefaultOptions()
+	options.NoBlockGroups = true
+	newTestFileSystem(t, 24<<20, options)
+	if groups, err := BlockGroups(); err != nil || len(groups) != 1 || groups[0].Blocks != ReadSuperBlock().BlockCount {
+		t.Fatalf("without block groups BlockGroups says %+v %v", groups, err)
+	}
+	checkFsck(t)
+}
+
+// TestBlockGroupPlacement checks a new directory goes in the emptiest group, and files get their
+// inode in their directory's group and their blocks in their inode's
+func TestBlockGroupPlacement(t *testing.T) {
+	device := newTestFileSystem(t, 24<<20, DefaultOptions())
+	sblock := ReadSuperBlock()
+	blockSize := sblock.BlockSize
+	rootFile := createTestFile(t, RootFolder, "root file", strings.Repeat("r", 20*blockSize))
+
+	_, subNum := Open(CREATE, "sub", RootFolder)
+	CreateDirectoryFile(sblock.RootDirInode, subNum)
+	sub, _ := Open(READ, "sub", RootFolder)
+	subGroup := groupOfBlock(sblock, sub.DirectBlock1)
+	if subGroup == 0 {
+		t.Fatalf("the new directory went in group 0 with two empty groups going")
+	}
+	subFile := createTestFile(t, sub, "sub file", strings.Repeat("s", 20*blockSize))
+	if err := Sync(); err != nil { //the files get their blocks
+		t.Fatalf("Sync: %v", err)
+	}
+
+	for inodeNum, group := range map[int]int{rootFile: 0, subFile: subGroup} {
+		if got := groupOfInode(sblock, inodeNum); got != group {
+			t.Fatalf("inode %d is in group %d, its directory is in group %d", inodeNum, got, group)
+		}
+		file := getInodeFromDisk(inodeNum)
+		for _, blockNum := range fileBlocks(sblock, &file) {
+			if got := groupOfBlock(sblock, blockNum); got != group {
+				t.Fatalf("block %d of inode %d is in group %d, the inode is in group %d", blockNum, inodeNum, got, group)
+			}
+		}
+	}
+	groups, err := BlockGroups()
+	if err != nil {
+		t.Fatalf("BlockGroups: %v", err)
+	}
+	if groups[subGroup].FreeInodes != sblock.InodesPerGroup-1 {
+		t.Fatalf("the directory's group has %d free inodes", groups[subGroup].FreeInodes)
+	}
+
+	remount(t, device)
+	if got, _ := readTestFile(sub, "sub file"); got != strings.Repeat("s", 20*blockSize) {
+		t.Fatalf("the file in the directory holds %.10q...", got)
+	}
+	checkFsck(t)
+}
@@ -0,0 +1,345 @@
+package FileSystem
+
+import (
+	"container/list"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Buffer cache
+// Every block read or written goes through a cache of the most recently used blocks instead of
+// straight to Disk, so looking at the same inode table block or directory over and over doesn't go
+// to the device each time. Writes only change the cached copy and mark it dirty. Dirty blocks get
+// written back when they are pushed out of the cache, when they have been dirty for longer than the
+// write back interval, and whenever something needs the disk to be in order - syncDisk writes back
+// everything before it syncs and syncBlocks just the blocks it is given, so the journal and copy on
+// write still get their writes down in the order they asked for. The superblock is kept decoded as
+// well, since nearly everything reads it.
+
+const (
+	DEFAULT_CACHE_BLOCKS        = 4096
+	DEFAULT_WRITE_BACK_INTERVAL = 5 * time.Second
+)
+
+// CacheStats is what the buffer cache has been up to since the mount
+type CacheStats struct {
+	Hits       int64
+	Misses     int64
+	Evictions  int64
+	WriteBacks int64 //dirty blocks written out to the device
+	Cached     int   //blocks in the cache right now
+	Dirty      int   //blocks in the cache that are newer than the device
+	Capacity   int
+}
+
+type buffer struct {
+	blockNum   int
+	data       []byte
+	dirty      bool
+	dirtySince time.Time
+}
+
+type bufferCache struct {
+	lock      sync.Mutex
+	device    BlockDevice
+	blockSize int
+	capacity  int
+	buffers   map[int]*list.Element
+	lru       *list.List //most recently used at the front
+	stats     CacheStats
+
+	//the decoded superblock and the block it came from, superBlockNum is -1 if there isn't one
+	superBlock    SuperBlock
+	superBlockNum int
+
+	stop    chan struct{}
+	stopped sync.WaitGroup
+}
+
+// cache sits in front of Disk, it gets replaced along with Disk by Format and Mount
+var cache *bufferCache
+
+// setDisk makes device the Disk with an empty cache in front of it. Whatever the old cache still had
+// gets written back to the old device first. Only while holding mountLock exclusively
+func setDisk(device BlockDevice, blockSize int, cacheBlocks int, writeBack time.Duration) {
+	if cache != nil {
+		cache.close()
+		cache = nil
+	}
+	dropNameCaches()
+	dropDelayedWrites()
+	Disk = device
+	if device == nil {
+		return
+	}
+	if cacheBlocks <= 0 {
+		cacheBlocks = DEFAULT_CACHE_BLOCKS
+	}
+	if writeBack == 0 {
+		writeBack = DEFAULT_WRITE_BACK_INTERVAL
+	}
+	cache = &bufferCache{
+		device:        device,
+		blockSize:     blockSize,
+		capacity:      cacheBlocks,
+		buffers:       map[int]*list.Element{},
+		lru:           list.New(),
+		superBlockNum: -1,
+		stop:          make(chan struct{}),
+	}
+	cache.stats.Capacity = cacheBlocks
+	if writeBack > 0 {
+		cache.stopped.Add(1)
+		go cache.writeBackLoop(writeBack)
+	}
+}
+
+// flushCache writes back everything in the cache without syncing, so the device can be read directly
+func flushCache() {
+	if cache != nil {
+		cache.lock.Lock()
+		defer cache.lock.Unlock()
+		cache.writeBackLocked(func(*buffer) bool { return true })
+	}
+}
+
+// close stops the write back and writes back everything that is left
+func (c *bufferCache) close() {
+	close(c.stop)
+	c.stopped.Wait()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.writeBackLocked(func(*buffer) bool { return true })
+}
+
+// writeBackLoop writes back the blocks that have been dirty for longer than interval, every interval
+func (c *bufferCache) writeBackLoop(interval time.Duration) {
+	defer c.stopped.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case now := <-ticker.C:
+			c.lock.Lock()
+			c.writeBackLocked(func(buf *buffer) bool { return now.Sub(buf.dirtySince) >= interval })
+			c.lock.Unlock()
+		}
+	}
+}
+
+// truncate makes the device size bytes long, whatever is cached past the new end gets thrown away
+func (c *bufferCache) truncate(size int64) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	device, ok := c.device.(ResizableDevice)
+	if !ok {
+		return fmt.Errorf("the device can't change size")
+	}
+	for blockNum, element := range c.buffers {
+		if int64(blockNum+1)*int64(c.blockSize) <= size {
+			continue
+		}
+		if element.Value.(*buffer).dirty {
+			c.stats.Dirty--
+		}
+		c.lru.Remove(element)
+		delete(c.buffers, blockNum)
+		if blockNum == c.superBlockNum {
+			c.superBlockNum = -1
+		}
+	}
+	return device.Truncate(size)
+}
+
+func (c *bufferCache) checkBlock(blockNum int) {
+	if blockNum < 0 || int64(blockNum+1)*int64(c.blockSize) > c.device.Size() {
+		log.Fatal("Tried to use block ", blockNum, " which isn't on the device")
+	}
+}
+
+// read returns a copy of the block
+func (c *bufferCache) read(blockNum int) []byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]byte{}, c.getLocked(blockNum).data...)
+}
+
+// getLocked finds the block in the cache, reading it in if it isn't there
+func (c *bufferCache) getLocked(blockNum int) *buffer {
+	if element, ok := c.buffers[blockNum]; ok {
+		c.stats.Hits++
+		c.lru.MoveToFront(element)
+		return element.Value.(*buffer)
+	}
+	c.stats.Misses++
+	c.checkBlock(blockNum)
+	buf := &buffer{blockNum: blockNum, data: make([]byte, c.blockSize)}
+	if _, err := c.device.ReadAt(buf.data, int64(blockNum)*int64(c.blockSize)); err != nil {
+		log.Fatal("Error reading block ", blockNum, ": ", err)
+	}
+	c.insertLocked(buf)
+	return buf
+}
+
+// write replaces the whole block, anything past the end of data is zeroed
+func (c *bufferCache) write(blockNum int, data []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var buf *buffer
+	if element, ok := c.buffers[blockNum]; ok {
+		c.lru.MoveToFront(element)
+		buf = element.Value.(*buffer)
+	} else {
+		//no need to read a block in just to overwrite all of it
+		c.checkBlock(blockNum)
+		buf = &buffer{blockNum: blockNum, data: make([]byte, c.blockSize)}
+		c.insertLocked(buf)
+	}
+	copy(buf.data, data)
+	for pos := len(data); pos < len(buf.data); pos++ {
+		buf.data[pos] = 0
+	}
+	if !buf.dirty {
+		buf.dirty = true
+		buf.dirtySince = time.Now()
+		c.stats.Dirty++
+	}
+	if blockNum == c.superBlockNum {
+		c.superBlockNum = -1
+	}
+}
+
+// insertLocked puts a new buffer at the front, pushing the least recently used one out if we are full
+func (c *bufferCache) insertLocked(buf *buffer) {
+	for c.lru.Len() >= c.capacity {
+		oldest := c.lru.Back()
+		victim := oldest.Value.(*buffer)
+		if victim.dirty {
+			c.writeBufferLocked(victim)
+		}
+		c.lru.Remove(oldest)
+		delete(c.buffers, victim.blockNum)
+		if victim.blockNum == c.superBlockNum {
+			c.superBlockNum = -1
+		}
+		c.stats.Evictions++
+	}
+	c.buffers[buf.blockNum] = c.lru.PushFront(buf)
+}
+
+func (c *bufferCache) writeBufferLocked(buf *buffer) {
+	if _, err := c.device.WriteAt(buf.data, int64(buf.blockNum)*int64(c.blockSize)); err != nil {
+		log.Fatal("Error writing block ", buf.blockNum, ": ", err)
+	}
+	buf.dirty = false
+	c.stats.Dirty--
+	c.stats.WriteBacks++
+}
+
+// writeBackLocked writes back the dirty blocks that want says to
+func (c *bufferCache) writeBackLocked(want func(*buffer) bool) {
+	for element := c.lru.Back(); element != nil; element = element.Prev() {
+		if buf := element.Value.(*buffer); buf.dirty && want(buf) {
+			c.writeBufferLocked(buf)
+		}
+	}
+}
+
+// writeBackBlocks writes back just the listed blocks, if they are dirty
+func (c *bufferCache) writeBackBlocks(blockNums []int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, blockNum := range blockNums {
+		if element, ok := c.buffers[blockNum]; ok && element.Value.(*buffer).dirty {
+			c.writeBufferLocked(element.Value.(*buffer))
+		}
+	}
+}
+
+// readSuperBlock decodes the superblock at the start of blockNum, or hands back the one it decoded
+// last time if the block hasn't been written since
+func (c *bufferCache) readSuperBlock(blockNum int) SuperBlock {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if blockNum != c.superBlockNum {
+		c.superBlock = decodeSuperBlock(c.getLocked(blockNum).data[:SUPERBLOCK_SIZE])
+		c.superBlockNum = blockNum
+	} else {
+		c.stats.Hits++
+	}
+	return c.superBlock
+}
+
+func (c *bufferCache) statistics() CacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	stats := c.stats
+	stats.Cached = c.lru.Len()
+	return stats
+}
+
+// BufferCacheStats reports how well the buffer cache is doing
+func BufferCacheStats() CacheStats {
+	defer lockShared()()
+	if cache == nil {
+		return CacheStats{}
+	}
+	return cache.statistics()
+}
+
+// Sync writes everything that has been done so far out to the device, giving the writes still waiting
+// for their blocks their blocks first. Operations that are still going finish first, so their
+// transaction has committed by the time we write back
+func Sync() error {
+	defer lockExclusive()()
+	if Disk == nil {
+		return fmt.Errorf("there is no file system mounted")
+	}
+	if err := lastCommitError(); err != nil {
+		return err
+	}
+	delayedErr := writeDelayedWrites()
+	flushCache()
+	if err := Disk.Sync(); err != nil {
+		return err
+	}
+	return delayedErr
+}
+
+// Fsync is Sync for one file: it gets its blocks if it is still waiting for them, then its inode, its
+// indirect block and its data go out to the device. Getting the blocks commits a transaction, which
+// writes back the whole cache, so other files can go out with it when it was still waiting. Copy on
+// write has nothing of the file left in the cache by then, every commit writes everything back, so
+// it only has to sync the device
+func Fsync(inodeNum int) error {
+	defer lockExclusive()()
+	if Disk == nil {
+		return fmt.Errorf("there is no file system mounted")
+	}
+	sblock := ReadSuperBlock()
+	if inodeNum <= 0 || inodeNum >= sblock.InodeCount {
+		return fmt.Errorf("inode %d doesn't exist", inodeNum)
+	}
+	if !getInodeFromDisk(inodeNum).IsValid {
+		return fmt.Errorf("inode %d isn't in use", inodeNum)
+	}
+	if err := flushDelayed(inodeNum); err != nil {
+		return err
+	}
+	file := getInodeFromDisk(inodeNum)
+	if cow != nil {
+		//every commit already wrote everything back, there can't be anything of this file left
+		return Disk.Sync()
+	}
+	inodeBlock, _ := inodeLocation(sblock, inodeNum)
+	blocks := append(fileBlocks(sblock, &file), inodeBlock)
+	if file.IndirectBlock != 0 {
+		blocks = append(blocks, file.IndirectBlock)
+	}
+	cache.writeBackBlocks(blocks)
+	return Disk.Sync()
+}
@@ -0,0 +1,80 @@
+package FileSystem
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// TestBufferCacheWriteBack puts a four block cache in front of a device and checks writes stay in
+// the cache until the least recently used block gets pushed out or the cache is flushed, and that
+// the stats count all of it
+func TestBufferCacheWriteBack(t *testing.T) {
+	const blockSize = 64
+	device := NewMemDevice(16 * blockSize)
+	setDisk(device, blockSize, 4, -1) //no write back loop, only eviction and flushCache write
+	t.Cleanup(func() { setDisk(nil, 0, 0, 0) })
+	onDevice := func(blockNum int) []byte {
+		return device.data[blockNum*blockSize : (blockNum+1)*blockSize]
+	}
+	block := func(fill byte) []byte {
+		return bytes.Repeat([]byte{fill}, blockSize)
+	}
+
+	for blockNum := 0; blockNum < 4; blockNum++ {
+		cache.write(blockNum, block(byte('a'+blockNum)))
+	}
+	if stats := cache.statistics(); stats.Dirty != 4 || stats.Cached != 4 || stats.WriteBacks != 0 {
+		t.Fatalf("four writes left %+v", stats)
+	}
+	if !bytes.Equal(onDevice(0), make([]byte, blockSize)) {
+		t.Fatalf("a write went to the device before anything pushed it out")
+	}
+	if !bytes.Equal(cache.read(0), block('a')) {
+		t.Fatalf("the cache gave back %q", cache.read(0))
+	}
+
+	//block 0 was just read, so block 1 is the least recently used and goes when block 4 comes in
+	cache.write(4, []byte("short"))
+	if !bytes.Equal(onDevice(1), block('b')) || !bytes.Equal(onDevice(0), make([]byte, blockSize)) {
+		t.Fatalf("block 4 pushed out the wrong block")
+	}
+	if got := cache.read(4); !bytes.Equal(got, append([]byte("short"), make([]byte, blockSize-5)...)) {
+		t.Fatalf("a short write reads back as %q", got)
+	}
+	if got := cache.read(1); !bytes.Equal(got, block('b')) {
+		t.Fatalf("block 1 reads back from the device as %q", got)
+	}
+	stats := cache.statistics()
+	if stats.Evictions != 2 || stats.WriteBacks != 2 || stats.Misses != 1 || stats.Hits != 2 || stats.Cached != 4 {
+		t.Fatalf("after pushing two blocks out %+v", stats)
+	}
+
+	flushCache()
+	for blockNum, fill := range []byte{'a', 'b'} {
+		if !bytes.Equal(onDevice(blockNum), block(fill)) {
+			t.Fatalf("block %d holds %q after a flush", blockNum, onDevice(blockNum))
+		}
+	}
+	if stats := cache.statistics(); stats.Dirty != 0 {
+		t.Fatalf("a flush left %d dirty blocks", stats.Dirty)
+	}
+}
+
+// TestBufferCacheWriteBackInterval checks the write back loop gets a dirty block to the device on
+// its own once it has been dirty for the interval
+func TestBufferCacheWriteBackInterval(t *testing.T) {
+	device := NewMemDevice(4 * 64)
+	setDisk(device, 64, 4, 10*time.Millisecond)
+	t.Cleanup(func() { setDisk(nil, 0, 0, 0) })
+	cache.write(2, []byte("later"))
+	for deadline := time.Now().Add(5 * time.Second); cache.statistics().WriteBacks == 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("the write back loop never wrote the block")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !bytes.HasPrefix(device.data[2*64:], []byte("later")) {
+		t.Fatalf("the write back loop wrote something else")
+	}
+}
@@ -0,0 +1,165 @@
+package FileSystem
+
+import (
+	"fmt"
+	"time"
+)
+
+// Cloning files
+// CloneFile makes a new file that points at the same data blocks as an existing one instead of
+// copying them, so a copy of a big file costs an inode and maybe an indirect block. The allocator
+// keeps a reference count for every block more than one file points at - freeing a shared block
+// only takes one off the count, and Write gives a file its own block before writing into a shared one.
+// Indirect blocks and directory blocks are never shared.
+//
+// The counts aren't stored anywhere, they are worked out from the inodes the first time they are
+// needed after a mount, so they can't disagree with the inodes after a crash. The file system is
+// only marked as having shared blocks once something has been cloned or an old version kept (see
+// Version.go), and until then there is no need to look. Older code would free a shared block out from under the other file, which is why
+// that mark is a read only compatible feature.
+
+const FEATURE_ROCOMPAT_SHARED_BLOCKS uint32 = 1 << 1
+
+// blockRefs has the number of files pointing at each shared block, blocks with one owner aren't in it.
+// nil means it hasn't been worked out since the mount. It belongs to blockRefsLock
+var blockRefs map[int]int
+
+func sharedBlocksEnabled(sblock SuperBlock) bool {
+	return sblock.FeatureROCompat&FEATURE_ROCOMPAT_SHARED_BLOCKS != 0
+}
+
+// readBlockRefs works out the reference counts if we don't have them yet, the caller holds blockRefsLock
+func readBlockRefs(sblock SuperBlock) map[int]int {
+	if blockRefs != nil {
+		return blockRefs
+	}
+	blockRefs = map[int]int{}
+	if !sharedBlocksEnabled(sblock) {
+		return blockRefs //nothing has ever been cloned
+	}
+	for inodeNum := 1; inodeNum < sblock.InodeCount; inodeNum++ {
+		inode := getInodeFromDisk(inodeNum)
+		if !inode.IsValid || inode.IsDirectory {
+			continue
+		}
+		for _, blockNum := range fileBlocks(sblock, &inode) {
+			blockRefs[blockNum]++
+		}
+	}
+	for blockNum, refs := range blockRefs {
+		if refs < 2 {
+			delete(blockRefs, blockNum)
+		}
+	}
+	return blockRefs
+}
+
+// blockShared is true if more than one file points at the block
+func blockShared(sblock SuperBlock, blockNum int) bool {
+	blockRefsLock.Lock()
+	defer blockRefsLock.Unlock()
+	return readBlockRefs(sblock)[blockNum] > 1
+}
+
+// shareBlock adds a reference to a block that is already in use
+func shareBlock(sblock SuperBlock, blockNum int) {
+	blockRefsLock.Lock()
+	defer blockRefsLock.Unlock()
+	refs := readBlockRefs(sblock)
+	if refs[blockNum] == 0 {
+		refs[blockNum] = 1 //the owner it already had
+	}
+	refs[blockNum]++
+}
+
+// releaseBlock drops a reference to a data block, and frees it if that was the last one
+func releaseBlock(sblock SuperBlock, blockNum int) {
+	blockRefsLock.Lock()
+	defer blockRefsLock.Unlock()
+	refs := readBlockRefs(sblock)
+	switch refs[blockNum] {
+	case 0:
+		freeDataBlock(sblock, blockNum)
+	case 2:
+		delete(refs, blockNum)
+	default:
+		refs[blockNum]--
+	}
+}
+
+// enableSharedBlocks marks the file system as having shared blocks, if it isn't already
+func enableSharedBlocks(sblock SuperBlock) {
+	blockRefsLock.Lock()
+	readBlockRefs(sblock) //before the feature gets turned on, so it knows there's nothing to count yet
+	blockRefsLock.Unlock()
+	superBlockLock.Lock()
+	defer superBlockLock.Unlock()
+	if sblock = ReadSuperBlock(); !sharedBlocksEnabled(sblock) {
+		sblock.FeatureROCompat |= FEATURE_ROCOMPAT_SHARED_BLOCKS
+		writeSuperBlock(sblock)
+	}
+}
+
+// shareFileBlocks points dst, which has no blocks yet, at all of src's data blocks
+func shareFileBlocks(sblock SuperBlock, src *INode, dst *INode) {
+	enableSharedBlocks(sblock)
+	blocks := fileBlocks(sblock, src)
+	for blockIndex, blockNum := range blocks {
+		shareBlock(sblock, blockNum)
+		switch blockIndex {
+		case 0:
+			dst.DirectBlock1 = blockNum
+		case 1:
+			dst.DirectBlock2 = blockNum
+		case 2:
+			dst.DirectBlock3 = blockNum
+		}
+	}
+	if len(blocks) > 3 {
+		//the indirect block is dst's own, only what it points at is shared
+		indirectBlockVal := getIndirectBlock(dst)
+		copy(indirectBlockVal, blocks[3:])
+		writeBlock(sblock, dst.IndirectBlock, EncodeToBytes(indirectBlockVal))
+	}
+}
+
+// CloneFile makes dstName in dstDir a copy of the file with inode number src that shares all of its
+// data blocks, and returns the new inode and its number
+func CloneFile(src int, dstName string, dstDir INode) (INode, int, error) {
+	defer lockShared()()
+	if err := flushDelayed(src); err != nil { //the clone shares the blocks src has on Disk
+		return INode{}, 0, err
+	}
+	beginOperation()
+	defer endOperation()
+	defer lockInodes([]int{directoryNum(dstDir)}, []int{src})()
+	if readOnly {
+		return INode{}, 0, fmt.Errorf("file system is mounted read only")
+	}
+	sblock := ReadSuperBlock()
+	if src <= 0 || src >= sblock.InodeCount {
+		return INode{}, 0, fmt.Errorf("inode %d doesn't exist", src)
+	}
+	srcInode := getInodeFromDisk(src)
+	if !srcInode.IsValid || srcInode.IsDirectory {
+		return INode{}, 0, fmt.Errorf("inode %d isn't a file", src)
+	}
+	if !dstDir.IsValid || !dstDir.IsDirectory {
+		return INode{}, 0, fmt.Errorf("destination isn't a directory")
+	}
+	if err := validName(dstName); err != nil {
+		return INode{}, 0, err
+	}
+	if _, existing := openFile(READ, dstName, dstDir); existing != 0 {
+		return INode{}, 0, fmt.Errorf("%s already exists", dstName)
+	}
+
+	beginTransaction()
+	defer commitTransaction()
+	clone, cloneNum := openFile(CREATE, dstName, dstDir)
+	shareFileBlocks(sblock, &srcInode, &clone)
+	clone.LastModifyTime = time.Now().Unix()
+	writeInodeToDisk(&clone, cloneNum, sblock)
+	syncBitmaps()
+	return clone, cloneNum, nil
+}
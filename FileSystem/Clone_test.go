@@ -0,0 +1,95 @@
+package FileSystem
+
+import (
+	"strings"
+	"testing"
+)
+
+// checkBlockRefs makes sure every data block of the files in inodeNums has as many references as
+// there are files in the list pointing at it, and that the counts come out the same worked out
+// from the disk after a remount. Writes still waiting for their blocks get them first
+func checkBlockRefs(t *testing.T, device BlockDevice, inodeNums ...int) {
+	t.Helper()
+	if err := Sync(); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	sblock := ReadSuperBlock()
+	want := map[int]int{}
+	for _, inodeNum := range inodeNums {
+		inode := getInodeFromDisk(inodeNum)
+		for _, blockNum := range fileBlocks(sblock, &inode) {
+			want[blockNum]++
+		}
+	}
+	for pass := 0; pass < 2; pass++ {
+		blockRefsLock.Lock()
+		refs := readBlockRefs(sblock)
+		for blockNum, count := range want {
+			if got := refs[blockNum]; count > 1 && got != count || count == 1 && got != 0 {
+				blockRefsLock.Unlock()
+				t.Fatalf("block %d has %d references, %d files point at it", blockNum, got, count)
+			}
+		}
+		blockRefsLock.Unlock()
+		checkFsck(t)
+		remount(t, device)
+	}
+}
+
+// TestCloneFile clones a file that runs into its indirect block, writes one of the copies and
+// unlinks them one at a time. The shared blocks have to be counted right all the way through and
+// only go back to being free once the last file using them has gone
+func TestCloneFile(t *testing.T) {
+	device := newTestFileSystem(t, 4<<20, DefaultOptions())
+	sblock := ReadSuperBlock()
+	free := Statfs().FreeBlocks
+	content := strings.Repeat("a", 6*sblock.BlockSize)
+	original := createTestFile(t, RootFolder, "original", content)
+	used := free - Statfs().FreeBlocks
+
+	_, first, err := CloneFile(original, "first", RootFolder)
+	if err != nil {
+		t.Fatalf("CloneFile: %v", err)
+	}
+	_, second, err := CloneFile(original, "second", RootFolder)
+	if err != nil {
+		t.Fatalf("CloneFile: %v", err)
+	}
+	if _, _, err := CloneFile(original, "first", RootFolder); err == nil {
+		t.Fatalf("cloned over a file that already exists")
+	}
+	//the clones only cost an indirect block each
+	if extra := free - used - Statfs().FreeBlocks; extra != 2 {
+		t.Fatalf("two clones took %d blocks", extra)
+	}
+	checkBlockRefs(t, device, original, first, second)
+
+	//writing a clone gives it its own blocks and leaves the other two sharing
+	changed := strings.Repeat("b", 6*sblock.BlockSize)
+	file := getInodeFromDisk(first)
+	Write(&file, first, []byte(changed))
+	checkBlockRefs(t, device, original, second)
+	checkBlockRefs(t, device, first)
+	for name, want := range map[string]string{"original": content, "first": changed, "second": content} {
+		if got, _ := readTestFile(RootFolder, name); got != want {
+			t.Fatalf("%s holds %.20q", name, got)
+		}
+	}
+
+	for _, name := range []string{"original", "first"} {
+		if err := UnlinkName(name, RootFolder); err != nil {
+			t.Fatalf("UnlinkName %s: %v", name, err)
+		}
+	}
+	checkBlockRefs(t, device, second)
+	if got, _ := readTestFile(RootFolder, "second"); got != content {
+		t.Fatalf("second holds %.20q after the file it was cloned from went", got)
+	}
+	if err := UnlinkName("second", RootFolder); err != nil {
+		t.Fatalf("UnlinkName second: %v", err)
+	}
+	checkFsck(t)
+	if now := Statfs().FreeBlocks; now != free {
+		t.Fatalf("%d blocks free after unlinking everything, there were %d", now, free)
+	}
+}
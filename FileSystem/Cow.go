@@ -0,0 +1,364 @@
+package FileSystem
+
+import (
+	"fmt"
+	"log"
+)
+
+// Copy on write
+// The journal writes everything twice. A copy on write file system instead never overwrites a
+// block that is in use: every block number the rest of the code uses (a logical block) is looked
+// up in the block map to find the physical block that holds it, and writing a logical block puts
+// the new contents in a fresh physical block and points the map at it. Nothing above readBlock
+// and writeBlock can tell the difference.
+//
+// The block map is kept twice, copy 0 and copy 1, and the superblock says which one is live. A
+// transaction writes its blocks to fresh physical blocks, writes the changed parts of the map to
+// the copy that isn't live, and then writes the superblock pointing at that copy. That one
+// superblock write is the commit - crash before it and the old map is still live and still points
+// at the old blocks, which nobody has touched. The copy that isn't live is always one commit
+// behind, so each commit writes the map blocks it changed plus the ones the commit before changed.
+//
+// Physical blocks are reference counted so more than one map can share them, which is what
+// snapshots are built on. The physical layout is the superblock in block 0, map copy 0, map copy 1
+// and then the pool of physical blocks. There are no backup superblocks or journal in this mode.
+//
+// A commit can't let go of the old copies until the new ones are down, so the pool is kept bigger
+// than the logical blocks (see cowLayout). Write asks for room for everything it writes first and
+// gets ErrNoSpace if there isn't any, and a commit that runs out anyway leaves the file system read
+// only rather than half written.
+
+const FEATURE_INCOMPAT_COW uint32 = 1 << 0
+
+// COW_SPARE_BLOCKS is what the pool keeps free on top of a sixteenth of it for the metadata a commit
+// writes. Writing file contents into it gets ErrNoSpace instead
+const COW_SPARE_BLOCKS = 32
+
+// cowState is the in memory block map of a mounted copy on write file system
+type cowState struct {
+	blockMap       []int    //physical block for each logical block, 0 if it has never been written
+	refs           []uint16 //how many maps point at each physical block
+	active         int      //which copy of the map the superblock points at
+	generation     uint32   //bumped by every commit
+	blockSize      int
+	mapStart       int
+	mapBlocks      int
+	poolStart      int
+	physicalBlocks int
+	lastDirty      map[int]bool //map blocks the previous commit changed, nil means we don't know so write them all
+	cursor         int          //where allocate starts looking
+	snapshot       *SuperBlock  //superblock of the snapshot we mounted instead of the live file system
+	free           int          //pool blocks nothing points at
+	mapped         int          //logical blocks the live map points somewhere
+	reserved       int          //free blocks the operations in the running transaction have asked for
+}
+
+// cow is nil unless the mounted file system is copy on write
+var cow *cowState
+
+func cowEnabled(sblock SuperBlock) bool {
+	return sblock.FeatureIncompat&FEATURE_INCOMPAT_COW != 0
+}
+
+// cowLayout works out how many logical blocks fit on physicalBlocks and how big the map for them is.
+// The pool has to be bigger than the logical blocks, a commit needs room for the new copies
+// before it can let go of the old ones
+func cowLayout(physicalBlocks int, blockSize int) (int, int) {
+	logicalBlocks := physicalBlocks
+	for {
+		mapBlocks := (logicalBlocks*4 + blockSize - 1) / blockSize
+		pool := physicalBlocks - 1 - 2*mapBlocks
+		next := pool - pool/16 - COW_SPARE_BLOCKS + 1 //block 0 is the superblock, which isn't in the pool
+		if next >= logicalBlocks || next <= 0 {
+			return logicalBlocks, mapBlocks
+		}
+		logicalBlocks = next
+	}
+}
+
+func newCowState(sblock SuperBlock) *cowState {
+	return &cowState{
+		blockMap:       make([]int, sblock.BlockCount),
+		refs:           make([]uint16, sblock.PhysicalBlocks),
+		active:         sblock.CowActive,
+		generation:     sblock.CowGeneration,
+		blockSize:      sblock.BlockSize,
+		mapStart:       sblock.CowMapStart,
+		mapBlocks:      sblock.CowMapBlocks,
+		poolStart:      sblock.CowMapStart + 2*sblock.CowMapBlocks,
+		physicalBlocks: sblock.PhysicalBlocks,
+		free:           sblock.PhysicalBlocks - sblock.CowMapStart - 2*sblock.CowMapBlocks,
+	}
+}
+
+func (state *cowState) entriesPerMapBlock() int {
+	return state.blockSize / BLOCK_POINTER_SIZE
+}
+
+func (state *cowState) readPhysical(physicalNum int) []byte {
+	return cache.read(physicalNum)
+}
+
+func (state *cowState) writePhysical(physicalNum int, data []byte) {
+	cache.write(physicalNum, data)
+}
+
+// readMap loads a whole copy of the block map
+func (state *cowState) readMap(copyNum int, logicalBlocks int) ([]int, error) {
+	blockMap := make([]int, logicalBlocks)
+	perBlock := state.entriesPerMapBlock()
+	for mapBlock := 0; mapBlock < state.mapBlocks; mapBlock++ {
+		entries := decodeIndirectBlock(state.readPhysical(state.mapStart + copyNum*state.mapBlocks + mapBlock))
+		for num, physicalNum := range entries {
+			logicalNum := mapBlock*perBlock + num
+			if logicalNum >= logicalBlocks {
+				break
+			}
+			if physicalNum != 0 && !state.inPool(physicalNum) {
+				return nil, fmt.Errorf("block map says logical block %d is at %d which isn't in the pool", logicalNum, physicalNum)
+			}
+			blockMap[logicalNum] = physicalNum
+		}
+	}
+	return blockMap, nil
+}
+
+// encodeMapBlock is one block's worth of a block map in its on disk form
+func (state *cowState) encodeMapBlock(blockMap []int, mapBlock int) []byte {
+	perBlock := state.entriesPerMapBlock()
+	entries := make(IndirectBlock, perBlock)
+	for num := range entries {
+		if logicalNum := mapBlock*perBlock + num; logicalNum < len(blockMap) {
+			entries[num] = blockMap[logicalNum]
+		}
+	}
+	return EncodeToBytes(entries)
+}
+
+// writeMapBlock writes one block of the in memory map into a copy of the map on Disk
+func (state *cowState) writeMapBlock(copyNum int, mapBlock int) {
+	state.writePhysical(state.mapStart+copyNum*state.mapBlocks+mapBlock, state.encodeMapBlock(state.blockMap, mapBlock))
+}
+
+// mountCow loads the live block map and counts the references to every physical block
+func mountCow(sblock SuperBlock) error {
+	if sblock.CowActive > 1 || sblock.CowMapBlocks*sblock.BlockSize/BLOCK_POINTER_SIZE < sblock.BlockCount ||
+		sblock.CowMapStart < 1 || sblock.CowMapStart+2*sblock.CowMapBlocks >= sblock.PhysicalBlocks ||
+		int64(sblock.PhysicalBlocks)*int64(sblock.BlockSize) > Disk.Size() {
+		return fmt.Errorf("copy on write layout in the superblock doesn't make sense")
+	}
+	state := newCowState(sblock)
+	blockMap, err := state.readMap(state.active, sblock.BlockCount)
+	if err != nil {
+		return err
+	}
+	state.blockMap = blockMap
+	state.reference(blockMap)
+	for _, physicalNum := range blockMap {
+		if physicalNum != 0 {
+			state.mapped++
+		}
+	}
+	if sblock.SnapshotTable != 0 {
+		//snapshots hold on to their own blocks as well as any they share with the live map
+		table, err := state.readSnapshotTable(sblock.SnapshotTable)
+		if err != nil {
+			return err
+		}
+		state.reference([]int{sblock.SnapshotTable})
+		for _, header := range table {
+			snap, err := state.readSnapshot(header, sblock.BlockCount)
+			if err != nil {
+				return err
+			}
+			state.reference(snap.ownBlocks())
+			state.reference(snap.blockMap)
+		}
+	}
+	cow = state
+	return nil
+}
+
+// reference adds one to the count of every physical block in the list, 0 is skipped
+func (state *cowState) reference(physicalBlocks []int) {
+	for _, physicalNum := range physicalBlocks {
+		if physicalNum != 0 {
+			if state.refs[physicalNum] == 0 {
+				state.free--
+			}
+			state.refs[physicalNum]++
+		}
+	}
+}
+
+// release is the other way round
+func (state *cowState) release(physicalBlocks []int) {
+	for _, physicalNum := range physicalBlocks {
+		if physicalNum != 0 {
+			state.refs[physicalNum]--
+			if state.refs[physicalNum] == 0 {
+				state.free++
+			}
+		}
+	}
+}
+
+// setMapping points a logical block at a physical one, 0 for nowhere
+func (state *cowState) setMapping(logicalNum int, physicalNum int) {
+	if state.blockMap[logicalNum] == 0 && physicalNum != 0 {
+		state.mapped++
+	} else if state.blockMap[logicalNum] != 0 && physicalNum == 0 {
+		state.mapped--
+	}
+	state.blockMap[logicalNum] = physicalNum
+}
+
+// held is how many pool blocks only snapshots are holding on to, everything in use that the live
+// map doesn't point at. The free block bitmap only knows about logical blocks, so these get taken
+// off its count (see freeBlockCount)
+func (state *cowState) held() int {
+	return state.physicalBlocks - state.poolStart - state.free - state.mapped
+}
+
+// snapshotHeldBlocks is held for the mounted file system, 0 without copy on write
+func snapshotHeldBlocks() int {
+	transactionLock.Lock()
+	defer transactionLock.Unlock()
+	if cow == nil {
+		return 0
+	}
+	return cow.held()
+}
+
+// inPool is whether a physical block number is one blocks can be allocated from
+func (state *cowState) inPool(physicalNum int) bool {
+	return physicalNum >= state.poolStart && physicalNum < state.physicalBlocks
+}
+
+// read returns the contents of a logical block, blocks that were never written read as zeros
+func (state *cowState) read(logicalNum int) []byte {
+	if physicalNum := state.blockMap[logicalNum]; physicalNum != 0 {
+		return state.readPhysical(physicalNum)
+	}
+	return make([]byte, state.blockSize)
+}
+
+// allocate finds a physical block nothing points at and claims it, ErrNoSpace if there isn't one
+func (state *cowState) allocate() (int, error) {
+	poolSize := state.physicalBlocks - state.poolStart
+	for tries := 0; tries < poolSize && state.free > 0; tries++ {
+		physicalNum := state.poolStart + (state.cursor+tries)%poolSize
+		if state.refs[physicalNum] == 0 {
+			state.refs[physicalNum] = 1
+			state.free--
+			state.cursor = (state.cursor + tries + 1) % poolSize
+			return physicalNum, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: the copy on write pool is full", ErrNoSpace)
+}
+
+// reserveCowBlocks asks for room in the pool for count more blocks in the running transaction, on
+// top of what the operations already in it asked for and the spare blocks. Without copy on write
+// there is nothing to reserve
+func reserveCowBlocks(count int) error {
+	transactionLock.Lock()
+	defer transactionLock.Unlock()
+	if cow == nil {
+		return nil
+	}
+	if cow.free-cow.reserved-count < COW_SPARE_BLOCKS {
+		return fmt.Errorf("%w: the copy on write pool has %d blocks free and %d more are needed", ErrNoSpace,
+			max(cow.free-cow.reserved-COW_SPARE_BLOCKS, 0), count)
+	}
+	cow.reserved += count
+	return nil
+}
+
+// commitCowOrFail commits the transaction, and if the pool couldn't hold it leaves the file system
+// read only with Disk as the last commit left it, commitErr says why
+func (running *transaction) commitCowOrFail() {
+	if err := running.commitCow(); err != nil {
+		commitErr = err
+		readOnly = true
+	}
+}
+
+// commitCow writes the transaction to fresh blocks and switches the superblock over to the new map.
+// If the pool runs out nothing on Disk has changed and the map is put back how it was
+func (running *transaction) commitCow() error {
+	state := cow
+	defer func() { state.reserved = 0 }()
+	if len(running.order) == 0 && len(running.freed) == 0 {
+		return nil
+	}
+	if state.snapshot != nil {
+		log.Fatal("Tried to commit to a snapshot, snapshots are read only")
+	}
+	sblock := readSuperBlockLocked()
+	if block := running.lookup(0); block != nil {
+		sblock = decodeSuperBlock(block) //the transaction changed the superblock too
+	}
+	perBlock := state.entriesPerMapBlock()
+	dirty := map[int]bool{}
+	released := []int{}
+	previous := map[int]int{} //what the map said before this commit, to put back if it fails
+	remap := func(logicalNum int, physicalNum int) {
+		if _, ok := previous[logicalNum]; !ok {
+			previous[logicalNum] = state.blockMap[logicalNum]
+		}
+		if old := state.blockMap[logicalNum]; old != 0 {
+			released = append(released, old)
+		}
+		state.setMapping(logicalNum, physicalNum)
+		dirty[logicalNum/perBlock] = true
+	}
+	allocated := []int{}
+	for _, logicalNum := range running.order {
+		if logicalNum == 0 {
+			continue //the superblock is the one block that always stays put
+		}
+		physicalNum, err := state.allocate()
+		if err != nil {
+			for logicalNum, physicalNum := range previous {
+				state.setMapping(logicalNum, physicalNum)
+			}
+			state.release(allocated)
+			return err
+		}
+		allocated = append(allocated, physicalNum)
+		state.writePhysical(physicalNum, running.blocks[logicalNum])
+		remap(logicalNum, physicalNum)
+	}
+	//blocks the bitmap has let go of don't need anywhere to live any more, unless something took
+	//them again later in the transaction
+	for _, logicalNum := range running.freed {
+		if state.blockMap[logicalNum] != 0 && !freeBlockBitmap.IsSet(logicalNum) {
+			remap(logicalNum, 0)
+		}
+	}
+	syncDisk() //the new blocks have to be down before any map points at them
+
+	inactive := 1 - state.active
+	for mapBlock := 0; mapBlock < state.mapBlocks; mapBlock++ {
+		if state.lastDirty == nil || dirty[mapBlock] || state.lastDirty[mapBlock] {
+			state.writeMapBlock(inactive, mapBlock)
+		}
+	}
+	syncDisk()
+	//what gets let go of decides how much snapshots are holding, which the free count has to know
+	state.release(released)
+	state.release(running.released)
+	if freeBlockBitmap != nil {
+		sblock.FreeBlocks = max(freeBlockBitmap.CountFree()-state.held(), 0)
+	}
+	sblock.CowActive = inactive
+	sblock.CowGeneration = state.generation + 1
+	state.writePhysical(0, EncodeToBytes(sblock))
+	syncDisk()
+
+	state.active = inactive
+	state.generation++
+	state.lastDirty = dirty
+	return nil
+}
@@ -0,0 +1,147 @@
+package FileSystem
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestCowCrashKeepsWholeCommits crashes a copy on write file system after every write a few
+// operations make. Until the superblock write lands the old map is live, so whatever a crash left
+// has to be the file system as some commit left it: the file holds the whole of one of the things
+// written to it, and later crashes never see an older commit than earlier ones
+func TestCowCrashKeepsWholeCommits(t *testing.T) {
+	options := DefaultOptions()
+	options.CopyOnWrite = true
+	image := formattedImage(t, 2<<20, options)
+	first, second, third := strings.Repeat("1", 2500), strings.Repeat("2", 6000), strings.Repeat("3", 7000)
+	workload := func() {
+		file, inodeNum := Open(CREATE, "file", RootFolder)
+		Write(&file, inodeNum, []byte(first))
+		Write(&file, inodeNum, []byte(second))
+		createTestFile(t, RootFolder, "other", "other")
+		Write(&file, inodeNum, []byte(third))
+	}
+	var generation uint32
+	halfCommitted := 0
+	crashTest(t, image, MountOptions{}, workload, func(limit int) {
+		sblock := ReadSuperBlock()
+		if sblock.CowGeneration < generation {
+			t.Fatalf("a crash after %d writes went back to generation %d from %d", limit, sblock.CowGeneration, generation)
+		}
+		if sblock.CowGeneration == generation && limit > 0 {
+			halfCommitted++
+		}
+		generation = sblock.CowGeneration
+		content, _ := readTestFile(RootFolder, "file")
+		if content != "" && content != first && content != second && content != third {
+			t.Fatalf("a crash after %d writes left the file holding %d bytes starting %.20q", limit, len(content), content)
+		}
+		if other, num := readTestFile(RootFolder, "other"); num != 0 && other != "" && other != "other" {
+			t.Fatalf("a crash after %d writes left other holding %q", limit, other)
+		}
+		if content == third {
+			if _, num := readTestFile(RootFolder, "other"); num == 0 {
+				t.Fatalf("a crash after %d writes kept the last write but lost the file made before it", limit)
+			}
+		}
+	})
+	if halfCommitted == 0 {
+		t.Fatalf("no crash landed in the middle of a commit")
+	}
+	if generation == 0 {
+		t.Fatalf("no commit ever made it to the disk")
+	}
+}
+
+// TestCowWriteTooBigForThePool fills a copy on write file system until only the pool's headroom is
+// left and then writes a big file over again. Every block of it needs a new home before the old ones
+// can go, there isn't room for that, so Write has to say ErrNoSpace and leave the file as it was
+func TestCowWriteTooBigForThePool(t *testing.T) {
+	options := DefaultOptions()
+	options.CopyOnWrite = true
+	device := newTestFileSystem(t, 2<<20, options)
+	blockSize := ReadSuperBlock().BlockSize
+	big := strings.Repeat("b", 250*blockSize)
+	bigNum := createTestFile(t, RootFolder, "big", big)
+	for num := 0; Statfs().FreeBlocks > 30; num++ {
+		createTestFile(t, RootFolder, fmt.Sprint("fill", num), strings.Repeat("f", min(50, Statfs().FreeBlocks-25)*blockSize))
+	}
+
+	file := getInodeFromDisk(bigNum)
+	if err := Write(&file, bigNum, []byte(strings.Repeat("B", len(big)))); !errors.Is(err, ErrNoSpace) {
+		t.Fatalf("writing %d blocks over with %d free in the pool: %v", len(big)/blockSize, cow.free, err)
+	}
+	if got, _ := readTestFile(RootFolder, "big"); got != big {
+		t.Fatalf("the write that didn't fit changed the file")
+	}
+	checkFsck(t)
+	createTestFile(t, RootFolder, "small", "still room for this")
+	remount(t, device)
+	if got, _ := readTestFile(RootFolder, "big"); got != big {
+		t.Fatalf("the write that didn't fit changed the file on Disk")
+	}
+	if got, _ := readTestFile(RootFolder, "small"); got != "still room for this" {
+		t.Fatalf("small holds %q", got)
+	}
+	checkFsck(t)
+}
+
+// TestCowCommitOutOfRoom makes the pool run out in the middle of a commit. Nothing on Disk may have
+// changed, the map has to be as it was, and the file system goes read only with Sync saying why
+func TestCowCommitOutOfRoom(t *testing.T) {
+	options := DefaultOptions()
+	options.CopyOnWrite = true
+	device := newTestFileSystem(t, 2<<20, options)
+	createTestFile(t, RootFolder, "before", "before")
+	before := slices.Clone(cow.blockMap)
+	cow.free = 1 //a commit makes a new inode, directory and bitmap blocks, one isn't enough
+
+	Open(CREATE, "after", RootFolder)
+	if err := Sync(); !errors.Is(err, ErrNoSpace) {
+		t.Fatalf("Sync after a commit that didn't fit: %v", err)
+	}
+	if !slices.Equal(cow.blockMap, before) || cow.free != 1 {
+		t.Fatalf("the commit that didn't fit left the map changed or %d blocks free", cow.free)
+	}
+	file, inodeNum := Open(READ, "before", RootFolder)
+	if err := Write(&file, inodeNum, []byte("again")); err == nil {
+		t.Fatalf("Write worked after the file system went read only")
+	}
+	if err := Mount(device); err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	if _, num := readTestFile(RootFolder, "after"); num != 0 {
+		t.Fatalf("the file from the commit that didn't fit is there after a remount")
+	}
+	if got, _ := readTestFile(RootFolder, "before"); got != "before" {
+		t.Fatalf("before holds %q", got)
+	}
+	checkFsck(t)
+}
+
+// TestCowUnmapsFreedBlocks checks the commit that frees a file's blocks takes them out of the map
+// and gives their physical blocks back to the pool
+func TestCowUnmapsFreedBlocks(t *testing.T) {
+	options := DefaultOptions()
+	options.CopyOnWrite = true
+	newTestFileSystem(t, 2<<20, options)
+	sblock := ReadSuperBlock()
+	inodeNum := createTestFile(t, RootFolder, "file", strings.Repeat("x", 10*sblock.BlockSize))
+	file := getInodeFromDisk(inodeNum)
+	blocks := append(fileBlocks(sblock, &file), file.IndirectBlock)
+	free := cow.free
+
+	Unlink(inodeNum, RootFolder)
+	for _, blockNum := range blocks {
+		if cow.blockMap[blockNum] != 0 {
+			t.Fatalf("freed block %d is still mapped to %d", blockNum, cow.blockMap[blockNum])
+		}
+	}
+	if cow.free < free+len(blocks) {
+		t.Fatalf("the pool went from %d to %d free blocks after freeing %d", free, cow.free, len(blocks))
+	}
+	checkFsck(t)
+}
@@ -0,0 +1,204 @@
+package FileSystem
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Online defragmenter
+// Defragment moves a file's blocks into one run of free blocks, as near its inode as there is room.
+// The data gets copied to the new blocks first, then the block pointers, the indirect block and the
+// freed old blocks all go in one transaction, so after a crash the file either has all of its old
+// blocks or all of its new ones. Each file is locked on its own while it moves, everything else
+// carries on as normal. Files with blocks shared with a clone or an old version are left where they
+// are - moving them would mean unsharing them.
+//
+// The score is how broken up the files are: for every file, the breaks between its runs of blocks out
+// of the most breaks it could have (one between every pair of blocks). 0 is every file in one run and
+// 100 every block somewhere different.
+
+// DefragReport is what Defragment and DefragmentAll did
+type DefragReport struct {
+	ScoreBefore float64
+	ScoreAfter  float64
+	Files       int //files looked at
+	FilesMoved  int
+	BlocksMoved int
+	Skipped     int //fragmented files that stayed put, they had shared blocks or there wasn't a big enough run free
+}
+
+// fragmentationScore turns breaks between runs and the most breaks there could have been into the score
+func fragmentationScore(breaks int, possible int) float64 {
+	if possible == 0 {
+		return 0
+	}
+	return 100 * float64(breaks) / float64(possible)
+}
+
+// Defragment moves the blocks of the file at path into one run
+func Defragment(path string) (DefragReport, error) {
+	defer lockShared()()
+	if err := checkDefragment(); err != nil {
+		return DefragReport{}, err
+	}
+	sblock := ReadSuperBlock()
+	inodeNum, err := lookupPath(sblock, path)
+	if err != nil {
+		return DefragReport{}, err
+	}
+	if err := flushDelayed(inodeNum); err != nil {
+		return DefragReport{}, err
+	}
+	beginOperation()
+	defer endOperation()
+	defer lockInodes([]int{inodeNum}, nil)()
+	file := getInodeFromDisk(inodeNum)
+	if !file.IsValid || file.IsDirectory {
+		return DefragReport{}, fmt.Errorf("%s isn't a file", path)
+	}
+	report := DefragReport{}
+	before, after, possible := defragmentInode(sblock, inodeNum, &report)
+	report.ScoreBefore = fragmentationScore(before, possible)
+	report.ScoreAfter = fragmentationScore(after, possible)
+	return report, nil
+}
+
+// DefragmentAll defragments every file in the file system, one at a time
+func DefragmentAll() (DefragReport, error) {
+	defer lockShared()()
+	if err := checkDefragment(); err != nil {
+		return DefragReport{}, err
+	}
+	if err := writeDelayedWrites(); err != nil {
+		return DefragReport{}, err
+	}
+	sblock := ReadSuperBlock()
+	report := DefragReport{}
+	breaksBefore, breaksAfter, possible := 0, 0, 0
+	for inodeNum := 1; inodeNum < sblock.InodeCount; inodeNum++ {
+		beginOperation() //a file at a time
+		unlock := lockInodes([]int{inodeNum}, nil)
+		if file := getInodeFromDisk(inodeNum); file.IsValid && !file.IsDirectory && file.LinksCount > 0 {
+			before, after, filePossible := defragmentInode(sblock, inodeNum, &report)
+			breaksBefore += before
+			breaksAfter += after
+			possible += filePossible
+		}
+		unlock()
+		endOperation()
+	}
+	report.ScoreBefore = fragmentationScore(breaksBefore, possible)
+	report.ScoreAfter = fragmentationScore(breaksAfter, possible)
+	return report, nil
+}
+
+func checkDefragment() error {
+	if Disk == nil {
+		return fmt.Errorf("there is no file system mounted")
+	}
+	if readOnly {
+		return fmt.Errorf("file system is mounted read only")
+	}
+	if cow != nil {
+		return fmt.Errorf("copy on write file systems put every write somewhere new, there is nothing to defragment")
+	}
+	return nil
+}
+
+// lookupPath follows a path from the root to whatever is at the end of it
+func lookupPath(sblock SuperBlock, path string) (int, error) {
+	inodeNum := sblock.RootDirInode
+	for _, name := range strings.Split(path, "/") {
+		if name == "" {
+			continue
+		}
+		unlock := lockInodes(nil, []int{inodeNum})
+		dir := getInodeFromDisk(inodeNum)
+		if !dir.IsValid || !dir.IsDirectory {
+			unlock()
+			return 0, fmt.Errorf("%s isn't a path to anything", path)
+		}
+		inodeNum = findEntry(sblock, dir, name)
+		unlock()
+		if inodeNum == 0 {
+			return 0, fmt.Errorf("%s doesn't exist", path)
+		}
+	}
+	return inodeNum, nil
+}
+
+// defragmentInode moves one file, the caller has it locked for writing. It returns the breaks between
+// the file's runs of blocks before and after, and the most breaks it could have
+func defragmentInode(sblock SuperBlock, inodeNum int, report *DefragReport) (int, int, int) {
+	file := getInodeFromDisk(inodeNum)
+	blocks := fileBlocks(sblock, &file)
+	report.Files++
+	if len(blocks) < 2 {
+		return 0, 0, 0
+	}
+	breaks, possible := fileExtents(blocks)-1, len(blocks)-1
+	if breaks == 0 {
+		return 0, 0, possible
+	}
+	for _, blockNum := range blocks {
+		if blockShared(sblock, blockNum) {
+			report.Skipped++
+			return breaks, breaks, possible
+		}
+	}
+	total := len(blocks)
+	if file.IndirectBlock != 0 {
+		total++ //it moves too, in front of the data like placeFileBlocks puts it
+	}
+	newBlocks := allocateRunOf(sblock, fileBlockGoal(sblock, inodeNum, 0), total)
+	if newBlocks < 0 {
+		report.Skipped++
+		return breaks, breaks, possible
+	}
+
+	beginTransaction()
+	defer commitTransaction()
+	next := newBlocks
+	if file.IndirectBlock != 0 {
+		releaseBlock(sblock, file.IndirectBlock)
+		file.IndirectBlock = next
+		next++
+	}
+	moved := make([]int, len(blocks))
+	for num, blockNum := range blocks {
+		moved[num] = next + num
+		writeDataBlock(sblock, moved[num], readBlock(sblock, blockNum))
+	}
+	//the data is in place, now point the file at it
+	moved = append(moved, 0, 0, 0)
+	file.DirectBlock1, file.DirectBlock2, file.DirectBlock3 = moved[0], moved[1], moved[2]
+	if file.IndirectBlock != 0 {
+		indirect := make(IndirectBlock, sblock.BlockSize/BLOCK_POINTER_SIZE)
+		copy(indirect, moved[3:len(blocks)])
+		writeBlock(sblock, file.IndirectBlock, EncodeToBytes(indirect))
+	}
+	writeInodeToDisk(&file, inodeNum, sblock)
+	for _, blockNum := range blocks {
+		releaseBlock(sblock, blockNum)
+	}
+	syncBitmaps()
+	report.FilesMoved++
+	report.BlocksMoved += total
+	return breaks, 0, possible
+}
+
+// allocateRunOf allocates count free blocks one after the other, in goal's block group if there is
+// room there, and returns the first. -1 if there isn't a run that long. It won't touch the reserved blocks
+func allocateRunOf(sblock SuperBlock, goal int, count int) int {
+	freeBlocks := ReadFreeBlockBitmap(sblock)
+	for _, start := range []int{allocationStart(sblock, goal), sblock.DataBlockStart} {
+		first, length := freeBlocks.allocateRun(firstFit{}, start, count, sblock.ReservedBlocks)
+		if length == count {
+			return first
+		}
+		for blockNum := first; blockNum < first+length; blockNum++ {
+			freeBlocks.Clear(blockNum) //not long enough, it's no good to us
+		}
+	}
+	return -1
+}
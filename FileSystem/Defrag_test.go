@@ -0,0 +1,147 @@
+package FileSystem
+
+import (
+	"strings"
+	"testing"
+)
+
+// newFragmentedFiles appends to each of names in turns with nothing delayed, so every append gets
+// whatever is free next and the files end up in pieces. It returns the device and what each file holds
+func newFragmentedFiles(t *testing.T, names ...string) (*MemDevice, map[string]string) {
+	t.Helper()
+	device := newTestFileSystem(t, 4<<20, DefaultOptions())
+	if err := MountWithOptions(device, MountOptions{DelayedBlocks: -1}); err != nil {
+		t.Fatalf("MountWithOptions: %v", err)
+	}
+	blockSize := ReadSuperBlock().BlockSize
+	contents := map[string]string{}
+	inodeNums := map[string]int{}
+	for _, name := range names {
+		inodeNums[name] = createTestFile(t, RootFolder, name, "")
+	}
+	for round := 0; round < 6; round++ {
+		for _, name := range names {
+			contents[name] += strings.Repeat(name[:1], 2*blockSize)
+			file := getInodeFromDisk(inodeNums[name])
+			if err := Write(&file, inodeNums[name], []byte(contents[name])); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+		}
+	}
+	return device, contents
+}
+
+// checkOneRun fails the test unless the file at path is one run of blocks with its indirect block in
+// front of them, and still holds want
+func checkOneRun(t *testing.T, path string, want string) {
+	t.Helper()
+	sblock := ReadSuperBlock()
+	inodeNum, err := lookupPath(sblock, path)
+	if err != nil {
+		t.Fatalf("lookupPath: %v", err)
+	}
+	file := getInodeFromDisk(inodeNum)
+	blocks := fileBlocks(sblock, &file)
+	if fileExtents(blocks) != 1 || file.IndirectBlock != blocks[0]-1 {
+		t.Fatalf("%s is in blocks %v with its indirect block at %d", path, blocks, file.IndirectBlock)
+	}
+	if got, _ := readTestFile(RootFolder, path); got != want {
+		t.Fatalf("%s holds %.10q... after moving", path, got)
+	}
+}
+
+// TestDefragment moves one fragmented file and then the rest, and checks the scores, the report and
+// that everything reads back the same from the device
+func TestDefragment(t *testing.T) {
+	device, contents := newFragmentedFiles(t, "first", "second")
+
+	report, err := Defragment("/first")
+	if err != nil {
+		t.Fatalf("Defragment: %v", err)
+	}
+	if report.Files != 1 || report.FilesMoved != 1 || report.BlocksMoved != 13 || report.Skipped != 0 {
+		t.Fatalf("moving a twelve block file said %+v", report)
+	}
+	if report.ScoreBefore < 40 || report.ScoreAfter != 0 {
+		t.Fatalf("moving a file a block pair at a time scored %v before and %v after", report.ScoreBefore, report.ScoreAfter)
+	}
+	checkOneRun(t, "first", contents["first"])
+
+	//first is done already, so only second moves
+	report, err = DefragmentAll()
+	if err != nil {
+		t.Fatalf("DefragmentAll: %v", err)
+	}
+	if report.Files != 2 || report.FilesMoved != 1 || report.ScoreBefore <= 0 || report.ScoreAfter != 0 {
+		t.Fatalf("DefragmentAll said %+v", report)
+	}
+	stats, err := Fragmentation()
+	if err != nil {
+		t.Fatalf("Fragmentation: %v", err)
+	}
+	if stats.FragmentedFiles != 0 || stats.FileExtents != 2 {
+		t.Fatalf("after DefragmentAll Fragmentation says %+v", stats)
+	}
+	remount(t, device)
+	for name, want := range contents {
+		checkOneRun(t, name, want)
+	}
+	checkFsck(t)
+
+	if report, err := DefragmentAll(); err != nil || report.FilesMoved != 0 || report.ScoreBefore != 0 {
+		t.Fatalf("nothing left to move and DefragmentAll said %+v %v", report, err)
+	}
+	for _, path := range []string{"missing", "first/nothing"} {
+		if _, err := Defragment(path); err == nil {
+			t.Fatalf("defragmented %s", path)
+		}
+	}
+	if _, err := Defragment("/"); err == nil {
+		t.Fatalf("defragmented the root directory")
+	}
+}
+
+// TestDefragmentSkipsShared checks a file sharing its blocks with a clone stays put, moving it would
+// mean unsharing them
+func TestDefragmentSkipsShared(t *testing.T) {
+	device, contents := newFragmentedFiles(t, "first", "second")
+	_, secondNum := Open(READ, "second", RootFolder)
+	if _, _, err := CloneFile(secondNum, "copy", RootFolder); err != nil {
+		t.Fatalf("CloneFile: %v", err)
+	}
+	second := getInodeFromDisk(secondNum)
+	blocks := fileBlocks(ReadSuperBlock(), &second)
+
+	report, err := DefragmentAll()
+	if err != nil {
+		t.Fatalf("DefragmentAll: %v", err)
+	}
+	if report.Files != 3 || report.FilesMoved != 1 || report.Skipped != 2 || report.ScoreAfter <= 0 || report.ScoreAfter >= report.ScoreBefore {
+		t.Fatalf("with a clone of second DefragmentAll said %+v", report)
+	}
+	second = getInodeFromDisk(secondNum)
+	if moved := fileBlocks(ReadSuperBlock(), &second); fileExtents(moved) != fileExtents(blocks) || moved[0] != blocks[0] {
+		t.Fatalf("second moved from %v to %v with its blocks shared", blocks, moved)
+	}
+	checkOneRun(t, "first", contents["first"])
+	for _, name := range []string{"second", "copy"} {
+		if got, _ := readTestFile(RootFolder, name); got != contents["second"] {
+			t.Fatalf("%s holds %.10q...", name, got)
+		}
+	}
+	_, copyNum := Open(READ, "copy", RootFolder)
+	checkBlockRefs(t, device, secondNum, copyNum)
+}
+
+// TestDefragmentCopyOnWrite checks Defragment refuses a copy on write file system, where a file's
+// blocks are logical ones the map can put anywhere
+func TestDefragmentCopyOnWrite(t *testing.T) {
+	newCowTestFileSystem(t, 2<<20)
+	createTestFile(t, RootFolder, "file", strings.Repeat("c", 5*ReadSuperBlock().BlockSize))
+	if _, err := Defragment("file"); err == nil {
+		t.Fatalf("defragmented a file on copy on write")
+	}
+	if _, err := DefragmentAll(); err == nil {
+		t.Fatalf("defragmented a copy on write file system")
+	}
+}
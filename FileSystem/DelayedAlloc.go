@@ -0,0 +1,243 @@
+package FileSystem
+
+import (
+	"container/list"
+	"log"
+	"time"
+)
+
+// Delayed allocation
+// Write used to pick a file's blocks as soon as it was called, so a file written a piece at a time,
+// or two files written in turns, got whatever happened to be free at each Write and ended up all over
+// the place. Now Write only reserves the blocks it is going to need (so running out is still ErrNoSpace
+// from Write, see reserveBlocks) and keeps the contents in memory. The blocks get picked, all of them
+// in one allocateBlocks call, once the contents have to go to the disk: on Sync, on Fsync of the file,
+// when more than the mount's DelayedBlocks blocks are waiting (the file written longest ago goes first),
+// and before anything else looks at the file's blocks - moving it to the trash, CloneFile, Defragment,
+// Fsck, Resize, a new version policy and mounting or formatting something else. Read and Open see what
+// is waiting, and a file that is deleted for real just forgets it.
+//
+// A waiting write that can't get its blocks when it has to go out stays waiting, with its contents and
+// its reservation, and whoever pushed it out gets the error: Sync, Fsync, whatever needed the file's
+// blocks, or the Write that needed the room.
+//
+// Nothing of a waiting write is on the disk, not even the inode's new version, so a crash loses it the
+// same way it loses whatever the buffer cache hasn't written back. Directories, copy on write file
+// systems (their blocks only get picked at the commit anyway) and files while old versions are kept
+// still get their blocks straight away.
+
+const DEFAULT_DELAYED_BLOCKS = 1024
+
+// delayedWrite is a Write that hasn't had its blocks picked yet. Its fields only change while holding
+// the inode's lock for writing and transactionLock
+type delayedWrite struct {
+	inodeNum int
+	content  []byte
+	blocks   int   //blocks of content
+	reserved int   //blocks reserved for it with reserveBlocks
+	writes   int   //how many Writes it stands for, the version goes up by one for each
+	modified int64 //when the last of them was
+}
+
+// delayedWrites are the writes waiting for their blocks, delayedOrder has the most recent at the front
+// and delayedBlocks is how many blocks of contents they have between them. They belong to
+// transactionLock
+var (
+	delayedWrites = map[int]*list.Element{}
+	delayedOrder  = list.New()
+	delayedBlocks int
+)
+
+// delayedLimit is how many blocks of writes can wait, -1 if Write doesn't delay anything. It only
+// changes while holding mountLock exclusively
+var delayedLimit = DEFAULT_DELAYED_BLOCKS
+
+// useDelayedLimit sets delayedLimit from MountOptions.DelayedBlocks
+func useDelayedLimit(blocks int) {
+	switch {
+	case blocks == 0:
+		delayedLimit = DEFAULT_DELAYED_BLOCKS
+	case blocks < 0:
+		delayedLimit = -1
+	default:
+		delayedLimit = blocks
+	}
+}
+
+// delayWrite is Write for when the blocks can wait, false if they can't and the caller has to write
+// the file as usual. The caller has the inode locked for writing
+func delayWrite(sblock SuperBlock, file *INode, inodeNum int, content []byte) (bool, error) {
+	onDisk := getInodeFromDisk(inodeNum)
+	blockCount := (len(content) + sblock.BlockSize - 1) / sblock.BlockSize
+	if delayedLimit < blockCount || cow != nil || sblock.VersionsKept > 0 || onDisk.IsDirectory {
+		return false, nil
+	}
+	if blockCount > maxFileBlocks(sblock) {
+		log.Fatal("File is too big, only ", maxFileBlocks(sblock), " blocks fit in an inode")
+	}
+	transactionLock.Lock()
+	pending := &delayedWrite{inodeNum: inodeNum}
+	element, waiting := delayedWrites[inodeNum]
+	if waiting {
+		pending = element.Value.(*delayedWrite)
+	}
+	transactionLock.Unlock()
+	//nothing else can change what is waiting for the inode while we have it locked
+	needed := blocksNeeded(sblock, onDisk, blockCount)
+	if needed > pending.reserved {
+		if err := reserveBlocks(sblock, needed-pending.reserved); err != nil {
+			return true, err
+		}
+	} else {
+		unreserveBlocks(pending.reserved - needed)
+	}
+	contentCopy := append([]byte{}, content...) //the caller can do what it likes with theirs
+	transactionLock.Lock()
+	defer transactionLock.Unlock()
+	if waiting {
+		delayedOrder.MoveToFront(element)
+	} else {
+		delayedWrites[inodeNum] = delayedOrder.PushFront(pending)
+	}
+	delayedBlocks += blockCount - pending.blocks
+	pending.content, pending.blocks, pending.reserved = contentCopy, blockCount, needed
+	pending.writes++
+	pending.modified = time.Now().Unix()
+	*file = onDisk
+	file.Version = onDisk.Version + pending.writes
+	file.LastModifyTime = pending.modified
+	file.delayed = inodeNum
+	return true, nil
+}
+
+// hasDelayedWrite is true if inodeNum has a write waiting for its blocks
+func hasDelayedWrite(inodeNum int) bool {
+	transactionLock.Lock()
+	defer transactionLock.Unlock()
+	_, ok := delayedWrites[inodeNum]
+	return ok
+}
+
+// delayedContent is what is waiting to be written to inodeNum, if anything
+func delayedContent(inodeNum int) ([]byte, bool) {
+	transactionLock.Lock()
+	defer transactionLock.Unlock()
+	if element, ok := delayedWrites[inodeNum]; ok {
+		return element.Value.(*delayedWrite).content, true
+	}
+	return nil, false
+}
+
+// takeDelayedWrite takes inodeNum's waiting write out of the list, nil if there isn't one. Its blocks
+// are still reserved
+func takeDelayedWrite(inodeNum int) *delayedWrite {
+	transactionLock.Lock()
+	defer transactionLock.Unlock()
+	element, ok := delayedWrites[inodeNum]
+	if !ok {
+		return nil
+	}
+	delete(delayedWrites, inodeNum)
+	delayedOrder.Remove(element)
+	pending := element.Value.(*delayedWrite)
+	delayedBlocks -= pending.blocks
+	return pending
+}
+
+// dropDelayedWrite forgets inodeNum's waiting write, for when the file is going away. The caller has
+// the inode locked for writing
+func dropDelayedWrite(inodeNum int) {
+	if pending := takeDelayedWrite(inodeNum); pending != nil {
+		unreserveBlocks(pending.reserved)
+	}
+}
+
+// putBackDelayedWrite puts a write takeDelayedWrite took back in the list as the oldest, for when it
+// couldn't be written out
+func putBackDelayedWrite(pending *delayedWrite) {
+	transactionLock.Lock()
+	defer transactionLock.Unlock()
+	delayedWrites[pending.inodeNum] = delayedOrder.PushBack(pending)
+	delayedBlocks += pending.blocks
+}
+
+// writeDelayed gives inodeNum's waiting write its blocks and writes it out. If it can't, the write is
+// left waiting. The caller has the inode locked for writing and is in an operation
+func writeDelayed(inodeNum int) error {
+	pending := takeDelayedWrite(inodeNum)
+	if pending == nil {
+		return nil
+	}
+	file := INode{}
+	if err := writeFile(&file, inodeNum, pending.content, pending); err != nil {
+		putBackDelayedWrite(pending)
+		return err
+	}
+	return nil
+}
+
+// flushDelayed is writeDelayed as an operation of its own, the caller can't be in one or have any
+// inodes locked
+func flushDelayed(inodeNum int) error {
+	if !hasDelayedWrite(inodeNum) {
+		return nil
+	}
+	beginOperation()
+	defer endOperation()
+	defer lockInodes([]int{inodeNum}, nil)()
+	return writeDelayed(inodeNum)
+}
+
+// writeDelayedWrites writes out every waiting write, oldest first, and returns the first thing that
+// went wrong with any of them. The ones that went wrong are still waiting afterwards
+func writeDelayedWrites() error {
+	transactionLock.Lock()
+	inodeNums := make([]int, 0, delayedOrder.Len())
+	for element := delayedOrder.Back(); element != nil; element = element.Prev() {
+		inodeNums = append(inodeNums, element.Value.(*delayedWrite).inodeNum)
+	}
+	transactionLock.Unlock()
+	var firstErr error
+	for _, inodeNum := range inodeNums {
+		if err := flushDelayed(inodeNum); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// evictDelayedWrites writes out the oldest waiting writes, other than inodeNum's, until there is room
+// for blocks more. If one can't be written out it stays waiting and we give up with its error. The
+// caller can't be in an operation or have any inodes locked
+func evictDelayedWrites(inodeNum int, blocks int) error {
+	for {
+		victim := 0
+		transactionLock.Lock()
+		if delayedLimit >= 0 && delayedBlocks+blocks > delayedLimit {
+			for element := delayedOrder.Back(); element != nil; element = element.Prev() {
+				if num := element.Value.(*delayedWrite).inodeNum; num != inodeNum {
+					victim = num
+					break
+				}
+			}
+		}
+		transactionLock.Unlock()
+		if victim == 0 {
+			return nil
+		}
+		if err := flushDelayed(victim); err != nil {
+			return err
+		}
+	}
+}
+
+// dropDelayedWrites forgets every waiting write and gives back its blocks, for when the disk is
+// changing under them. Anything that wanted them kept has called writeDelayedWrites first
+func dropDelayedWrites() {
+	transactionLock.Lock()
+	defer transactionLock.Unlock()
+	for element := delayedOrder.Front(); element != nil; element = element.Next() {
+		reservedBlocks -= element.Value.(*delayedWrite).reserved
+	}
+	delayedWrites, delayedOrder, delayedBlocks = map[int]*list.Element{}, list.New(), 0
+}
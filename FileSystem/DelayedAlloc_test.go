@@ -0,0 +1,226 @@
+package FileSystem
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// TestDelayedAllocationAppends appends to two files in turns, which used to leave both of them in
+// pieces, one per append. With the blocks picked at Sync each of them is one run
+func TestDelayedAllocationAppends(t *testing.T) {
+	for _, delayed := range []int{0, -1} {
+		t.Run(fmt.Sprint("DelayedBlocks=", delayed), func(t *testing.T) {
+			device := newTestFileSystem(t, 4<<20, DefaultOptions())
+			if err := MountWithOptions(device, MountOptions{DelayedBlocks: delayed}); err != nil {
+				t.Fatalf("MountWithOptions: %v", err)
+			}
+			sblock := ReadSuperBlock()
+			names := []string{"first", "second"}
+			contents := map[string]string{}
+			inodeNums := map[string]int{}
+			for _, name := range names {
+				inodeNums[name] = createTestFile(t, RootFolder, name, "")
+			}
+			for round := 0; round < 10; round++ {
+				for _, name := range names {
+					contents[name] += strings.Repeat(name[:1], 2*sblock.BlockSize)
+					file := getInodeFromDisk(inodeNums[name])
+					if err := Write(&file, inodeNums[name], []byte(contents[name])); err != nil {
+						t.Fatalf("Write: %v", err)
+					}
+				}
+			}
+			if err := Sync(); err != nil {
+				t.Fatalf("Sync: %v", err)
+			}
+			extents := 0
+			for _, name := range names {
+				file := getInodeFromDisk(inodeNums[name])
+				extents += fileExtents(fileBlocks(sblock, &file)[3:]) //the direct blocks come before the indirect one
+				if got, _ := readTestFile(RootFolder, name); got != contents[name] {
+					t.Fatalf("%s holds %.10q...", name, got)
+				}
+			}
+			if delayed == 0 && extents != 2 {
+				t.Fatalf("with delayed allocation the two files are in %d pieces", extents)
+			}
+			if delayed < 0 && extents < 10 {
+				t.Fatalf("without delayed allocation the two files are in only %d pieces, the test isn't testing anything", extents)
+			}
+			checkFsck(t)
+		})
+	}
+}
+
+// TestDelayedWriteWaits checks a Write doesn't get its blocks until it has to, while Read, Open and
+// Statfs already see it, and that Fsync, too many blocks waiting and Unlink each deal with it
+func TestDelayedWriteWaits(t *testing.T) {
+	device := newTestFileSystem(t, 2<<20, DefaultOptions())
+	if err := MountWithOptions(device, MountOptions{DelayedBlocks: 8}); err != nil {
+		t.Fatalf("MountWithOptions: %v", err)
+	}
+	blockSize := ReadSuperBlock().BlockSize
+	empty := Statfs()
+	content := strings.Repeat("w", 3*blockSize)
+	file, inodeNum := Open(CREATE, "file", RootFolder)
+	for _, write := range []string{"x", "y", content} {
+		if err := Write(&file, inodeNum, []byte(write)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if onDisk := getInodeFromDisk(inodeNum); onDisk.DirectBlock1 != 0 || onDisk.Version != 0 {
+		t.Fatalf("the file has blocks before anything asked for them: %+v", onDisk)
+	}
+	if got := strings.TrimRight(Read(&file), "\x00"); got != content || file.Version != 3 {
+		t.Fatalf("Read of what Write handed back gives %d bytes at version %d", len(got), file.Version)
+	}
+	if got, _ := readTestFile(RootFolder, "file"); got != content {
+		t.Fatalf("the file holds %.10q... opened again", got)
+	}
+	if used := empty.FreeBlocks - Statfs().FreeBlocks; used != 3 {
+		t.Fatalf("Statfs counts %d blocks for a three block write", used)
+	}
+
+	if err := Fsync(inodeNum); err != nil {
+		t.Fatalf("Fsync: %v", err)
+	}
+	onDisk := getInodeFromDisk(inodeNum)
+	if blocks := fileBlocks(ReadSuperBlock(), &onDisk); len(blocks) != 3 || fileExtents(blocks) != 1 || onDisk.Version != 3 {
+		t.Fatalf("after Fsync the file has blocks %v at version %d", blocks, onDisk.Version)
+	}
+	if got := strings.TrimRight(Read(&file), "\x00"); got != content {
+		t.Fatalf("Read after Fsync gives %.10q...", got)
+	}
+
+	//a shorter write leaves the blocks past its end, waiting or not
+	if err := Write(&file, inodeNum, []byte("short")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	want := "short" + strings.Repeat("\x00", blockSize-5) + content[blockSize:]
+	if got, _ := readTestFile(RootFolder, "file"); got != want {
+		t.Fatalf("the shortened file holds %.10q... while it waits", got)
+	}
+	remount(t, device)
+	if got, _ := readTestFile(RootFolder, "file"); got != want {
+		t.Fatalf("the shortened file holds %.10q... on Disk", got)
+	}
+	if err := MountWithOptions(device, MountOptions{DelayedBlocks: 8}); err != nil {
+		t.Fatalf("MountWithOptions: %v", err)
+	}
+
+	//eight blocks can wait, so the second file pushes the first out
+	first := createTestFile(t, RootFolder, "first", strings.Repeat("1", 5*blockSize))
+	beforeSecond := Statfs()
+	second := createTestFile(t, RootFolder, "second", strings.Repeat("2", 5*blockSize))
+	if getInodeFromDisk(first).DirectBlock1 == 0 || getInodeFromDisk(second).DirectBlock1 != 0 {
+		t.Fatalf("with room for eight blocks waiting, two five block files were handled wrong")
+	}
+	if err := UnlinkName("second", RootFolder); err != nil {
+		t.Fatalf("UnlinkName: %v", err)
+	}
+	//the indirect block it would have needed was reserved too
+	if after := Statfs(); after.FreeBlocks != beforeSecond.FreeBlocks {
+		t.Fatalf("unlinking a file still waiting left %d free blocks, it had %d before", after.FreeBlocks, beforeSecond.FreeBlocks)
+	}
+	checkFsck(t)
+	remount(t, device)
+	checkFsck(t)
+}
+
+// TestDelayedWriteNoSpace fills the disk with writes that are all waiting, the one that doesn't fit
+// has to get ErrNoSpace from Write and the rest all get their blocks at Sync
+func TestDelayedWriteNoSpace(t *testing.T) {
+	device := newTestFileSystem(t, 1<<20, DefaultOptions())
+	if err := MountWithOptions(device, MountOptions{DelayedBlocks: 1 << 20}); err != nil {
+		t.Fatalf("MountWithOptions: %v", err)
+	}
+	chunk := strings.Repeat("f", 50*ReadSuperBlock().BlockSize)
+	var err error
+	written := 0
+	for ; err == nil; written++ {
+		file, inodeNum := Open(CREATE, fmt.Sprint("fill", written), RootFolder)
+		err = Write(&file, inodeNum, []byte(chunk))
+		if written > 100 {
+			t.Fatalf("still writing with %+v", Statfs())
+		}
+	}
+	if !errors.Is(err, ErrNoSpace) {
+		t.Fatalf("filling up with delayed writes: %v", err)
+	}
+	if stats := Statfs(); stats.AvailableBlocks >= 51 {
+		t.Fatalf("Write said ErrNoSpace with %+v", stats)
+	}
+	remount(t, device)
+	for num := 0; num < written-1; num++ {
+		if got, _ := readTestFile(RootFolder, fmt.Sprint("fill", num)); got != chunk {
+			t.Fatalf("fill%d holds %d bytes", num, len(got))
+		}
+	}
+	checkFsck(t)
+}
+
+// TestDelayedWriteCrash is TestJournalCrashReplay with the default DelayedBlocks, so the writes wait
+// for their blocks until Fsync or Sync. A crash can lose the ones still waiting, but whatever it
+// leaves has to mount and pass Fsck, and the file never holds anything that wasn't written to it
+func TestDelayedWriteCrash(t *testing.T) {
+	image := formattedImage(t, 2<<20, DefaultOptions())
+	first, second, third := strings.Repeat("1", 2500), strings.Repeat("2", 6000), strings.Repeat("3", 7000)
+	workload := func() {
+		file, inodeNum := Open(CREATE, "file", RootFolder)
+		Write(&file, inodeNum, []byte(first))
+		Fsync(inodeNum)
+		Write(&file, inodeNum, []byte(second))
+		Write(&file, inodeNum, []byte(third))
+		other, otherNum := Open(CREATE, "other", RootFolder)
+		Write(&other, otherNum, []byte(second))
+	}
+	crashTest(t, image, MountOptions{}, workload, func(limit int) {
+		if content, _ := readTestFile(RootFolder, "file"); strings.Trim(content, "123") != "" {
+			t.Fatalf("a crash after %d writes left the file holding %q", limit, content)
+		}
+		if content, _ := readTestFile(RootFolder, "other"); content != "" && content != second {
+			t.Fatalf("a crash after %d writes left the other file holding %d bytes", limit, len(content))
+		}
+	})
+}
+
+// TestDelayedWriteEvictionFails makes a waiting write unable to get its blocks when a Write pushes it
+// out. The Write has to get the error, and the waiting write has to still be there with its contents
+// for Sync to write once there is room again
+func TestDelayedWriteEvictionFails(t *testing.T) {
+	device := newTestFileSystem(t, 2<<20, DefaultOptions())
+	if err := MountWithOptions(device, MountOptions{DelayedBlocks: 8}); err != nil {
+		t.Fatalf("MountWithOptions: %v", err)
+	}
+	sblock := ReadSuperBlock()
+	waiting := strings.Repeat("w", 4*sblock.BlockSize)
+	waitingNum := createTestFile(t, RootFolder, "waiting", waiting)
+	//take its reservation away and everything else with it, so it can't get its blocks
+	pending := delayedWrites[waitingNum].Value.(*delayedWrite)
+	unreserveBlocks(pending.reserved)
+	pending.reserved = 0
+	free := ReadFreeBlockBitmap(sblock).countClaimable() - keptBlocks(sblock) - reservedFor()
+	if err := reserveBlocks(sblock, free); err != nil {
+		t.Fatal(err)
+	}
+
+	file, inodeNum := Open(CREATE, "pusher", RootFolder)
+	if err := Write(&file, inodeNum, []byte(strings.Repeat("p", 6*sblock.BlockSize))); !errors.Is(err, ErrNoSpace) {
+		t.Fatalf("the Write that pushed it out got %v", err)
+	}
+	if !hasDelayedWrite(waitingNum) {
+		t.Fatalf("the write that couldn't get its blocks was dropped")
+	}
+	if err := Sync(); !errors.Is(err, ErrNoSpace) {
+		t.Fatalf("Sync with no room got %v", err)
+	}
+
+	unreserveBlocks(free)
+	remount(t, device)
+	if got, _ := readTestFile(RootFolder, "waiting"); got != waiting {
+		t.Fatalf("the waiting file holds %d bytes", len(got))
+	}
+	checkFsck(t)
+}
@@ -0,0 +1,124 @@
+package FileSystem
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Directory entry cache
+// Looking a name up in a directory means decoding the directory block and going through every entry.
+// The dentry cache remembers what each lookup found, keyed on the directory block (the leaf the name
+// hashes to, in an indexed directory) and the name, and remembers names that weren't there as well
+// (inode 0), since asking for a file before creating it is the usual way round. Like the inode cache
+// it doesn't need telling about creates, unlinks or entries moving between directories - writing a
+// directory block drops everything cached from it.
+
+const DEFAULT_DENTRY_CACHE_SIZE = 4096
+
+type dentryKey struct {
+	dirBlock int
+	name     string
+}
+
+type dentryCache struct {
+	lock     sync.Mutex
+	capacity int
+	entries  map[dentryKey]*list.Element
+	byBlock  map[int]map[string]bool //the names we have cached for each directory block
+	lru      *list.List              //of dentries, most recently used at the front
+	//generation works the same as the inode cache's
+	generation uint64
+}
+
+type dentry struct {
+	key      dentryKey
+	inodeNum int //0 if the name isn't in the directory
+}
+
+// dentries is the dentry cache for the mounted file system, nil while there isn't one
+var dentries *dentryCache
+
+func newDentryCache(capacity int) *dentryCache {
+	return &dentryCache{
+		capacity: capacity,
+		entries:  map[dentryKey]*list.Element{},
+		byBlock:  map[int]map[string]bool{},
+		lru:      list.New(),
+	}
+}
+
+func (c *dentryCache) lookup(key dentryKey) (int, bool, uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(element)
+		return element.Value.(*dentry).inodeNum, true, c.generation
+	}
+	return 0, false, c.generation
+}
+
+// add remembers what a lookup found, unless a directory block was written while it was looking
+func (c *dentryCache) add(key dentryKey, inodeNum int, generation uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*dentry).inodeNum = inodeNum
+		c.lru.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&dentry{key: key, inodeNum: inodeNum})
+	if c.byBlock[key.dirBlock] == nil {
+		c.byBlock[key.dirBlock] = map[string]bool{}
+	}
+	c.byBlock[key.dirBlock][key.name] = true
+	for c.lru.Len() > c.capacity {
+		c.removeLocked(c.lru.Back())
+	}
+}
+
+func (c *dentryCache) removeLocked(element *list.Element) {
+	key := element.Value.(*dentry).key
+	c.lru.Remove(element)
+	delete(c.entries, key)
+	delete(c.byBlock[key.dirBlock], key.name)
+	if len(c.byBlock[key.dirBlock]) == 0 {
+		delete(c.byBlock, key.dirBlock)
+	}
+}
+
+// dropBlock forgets every lookup done in blockNum
+func (c *dentryCache) dropBlock(blockNum int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.generation++
+	for name := range c.byBlock[blockNum] {
+		c.removeLocked(c.entries[dentryKey{blockNum, name}])
+	}
+}
+
+// lookupEntry returns the inode number name has in the directory block, 0 if it isn't there
+func lookupEntry(sblock SuperBlock, dirBlock int, name string) int {
+	key := dentryKey{dirBlock, name}
+	var generation uint64
+	if dentries != nil {
+		inodeNum, ok, gen := dentries.lookup(key)
+		if ok {
+			return inodeNum
+		}
+		generation = gen
+	}
+	inodeNum := 0
+	for _, entry := range decodeDirectoryBlock(readBlock(sblock, dirBlock)) {
+		if entryIsUsed(entry) && entryName(entry) == name {
+			inodeNum = entry.Inode
+			break
+		}
+	}
+	if dentries != nil {
+		dentries.add(key, inodeNum, generation)
+	}
+	return inodeNum
+}
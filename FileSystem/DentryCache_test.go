@@ -0,0 +1,58 @@
+package FileSystem
+
+import (
+	"testing"
+)
+
+// TestDentryCacheRemembersMissingNames looks a name up before creating it, the usual way round, and
+// checks the cached miss is dropped when the directory block gets the entry, and the hit when it
+// loses it again
+func TestDentryCacheRemembersMissingNames(t *testing.T) {
+	newTestFileSystem(t, 2<<20, DefaultOptions())
+	if _, inodeNum := Open(READ, "file", RootFolder); inodeNum != 0 {
+		t.Fatalf("file is there before it was made")
+	}
+	key := dentryKey{getInodeFromDisk(ReadSuperBlock().RootDirInode).DirectBlock1, "file"}
+	if inodeNum, ok, _ := dentries.lookup(key); !ok || inodeNum != 0 {
+		t.Fatalf("the miss isn't cached, the cache says %d %v", inodeNum, ok)
+	}
+	inodeNum := createTestFile(t, RootFolder, "file", "found")
+	if _, ok, _ := dentries.lookup(key); ok {
+		t.Fatalf("the miss is still cached after the entry went in")
+	}
+	if got, found := readTestFile(RootFolder, "file"); found != inodeNum || got != "found" {
+		t.Fatalf("the lookup after creating file found inode %d holding %q", found, got)
+	}
+	UnlinkName("file", RootFolder)
+	if _, found := Open(READ, "file", RootFolder); found != 0 {
+		t.Fatalf("the lookup after unlinking file still found inode %d", found)
+	}
+}
+
+// TestDentryCacheDropsBlocks fills a two entry cache past capacity and drops a block, and checks a
+// lookup done before a drop isn't kept
+func TestDentryCacheDropsBlocks(t *testing.T) {
+	cache := newDentryCache(2)
+	_, _, generation := cache.lookup(dentryKey{10, "a"})
+	cache.add(dentryKey{10, "a"}, 1, generation)
+	cache.add(dentryKey{10, "b"}, 2, generation)
+	cache.add(dentryKey{11, "c"}, 0, generation)
+	if _, ok, _ := cache.lookup(dentryKey{10, "a"}); ok {
+		t.Fatalf("a was the least recently used, it should have gone")
+	}
+	if inodeNum, ok, _ := cache.lookup(dentryKey{11, "c"}); !ok || inodeNum != 0 {
+		t.Fatalf("the cached miss for c came back as %d %v", inodeNum, ok)
+	}
+
+	cache.dropBlock(10)
+	if _, ok, _ := cache.lookup(dentryKey{10, "b"}); ok {
+		t.Fatalf("b is still cached after its block was dropped")
+	}
+	if _, ok, _ := cache.lookup(dentryKey{11, "c"}); !ok {
+		t.Fatalf("dropping block 10 took c in block 11 with it")
+	}
+	cache.add(dentryKey{10, "b"}, 2, generation) //looked up before the drop
+	if _, ok, _ := cache.lookup(dentryKey{10, "b"}); ok {
+		t.Fatalf("kept a lookup done before its block was written")
+	}
+}
@@ -0,0 +1,166 @@
+package FileSystem
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// BlockDevice is whatever the file system lives on. The file system only ever reads and writes
+// whole blocks at block aligned offsets, the device itself knows nothing about block size.
+// Sync must not return until everything written so far is safely stored, the journal counts on it.
+// ReadAt and WriteAt get called from more than one goroutine at once.
+type BlockDevice interface {
+	io.ReaderAt
+	io.WriterAt
+	Size() int64
+	Sync() error
+}
+
+// ResizableDevice is a BlockDevice that can be made bigger or smaller, Resize needs one to change how
+// much room the file system has. Anything added at the end reads back as zeros
+type ResizableDevice interface {
+	BlockDevice
+	Truncate(size int64) error
+}
+
+// MemDevice is a disk that only lives in memory, which is what the original Disk array was
+type MemDevice struct {
+	lock sync.RWMutex
+	data []byte
+}
+
+func NewMemDevice(size int64) *MemDevice {
+	return &MemDevice{data: make([]byte, size)}
+}
+
+func (device *MemDevice) ReadAt(p []byte, off int64) (int, error) {
+	device.lock.RLock()
+	defer device.lock.RUnlock()
+	if off < 0 || off+int64(len(p)) > int64(len(device.data)) {
+		return 0, fmt.Errorf("read of %d bytes at %d is past the end of a %d byte device", len(p), off, len(device.data))
+	}
+	return copy(p, device.data[off:]), nil
+}
+
+func (device *MemDevice) WriteAt(p []byte, off int64) (int, error) {
+	device.lock.Lock()
+	defer device.lock.Unlock()
+	if off < 0 || off+int64(len(p)) > int64(len(device.data)) {
+		return 0, fmt.Errorf("write of %d bytes at %d is past the end of a %d byte device", len(p), off, len(device.data))
+	}
+	return copy(device.data[off:], p), nil
+}
+
+func (device *MemDevice) Size() int64 {
+	return int64(len(device.data))
+}
+
+func (device *MemDevice) Truncate(size int64) error {
+	device.lock.Lock()
+	defer device.lock.Unlock()
+	if size < 0 {
+		return fmt.Errorf("can't make a device %d bytes long", size)
+	}
+	data := make([]byte, size)
+	copy(data, device.data)
+	device.data = data
+	return nil
+}
+
+// Sync has nothing to do, memory is as stored as a MemDevice gets
+func (device *MemDevice) Sync() error {
+	return nil
+}
+
+// FileDevice keeps the disk in an image file so it survives between runs
+type FileDevice struct {
+	file *os.File
+	size int64
+}
+
+// CreateFileDevice makes a new zero filled image file of the given size
+func CreateFileDevice(path string, size int64) (*FileDevice, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Truncate(size); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &FileDevice{file: file, size: size}, nil
+}
+
+// OpenFileDevice opens an existing image file
+func OpenFileDevice(path string) (*FileDevice, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &FileDevice{file: file, size: info.Size()}, nil
+}
+
+func (device *FileDevice) ReadAt(p []byte, off int64) (int, error) {
+	return device.file.ReadAt(p, off)
+}
+
+func (device *FileDevice) WriteAt(p []byte, off int64) (int, error) {
+	return device.file.WriteAt(p, off)
+}
+
+func (device *FileDevice) Size() int64 {
+	return device.size
+}
+
+func (device *FileDevice) Truncate(size int64) error {
+	if err := device.file.Truncate(size); err != nil {
+		return err
+	}
+	device.size = size
+	return nil
+}
+
+func (device *FileDevice) Sync() error {
+	return device.file.Sync()
+}
+
+func (device *FileDevice) Close() error {
+	return device.file.Close()
+}
+
+// replayDevice is a device with the blocks of a journal transaction laid over it, reads see the
+// transaction as if it had been replayed. It can't be written, it is only for read only mounts
+type replayDevice struct {
+	BlockDevice
+	blockSize int
+	blocks    map[int][]byte
+}
+
+func (device *replayDevice) ReadAt(p []byte, off int64) (int, error) {
+	count, err := device.BlockDevice.ReadAt(p, off)
+	if err != nil {
+		return count, err
+	}
+	end := off + int64(len(p))
+	for blockNum := off / int64(device.blockSize); blockNum*int64(device.blockSize) < end; blockNum++ {
+		block, ok := device.blocks[int(blockNum)]
+		if !ok {
+			continue
+		}
+		blockStart := blockNum * int64(device.blockSize)
+		from, to := max(blockStart, off), min(blockStart+int64(device.blockSize), end)
+		copy(p[from-off:to-off], block[from-blockStart:to-blockStart])
+	}
+	return count, nil
+}
+
+func (device *replayDevice) WriteAt(p []byte, off int64) (int, error) {
+	return 0, fmt.Errorf("the journal hasn't been replayed, nothing can be written until it is")
+}
@@ -0,0 +1,460 @@
+package FileSystem
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sort"
+)
+
+// Indexed directories
+// A directory starts out as one block of entries that gets searched from one end to the other, which
+// is fine for a few dozen names. Once that block is full, on a file system with FEATURE_INCOMPAT_DIR_INDEX,
+// the directory turns into a hash tree: its first block keeps '.' and '..' and nothing else, its second
+// block is the root of a B+tree keyed on the hash of the name, and the rest of its blocks are index
+// nodes and leaves. A leaf is an ordinary DirectoryBlock with every entry whose hash is in its range,
+// so finding, adding or removing a name reads one index node a level and then one leaf. A full leaf
+// splits in two at a hash near the middle of its entries, and a full index node splits the same way,
+// up to the root, which stays in the second block and pushes both halves down a level.
+//
+// The index points at blocks of the directory by where they are in the directory rather than where
+// they are on Disk, so moving a directory's blocks around doesn't have to know about it. Names with the
+// same hash always go in the same leaf. Leaves don't get merged when names are removed and a directory
+// never goes back to one block, an empty leaf just waits for names in its range.
+
+const (
+	FEATURE_INCOMPAT_DIR_INDEX uint32 = 1 << 3
+
+	DIR_INDEX_MAGIC       = 0x58444944 //"DIDX"
+	DIR_INDEX_HEADER_SIZE = 16
+	DIR_INDEX_ENTRY_SIZE  = 8
+	DIR_INDEX_ROOT        = 1 //the root is always the directory's second block
+	DIR_INDEX_MAX_LEVELS  = 4 //far more than a directory that fits in an inode can use
+)
+
+type dirIndexEntry struct {
+	hash  uint32 //lowest hash under this entry, the first entry of a node has the lowest hash of the node
+	block int    //block of the directory, not of the disk
+}
+
+type dirIndexNode struct {
+	level   int //0 if the entries point at leaves
+	entries []dirIndexEntry
+}
+
+// indexStep is one node on the way down the index, and which of its entries we went down
+type indexStep struct {
+	block int
+	node  dirIndexNode
+	child int
+}
+
+// indexLeaf is a leaf and the hashes that belong in it, high isn't included
+type indexLeaf struct {
+	block     int
+	low, high uint64
+}
+
+func dirIndexEnabled(sblock SuperBlock) bool {
+	return sblock.FeatureIncompat&FEATURE_INCOMPAT_DIR_INDEX != 0
+}
+
+// nameHash is what the index is keyed on, names get cut off the same way newDirectoryEntry does it
+func nameHash(name string) uint32 {
+	hash := fnv.New32a()
+	hash.Write([]byte(entryName(newDirectoryEntry(name, 0))))
+	return hash.Sum32()
+}
+
+// dirIndexCapacity is how many entries fit in an index node
+func dirIndexCapacity(sblock SuperBlock) int {
+	return (sblock.BlockSize - DIR_INDEX_HEADER_SIZE) / DIR_INDEX_ENTRY_SIZE
+}
+
+func encodeDirIndexNode(sblock SuperBlock, node dirIndexNode) []byte {
+	b := make([]byte, sblock.BlockSize)
+	byteOrder.PutUint32(b[0:], DIR_INDEX_MAGIC)
+	byteOrder.PutUint32(b[4:], uint32(node.level))
+	byteOrder.PutUint32(b[8:], uint32(len(node.entries)))
+	for num, entry := range node.entries {
+		entryBytes := b[DIR_INDEX_HEADER_SIZE+num*DIR_INDEX_ENTRY_SIZE:]
+		byteOrder.PutUint32(entryBytes[0:], entry.hash)
+		byteOrder.PutUint32(entryBytes[4:], uint32(entry.block))
+	}
+	return b
+}
+
+// decodeDirIndexNode is false if the block isn't an index node
+func decodeDirIndexNode(b []byte) (dirIndexNode, bool) {
+	count := int(byteOrder.Uint32(b[8:]))
+	if byteOrder.Uint32(b[0:]) != DIR_INDEX_MAGIC || count == 0 || count > (len(b)-DIR_INDEX_HEADER_SIZE)/DIR_INDEX_ENTRY_SIZE {
+		return dirIndexNode{}, false
+	}
+	node := dirIndexNode{level: int(byteOrder.Uint32(b[4:])), entries: make([]dirIndexEntry, count)}
+	for num := range node.entries {
+		entryBytes := b[DIR_INDEX_HEADER_SIZE+num*DIR_INDEX_ENTRY_SIZE:]
+		node.entries[num] = dirIndexEntry{hash: byteOrder.Uint32(entryBytes[0:]), block: int(byteOrder.Uint32(entryBytes[4:]))}
+	}
+	return node, true
+}
+
+// childFor is the entry of node whose range hash is in
+func (node dirIndexNode) childFor(hash uint32) int {
+	return max(sort.Search(len(node.entries), func(num int) bool { return node.entries[num].hash > hash })-1, 0)
+}
+
+// indexPath goes down the index of a directory whose blocks are blocks to the leaf for hash. It
+// returns the nodes it went through from the root down and the leaf's block in the directory
+func indexPath(sblock SuperBlock, blocks []int, hash uint32) ([]indexStep, int, error) {
+	if len(blocks) <= DIR_INDEX_ROOT {
+		return nil, 0, fmt.Errorf("the directory has no index root")
+	}
+	path := []indexStep{}
+	block := DIR_INDEX_ROOT
+	for {
+		node, ok := decodeDirIndexNode(readBlock(sblock, blocks[block]))
+		if !ok || node.level >= DIR_INDEX_MAX_LEVELS || len(path) > 0 && node.level != path[len(path)-1].node.level-1 {
+			return nil, 0, fmt.Errorf("block %d of the directory isn't the index node it should be", block)
+		}
+		child := node.childFor(hash)
+		path = append(path, indexStep{block: block, node: node, child: child})
+		block = node.entries[child].block
+		if block <= DIR_INDEX_ROOT || block >= len(blocks) {
+			return nil, 0, fmt.Errorf("the index points at block %d of a directory with %d blocks", block, len(blocks))
+		}
+		if node.level == 0 {
+			return path, block, nil
+		}
+	}
+}
+
+// indexLeaves checks the whole index of a directory whose blocks are blocks and returns its leaves in
+// hash order
+func indexLeaves(sblock SuperBlock, blocks []int) ([]indexLeaf, error) {
+	if len(blocks) <= DIR_INDEX_ROOT {
+		return nil, fmt.Errorf("the directory has no index root")
+	}
+	root, ok := decodeDirIndexNode(readBlock(sblock, blocks[DIR_INDEX_ROOT]))
+	if !ok || root.level >= DIR_INDEX_MAX_LEVELS {
+		return nil, fmt.Errorf("block %d of the directory isn't an index root", DIR_INDEX_ROOT)
+	}
+	leaves := []indexLeaf{}
+	seen := map[int]bool{}
+	var walk func(block int, level int, low uint64, high uint64) error
+	walk = func(block int, level int, low uint64, high uint64) error {
+		if block < DIR_INDEX_ROOT || block >= len(blocks) || seen[block] {
+			return fmt.Errorf("the index points at block %d of the directory more than once or off the end", block)
+		}
+		seen[block] = true
+		if level < 0 {
+			leaves = append(leaves, indexLeaf{block: block, low: low, high: high})
+			return nil
+		}
+		node, ok := decodeDirIndexNode(readBlock(sblock, blocks[block]))
+		if !ok || node.level != level {
+			return fmt.Errorf("block %d of the directory isn't a level %d index node", block, level)
+		}
+		if uint64(node.entries[0].hash) != low {
+			return fmt.Errorf("index node in block %d of the directory starts at the wrong hash", block)
+		}
+		for num, entry := range node.entries {
+			next := high
+			if num+1 < len(node.entries) {
+				next = uint64(node.entries[num+1].hash)
+			}
+			if uint64(entry.hash) >= next {
+				return fmt.Errorf("index node in block %d of the directory is out of order", block)
+			}
+			if err := walk(entry.block, level-1, uint64(entry.hash), next); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return leaves, walk(DIR_INDEX_ROOT, root.level, 0, 1<<32)
+}
+
+// currentDirectory is dir as it is on Disk and its inode number. Adding entries can index a directory
+// or give it more blocks, so an older copy is only good for finding its first block
+func currentDirectory(dir INode) (INode, int) {
+	dirNum := directoryNum(dir)
+	return getInodeFromDisk(dirNum), dirNum
+}
+
+// entryBlock is the block of the disk where name is in dir, or would be
+func entryBlock(sblock SuperBlock, dir INode, name string) int {
+	if !dir.IsIndexed || name == "." || name == ".." {
+		return dir.DirectBlock1
+	}
+	blocks := fileBlocks(sblock, &dir)
+	_, leaf, err := indexPath(sblock, blocks, nameHash(name))
+	if err != nil {
+		log.Fatal("The index of the directory at block ", dir.DirectBlock1, " is damaged: ", err)
+	}
+	return blocks[leaf]
+}
+
+// findEntry returns the inode number name has in dir, 0 if it isn't there
+func findEntry(sblock SuperBlock, dir INode, name string) int {
+	return lookupEntry(sblock, entryBlock(sblock, dir, name), name)
+}
+
+// entryBlocks is every block of dir with entries in it, the first block and then the leaves in hash order
+func entryBlocks(sblock SuperBlock, dir INode) []int {
+	if !dir.IsIndexed {
+		return []int{dir.DirectBlock1}
+	}
+	blocks := fileBlocks(sblock, &dir)
+	leaves, err := indexLeaves(sblock, blocks)
+	if err != nil {
+		log.Fatal("The index of the directory at block ", dir.DirectBlock1, " is damaged: ", err)
+	}
+	result := []int{dir.DirectBlock1}
+	for _, leaf := range leaves {
+		result = append(result, blocks[leaf.block])
+	}
+	return result
+}
+
+// directoryEntries is everything in dir apart from '.' and '..'
+func directoryEntries(sblock SuperBlock, dir INode) []DirectoryEntry {
+	result := []DirectoryEntry{}
+	for blockIndex, blockNum := range entryBlocks(sblock, dir) {
+		entries := decodeDirectoryBlock(readBlock(sblock, blockNum))
+		if blockIndex == 0 {
+			entries = entries[2:]
+		}
+		for _, entry := range entries {
+			if entryIsUsed(entry) {
+				result = append(result, entry)
+			}
+		}
+	}
+	return result
+}
+
+// entryNameOf is the name inodeNum has in dir, "" if it isn't there. Only the inode number to go on
+// means looking at every entry
+func entryNameOf(sblock SuperBlock, dir INode, inodeNum int) string {
+	for _, entry := range directoryEntries(sblock, dir) {
+		if entry.Inode == inodeNum {
+			return entryName(entry)
+		}
+	}
+	return ""
+}
+
+// freeSlot is the first entry of entries that isn't in use, -1 if they all are
+func freeSlot(entries DirectoryBlock) int {
+	for entryNum, entry := range entries {
+		if !entryIsUsed(entry) {
+			return entryNum
+		}
+	}
+	return -1
+}
+
+// putEntry puts entry in the first free slot of entries, false if there isn't one
+func putEntry(entries DirectoryBlock, entry DirectoryEntry) bool {
+	entryNum := freeSlot(entries)
+	if entryNum < 0 {
+		return false
+	}
+	entries[entryNum] = entry
+	return true
+}
+
+// addEntry puts an entry for name in dir, which has to be up to date, indexing dir first if its one
+// block is full. It is false if there is no room. If dir gets more blocks it is written back
+func addEntry(sblock SuperBlock, dir *INode, dirNum int, name string, inodeNum int) bool {
+	entry := newDirectoryEntry(name, inodeNum)
+	if !dir.IsIndexed {
+		entries := decodeDirectoryBlock(readBlock(sblock, dir.DirectBlock1))
+		if putEntry(entries, entry) {
+			writeBlock(sblock, dir.DirectBlock1, EncodeToBytes(entries))
+			return true
+		}
+		if !dirIndexEnabled(sblock) {
+			return false
+		}
+		indexDirectory(sblock, dir, dirNum, entries)
+	}
+	return addIndexedEntry(sblock, dir, dirNum, entry)
+}
+
+// indexDirectory turns a directory with one full block into an index root with one leaf holding
+// everything that was in the block
+func indexDirectory(sblock SuperBlock, dir *INode, dirNum int, entries DirectoryBlock) {
+	leaf := make(DirectoryBlock, len(entries))
+	copy(leaf, entries[2:])
+	for entryNum := 2; entryNum < len(entries); entryNum++ {
+		entries[entryNum] = DirectoryEntry{}
+	}
+	root := dirIndexNode{entries: []dirIndexEntry{{hash: 0, block: DIR_INDEX_ROOT + 1}}}
+	writeBlock(sblock, getFileBlock(sblock, dir, dirNum, DIR_INDEX_ROOT), encodeDirIndexNode(sblock, root))
+	writeBlock(sblock, getFileBlock(sblock, dir, dirNum, DIR_INDEX_ROOT+1), EncodeToBytes(leaf))
+	writeBlock(sblock, dir.DirectBlock1, EncodeToBytes(entries))
+	dir.IsIndexed = true
+	writeInodeToDisk(dir, dirNum, sblock)
+}
+
+// addIndexedEntry puts entry in its leaf, splitting the leaf and the index nodes above it as far up as
+// they are full
+func addIndexedEntry(sblock SuperBlock, dir *INode, dirNum int, entry DirectoryEntry) bool {
+	blocks := fileBlocks(sblock, dir)
+	path, leaf, err := indexPath(sblock, blocks, nameHash(entryName(entry)))
+	if err != nil {
+		log.Fatal("The index of directory ", dirNum, " is damaged: ", err)
+	}
+	entries := decodeDirectoryBlock(readBlock(sblock, blocks[leaf]))
+	if putEntry(entries, entry) {
+		writeBlock(sblock, blocks[leaf], EncodeToBytes(entries))
+		return true
+	}
+
+	//the leaf has to split, make sure every block that takes will fit in the inode before changing anything
+	newBlocks := 1
+	for level := len(path) - 1; level >= 0 && len(path[level].node.entries) == dirIndexCapacity(sblock); level-- {
+		newBlocks++
+		if level == 0 {
+			newBlocks++ //the root splits into two new nodes under it
+			if path[0].node.level+1 >= DIR_INDEX_MAX_LEVELS {
+				return false
+			}
+		}
+	}
+	if len(blocks)+newBlocks > maxFileBlocks(sblock) {
+		return false
+	}
+	low, high, ok := splitEntries(append(entries, entry))
+	if !ok {
+		return false //every name in the leaf has the same hash, there is nowhere to split it
+	}
+	newBlock := func() int {
+		blocks = append(blocks, getFileBlock(sblock, dir, dirNum, len(blocks)))
+		return len(blocks) - 1
+	}
+	writeLeaf := func(block int, leafEntries []DirectoryEntry) {
+		leafBlock := make(DirectoryBlock, len(entries))
+		copy(leafBlock, leafEntries)
+		writeBlock(sblock, blocks[block], EncodeToBytes(leafBlock))
+	}
+	highLeaf := newBlock()
+	writeLeaf(leaf, low)
+	writeLeaf(highLeaf, high)
+
+	//now the new leaf goes in the index next to the old one, splitting nodes on the way up as needed
+	split := dirIndexEntry{hash: nameHash(entryName(high[0])), block: highLeaf}
+	for level := len(path) - 1; level >= 0; level-- {
+		step := path[level]
+		node := dirIndexNode{level: step.node.level, entries: append(append(append([]dirIndexEntry{}, step.node.entries[:step.child+1]...), split), step.node.entries[step.child+1:]...)}
+		if len(node.entries) <= dirIndexCapacity(sblock) {
+			writeBlock(sblock, blocks[step.block], encodeDirIndexNode(sblock, node))
+			break
+		}
+		half := len(node.entries) / 2
+		lowNode := dirIndexNode{level: node.level, entries: node.entries[:half]}
+		highNode := dirIndexNode{level: node.level, entries: node.entries[half:]}
+		if level == 0 {
+			//the root stays put, both halves go down a level under it
+			lowBlock, highBlock := newBlock(), newBlock()
+			writeBlock(sblock, blocks[lowBlock], encodeDirIndexNode(sblock, lowNode))
+			writeBlock(sblock, blocks[highBlock], encodeDirIndexNode(sblock, highNode))
+			root := dirIndexNode{level: node.level + 1, entries: []dirIndexEntry{{hash: 0, block: lowBlock}, {hash: highNode.entries[0].hash, block: highBlock}}}
+			writeBlock(sblock, blocks[DIR_INDEX_ROOT], encodeDirIndexNode(sblock, root))
+			break
+		}
+		highBlock := newBlock()
+		writeBlock(sblock, blocks[step.block], encodeDirIndexNode(sblock, lowNode))
+		writeBlock(sblock, blocks[highBlock], encodeDirIndexNode(sblock, highNode))
+		split = dirIndexEntry{hash: highNode.entries[0].hash, block: highBlock}
+	}
+	writeInodeToDisk(dir, dirNum, sblock)
+	return true
+}
+
+// splitEntries sorts the entries in use by hash and splits them as near the middle as it can without
+// names with the same hash ending up on both sides. It is false if they all have the same hash
+func splitEntries(entries []DirectoryEntry) ([]DirectoryEntry, []DirectoryEntry, bool) {
+	sorted, hashes := []DirectoryEntry{}, []uint32{}
+	for _, entry := range entries {
+		if entryIsUsed(entry) {
+			sorted = append(sorted, entry)
+			hashes = append(hashes, nameHash(entryName(entry)))
+		}
+	}
+	sort.Sort(entriesByHash{sorted, hashes})
+	middle := len(sorted) / 2
+	for offset := 0; offset <= middle; offset++ {
+		for _, split := range []int{middle - offset, middle + offset} {
+			if split > 0 && split < len(sorted) && hashes[split-1] != hashes[split] {
+				return sorted[:split], sorted[split:], true
+			}
+		}
+	}
+	return nil, nil, false
+}
+
+// entriesByHash sorts entries and their hashes together
+type entriesByHash struct {
+	entries []DirectoryEntry
+	hashes  []uint32
+}
+
+func (e entriesByHash) Len() int           { return len(e.entries) }
+func (e entriesByHash) Less(a, b int) bool { return e.hashes[a] < e.hashes[b] }
+func (e entriesByHash) Swap(a, b int) {
+	e.entries[a], e.entries[b] = e.entries[b], e.entries[a]
+	e.hashes[a], e.hashes[b] = e.hashes[b], e.hashes[a]
+}
+
+// removeEntry takes name out of dir and returns the inode number it had, 0 if it wasn't there
+func removeEntry(sblock SuperBlock, dir INode, name string) int {
+	blockNum := entryBlock(sblock, dir, name)
+	entries := decodeDirectoryBlock(readBlock(sblock, blockNum))
+	for entryNum, entry := range entries {
+		if entryNum >= 2 || blockNum != dir.DirectBlock1 { //never '.' or '..'
+			if entryIsUsed(entry) && entryName(entry) == name {
+				entries[entryNum] = DirectoryEntry{}
+				writeBlock(sblock, blockNum, EncodeToBytes(entries))
+				return entry.Inode
+			}
+		}
+	}
+	return 0
+}
+
+// hasRoomFor is true if addEntry would find room for name in dir. A leaf that is full may still have room
+// once it splits, so the answer is only no when the directory can't grow any more
+func hasRoomFor(sblock SuperBlock, dir INode, name string) bool {
+	if freeSlot(decodeDirectoryBlock(readBlock(sblock, entryBlock(sblock, dir, name)))) >= 0 {
+		return true
+	}
+	if !dir.IsIndexed {
+		return dirIndexEnabled(sblock)
+	}
+	//a split takes at most a block for each level of the index, the leaf and a new root
+	return len(fileBlocks(sblock, &dir))+DIR_INDEX_MAX_LEVELS+1 <= maxFileBlocks(sblock)
+}
+
+// reindexDirectory puts dir back together from scratch with entries in it, for when its index is
+// damaged. It goes back to one block if they fit. It returns the entries there wasn't room for
+func reindexDirectory(sblock SuperBlock, dirNum int, entries []DirectoryEntry) []DirectoryEntry {
+	dir := getInodeFromDisk(dirNum)
+	first := decodeDirectoryBlock(readBlock(sblock, dir.DirectBlock1))
+	rest := dir
+	rest.DirectBlock1 = 0
+	freeFileBlocks(sblock, &rest)
+	dir.DirectBlock2, dir.DirectBlock3, dir.IndirectBlock, dir.IsIndexed = 0, 0, 0, false
+	cleared := make(DirectoryBlock, len(first))
+	cleared[0], cleared[1] = first[0], first[1]
+	writeBlock(sblock, dir.DirectBlock1, EncodeToBytes(cleared))
+	writeInodeToDisk(&dir, dirNum, sblock)
+	left := []DirectoryEntry{}
+	for _, entry := range entries {
+		if !addEntry(sblock, &dir, dirNum, entryName(entry), entry.Inode) {
+			left = append(left, entry)
+		}
+	}
+	return left
+}
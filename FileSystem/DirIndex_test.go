@@ -0,0 +1,131 @@
+package FileSystem
+
+import (
+	"fmt"
+	"testing"
+)
+
+// collidingNames finds count pairs of different names with the same nameHash
+func collidingNames(count int) [][2]string {
+	seen := map[uint32]string{}
+	pairs := [][2]string{}
+	for num := 0; len(pairs) < count; num++ {
+		name := fmt.Sprint("c", num)
+		hash := nameHash(name)
+		if other, ok := seen[hash]; ok {
+			pairs = append(pairs, [2]string{other, name})
+		}
+		seen[hash] = name
+	}
+	return pairs
+}
+
+// indexRootLevel is the level of the root of dir's index
+func indexRootLevel(t *testing.T, dir INode) int {
+	t.Helper()
+	sblock := ReadSuperBlock()
+	dir, _ = currentDirectory(dir)
+	if !dir.IsIndexed {
+		t.Fatalf("the directory isn't indexed")
+	}
+	root, ok := decodeDirIndexNode(readBlock(sblock, fileBlocks(sblock, &dir)[DIR_INDEX_ROOT]))
+	if !ok {
+		t.Fatalf("the directory has no index root")
+	}
+	return root.level
+}
+
+// TestIndexedDirectoryCollisions fills a directory until its index root has split, with pairs of names
+// that hash the same among the rest, then unlinks one of each pair and half of the others. Every name
+// has to be found where it was put, before and after a remount
+func TestIndexedDirectoryCollisions(t *testing.T) {
+	options := DefaultOptions()
+	options.BlockSize = 512
+	device := newTestFileSystem(t, 8<<20, options)
+	sblock := ReadSuperBlock()
+	pairs := collidingNames(12)
+	names := map[string]int{}
+	create := func(name string) {
+		_, inodeNum := Open(CREATE, name, RootFolder)
+		if inodeNum == 0 {
+			t.Fatalf("couldn't create %s with %d names in the directory", name, len(names))
+		}
+		names[name] = inodeNum
+	}
+	for _, pair := range pairs {
+		create(pair[0])
+	}
+	//more leaves than the root can point at, so it has to push its entries down a level
+	for num := 0; num < 12*dirIndexCapacity(sblock); num++ {
+		create(fmt.Sprint("n", num))
+		if num%100 == 0 {
+			create(pairs[num/100%len(pairs)][1])
+		}
+	}
+	for _, pair := range pairs {
+		if _, ok := names[pair[1]]; !ok {
+			create(pair[1])
+		}
+	}
+	if level := indexRootLevel(t, RootFolder); level == 0 {
+		t.Fatalf("the index root never split with %d names in the directory", len(names))
+	}
+	check := func() {
+		t.Helper()
+		for name, inodeNum := range names {
+			if _, num := readTestFile(RootFolder, name); num != inodeNum {
+				t.Fatalf("%s is inode %d, it should be %d", name, num, inodeNum)
+			}
+		}
+		checkFsck(t)
+	}
+	check()
+	remount(t, device)
+	check()
+
+	for num, pair := range pairs {
+		gone := pair[num%2]
+		if err := UnlinkName(gone, RootFolder); err != nil {
+			t.Fatalf("UnlinkName %s: %v", gone, err)
+		}
+		delete(names, gone)
+		if _, inodeNum := readTestFile(RootFolder, gone); inodeNum != 0 {
+			t.Fatalf("%s is still there after unlinking it", gone)
+		}
+	}
+	for num := 0; num < 12*dirIndexCapacity(sblock); num += 2 {
+		name := fmt.Sprint("n", num)
+		if err := UnlinkName(name, RootFolder); err != nil {
+			t.Fatalf("UnlinkName %s: %v", name, err)
+		}
+		delete(names, name)
+	}
+	check()
+	remount(t, device)
+	check()
+}
+
+// TestSplitEntriesSameHash makes sure a leaf whose names all hash the same is never split, names with
+// the same hash have to stay in the same leaf
+func TestSplitEntriesSameHash(t *testing.T) {
+	pair := collidingNames(1)[0]
+	entries := []DirectoryEntry{}
+	for num := 0; num < 8; num++ {
+		entries = append(entries, newDirectoryEntry(pair[num%2], num+1))
+	}
+	if _, _, ok := splitEntries(entries); ok {
+		t.Fatalf("split a leaf where every name has the same hash")
+	}
+	entries = append(entries, newDirectoryEntry("other", 9))
+	low, high, ok := splitEntries(entries)
+	if !ok {
+		t.Fatalf("couldn't split a leaf with two hashes in it")
+	}
+	for _, side := range [][]DirectoryEntry{low, high} {
+		for _, entry := range side {
+			if nameHash(entryName(entry)) != nameHash(entryName(side[0])) {
+				t.Fatalf("the split put names with different hashes on the same side: %v %v", low, high)
+			}
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package FileSystem
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"log"
+)
+
+// On disk format
+// Everything is written little-endian with encoding/binary at fixed offsets, so unlike gob every
+// structure has an exact size and we don't need to guess how much room the encoder will want.
+// All block numbers and inode numbers are stored as uint32, bools are a single byte (0 or 1)
+// and timestamps are int64 unix seconds. Reserved bytes are always written as zero.
+//
+// SuperBlock - SUPERBLOCK_SIZE (304) bytes at byte 0 of the device, so it can be found before we know the block size.
+// Copies go at the start of each backup block (see backupSuperBlockLocations)
+//   offset 0   uint32   Magic (FS_MAGIC)
+//   offset 4   uint32   FormatVersion
+//   offset 8   uint32   FeatureCompat
+//   offset 12  uint32   FeatureIncompat
+//   offset 16  uint32   FeatureROCompat
+//   offset 20  uint32   BlockSize
+//   offset 24  uint32   BlockCount
+//   offset 28  uint32   InodeCount
+//   offset 32  uint32   InodeSize
+//   offset 36  uint32   INodeStart
+//   offset 40  uint32   RootDirInode
+//   offset 44  uint32   FreeBlockStart
+//   offset 48  uint32   InodeBitmapStart
+//   offset 52  uint32   DataBlockStart
+//   offset 56  [16]byte UUID
+//   offset 72  [16]byte Label (zero padded)
+//   offset 88  uint32   FreeBlocks
+//   offset 92  uint32   FreeInodes
+//   offset 96  uint32   ReservedBlocks
+//   offset 100 uint32   ReservedUID
+//   offset 104 uint32   JournalStart
+//   offset 108 uint32   JournalBlocks
+//   offset 112 uint32   CowMapStart
+//   offset 116 uint32   CowMapBlocks
+//   offset 120 uint32   CowActive
+//   offset 124 uint32   CowGeneration
+//   offset 128 uint32   PhysicalBlocks
+//   offset 132 uint32   SnapshotTable
+//   offset 136 uint32   VersionsKept
+//   offset 140 uint32   VersionMaxAge
+//   offset 144 uint32   TrashDir
+//   offset 148 uint32   Allocator
+//   offset 152 uint32   BlocksPerGroup
+//   offset 156 uint32   InodesPerGroup
+//   offset 160 uint32   InodesPerChunk
+//   offset 164 uint32   InodeChunks
+//   offset 168 [32]uint32 InodeMap
+//   offset 296 uint32   InodeChunkBase
+//   offset 300 uint32   CRC-32C of the 300 bytes before it
+//
+// INode - INODE_RECORD_SIZE (64) bytes at the start of each InodeSize slot in the inode table
+//   offset 0   uint8   IsValid
+//   offset 1   uint8   IsDirectory
+//   offset 2   uint16  LinksCount
+//   offset 4   uint32  Version
+//   offset 8   uint32  DirectBlock1
+//   offset 12  uint32  DirectBlock2
+//   offset 16  uint32  DirectBlock3
+//   offset 20  uint32  IndirectBlock
+//   offset 24  int64   CreateTime
+//   offset 32  int64   LastModifyTime
+//   offset 40  uint32  PrevVersion
+//   offset 44  uint8   IsIndexed
+//   offset 45  19 bytes reserved
+//
+// DirectoryEntry - DIRECTORY_ENTRY_SIZE (32) bytes, a DirectoryBlock is exactly one block of them
+//   offset 0   uint32   Inode
+//   offset 4   [20]byte Name (zero padded, not zero terminated when all 20 bytes are used)
+//   offset 24  8 bytes reserved
+//
+// Directory index node - one block, the second block of an indexed directory is the root (see DirIndex.go)
+//   offset 0   uint32   DIR_INDEX_MAGIC
+//   offset 4   uint32   level, 0 if the entries point at leaves
+//   offset 8   uint32   count
+//   offset 12  4 bytes reserved
+//   offset 16  count entries of uint32 lowest hash under the entry, uint32 block of the directory it points at
+//
+// IndirectBlock - exactly one block of uint32 block numbers, a zero ends the list
+//
+// Trash record - TRASH_RECORD_SIZE (128) bytes each, back to back in the trash index file
+//   offset 0   uint32   Inode, 0 ends the list
+//   offset 4   int64    time it was deleted
+//   offset 12  [20]byte name it had
+//   offset 32  [96]byte path of the directory it was in (zero padded, empty if it didn't fit)
+//
+// Block map (copy on write only) - CowMapBlocks blocks of uint32 physical block numbers, entry n is
+// where logical block n lives and 0 means it has never been written. There are two copies one after
+// the other starting at CowMapStart and CowActive says which one is live.
+//
+// Snapshot blocks (copy on write only) - all of these are physical blocks out of the pool.
+//   table:  uint32 magic SNAPSHOT_TABLE_MAGIC, uint32 count, then count uint32 header blocks
+//   header: uint32 magic SNAPSHOT_HEADER_MAGIC, [32]byte name (zero padded), int64 creation time,
+//           the SUPERBLOCK_SIZE byte superblock as it was, uint32 count, then count uint32 index blocks
+//   index:  uint32 block numbers of the snapshot's copy of the block map, in order, 0 padded
+//   map:    same as a copy of the live block map
+//
+// Journal blocks - every block in the journal that means anything starts with the same 12 bytes
+//   offset 0   uint32   JOURNAL_MAGIC
+//   offset 4   uint32   type (JOURNAL_HEADER, JOURNAL_DESCRIPTOR or JOURNAL_COMMIT)
+//   offset 8   uint32   transaction sequence number
+// the header (first journal block) has the sequence the next transaction will use.
+// A descriptor continues with a uint32 count and then count uint32 block numbers, running on into
+// as many blocks as that takes. The blocks right after it are the new contents of those blocks in the same order. The commit block follows them
+// and has the CRC-32C of the descriptor and the block copies at offset 12.
+
+const (
+	SUPERBLOCK_SIZE      = 304
+	INODE_RECORD_SIZE    = 64
+	DIRECTORY_ENTRY_SIZE = 32
+	BLOCK_POINTER_SIZE   = 4
+)
+
+var byteOrder = binary.LittleEndian
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+func putBool(b []byte, val bool) {
+	if val {
+		b[0] = 1
+	} else {
+		b[0] = 0
+	}
+}
+
+func encodeSuperBlock(sblock SuperBlock) []byte {
+	b := make([]byte, SUPERBLOCK_SIZE)
+	byteOrder.PutUint32(b[0:], sblock.Magic)
+	byteOrder.PutUint32(b[4:], sblock.FormatVersion)
+	byteOrder.PutUint32(b[8:], sblock.FeatureCompat)
+	byteOrder.PutUint32(b[12:], sblock.FeatureIncompat)
+	byteOrder.PutUint32(b[16:], sblock.FeatureROCompat)
+	byteOrder.PutUint32(b[20:], uint32(sblock.BlockSize))
+	byteOrder.PutUint32(b[24:], uint32(sblock.BlockCount))
+	byteOrder.PutUint32(b[28:], uint32(sblock.InodeCount))
+	byteOrder.PutUint32(b[32:], uint32(sblock.InodeSize))
+	byteOrder.PutUint32(b[36:], uint32(sblock.INodeStart))
+	byteOrder.PutUint32(b[40:], uint32(sblock.RootDirInode))
+	byteOrder.PutUint32(b[44:], uint32(sblock.FreeBlockStart))
+	byteOrder.PutUint32(b[48:], uint32(sblock.InodeBitmapStart))
+	byteOrder.PutUint32(b[52:], uint32(sblock.DataBlockStart))
+	copy(b[56:72], sblock.UUID[:])
+	copy(b[72:88], sblock.Label[:])
+	byteOrder.PutUint32(b[88:], uint32(sblock.FreeBlocks))
+	byteOrder.PutUint32(b[92:], uint32(sblock.FreeInodes))
+	byteOrder.PutUint32(b[96:], uint32(sblock.ReservedBlocks))
+	byteOrder.PutUint32(b[100:], uint32(sblock.ReservedUID))
+	byteOrder.PutUint32(b[104:], uint32(sblock.JournalStart))
+	byteOrder.PutUint32(b[108:], uint32(sblock.JournalBlocks))
+	byteOrder.PutUint32(b[112:], uint32(sblock.CowMapStart))
+	byteOrder.PutUint32(b[116:], uint32(sblock.CowMapBlocks))
+	byteOrder.PutUint32(b[120:], uint32(sblock.CowActive))
+	byteOrder.PutUint32(b[124:], sblock.CowGeneration)
+	byteOrder.PutUint32(b[128:], uint32(sblock.PhysicalBlocks))
+	byteOrder.PutUint32(b[132:], uint32(sblock.SnapshotTable))
+	byteOrder.PutUint32(b[136:], uint32(sblock.VersionsKept))
+	byteOrder.PutUint32(b[140:], uint32(sblock.VersionMaxAge))
+	byteOrder.PutUint32(b[144:], uint32(sblock.TrashDir))
+	byteOrder.PutUint32(b[148:], uint32(sblock.Allocator))
+	byteOrder.PutUint32(b[152:], uint32(sblock.BlocksPerGroup))
+	byteOrder.PutUint32(b[156:], uint32(sblock.InodesPerGroup))
+	byteOrder.PutUint32(b[160:], uint32(sblock.InodesPerChunk))
+	byteOrder.PutUint32(b[164:], uint32(sblock.InodeChunks))
+	for chunk, blockNum := range sblock.InodeMap {
+		byteOrder.PutUint32(b[168+chunk*4:], uint32(blockNum))
+	}
+	byteOrder.PutUint32(b[296:], uint32(sblock.InodeChunkBase))
+	byteOrder.PutUint32(b[SUPERBLOCK_SIZE-4:], crc32.Checksum(b[:SUPERBLOCK_SIZE-4], crcTable))
+	return b
+}
+
+// superBlockChecksumOK is true if the checksum at the end of an encoded superblock matches
+func superBlockChecksumOK(b []byte) bool {
+	return byteOrder.Uint32(b[SUPERBLOCK_SIZE-4:]) == crc32.Checksum(b[:SUPERBLOCK_SIZE-4], crcTable)
+}
+
+func decodeSuperBlock(b []byte) SuperBlock {
+	sblock := SuperBlock{
+		Magic:            byteOrder.Uint32(b[0:]),
+		FormatVersion:    byteOrder.Uint32(b[4:]),
+		FeatureCompat:    byteOrder.Uint32(b[8:]),
+		FeatureIncompat:  byteOrder.Uint32(b[12:]),
+		FeatureROCompat:  byteOrder.Uint32(b[16:]),
+		BlockSize:        int(byteOrder.Uint32(b[20:])),
+		BlockCount:       int(byteOrder.Uint32(b[24:])),
+		InodeCount:       int(byteOrder.Uint32(b[28:])),
+		InodeSize:        int(byteOrder.Uint32(b[32:])),
+		INodeStart:       int(byteOrder.Uint32(b[36:])),
+		RootDirInode:     int(byteOrder.Uint32(b[40:])),
+		FreeBlockStart:   int(byteOrder.Uint32(b[44:])),
+		InodeBitmapStart: int(byteOrder.Uint32(b[48:])),
+		DataBlockStart:   int(byteOrder.Uint32(b[52:])),
+		FreeBlocks:       int(byteOrder.Uint32(b[88:])),
+		FreeInodes:       int(byteOrder.Uint32(b[92:])),
+		ReservedBlocks:   int(byteOrder.Uint32(b[96:])),
+		ReservedUID:      int(byteOrder.Uint32(b[100:])),
+		JournalStart:     int(byteOrder.Uint32(b[104:])),
+		JournalBlocks:    int(byteOrder.Uint32(b[108:])),
+		CowMapStart:      int(byteOrder.Uint32(b[112:])),
+		CowMapBlocks:     int(byteOrder.Uint32(b[116:])),
+		CowActive:        int(byteOrder.Uint32(b[120:])),
+		CowGeneration:    byteOrder.Uint32(b[124:]),
+		PhysicalBlocks:   int(byteOrder.Uint32(b[128:])),
+		SnapshotTable:    int(byteOrder.Uint32(b[132:])),
+		VersionsKept:     int(byteOrder.Uint32(b[136:])),
+		VersionMaxAge:    int(byteOrder.Uint32(b[140:])),
+		TrashDir:         int(byteOrder.Uint32(b[144:])),
+		Allocator:        int(byteOrder.Uint32(b[148:])),
+		BlocksPerGroup:   int(byteOrder.Uint32(b[152:])),
+		InodesPerGroup:   int(byteOrder.Uint32(b[156:])),
+		InodesPerChunk:   int(byteOrder.Uint32(b[160:])),
+		InodeChunks:      int(byteOrder.Uint32(b[164:])),
+		InodeChunkBase:   int(byteOrder.Uint32(b[296:])),
+	}
+	copy(sblock.UUID[:], b[56:72])
+	copy(sblock.Label[:], b[72:88])
+	for chunk := range sblock.InodeMap {
+		sblock.InodeMap[chunk] = int(byteOrder.Uint32(b[168+chunk*4:]))
+	}
+	return sblock
+}
+
+func encodeInode(inode INode) []byte {
+	b := make([]byte, INODE_RECORD_SIZE)
+	putBool(b[0:], inode.IsValid)
+	putBool(b[1:], inode.IsDirectory)
+	byteOrder.PutUint16(b[2:], uint16(inode.LinksCount))
+	byteOrder.PutUint32(b[4:], uint32(inode.Version))
+	byteOrder.PutUint32(b[8:], uint32(inode.DirectBlock1))
+	byteOrder.PutUint32(b[12:], uint32(inode.DirectBlock2))
+	byteOrder.PutUint32(b[16:], uint32(inode.DirectBlock3))
+	byteOrder.PutUint32(b[20:], uint32(inode.IndirectBlock))
+	byteOrder.PutUint64(b[24:], uint64(inode.CreateTime))
+	byteOrder.PutUint64(b[32:], uint64(inode.LastModifyTime))
+	byteOrder.PutUint32(b[40:], uint32(inode.PrevVersion))
+	putBool(b[44:], inode.IsIndexed)
+	return b
+}
+
+func decodeInode(b []byte) INode {
+	return INode{
+		IsValid:        b[0] != 0,
+		IsDirectory:    b[1] != 0,
+		LinksCount:     int(byteOrder.Uint16(b[2:])),
+		Version:        int(byteOrder.Uint32(b[4:])),
+		DirectBlock1:   int(byteOrder.Uint32(b[8:])),
+		DirectBlock2:   int(byteOrder.Uint32(b[12:])),
+		DirectBlock3:   int(byteOrder.Uint32(b[16:])),
+		IndirectBlock:  int(byteOrder.Uint32(b[20:])),
+		CreateTime:     int64(byteOrder.Uint64(b[24:])),
+		LastModifyTime: int64(byteOrder.Uint64(b[32:])),
+		PrevVersion:    int(byteOrder.Uint32(b[40:])),
+		IsIndexed:      b[44] != 0,
+	}
+}
+
+func encodeDirectoryBlock(dirBlock DirectoryBlock) []byte {
+	b := make([]byte, len(dirBlock)*DIRECTORY_ENTRY_SIZE)
+	for entryNum, entry := range dirBlock {
+		entryBytes := b[entryNum*DIRECTORY_ENTRY_SIZE:]
+		byteOrder.PutUint32(entryBytes[0:], uint32(entry.Inode))
+		copy(entryBytes[4:24], entry.Name[:])
+	}
+	return b
+}
+
+func decodeDirectoryBlock(b []byte) DirectoryBlock {
+	dirBlock := make(DirectoryBlock, len(b)/DIRECTORY_ENTRY_SIZE)
+	for entryNum := range dirBlock {
+		entryBytes := b[entryNum*DIRECTORY_ENTRY_SIZE:]
+		dirBlock[entryNum].Inode = int(byteOrder.Uint32(entryBytes[0:]))
+		copy(dirBlock[entryNum].Name[:], entryBytes[4:24])
+	}
+	return dirBlock
+}
+
+func encodeIndirectBlock(indirect IndirectBlock) []byte {
+	b := make([]byte, len(indirect)*BLOCK_POINTER_SIZE)
+	for loc, blockNum := range indirect {
+		byteOrder.PutUint32(b[loc*BLOCK_POINTER_SIZE:], uint32(blockNum))
+	}
+	return b
+}
+
+func decodeIndirectBlock(b []byte) IndirectBlock {
+	indirect := make(IndirectBlock, len(b)/BLOCK_POINTER_SIZE)
+	for loc := range indirect {
+		indirect[loc] = int(byteOrder.Uint32(b[loc*BLOCK_POINTER_SIZE:]))
+	}
+	return indirect
+}
+
+// EncodeToBytes turns any of the on disk structures into its fixed size binary form
+func EncodeToBytes(p interface{}) []byte {
+	switch val := p.(type) {
+	case SuperBlock:
+		return encodeSuperBlock(val)
+	case *SuperBlock:
+		return encodeSuperBlock(*val)
+	case INode:
+		return encodeInode(val)
+	case *INode:
+		return encodeInode(*val)
+	case DirectoryBlock:
+		return encodeDirectoryBlock(val)
+	case *DirectoryBlock:
+		return encodeDirectoryBlock(*val)
+	case IndirectBlock:
+		return encodeIndirectBlock(val)
+	case *IndirectBlock:
+		return encodeIndirectBlock(*val)
+	}
+	log.Fatalf("Don't know how to encode a %T to disk", p)
+	return nil
+}
@@ -1,60 +1,107 @@
 package FileSystem
 
 import (
-	"bytes"
-	"encoding/gob"
+	"errors"
+	"fmt"
 	"log"
 	"strings"
 	"time"
 )
 
 // Disk
-// first index in number of blocks
-// second is block size
-// I need 6144 blocks for the data - one for the superblock
-// I'll cheese the 'bitmaps' as booleans so I need 6144 bytes (6 blocks) for the data 'bitmap'
-// and I'll need inodes and an inode bitmap. I'll setup my inodes to be 64 bytes and if
-// I have 256 of them, then I need 64 blocks for inodes
-// furthermore I'll need 1 block for the inode 'bitmap'
-
-var Disk [66184][BLOCK_SIZE]byte
+// The file system used to live in a fixed [66184][1024]byte array. Now it lives on a BlockDevice
+// and all of the geometry (block size, number of blocks and inodes, where everything starts)
+// comes from the superblock that Format writes, so nothing below assumes a block or inode size.
+// The layout is always: superblock in block 0, the inode bitmap, the free block bitmap,
+// the inode table and then the data blocks (see Format.go for how the sizes are worked out
+// and Encoding.go for the exact byte layout of each structure)
+
+var Disk BlockDevice
+
+// RootFolder is the root directory as it was when the file system was mounted. Its first block never
+// moves so it is fine for Open and Unlink, which go from there to the inode as it is now, but read the
+// inode again for an up to date link count or blocks
 var RootFolder INode
 
 const (
-	INODE_SIZE       = 512 //even though Inodes are only 64 bytes, encoded they take up 170, and need power of 2
-	BLOCK_SIZE       = 1024
-	NUM_INODES       = 256
-	DATA_BLOCK_START = 140
+	DEFAULT_BLOCK_SIZE      = 1024
+	DEFAULT_DISK_SIZE       = 66184 * DEFAULT_BLOCK_SIZE
+	DEFAULT_INODE_SIZE      = 64
+	DEFAULT_BYTES_PER_INODE = 16384
+	ROOT_DIR_INODE          = 1
+	MAX_NAME_LENGTH         = 20 //bytes in a directory entry's name, longer names are refused (see validName)
 )
 
 type SuperBlock struct {
-	INodeStart       int //the block location of the beginning of the inodes
-	RootDirInode     int //the inode number of the root folder
-	FreeBlockStart   int //the block number where the beginning of the booleans for the free blocks is found
-	InodeBitmapStart int //block number of the inode 'bitmap'
-	DataBlockStart   int //the block number of the beginning of the datablocks
+	Magic            uint32              //always FS_MAGIC, anything else isn't one of our file systems
+	FormatVersion    uint32              //the FORMAT_VERSION of the code that ran Format
+	FeatureCompat    uint32              //features that older code can safely ignore
+	FeatureIncompat  uint32              //features that code has to understand to mount at all
+	FeatureROCompat  uint32              //features that code has to understand to write, it can still mount read only
+	UUID             [16]byte            //random id made by Format
+	Label            [16]byte            //volume name, zero padded
+	BlockSize        int                 //number of bytes in a block
+	BlockCount       int                 //number of blocks in the file system, including the metadata blocks
+	InodeCount       int                 //inode numbers go up to this, holes nothing backs included (see InodeTable.go)
+	InodeSize        int                 //number of bytes each inode takes up in the inode table
+	INodeStart       int                 //the block location of the beginning of the inodes
+	RootDirInode     int                 //the inode number of the root folder
+	FreeBlockStart   int                 //the block number where the free block bitmap starts
+	InodeBitmapStart int                 //block number of the inode bitmap
+	DataBlockStart   int                 //the block number of the beginning of the datablocks
+	FreeBlocks       int                 //blocks not marked in the free block bitmap less what only snapshots hold, kept up to date by syncBitmaps
+	FreeInodes       int                 //inodes not marked in the inode bitmap, kept up to date by syncBitmaps
+	ReservedBlocks   int                 //the last this many free blocks can only be allocated by ReservedUID
+	ReservedUID      int                 //the privileged user who can dig into the reserved blocks
+	JournalStart     int                 //first block of the journal, which sits between the inode table and the data blocks
+	JournalBlocks    int                 //size of the journal, 0 if there isn't one
+	CowMapStart      int                 //copy on write only - physical block where the two copies of the block map start
+	CowMapBlocks     int                 //blocks in each copy of the block map
+	CowActive        int                 //which copy of the block map is live, switching this is what commits
+	CowGeneration    uint32              //goes up by one every commit
+	PhysicalBlocks   int                 //blocks on the device, BlockCount is only the logical blocks in copy on write mode
+	SnapshotTable    int                 //physical block listing the snapshots, 0 if there aren't any
+	VersionsKept     int                 //old versions Write keeps of each file, 0 turns version history off
+	VersionMaxAge    int                 //seconds an old version is kept for, 0 for no limit
+	TrashDir         int                 //inode of the trash directory, 0 if Unlink really deletes (see Trash.go)
+	Allocator        int                 //ALLOC_FIRST_FIT and so on, the block allocator mounts use unless told otherwise
+	BlocksPerGroup   int                 //blocks in each block group, 0 if the file system doesn't have them (see BlockGroup.go)
+	InodesPerGroup   int                 //inodes in each block group
+	InodesPerChunk   int                 //inodes in each chunk the inode table grows by, 0 if it can't grow (see InodeTable.go)
+	InodeChunks      int                 //chunks the inode table has grown by, InodeCount includes them
+	InodeMap         [INODE_MAP_SIZE]int //first block of each chunk, its bitmap block with the chunk's inodes after it
+	InodeChunkBase   int                 //number of the first chunk inode, fixed by Format so resizing doesn't renumber them
 }
 
 type INode struct {
 	IsValid        bool //true if this inode is a real file
 	IsDirectory    bool //true if this file is actually a directory entry
-	Version        int  //at the moment this is here mostly to make the inodes be 64 bytes
+	LinksCount     int  //how many directory entries point at this inode, '.' and '..' included
+	Version        int  //goes up by one every Write
 	DirectBlock1   int
 	DirectBlock2   int
 	DirectBlock3   int
 	IndirectBlock  int
 	CreateTime     int64
 	LastModifyTime int64
+	PrevVersion    int  //inode holding the version before this one, 0 if there isn't one (see Version.go)
+	IsIndexed      bool //directories only, true once the entries have moved out of the first block into a hash tree (see DirIndex.go)
+
+	//the inode's number if it had a write waiting for its blocks when this copy was made, so Read knows
+	//the block pointers are from before it (see DelayedAlloc.go). It isn't saved
+	delayed int
 }
 
 type DirectoryEntry struct {
 	Inode int
-	Name  [20]byte //I suggested 12 in class, but I realize that 20 will make this an even 32 bytes
+	Name  [MAX_NAME_LENGTH]byte //I suggested 12 in class, but I realize that 20 will make this an even 32 bytes
 }
 
-type DirectoryBlock [32]DirectoryEntry
+// DirectoryBlock is one block worth of entries, so BlockSize/DIRECTORY_ENTRY_SIZE of them
+type DirectoryBlock []DirectoryEntry
 
-type IndirectBlock [128]int
+// IndirectBlock is one block worth of block numbers, so BlockSize/BLOCK_POINTER_SIZE of them
+type IndirectBlock []int
 
 const (
 	CREATE = iota
@@ -63,57 +110,124 @@ const (
 	APPEND
 )
 
+// InitializeFileSystem formats a fresh in memory disk with the default geometry and mounts it
 func InitializeFileSystem() {
-	//explicitly zero the filesystem - this shouldn't be needed
-	for blockLoc, _ := range Disk {
-		for byteLoc, _ := range Disk[blockLoc] {
-			Disk[blockLoc][byteLoc] = 0
+	device := NewMemDevice(DEFAULT_DISK_SIZE)
+	if err := Format(device, DefaultOptions()); err != nil {
+		log.Fatal("Unable to format the disk: ", err)
+	}
+	if err := Mount(device); err != nil {
+		log.Fatal("Unable to mount the disk: ", err)
+	}
+}
+
+func readBlock(sblock SuperBlock, blockNum int) []byte {
+	transactionLock.Lock()
+	if cow != nil || runningTransaction != nil {
+		defer transactionLock.Unlock()
+		return readBlockLocked(sblock, blockNum)
+	}
+	transactionLock.Unlock() //nothing to look up, and the device looks after itself
+	return readBlockFromDisk(sblock, blockNum)
+}
+
+// readBlockLocked is readBlock for when we already hold transactionLock
+func readBlockLocked(sblock SuperBlock, blockNum int) []byte {
+	if runningTransaction != nil && blockNum >= 0 {
+		if block := runningTransaction.lookup(blockNum); block != nil {
+			return block //the transaction has a newer copy than Disk does
 		}
 	}
+	if cow != nil && blockNum > 0 && blockNum < sblock.BlockCount {
+		return cow.read(blockNum)
+	}
+	return readBlockFromDisk(sblock, blockNum)
+}
 
-	//order on the Disk will be Superblock in block 0, inode bitmap in block 1, free block bitmap  blocks 2-7
-	//inodes in blocks 8-39 and datablocks in blocks 40-end
+func readBlockFromDisk(sblock SuperBlock, blockNum int) []byte {
+	if blockNum < 0 || blockNum >= sblock.BlockCount {
+		log.Fatal("Tried to read block ", blockNum, " which isn't on the disk")
+	}
+	return cache.read(blockNum)
+}
+
+// writeBlock writes metadata to the start of the block, anything past the end of data is zeroed.
+// If there is a transaction running the block goes into it instead of straight to Disk
+func writeBlock(sblock SuperBlock, blockNum int, data []byte) {
+	transactionLock.Lock()
+	defer transactionLock.Unlock()
+	writeBlockLocked(sblock, blockNum, data)
+}
+
+func writeBlockLocked(sblock SuperBlock, blockNum int, data []byte) {
+	if runningTransaction != nil {
+		checkWritable()
+		if blockNum < 0 || blockNum >= sblock.BlockCount {
+			log.Fatal("Tried to write block ", blockNum, " which isn't on the disk")
+		}
+		block := make([]byte, sblock.BlockSize)
+		copy(block, data)
+		runningTransaction.add(blockNum, block)
+		blockChanged(blockNum)
+		return
+	}
+	if cow != nil {
+		//copy on write has nowhere to put a block outside a transaction, so it gets one of its own
+		checkWritable()
+		startTransaction(sblock)
+		writeBlockLocked(sblock, blockNum, data)
+		running := runningTransaction
+		runningTransaction = nil
+		running.commitCowOrFail()
+		return
+	}
+	writeBlockToDisk(sblock, blockNum, data)
+}
 
-	supBlock := SuperBlock{
-		INodeStart:       8,
-		RootDirInode:     1,
-		FreeBlockStart:   2,
-		InodeBitmapStart: 1,
-		DataBlockStart:   DATA_BLOCK_START,
+// writeBlockToDisk is writeBlock without the journal, only the journal itself should need it. Disk here
+// means the buffer cache, it gets to the device itself at the next syncDisk
+func writeBlockToDisk(sblock SuperBlock, blockNum int, data []byte) {
+	checkWritable()
+	if cow != nil {
+		log.Fatal("Tried to overwrite block ", blockNum, " in place on a copy on write file system")
+	}
+	if blockNum < 0 || blockNum >= sblock.BlockCount {
+		log.Fatal("Tried to write block ", blockNum, " which isn't on the disk")
 	}
-	superblockBytes := EncodeToBytes(supBlock)
-	copy(Disk[0][:], superblockBytes)
-	createInodeBitmap(supBlock)
-	createFreeBlockBitmap(supBlock)
-	createInodes(supBlock)
-	createRootDir(supBlock)
+	cache.write(blockNum, data)
+	blockChanged(blockNum)
 }
 
 func createFreeBlockBitmap(block SuperBlock) {
-	//unlike the inode bitmap, the free block bitmap will take up multiple blocks
-	wholeFreeBlockBitmap := make([][BLOCK_SIZE]bool, 1)
-	for bitmapBlock := block.InodeBitmapStart; bitmapBlock < block.INodeStart; bitmapBlock++ {
-		var currentFreeBlockBitmap [1024]bool //should be all false by default
-		wholeFreeBlockBitmap = append(wholeFreeBlockBitmap, currentFreeBlockBitmap)
+	//unlike the inode bitmap, the free block bitmap will usually take up multiple blocks
+	blocks, starts := freeBlockBitmapLayout(block)
+	freeBlockBitmap = newBitmap(block, block.BlockCount, blocks, starts)
+	//the start of every group is superblock, bitmaps and inodes (and the journal in the first), so mark those as used
+	for group := 0; group < groupCount(block); group++ {
+		for metadataBlock := groupStart(block, group); metadataBlock < groupDataStart(block, group); metadataBlock++ {
+			freeBlockBitmap.Set(metadataBlock)
+		}
+	}
+	//and so are the blocks holding the backup superblocks
+	for _, backup := range superBlockBackups(block) {
+		freeBlockBitmap.Set(backup)
 	}
-	writeFreeBlockBitmapToDisk(wholeFreeBlockBitmap, block)
 }
 
 func createInodeBitmap(block SuperBlock) {
-	//the inode bitmap will be in block 1 and will hold NUM_INODES booleans
-	var inodeBitmap [NUM_INODES]bool //all set to zero by default
-	writeInodeBitmapToDisk(inodeBitmap, block)
+	//the inode bitmap holds InodeCount bits
+	blocks, starts := inodeBitmapLayout(block)
+	inodeBitmap = newBitmap(block, block.InodeCount, blocks, starts)
+	inodeBitmap.Set(0) //inode 0 means 'no inode' so it can never be handed out
 }
 
 func createInodes(sblock SuperBlock) {
-	//here we will create all 256/NUM_INODES INodes in the filesystem as invalid files
-	//fix this
-	for iNodeNum := 0; iNodeNum < NUM_INODES; iNodeNum++ {
-		currentInode := INode{} //make empty with all fields having false/zero value
-		inodeBytes := EncodeToBytes(currentInode)
-		inodeblock := (iNodeNum * INODE_SIZE / BLOCK_SIZE) + sblock.INodeStart //this is all integer division, so result is floor division
-		inodeOffSet := iNodeNum * INODE_SIZE % BLOCK_SIZE
-		copy(Disk[inodeblock][inodeOffSet:inodeOffSet+INODE_SIZE], inodeBytes)
+	//here we will create all the INodes in the filesystem as invalid files, since every
+	//field is zero that is just zeroing the whole inode table, every group's part of it
+	for group := 0; group < groupCount(sblock); group++ {
+		for inodeBlock := groupInodeTable(sblock, group); inodeBlock < groupDataStart(sblock, group); inodeBlock++ {
+			writeBlock(sblock, inodeBlock, nil)
+		}
 	}
 }
 
@@ -122,8 +236,9 @@ func createRootDir(sblock SuperBlock) {
 	rootFolder := INode{
 		IsValid:        true,
 		IsDirectory:    true,
+		LinksCount:     1, //just its own '.', the root's '..' is inode 0
 		Version:        0,
-		DirectBlock1:   DATA_BLOCK_START + 1, //since this happens before any other allocation, just grab block 40
+		DirectBlock1:   allocateNewBlock(sblock, 0), //since this happens before any other allocation, this is the first data block
 		DirectBlock2:   0,
 		DirectBlock3:   0,
 		IndirectBlock:  0,
@@ -131,29 +246,34 @@ func createRootDir(sblock SuperBlock) {
 		LastModifyTime: time.Now().Unix(),
 	}
 	//now we need to mark the root inode as used
-	inodeBitmap := ReadINodeBitmap(sblock)
-	inodeBitmap[sblock.RootDirInode] = true //claim the inode for the root folder
-	writeInodeBitmapToDisk(inodeBitmap, sblock)
-	//and let's claim that direct block 40
-	freeBlockBitmap := ReadFreeBlockBitmap(sblock)
-	freeBlockBitmap[0][rootFolder.DirectBlock1] = true
-	writeFreeBlockBitmapToDisk(freeBlockBitmap, sblock)
-	rootBlock, _ := CreateDirectoryFile(0, sblock.RootDirInode)
-	rootBlockBytes := EncodeToBytes(rootBlock)
-	copy(Disk[rootFolder.DirectBlock1][:], rootBlockBytes)
-	rootFolderAsBytes := EncodeToBytes(rootFolder)
-	copy(Disk[sblock.INodeStart][INODE_SIZE*sblock.RootDirInode:INODE_SIZE*sblock.RootDirInode+INODE_SIZE], rootFolderAsBytes)
+	ReadINodeBitmap(sblock).Set(sblock.RootDirInode) //claim the inode for the root folder
+	rootBlock, _ := createDirectoryFile(0, sblock.RootDirInode)
+	writeBlock(sblock, rootFolder.DirectBlock1, EncodeToBytes(rootBlock))
+	writeInodeToDisk(&rootFolder, sblock.RootDirInode, sblock)
 	RootFolder = rootFolder
 }
 
-func CreateDirectoryFile(parentInode int, folderinode int) (retBlock DirectoryBlock, currentInode INode) {
+func CreateDirectoryFile(parentInode int, folderinode int) (DirectoryBlock, INode) {
+	defer lockShared()()
+	beginOperation()
+	defer endOperation()
+	defer lockInodes([]int{parentInode, folderinode}, nil)()
+	return createDirectoryFile(parentInode, folderinode)
+}
+
+func createDirectoryFile(parentInode int, folderinode int) (retBlock DirectoryBlock, currentInode INode) {
+	beginTransaction()
+	defer commitTransaction()
+	sblock := ReadSuperBlock()
 	if parentInode != 0 { //handle root directory specially, for all others, mark as folder now
 		currentInode = getInodeFromDisk(folderinode) //we need to mark this as a folder now
 		currentInode.IsDirectory = true
 		if !currentInode.IsValid {
 			currentInode.IsValid = true
 		}
-		writeInodeToDisk(&currentInode, folderinode, ReadSuperBlock())
+		currentInode.LinksCount++ //for the '.' entry
+		writeInodeToDisk(&currentInode, folderinode, sblock)
+		adjustLinks(sblock, parentInode, 1) //and the parent gets one for '..'
 	}
 	dot := DirectoryEntry{
 		Inode: folderinode,
@@ -164,155 +284,192 @@ func CreateDirectoryFile(parentInode int, folderinode int) (retBlock DirectoryBl
 	}
 	dotdot.Name[0] = '.'
 	dotdot.Name[1] = '.'
-	return DirectoryBlock{dot, dotdot}, currentInode
+	retBlock = make(DirectoryBlock, sblock.BlockSize/DIRECTORY_ENTRY_SIZE)
+	retBlock[0] = dot
+	retBlock[1] = dotdot
+	if parentInode != 0 {
+		if currentInode.DirectBlock1 == 0 {
+			//directories get spread over the block groups, and their files follow them (see BlockGroup.go).
+			//The inode itself was made by Open before anyone knew it would be a directory, so that stays
+			//next to its parent
+			currentInode.DirectBlock1 = allocateNewBlock(sblock, directoryGoal(sblock))
+		}
+		//write the block here as well so the directory is never without one, even if we crash
+		//before the caller gets around to writing it
+		writeBlock(sblock, getFileBlock(sblock, &currentInode, folderinode, 0), EncodeToBytes(retBlock))
+		writeInodeToDisk(&currentInode, folderinode, sblock)
+		syncBitmaps()
+	}
+	return retBlock, currentInode
 }
 
-func writeFreeBlockBitmapToDisk(bitmap [][BLOCK_SIZE]bool, sblock SuperBlock) {
-	for loc, bitmapPart := range bitmap {
-		for blockLoc, bit := range bitmapPart {
-			if bit {
-				Disk[loc+sblock.FreeBlockStart][blockLoc] = 1
-			} else {
-				Disk[loc+sblock.FreeBlockStart][blockLoc] = 0
-			}
+func ReadSuperBlock() SuperBlock {
+	transactionLock.Lock()
+	defer transactionLock.Unlock()
+	return readSuperBlockLocked()
+}
+
+// readSuperBlockLocked is ReadSuperBlock for when we already hold transactionLock
+func readSuperBlockLocked() SuperBlock {
+	if Disk == nil {
+		log.Fatal("There is no file system mounted")
+	}
+	if cow != nil && cow.snapshot != nil {
+		return *cow.snapshot //a mounted snapshot has its own superblock
+	}
+	if runningTransaction != nil {
+		//every copy of the superblock is at the start of its own block
+		if block := runningTransaction.lookup(int(superBlockOffset / int64(runningTransaction.sblock.BlockSize))); block != nil {
+			return decodeSuperBlock(block)
 		}
 	}
+	return cache.readSuperBlock(int(superBlockOffset / int64(cache.blockSize)))
 }
 
-func ReadFreeBlockBitmap(sblock SuperBlock) [][BLOCK_SIZE]bool {
-	//I decided to cheese this just a little to make life a little easier see below to do it right
-	freeBlockBitmap := make([][BLOCK_SIZE]bool, sblock.INodeStart-sblock.FreeBlockStart)
+// writeSuperBlock writes the primary superblock and every backup copy so they never drift apart
+func writeSuperBlock(sblock SuperBlock) {
+	superblockBytes := EncodeToBytes(sblock)
+	writeBlock(sblock, 0, superblockBytes) //block 0 is nothing but the superblock
+	for _, backup := range superBlockBackups(sblock) {
+		writeBlock(sblock, backup, superblockBytes)
+	}
+	transactionLock.Lock()
+	superBlockOffset = 0 //the primary is good again now
+	transactionLock.Unlock()
+}
 
-	for bitmapBlockNum := sblock.FreeBlockStart; bitmapBlockNum < sblock.INodeStart; bitmapBlockNum++ {
-		for bitLoc := 0; bitLoc < BLOCK_SIZE; bitLoc++ {
-			if Disk[bitmapBlockNum][bitLoc] != 0 {
-				freeBlockBitmap[bitmapBlockNum-sblock.FreeBlockStart][bitLoc] = true
-			} else {
-				freeBlockBitmap[bitmapBlockNum-sblock.FreeBlockStart][bitLoc] = false
-			}
-		}
+// superBlockNum is the block holding the copy of the superblock we are using
+func superBlockNum(sblock SuperBlock) int {
+	transactionLock.Lock()
+	defer transactionLock.Unlock()
+	return int(superBlockOffset / int64(sblock.BlockSize))
+}
+
+// entryName is the name in a directory entry as a string, without the zero padding
+func entryName(entry DirectoryEntry) string {
+	nameLength := 0
+	for nameLength < len(entry.Name) && entry.Name[nameLength] != 0 {
+		nameLength++
 	}
-	return freeBlockBitmap
+	return string(entry.Name[:nameLength])
 }
 
-//this is my original - do it right version.
-//func ReadFreeBlockBitmap(sblock SuperBlock) []bool {
-//	freeBlockBitmap := make([]bool, BLOCK_SIZE)
-//	for bitmapBlock := sblock.FreeBlockStart; bitmapBlock < sblock.INodeStart; bitmapBlock++ {
-//		freeBlockBitmapPart := make([]bool, BLOCK_SIZE)
-//		err := json.Unmarshal(Disk[bitmapBlock][:], &freeBlockBitmapPart)
-//		if err != nil {
-//			log.Fatal(err)
-//		}
-//		freeBlockBitmap = append(freeBlockBitmap, freeBlockBitmapPart...)
-//	}
-//	return freeBlockBitmap
-//}
+// entryIsUsed is false for empty slots - the root's '..' entry has inode 0 but is still used
+func entryIsUsed(entry DirectoryEntry) bool {
+	return entry.Inode != 0 || entry.Name[0] != 0
+}
 
-func writeInodeBitmapToDisk(bitmap [NUM_INODES]bool, sblock SuperBlock) {
-	//I ended up having to copy bit by bit (bool by bool) there was no scope for being lazy
-	for loc, bit := range bitmap {
-		if bit {
-			Disk[sblock.InodeBitmapStart][loc] = 1
-		} else {
-			Disk[sblock.InodeBitmapStart][loc] = 0
-		}
+// validName says why name can't go in a directory: it is empty, or longer than an entry has room for.
+// Cutting it short instead would leave an entry nothing could look up, and a second one made by the
+// next try
+func validName(name string) error {
+	if name == "" {
+		return fmt.Errorf("a name can't be empty")
 	}
+	if len(name) > MAX_NAME_LENGTH {
+		return fmt.Errorf("%q is %d bytes, a name can have at most %d", name, len(name), MAX_NAME_LENGTH)
+	}
+	return nil
 }
 
-func ReadINodeBitmap(block SuperBlock) [NUM_INODES]bool {
-	var iNodeBitmap [NUM_INODES]bool
-	bitMapOnDisk := Disk[block.InodeBitmapStart]
-	for bitNum := 0; bitNum < NUM_INODES; bitNum++ {
-		iNodeBitmap[bitNum] = bitMapOnDisk[bitNum] != 0 //if the byte is zero, bit is false, non-zero is true
+// newDirectoryEntry makes an entry for name, which validName has passed
+func newDirectoryEntry(name string, inodeNum int) DirectoryEntry {
+	entry := DirectoryEntry{
+		Inode: inodeNum,
+	}
+	for num, char := range []byte(name) {
+		if num >= len(entry.Name) {
+			break
+		}
+		entry.Name[num] = char
 	}
-	return iNodeBitmap
+	return entry
 }
 
-func ReadSuperBlock() SuperBlock {
-	sBlock := SuperBlock{}
-	decoder := gob.NewDecoder(bytes.NewReader(Disk[0][:]))
-	err := decoder.Decode(&sBlock)
-	if err != nil {
-		log.Fatal("Unable to Decode superblock - better blue Screen ", err)
+// addDirectoryEntry links an existing inode into dir as name, false if dir is full
+func addDirectoryEntry(sblock SuperBlock, dir INode, name string, inodeNum int) bool {
+	dir, dirNum := currentDirectory(dir)
+	if !addEntry(sblock, &dir, dirNum, name, inodeNum) {
+		return false
 	}
-	return sBlock
+	adjustLinks(sblock, inodeNum, 1)
+	return true
 }
 
-// from https://gist.github.com/SteveBate/042960baa7a4795c3565
-func EncodeToBytes(p interface{}) []byte {
+// adjustLinks changes the link count of an inode on disk, the caller has the inode locked
+func adjustLinks(sblock SuperBlock, inodeNum int, change int) {
+	inode := getInodeFromDisk(inodeNum)
+	inode.LinksCount += change
+	writeInodeToDisk(&inode, inodeNum, sblock)
+}
 
-	buf := bytes.Buffer{}
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(p)
-	if err != nil {
-		log.Fatal(err)
+// Open return values are first INodeStructure and second INode Number. The number is 0 if name isn't
+// there and, for CREATE, if name isn't one a directory can hold (see validName)
+func Open(mode int, name string, parentDir INode) (INode, int) {
+	defer lockShared()()
+	if mode == CREATE {
+		beginOperation()
+		defer endOperation()
+		defer lockInodes([]int{directoryNum(parentDir)}, nil)()
+	} else {
+		defer lockInodes(nil, []int{directoryNum(parentDir)})()
+	}
+	file, inodeNum := openFile(mode, name, parentDir)
+	if inodeNum != 0 && hasDelayedWrite(inodeNum) {
+		file.delayed = inodeNum
 	}
-	return buf.Bytes()
+	return file, inodeNum
 }
 
-// Open return values are first INodeStructure and second INode Number
-func Open(mode int, name string, parentDir INode) (INode, int) {
+func openFile(mode int, name string, parentDir INode) (INode, int) {
 	if !parentDir.IsDirectory || !parentDir.IsValid {
 		log.Fatal("Tried to open file with invalid directory")
 	}
-	BlockWhereWeFindDirectoryEntry := parentDir.DirectBlock1 //I'm going to cheat here and only check direct block one since we would need more than 30 files otherwise
-	DirectoryBlockBytes := Disk[BlockWhereWeFindDirectoryEntry]
-	directoryEntryBlock := DirectoryBlock{}
-	decoder := gob.NewDecoder(bytes.NewReader(DirectoryBlockBytes[:]))
-	err := decoder.Decode(&directoryEntryBlock)
-	if err != nil {
-		log.Fatal("Error decoding Directory block opening file ", name, ": ", err)
-	}
-	validDirectoryEntries := 0
-	for _, entry := range directoryEntryBlock {
-		//not really distinguishing read vs write here.
-		if string(entry.Name[:len(name)]) == name {
-			return getInodeFromDisk(entry.Inode), entry.Inode //if file is here, I'll just return it and the Inode Number for now
-		}
-		if entry.Inode == 0 && entry.Name[0] != '.' && entry.Name[1] != '.' { //once we get to invalid entries, get out of loop
-			break
-		}
-		validDirectoryEntries++
+	if validName(name) != nil {
+		return INode{}, 0 //it can't be there and can't be made
+	}
+	beginTransaction()
+	defer commitTransaction()
+	sblock := ReadSuperBlock()
+	//the caller's copy might be from before the directory got indexed or grew (see DirIndex.go)
+	parentDir, parentNum := currentDirectory(parentDir)
+	//not really distinguishing read vs write here.
+	if inodeNum := findEntry(sblock, parentDir, name); inodeNum != 0 {
+		return getInodeFromDisk(inodeNum), inodeNum //if file is here, I'll just return it and the Inode Number for now
 	}
 	//if we got here then the file wasn't in the directory
 	if mode == CREATE {
-		newInode, newInodeNum := createNewInode(ReadSuperBlock())
-		newFile := DirectoryEntry{
-			Inode: newInodeNum,
+		if !hasRoomFor(sblock, parentDir, name) {
+			log.Fatal("Directory is full, can't create ", name)
 		}
-		for num, char := range name {
-			if num >= 20 {
-				break
-			}
-			newFile.Name[num] = byte(char)
+		newInode, newInodeNum := createNewInode(sblock, parentDir.DirectBlock1)
+		if !addEntry(sblock, &parentDir, parentNum, name, newInodeNum) {
+			log.Fatal("Directory is full, can't create ", name)
 		}
-		directoryEntryBlock[validDirectoryEntries] = newFile
-		//write the directory entry back to the disk block
-		currentDirectoryBlockBytes := EncodeToBytes(directoryEntryBlock)
-		copy(Disk[parentDir.DirectBlock1][:], currentDirectoryBlockBytes)
+		syncBitmaps()
 		return newInode, newInodeNum
 	}
 	return INode{}, 0 //if we got here, return invalid/0 inode
 }
 
-// return value will be the INode data structure, and the Inode Number
-func createNewInode(sBlock SuperBlock) (INode, int) {
-	inodeBitmap := ReadINodeBitmap(sBlock)
-	freeInodeLoc := sBlock.RootDirInode               //we will begin looking for a free inode starting with the root node
-	for ; freeInodeLoc < NUM_INODES; freeInodeLoc++ { //there are only 25 possible inodes
-		if inodeBitmap[freeInodeLoc] == false { //once we find an unused one stop
-			inodeBitmap[freeInodeLoc] = true
-			break
-		}
+// return value will be the INode data structure, and the Inode Number. The inode goes in the block
+// group of block near if there is room there, 0 for no preference
+func createNewInode(sBlock SuperBlock, near int) (INode, int) {
+	//we will begin looking for a free inode at the start of the group, syncBitmaps will write the claim back
+	freeInodeLoc := ReadINodeBitmap(sBlock).claim(groupFirstInode(sBlock, groupOfBlock(sBlock, near)), 0)
+	if freeInodeLoc < 0 {
+		freeInodeLoc = ReadINodeBitmap(sBlock).claim(sBlock.RootDirInode, 0) //the groups after it are full, go round
+	}
+	for freeInodeLoc < 0 && growInodeTable(near) {
+		freeInodeLoc = ReadINodeBitmap(sBlock).claim(sBlock.RootDirInode, 0) //only the new chunk has any free
 	}
-	if freeInodeLoc >= 511 {
-		log.Fatal("All out of Inodes") //in a real file system I would return the 0/invalid inode
+	if freeInodeLoc < 0 {
+		log.Fatal("All out of Inodes") //the inode table can't grow any more either
 	}
-	writeInodeBitmapToDisk(inodeBitmap, sBlock) //let's write it back with our new inode claimed
 	newInode := INode{
 		IsValid:        true,
 		IsDirectory:    false,
+		LinksCount:     1, //Open puts it in a directory straight away
 		Version:        0,
 		DirectBlock1:   0,
 		DirectBlock2:   0,
@@ -325,219 +482,467 @@ func createNewInode(sBlock SuperBlock) (INode, int) {
 	return newInode, freeInodeLoc
 }
 
+// inodeLocation is the block holding an inode and the byte offset of the inode in that block
+func inodeLocation(sblock SuperBlock, inodeNum int) (int, int) {
+	if (inodeNum >= sblock.InodeCount || isInodeHole(sblock, inodeNum)) && dynamicInodesEnabled(sblock) {
+		sblock = ReadSuperBlock() //the table might have grown since the caller looked
+	}
+	if inodeNum < 0 || inodeNum >= sblock.InodeCount || isInodeHole(sblock, inodeNum) {
+		log.Fatal("Inode ", inodeNum, " is outside the inode table")
+	}
+	if inodeChunk(sblock, inodeNum) >= 0 {
+		return chunkInodeLocation(sblock, inodeNum)
+	}
+	inodesPerBlock := sblock.BlockSize / sblock.InodeSize
+	group := groupOfInode(sblock, inodeNum)
+	index := inodeNum - groupInodeBase(sblock, group)
+	return groupInodeTable(sblock, group) + index/inodesPerBlock, index % inodesPerBlock * sblock.InodeSize
+}
+
 func writeInodeToDisk(inode *INode, InodeNum int, sblock SuperBlock) {
-	InodeAsBytes := EncodeToBytes(inode)
-	InodeBlock := InodeNum / (BLOCK_SIZE / INODE_SIZE) //once again this is floor integer division
-	InodeLocInBlock := InodeNum % (BLOCK_SIZE / INODE_SIZE)
-	copy(Disk[sblock.INodeStart+InodeBlock][INODE_SIZE*InodeLocInBlock:INODE_SIZE*InodeLocInBlock+INODE_SIZE], InodeAsBytes)
+	inodeTableLock.Lock() //the other inodes in the block can be changing too
+	defer inodeTableLock.Unlock()
+	InodeBlock, InodeOffset := inodeLocation(sblock, InodeNum)
+	blockBytes := readBlock(sblock, InodeBlock) //the other inodes in the block have to be kept
+	copy(blockBytes[InodeOffset:InodeOffset+sblock.InodeSize], EncodeToBytes(inode))
+	writeBlock(sblock, InodeBlock, blockBytes)
+	if inodes != nil {
+		inodes.set(InodeNum, *inode)
+	}
 }
 
+// getInodeFromDisk reads an inode, from the inode cache if it's there
 func getInodeFromDisk(inodeNum int) INode {
-	INodeBlock := inodeNum / (BLOCK_SIZE / INODE_SIZE) //there are 4 inodes per block, again int/floor division
-	InodeOffset := inodeNum % (BLOCK_SIZE / INODE_SIZE)
+	var generation uint64
+	if inodes != nil {
+		inode, ok, gen := inodes.lookup(inodeNum)
+		if ok {
+			return inode
+		}
+		generation = gen
+	}
 	sblock := ReadSuperBlock()
-	InodeFromDisk := INode{}
-	InodeAsBytes := Disk[sblock.INodeStart+INodeBlock][InodeOffset*INODE_SIZE : (InodeOffset*INODE_SIZE)+INODE_SIZE]
-	decoder := gob.NewDecoder(bytes.NewReader(InodeAsBytes))
-	err := decoder.Decode(&InodeFromDisk)
-	if err != nil {
-		log.Fatal("Error decoding Inode ", inodeNum, " from disk - better blue Screen", err)
+	if isInodeHole(sblock, inodeNum) {
+		return INode{} //nothing to cache either, a chunk made there later starts out invalid
 	}
-	return InodeFromDisk
+	INodeBlock, InodeOffset := inodeLocation(sblock, inodeNum)
+	inode := decodeInode(readBlock(sblock, INodeBlock)[InodeOffset : InodeOffset+sblock.InodeSize])
+	if inodes != nil {
+		inodes.add(inodeNum, inode, generation)
+	}
+	return inode
 }
 
 func Unlink(inodeNumToDelete int, parentDir INode) {
-	BlockWhereWeFindDirectoryEntry := parentDir.DirectBlock1 //I'm going to cheat here and only check direct block one since we would need more than 30 files otherwise
-	DirectoryBlockBytes := Disk[BlockWhereWeFindDirectoryEntry]
-	directoryEntryBlock := DirectoryBlock{}
-	decoder := gob.NewDecoder(bytes.NewReader(DirectoryBlockBytes[:]))
-	err := decoder.Decode(&directoryEntryBlock)
-	if err != nil {
-		log.Fatal("Error decoding Directory block: ", err)
-	}
-	validDirectoryEntries := 0
-	for _, entry := range directoryEntryBlock {
-		if entry.Inode == inodeNumToDelete {
-			directoryEntryBlock[validDirectoryEntries] = DirectoryEntry{} //put empty one here
-			inodeBitmap := ReadINodeBitmap(ReadSuperBlock())
-			inodeBitmap[entry.Inode] = false
-			writeInodeBitmapToDisk(inodeBitmap, ReadSuperBlock())
-			inodeStruct := getInodeFromDisk(entry.Inode)
-			inodeStruct.IsValid = false
-			writeInodeToDisk(&inodeStruct, entry.Inode, ReadSuperBlock())
-			//now write directory structure back out to disk
-			currentDirectoryBlockBytes := EncodeToBytes(directoryEntryBlock)
-			copy(Disk[parentDir.DirectBlock1][:], currentDirectoryBlockBytes)
+	defer lockShared()()
+	sblock := ReadSuperBlock()
+	locked := []int{directoryNum(parentDir), inodeNumToDelete}
+	if trashEnabled(sblock) {
+		locked = append(locked, sblock.TrashDir) //the trash directory lock covers the trash index as well
+		if !inTrash(sblock, parentDir) {
+			makeRoomInTrash(inodeNumToDelete)
+		}
+	}
+	beginOperation()
+	defer endOperation()
+	defer lockInodes(locked, nil)()
+	parentDir, _ = currentDirectory(parentDir)
+	//all we have is the inode number, so this has to look at every entry. UnlinkName doesn't
+	name := entryNameOf(sblock, parentDir, inodeNumToDelete)
+	if name == "" {
+		log.Fatal("Tried to delete file not in folder")
+	}
+	unlinkNamed(sblock, inodeNumToDelete, name, parentDir)
+}
+
+// UnlinkName is Unlink for the entry called name, which only has to look at the part of a big
+// directory's index the name is in
+func UnlinkName(name string, parentDir INode) error {
+	defer lockShared()()
+	if Disk == nil {
+		return fmt.Errorf("there is no file system mounted")
+	}
+	if readOnly {
+		return fmt.Errorf("file system is mounted read only")
+	}
+	if !parentDir.IsValid || !parentDir.IsDirectory {
+		return fmt.Errorf("parent isn't a directory")
+	}
+	if name == "." || name == ".." {
+		return fmt.Errorf("can't unlink %s", name)
+	}
+	sblock := ReadSuperBlock()
+	parentNum := directoryNum(parentDir)
+	//find it with just the directory locked, then lock it as well and make sure it is still there
+	for {
+		unlock := lockInodes(nil, []int{parentNum})
+		parentDir, _ = currentDirectory(parentDir)
+		inodeNum := findEntry(sblock, parentDir, name)
+		unlock()
+		if inodeNum == 0 {
+			return fmt.Errorf("%s doesn't exist", name)
+		}
+		locked := []int{parentNum, inodeNum}
+		if trashEnabled(sblock) {
+			locked = append(locked, sblock.TrashDir)
+			if !inTrash(sblock, parentDir) {
+				makeRoomInTrash(inodeNum)
+			}
+		}
+		beginOperation()
+		unlock = lockInodes(locked, nil)
+		parentDir, _ = currentDirectory(parentDir)
+		if findEntry(sblock, parentDir, name) == inodeNum {
+			defer endOperation()
+			defer unlock()
+			unlinkNamed(sblock, inodeNum, name, parentDir)
+			return nil
+		}
+		unlock()
+		endOperation()
+	}
+}
+
+// unlinkNamed is what Unlink and UnlinkName do once they have the entry and everything locked
+func unlinkNamed(sblock SuperBlock, inodeNumToDelete int, name string, parentDir INode) {
+	beginTransaction()
+	defer commitTransaction()
+	if trashEnabled(sblock) {
+		if inodeNumToDelete == sblock.TrashDir {
+			log.Fatal("The trash can't be deleted, turn it off with SetTrash(false)")
+		}
+		if !inTrash(sblock, parentDir) { //deleting from the trash itself is for real
+			moveToTrash(sblock, inodeNumToDelete, name, parentDir)
 			return
 		}
-		validDirectoryEntries++
 	}
-	//if we got here then we tried to delete a file not in this directory
-	log.Fatal("Tried to delete file not in folder")
+	unlinkEntry(sblock, inodeNumToDelete, name, parentDir)
+}
+
+// unlinkEntry is Unlink without the trash, for the entry called name
+func unlinkEntry(sblock SuperBlock, inodeNumToDelete int, name string, parentDir INode) {
+	parentDir, parentNum := currentDirectory(parentDir)
+	if findEntry(sblock, parentDir, name) != inodeNumToDelete {
+		//if we got here then we tried to delete a file not in this directory
+		log.Fatal("Tried to delete file not in folder")
+	}
+	inodeStruct := getInodeFromDisk(inodeNumToDelete)
+	inodeStruct.IsValid = false
+	inodeStruct.LinksCount = 0
+	if inodeStruct.IsDirectory {
+		adjustLinks(sblock, parentNum, -1) //its '..' pointed at us
+	}
+	dropDelayedWrite(inodeNumToDelete)
+	freeFileBlocks(sblock, &inodeStruct) //give the file's blocks back too, we used to leak them
+	freeVersions(sblock, inodeStruct.PrevVersion)
+	inodeStruct.PrevVersion = 0
+	writeInodeToDisk(&inodeStruct, inodeNumToDelete, sblock)
+	//only now, or someone could claim the inode and have it overwritten by the write above
+	ReadINodeBitmap(sblock).Clear(inodeNumToDelete)
+	//now take the entry out of the directory
+	removeEntry(sblock, parentDir, name)
+	syncBitmaps()
+}
+
+// fileBlocks returns the data blocks of a file in order, it stops at the first block that was never written
+func fileBlocks(sblock SuperBlock, file *INode) []int {
+	blocks := []int{}
+	for _, blockNum := range []int{file.DirectBlock1, file.DirectBlock2, file.DirectBlock3} {
+		if blockNum == 0 {
+			return blocks
+		}
+		blocks = append(blocks, blockNum)
+	}
+	if file.IndirectBlock == 0 {
+		return blocks
+	}
+	for _, blockNum := range decodeIndirectBlock(readBlock(sblock, file.IndirectBlock)) {
+		if blockNum == 0 {
+			break
+		}
+		blocks = append(blocks, blockNum)
+	}
+	return blocks
+}
+
+// maxFileBlocks is the most blocks a file can have - the three direct blocks plus one indirect block
+func maxFileBlocks(sblock SuperBlock) int {
+	return 3 + sblock.BlockSize/BLOCK_POINTER_SIZE
+}
+
+// getFileBlock returns the disk block that holds block number blockIndex of the file,
+// allocating it (and the indirect block if we need it) when it doesn't exist yet
+func getFileBlock(sblock SuperBlock, file *INode, inodeNum int, blockIndex int) int {
+	switch blockIndex {
+	case 0:
+		if file.DirectBlock1 == 0 {
+			file.DirectBlock1 = allocateNewBlock(sblock, fileBlockGoal(sblock, inodeNum, 0))
+		}
+		return file.DirectBlock1
+	case 1:
+		if file.DirectBlock2 == 0 {
+			file.DirectBlock2 = allocateNewBlock(sblock, fileBlockGoal(sblock, inodeNum, file.DirectBlock1))
+		}
+		return file.DirectBlock2
+	case 2:
+		if file.DirectBlock3 == 0 {
+			file.DirectBlock3 = allocateNewBlock(sblock, fileBlockGoal(sblock, inodeNum, file.DirectBlock2))
+		}
+		return file.DirectBlock3
+	}
+	//now things get more complicated, we need to go through the indirect block
+	if blockIndex >= maxFileBlocks(sblock) {
+		log.Fatal("File is too big, only ", maxFileBlocks(sblock), " blocks fit in an inode")
+	}
+	indirectBlockVal := getIndirectBlock(file)
+	if indirectBlockVal[blockIndex-3] == 0 {
+		prevBlock := file.DirectBlock3
+		if blockIndex > 3 {
+			prevBlock = indirectBlockVal[blockIndex-4]
+		}
+		indirectBlockVal[blockIndex-3] = allocateNewBlock(sblock, fileBlockGoal(sblock, inodeNum, prevBlock))
+		writeBlock(sblock, file.IndirectBlock, EncodeToBytes(indirectBlockVal))
+	}
+	return indirectBlockVal[blockIndex-3]
+}
+
+// placeFileBlocks makes sure blocks 0 to count-1 of the file are there and its own to write, and
+// returns them. Every block it is missing, or shares with a clone or an old version, gets allocated in
+// one allocateBlocks call, so a big Write gets a run of blocks instead of whatever allocateNewBlock
+// would have found for each block as it went. A new indirect block goes in front of the data blocks,
+// and keep is how many free blocks have to be left alone (see keptBlocks)
+func placeFileBlocks(sblock SuperBlock, file *INode, inodeNum int, count int, keep int) []int {
+	if count > maxFileBlocks(sblock) {
+		log.Fatal("File is too big, only ", maxFileBlocks(sblock), " blocks fit in an inode")
+	}
+	pointers := make([]int, max(count, 3))
+	pointers[0], pointers[1], pointers[2] = file.DirectBlock1, file.DirectBlock2, file.DirectBlock3
+	var indirect IndirectBlock
+	if count > 3 && file.IndirectBlock != 0 {
+		indirect = decodeIndirectBlock(readBlock(sblock, file.IndirectBlock))
+		copy(pointers[3:], indirect)
+	}
+	needed := []int{}
+	for blockIndex := 0; blockIndex < count; blockIndex++ {
+		if pointers[blockIndex] == 0 || blockShared(sblock, pointers[blockIndex]) {
+			needed = append(needed, blockIndex)
+		}
+	}
+	newIndirect := count > 3 && file.IndirectBlock == 0
+	if len(needed) > 0 || newIndirect {
+		prevBlock := 0
+		if len(needed) > 0 && needed[0] > 0 {
+			prevBlock = pointers[needed[0]-1]
+		}
+		total := len(needed)
+		if newIndirect {
+			total++
+		}
+		newBlocks := allocateBlocks(sblock, fileBlockGoal(sblock, inodeNum, prevBlock), total, keep)
+		if newIndirect {
+			file.IndirectBlock = newBlocks[0]
+			indirect = make(IndirectBlock, sblock.BlockSize/BLOCK_POINTER_SIZE)
+			newBlocks = newBlocks[1:]
+		}
+		for num, blockIndex := range needed {
+			if pointers[blockIndex] != 0 {
+				releaseBlock(sblock, pointers[blockIndex]) //a clone is still using it, it just loses us
+			}
+			pointers[blockIndex] = newBlocks[num]
+		}
+		file.DirectBlock1, file.DirectBlock2, file.DirectBlock3 = pointers[0], pointers[1], pointers[2]
+		if count > 3 && (newIndirect || needed[len(needed)-1] >= 3) {
+			copy(indirect, pointers[3:count])
+			writeBlock(sblock, file.IndirectBlock, EncodeToBytes(indirect))
+		}
+	}
+	return pointers[:count]
 }
 
 func Read(file *INode) string { //I told some of you who asked that you can assume all text files, so I'll return a string
+	defer lockShared()()
+	return readFile(file)
+}
+
+func readFile(file *INode) string {
 	if !file.IsValid || file.IsDirectory {
 		return "" //maybe we should error, but I'll just return nothing
 	}
+	sblock := ReadSuperBlock()
 	//I'm going to use string.Builder - which I didn't introduce in your class, but you can use + and it will be less efficient but will work
 	fileContents := strings.Builder{}
-	firstBlock := Disk[file.DirectBlock1]
-	fileContents.Write(firstBlock[:])
-	if file.DirectBlock2 == 0 {
-		return fileContents.String()
-	}
-	secondBlock := Disk[file.DirectBlock2]
-	fileContents.Write(secondBlock[:])
-	if file.DirectBlock3 == 0 {
-		return fileContents.String()
-	}
-	thirdBlock := Disk[file.DirectBlock3]
-	fileContents.Write(thirdBlock[:])
-	if file.IndirectBlock == 0 {
-		return fileContents.String()
-	}
-	//now things get more complicated, we need to read from the indirect block
-	indirectBlockVal := getIndirectBlock(file)
-	for _, blockNum := range indirectBlockVal {
-		if blockNum == 0 {
-			break
-		} else {
-			fileContents.Write(Disk[blockNum][:])
+	blocks := fileBlocks(sblock, file)
+	if file.delayed != 0 {
+		//the copy's blocks are from before the delayed write, which might have its own by now
+		onDisk := getInodeFromDisk(file.delayed)
+		blocks = fileBlocks(sblock, &onDisk)
+		if content, ok := delayedContent(file.delayed); ok {
+			//padded out to whole blocks, and the blocks past the end of it stay, like they would on Disk
+			count := (len(content) + sblock.BlockSize - 1) / sblock.BlockSize
+			fileContents.Write(content)
+			fileContents.Write(make([]byte, count*sblock.BlockSize-len(content)))
+			blocks = blocks[min(count, len(blocks)):]
 		}
 	}
+	for _, blockNum := range blocks {
+		fileContents.Write(readBlock(sblock, blockNum))
+	}
 	return fileContents.String()
 }
 
-func Write(file *INode, inodeNum int, content []byte) {
-	file.LastModifyTime = time.Now().Unix() //update last modify time
-	numCompleteBlocks := len(content) / BLOCK_SIZE
-	hasLeftovers := len(content)%BLOCK_SIZE > 0
-	block := 0
-	for ; block < numCompleteBlocks; block++ {
-		if block == 0 {
-			if file.DirectBlock1 == 0 {
-				file.DirectBlock1 = allocateNewBlock(ReadSuperBlock())
-			}
-			blockEnd := BLOCK_SIZE * (block + 1)
-			if blockEnd > len(content) {
-				blockEnd = len(content)
-			}
-			copy(Disk[file.DirectBlock1][:], content[BLOCK_SIZE*block:blockEnd])
-		} else if block == 1 {
-			if file.DirectBlock2 == 0 {
-				file.DirectBlock2 = allocateNewBlock(ReadSuperBlock())
-			}
-			blockEnd := BLOCK_SIZE * (block + 1)
-			if blockEnd > len(content) {
-				blockEnd = len(content)
-			}
-			copy(Disk[file.DirectBlock2][:], content[BLOCK_SIZE*block:blockEnd])
-		} else if block == 2 {
-			if file.DirectBlock3 == 0 {
-				file.DirectBlock3 = allocateNewBlock(ReadSuperBlock())
-			}
-			blockEnd := BLOCK_SIZE * (block + 1)
-			if blockEnd > len(content) {
-				blockEnd = len(content)
-			}
-			copy(Disk[file.DirectBlock3][:], content[BLOCK_SIZE*block:blockEnd])
-		} else {
-			indirectBlockVal := getIndirectBlock(file)
-			for indirectBlockNum, blockLoc := range indirectBlockVal {
-				blockEnd := BLOCK_SIZE * (block + 1)
-				if blockEnd > len(content) {
-					blockEnd = len(content)
-				}
-				if blockLoc != 0 {
-					copy(Disk[blockLoc][:], content[BLOCK_SIZE*block:BLOCK_SIZE*(block+1)])
-					block++
-					if block >= numCompleteBlocks {
-						break
-					}
-				} else { //at this point we are appending to the file, we need to allocate blocks that we write to
-					newBlock := allocateNewBlock(ReadSuperBlock())
-					indirectBlockVal[indirectBlockNum] = newBlock
-					//write the actual data to disk
-					copy(Disk[newBlock][:], content[BLOCK_SIZE*block:blockEnd])
-					block++
-				}
-			}
-			//if we wrote anything to indirect blocks, then write the indirect block block again just incase
-			indirectBlockBytes := EncodeToBytes(indirectBlockVal)
-			//write the indirect block to disk
-			copy(Disk[file.IndirectBlock][:], indirectBlockBytes)
+// ErrNoSpace is what a write gets when there is nowhere to put what it wrote, nothing has changed
+var ErrNoSpace = errors.New("no space left on the file system")
+
+// Write replaces the file's contents with content. It returns ErrNoSpace if they don't fit. The blocks
+// usually aren't picked until later (see DelayedAlloc.go)
+func Write(file *INode, inodeNum int, content []byte) error {
+	defer lockShared()()
+	if readOnly {
+		return fmt.Errorf("file system is mounted read only")
+	}
+	blockSize := ReadSuperBlock().BlockSize
+	blockCount := (len(content) + blockSize - 1) / blockSize
+	purgeTrashForSpace(blockCount) //what's in the trash goes before anything else has to give
+	//and the writes waiting longest make room if this one has to wait
+	if err := evictDelayedWrites(inodeNum, blockCount); err != nil {
+		return err
+	}
+	beginOperation()
+	defer endOperation()
+	defer lockInodes([]int{inodeNum}, nil)()
+	if delayed, err := delayWrite(ReadSuperBlock(), file, inodeNum, content); delayed {
+		return err
+	}
+	return writeFile(file, inodeNum, content, nil)
+}
+
+// writeFile is Write once the inode is locked, or for pending the delayed write getting its blocks
+func writeFile(file *INode, inodeNum int, content []byte, pending *delayedWrite) error {
+	beginTransaction()
+	defer commitTransaction()
+	sblock := ReadSuperBlock()
+	//with copy on write every block written, and the indirect block pointing at them, needs a new
+	//home in the pool before the commit can let the old ones go
+	blockCount := (len(content) + sblock.BlockSize - 1) / sblock.BlockSize
+	if err := reserveCowBlocks(blockCount + 1); err != nil {
+		return err
+	}
+	held, keep, writes, modified := 0, keptBlocks(sblock), 1, time.Now().Unix()
+	if pending != nil {
+		//the delayed write reserved its blocks when it was written, as whoever wrote it
+		held, keep, writes, modified = pending.reserved, snapshotHeldBlocks(), pending.writes, pending.modified
+	}
+	extra := max(blocksNeeded(sblock, getInodeFromDisk(inodeNum), blockCount)-held, 0)
+	if err := reserveBlocks(sblock, extra); err != nil {
+		return err //a delayed write keeps what it had reserved, it is still waiting
+	}
+	defer unreserveBlocks(held + extra) //they are allocated by the time we are done
+	//start from what is on Disk, not the caller's copy - someone else may have written the file since
+	//the caller read it, and the blocks in an old copy could belong to an old version or nobody by now
+	onDisk := getInodeFromDisk(inodeNum)
+	*file = onDisk
+	file.LastModifyTime = modified
+	file.Version = onDisk.Version + writes
+	if sblock.VersionsKept > 0 && onDisk.DirectBlock1 != 0 {
+		file.PrevVersion = saveVersion(sblock, &onDisk) //what is on Disk now becomes the previous version
+	}
+	//we have all of the data before any of it goes anywhere, so the blocks get allocated in one go
+	blocks := placeFileBlocks(sblock, file, inodeNum, blockCount, keep)
+	for block, blockNum := range blocks {
+		blockEnd := sblock.BlockSize * (block + 1)
+		if blockEnd > len(content) {
+			blockEnd = len(content) //the last block might only be partly full, writeBlock zeros the rest
 		}
+		writeDataBlock(sblock, blockNum, content[sblock.BlockSize*block:blockEnd])
 	}
-	if hasLeftovers {
-		leftovers := content[(len(content)/BLOCK_SIZE)*block:]
-		if numCompleteBlocks == 0 {
-			if file.DirectBlock1 == 0 {
-				file.DirectBlock1 = allocateNewBlock(ReadSuperBlock())
-			}
-			copy(Disk[file.DirectBlock1][:], leftovers)
-		} else if numCompleteBlocks == 1 {
-			copy(Disk[file.DirectBlock2][:], leftovers)
-		} else if numCompleteBlocks == 2 {
-			copy(Disk[file.DirectBlock3][:], leftovers)
-		} else {
-			indirectBlockVal := getIndirectBlock(file)
-			finalBlockLoc := indirectBlockVal[numCompleteBlocks-3] //minus 3 for the three direct blocks
-			if finalBlockLoc != 0 {
-				copy(Disk[finalBlockLoc][:], leftovers)
-			} else {
-				newBlock := allocateNewBlock(ReadSuperBlock())
-				indirectBlockVal[numCompleteBlocks-3] = newBlock
-				indirectBlockBytes := EncodeToBytes(indirectBlockVal)
-				//write the indirect block to disk
-				copy(Disk[file.IndirectBlock][:], indirectBlockBytes)
-				//write the actual data to disk
-				copy(Disk[newBlock][:], leftovers)
-			}
+	pruneVersions(sblock, file)
+	writeInodeToDisk(file, inodeNum, sblock)
+	syncBitmaps()
+	return nil
+}
+
+// blocksNeeded is how many blocks writing count blocks over file will allocate: the ones it doesn't
+// have yet or shares with a clone, a new indirect block, and with versions kept a new copy of every
+// block it has plus an indirect block for the old version
+func blocksNeeded(sblock SuperBlock, file INode, count int) int {
+	blocks := fileBlocks(sblock, &file)
+	versioned := sblock.VersionsKept > 0 && file.DirectBlock1 != 0
+	needed := 0
+	for blockIndex := 0; blockIndex < count; blockIndex++ {
+		if blockIndex >= len(blocks) || versioned || blockShared(sblock, blocks[blockIndex]) {
+			needed++
 		}
 	}
-	writeInodeToDisk(file, inodeNum, ReadSuperBlock())
+	if count > 3 && file.IndirectBlock == 0 {
+		needed++
+	}
+	if versioned && file.IndirectBlock != 0 {
+		needed++
+	}
+	return needed
 }
 
-// returns location of newly allocated block
-func allocateNewBlock(sblock SuperBlock) int {
+// returns location of newly allocated block, in the same block group as goal if there is room there
+// (0 means anywhere will do)
+func allocateNewBlock(sblock SuperBlock, goal int) int {
+	return allocateBlocks(sblock, goal, 1, keptBlocks(sblock))[0]
+}
+
+// allocateBlocks is allocateNewBlock for count blocks at once, leaving keep free blocks alone. It asks
+// the allocator for runs, so the blocks come back in as few runs as there is free space for, in order
+func allocateBlocks(sblock SuperBlock, goal int, count int, keep int) []int {
 	freeBlockBitmap := ReadFreeBlockBitmap(sblock)
-	blockNum := RootFolder.DirectBlock1 //lets start after the first direct block
-	for bitblock, bitmapBlock := range freeBlockBitmap {
-		for locInBlock, bit := range bitmapBlock {
-			if bitblock == 0 && locInBlock <= blockNum {
-				continue //skip till we get to one in a valid area
-			}
-			if !bit {
-				//this bit is available
-				freeBlockBitmap[bitblock][locInBlock] = true
-				writeFreeBlockBitmapToDisk(freeBlockBitmap, sblock)
-				return locInBlock
-			} else {
+	//the metadata blocks are marked as used, so the allocator only has to look from the start of the
+	//goal's data blocks, and if everything from there on is full from the start of the data blocks
+	start := allocationStart(sblock, goal)
+	blocks := make([]int, 0, count)
+	for len(blocks) < count {
+		first, length := freeBlockBitmap.allocateRun(blockAllocator, start, count-len(blocks), keep)
+		if length == 0 && start > sblock.DataBlockStart {
+			start = sblock.DataBlockStart
+			continue
+		}
+		if length == 0 && freeBlockBitmap.CountFree() > 0 {
+			log.Fatal("Unable to allocate a free block, the rest are reserved for uid ", sblock.ReservedUID, " or held by snapshots")
+		}
+		if length == 0 {
+			log.Fatal("Unable to allocate a free block")
+		}
+		for blockNum := first; blockNum < first+length; blockNum++ {
+			blocks = append(blocks, blockNum)
+		}
+		start = allocationStart(sblock, first+length) //the next run goes after this one if it can
+	}
+	return blocks
+}
 
+// freeFileBlocks gives every block the file owns back to the free block bitmap and clears its pointers.
+// Blocks shared with a clone just lose a reference
+func freeFileBlocks(sblock SuperBlock, file *INode) {
+	for _, blockNum := range []int{file.DirectBlock1, file.DirectBlock2, file.DirectBlock3} {
+		if blockNum != 0 {
+			releaseBlock(sblock, blockNum)
+		}
+	}
+	if file.IndirectBlock != 0 {
+		for _, blockNum := range decodeIndirectBlock(readBlock(sblock, file.IndirectBlock)) {
+			if blockNum != 0 {
+				releaseBlock(sblock, blockNum)
 			}
 		}
+		freeDataBlock(sblock, file.IndirectBlock)
 	}
-	log.Fatal("Unable to allocate a free block")
-	return 0
+	file.DirectBlock1, file.DirectBlock2, file.DirectBlock3, file.IndirectBlock = 0, 0, 0, 0
 }
 
 func getIndirectBlock(file *INode) IndirectBlock {
+	sblock := ReadSuperBlock()
 	if file.IndirectBlock == 0 {
-		file.IndirectBlock = allocateNewBlock(ReadSuperBlock())
-		return IndirectBlock{}
+		file.IndirectBlock = allocateNewBlock(sblock, file.DirectBlock3) //it goes with the file's other blocks
+		indirectBlockVal := make(IndirectBlock, sblock.BlockSize/BLOCK_POINTER_SIZE)
+		writeBlock(sblock, file.IndirectBlock, EncodeToBytes(indirectBlockVal)) //the block might have old pointers in it
+		return indirectBlockVal
 	}
 	//now we need to do the indirect blocks
-	indirectBlockBytes := getIndirectBlockFromDisk(file.IndirectBlock)
-	indirectBlockVal := IndirectBlock{}
-	decoder := gob.NewDecoder(bytes.NewReader(indirectBlockBytes[:]))
-	err := decoder.Decode(&indirectBlockVal)
-	if err != nil { //the better blue screen came from jetbrains AI
-		log.Fatal("Error decoding IndirectBlock from disk - better blue Screen", err)
-	}
-	return indirectBlockVal
-}
-
-func getIndirectBlockFromDisk(indirectBlockNum int) [1024]byte {
-	return Disk[indirectBlockNum]
+	return decodeIndirectBlock(readBlock(sblock, file.IndirectBlock))
 }
@@ -0,0 +1,100 @@
+package FileSystem
+
+import (
+	"strings"
+	"testing"
+)
+
+// newTestFileSystem formats a MemDevice of size bytes and mounts it
+func newTestFileSystem(t *testing.T, size int64, options Options) *MemDevice {
+	t.Helper()
+	device := NewMemDevice(size)
+	if err := Format(device, options); err != nil {
+		t.Fatalf("Format: %v", err)
+	}
+	if err := Mount(device); err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	return device
+}
+
+// formattedImage is the bytes of a freshly formatted device of size bytes
+func formattedImage(t *testing.T, size int64, options Options) []byte {
+	t.Helper()
+	device := NewMemDevice(size)
+	if err := Format(device, options); err != nil {
+		t.Fatalf("Format: %v", err)
+	}
+	return device.data
+}
+
+// remount writes everything back and mounts device again, so whatever comes next reads it from the device
+func remount(t *testing.T, device BlockDevice) {
+	t.Helper()
+	if err := Sync(); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	if err := Mount(device); err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+}
+
+// checkFsck fails the test if Fsck finds anything wrong
+func checkFsck(t *testing.T) {
+	t.Helper()
+	report, err := Fsck(false)
+	if err != nil {
+		t.Fatalf("Fsck: %v", err)
+	}
+	if !report.Clean() {
+		t.Fatalf("Fsck found problems: %v", report.Problems)
+	}
+}
+
+// createTestFile makes name in dir holding content and returns its inode number
+func createTestFile(t *testing.T, dir INode, name string, content string) int {
+	t.Helper()
+	file, inodeNum := Open(CREATE, name, dir)
+	if inodeNum == 0 {
+		t.Fatalf("couldn't create %s", name)
+	}
+	if err := Write(&file, inodeNum, []byte(content)); err != nil {
+		t.Fatalf("writing %s: %v", name, err)
+	}
+	return inodeNum
+}
+
+// readTestFile is what name in dir holds without the padding on the end of its last block, and its
+// inode number. The number is 0 if it isn't there
+func readTestFile(dir INode, name string) (string, int) {
+	file, inodeNum := Open(READ, name, dir)
+	if inodeNum == 0 {
+		return "", 0
+	}
+	return strings.TrimRight(Read(&file), "\x00"), inodeNum
+}
+
+// TestOpenNames makes sure Open won't make a file it couldn't find again: an empty name or one longer
+// than a directory entry holds gets nothing, and opening the longest name there can be with CREATE a
+// second time opens the same file instead of adding another entry
+func TestOpenNames(t *testing.T) {
+	newTestFileSystem(t, 1<<20, DefaultOptions())
+	longest := strings.Repeat("n", MAX_NAME_LENGTH)
+	for _, name := range []string{"", longest + "x"} {
+		if _, inodeNum := Open(CREATE, name, RootFolder); inodeNum != 0 {
+			t.Fatalf("created %q as inode %d", name, inodeNum)
+		}
+	}
+	inodeNum := createTestFile(t, RootFolder, longest, "contents")
+	if _, again := Open(CREATE, longest, RootFolder); again != inodeNum {
+		t.Fatalf("opening %s again with CREATE gave inode %d, it is %d", longest, again, inodeNum)
+	}
+	if _, _, err := CloneFile(inodeNum, longest+"x", RootFolder); err == nil {
+		t.Fatalf("cloned to a name longer than %d bytes", MAX_NAME_LENGTH)
+	}
+	root, _ := currentDirectory(RootFolder)
+	if entries := directoryEntries(ReadSuperBlock(), root); len(entries) != 1 || entries[0].Inode != inodeNum {
+		t.Fatalf("the root directory has %v, it should only have %s", entries, longest)
+	}
+	checkFsck(t)
+}
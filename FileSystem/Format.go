@@ -0,0 +1,474 @@
+package FileSystem
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	MIN_BLOCK_SIZE = 512
+	MAX_BLOCK_SIZE = 65536
+	MIN_INODES     = 16
+	LABEL_SIZE     = 16
+
+	DEFAULT_RESERVED_PERCENT = 5
+	MAX_RESERVED_PERCENT     = 50
+)
+
+const (
+	FS_MAGIC       = 0x32534656 //"VFS2" when you hexdump the first four bytes of the disk
+	FORMAT_VERSION = 1          //bump this when the layout changes in a way feature flags can't describe
+)
+
+// Images from before the binary format have no magic number at all, MigrateGobImage (fsmigrate)
+// converts those. Everything added to the superblock since is only used when a feature flag says so,
+// a disk without the flag has zeros there, so the flags are what decide whether we can mount it, not
+// the version.
+
+// Feature flags - each feature gets a bit in one of the three sets depending on what older code
+// should do when it sees a disk using it. Add the bit to the matching SUPPORTED_ mask once the
+// code here actually handles it.
+const (
+	SUPPORTED_FEATURE_COMPAT   uint32 = FEATURE_COMPAT_JOURNAL
+	SUPPORTED_FEATURE_INCOMPAT uint32 = FEATURE_INCOMPAT_COW | FEATURE_INCOMPAT_BLOCK_GROUPS | FEATURE_INCOMPAT_DYNAMIC_INODES |
+		FEATURE_INCOMPAT_DIR_INDEX
+	SUPPORTED_FEATURE_ROCOMPAT uint32 = FEATURE_ROCOMPAT_BACKUP_SUPERBLOCKS | FEATURE_ROCOMPAT_SHARED_BLOCKS
+)
+
+var (
+	ErrNotAFileSystem      = errors.New("no file system found (bad magic number)")
+	ErrNewerFormat         = errors.New("file system was made by a newer format version")
+	ErrOlderFormat         = errors.New("file system was made by an older format version")
+	ErrIncompatibleFeature = errors.New("file system uses features this code doesn't support")
+	ErrReadOnlyFeature     = errors.New("file system uses features this code can only mount read only")
+)
+
+// readOnly is set by mounting read only, nothing gets written to Disk while it is true
+var readOnly bool
+
+// checkWritable stops us dead if something tries to change a read only file system
+func checkWritable() {
+	if readOnly {
+		log.Fatal("File system is mounted read only")
+	}
+}
+
+// Options are the mkfs knobs, anything left at zero gets the default from DefaultOptions
+type Options struct {
+	Size          int64  //bytes of the device to use, 0 means all of it
+	BlockSize     int    //bytes per block, a power of two between MIN_BLOCK_SIZE and MAX_BLOCK_SIZE
+	BytesPerInode int    //one inode gets made for every this many bytes of disk
+	InodeSize     int    //bytes per inode in the inode table, a power of two of at least INODE_RECORD_SIZE
+	Label         string //volume name, at most LABEL_SIZE bytes
+
+	//percent of the blocks held back for ReservedUID so repairs still work on a full disk.
+	//Unlike the rest this one isn't defaulted, 0 really means nothing is reserved
+	ReservedPercent int
+	ReservedUID     int
+
+	JournalBlocks int  //size of the journal, 0 picks one from the size of the disk
+	NoJournal     bool //leave the journal out altogether
+	CopyOnWrite   bool //make a copy on write file system instead of a journaled one (see Cow.go)
+	NoBlockGroups bool //one set of bitmaps and one inode table at the front, the way it used to be (see BlockGroup.go)
+	FixedInodes   bool //the inode table stays the size it is made, running out of inodes is running out (see InodeTable.go)
+	LinearDirs    bool //directories never get an index, each one is a single block of entries (see DirIndex.go)
+
+	Allocator string //the block allocator every mount uses, one of the built in ones (see Allocator.go), "" for first-fit
+}
+
+// MountOptions change how a file system gets mounted, the zero value is a normal read/write mount
+type MountOptions struct {
+	ReadOnly         bool
+	RepairSuperBlock bool   //if the primary superblock is damaged, rewrite it from the backup we mounted with
+	DataMode         int    //DATA_ORDERED, DATA_WRITEBACK or DATA_JOURNAL, only matters if there is a journal
+	Snapshot         string //mount this snapshot instead of the live file system, always read only
+	ReplayInMemory   bool   //read only mounts of a crashed file system read through what the journal still has to replay instead of refusing
+
+	Allocator string //block allocator for this mount, "" for the one the superblock says (see Allocator.go)
+
+	CacheBlocks       int           //how many blocks the buffer cache holds, 0 for DEFAULT_CACHE_BLOCKS
+	WriteBackInterval time.Duration //how long a block can stay dirty in the cache, 0 for the default and negative for only when synced
+	DelayedBlocks     int           //how many blocks of Writes can wait for their blocks (see DelayedAlloc.go), 0 for DEFAULT_DELAYED_BLOCKS and negative for none
+}
+
+// MountReport is what Mount had to do to get the file system going, for whoever wants to tell the user
+type MountReport struct {
+	BackupSuperBlock int //block of the backup superblock we mounted with, 0 if the primary was fine
+	ReplayedBlocks   int //blocks of a transaction the last mount left in the journal that got written again
+	PendingBlocks    int //blocks a ReplayInMemory mount read through without writing them, the journal still needs replaying
+}
+
+// lastMount belongs to mountLock
+var lastMount MountReport
+
+// LastMount reports what the last successful Mount had to do
+func LastMount() MountReport {
+	defer lockShared()()
+	return lastMount
+}
+
+func DefaultOptions() Options {
+	return Options{
+		BlockSize:     DEFAULT_BLOCK_SIZE,
+		BytesPerInode: DEFAULT_BYTES_PER_INODE,
+		InodeSize:     DEFAULT_INODE_SIZE,
+
+		ReservedPercent: DEFAULT_RESERVED_PERCENT,
+	}
+}
+
+func isPowerOfTwo(n int) bool {
+	return n > 0 && n&(n-1) == 0
+}
+
+// computeLayout works out where everything goes on the disk from the options
+// the order is superblock, inode bitmap, free block bitmap, inode table, journal and then the data blocks.
+// With block groups that is just the first group, the rest have their own bitmaps and inode tables
+func computeLayout(deviceSize int64, options Options) (SuperBlock, error) {
+	defaults := DefaultOptions()
+	if options.BlockSize == 0 {
+		options.BlockSize = defaults.BlockSize
+	}
+	if options.BytesPerInode == 0 {
+		options.BytesPerInode = defaults.BytesPerInode
+	}
+	if options.InodeSize == 0 {
+		options.InodeSize = defaults.InodeSize
+	}
+	if options.Size == 0 {
+		options.Size = deviceSize
+	}
+	if !isPowerOfTwo(options.BlockSize) || options.BlockSize < MIN_BLOCK_SIZE || options.BlockSize > MAX_BLOCK_SIZE {
+		return SuperBlock{}, fmt.Errorf("block size %d must be a power of two from %d to %d", options.BlockSize, MIN_BLOCK_SIZE, MAX_BLOCK_SIZE)
+	}
+	if !isPowerOfTwo(options.InodeSize) || options.InodeSize < INODE_RECORD_SIZE || options.InodeSize > options.BlockSize {
+		return SuperBlock{}, fmt.Errorf("inode size %d must be a power of two from %d to the block size", options.InodeSize, INODE_RECORD_SIZE)
+	}
+	if options.Size > deviceSize {
+		return SuperBlock{}, fmt.Errorf("asked for %d bytes but the device only has %d", options.Size, deviceSize)
+	}
+	if options.BytesPerInode < options.BlockSize {
+		return SuperBlock{}, fmt.Errorf("bytes per inode %d is smaller than a block", options.BytesPerInode)
+	}
+	if options.ReservedPercent < 0 || options.ReservedPercent > MAX_RESERVED_PERCENT {
+		return SuperBlock{}, fmt.Errorf("reserved percent %d must be from 0 to %d", options.ReservedPercent, MAX_RESERVED_PERCENT)
+	}
+	if options.ReservedUID < 0 {
+		return SuperBlock{}, fmt.Errorf("reserved uid %d can't be negative", options.ReservedUID)
+	}
+	if options.JournalBlocks < 0 || options.JournalBlocks > 0 && options.JournalBlocks < MIN_JOURNAL_BLOCKS {
+		return SuperBlock{}, fmt.Errorf("journal of %d blocks is smaller than the minimum of %d", options.JournalBlocks, MIN_JOURNAL_BLOCKS)
+	}
+	if len(options.Label) > LABEL_SIZE {
+		return SuperBlock{}, fmt.Errorf("label %q is longer than %d bytes", options.Label, LABEL_SIZE)
+	}
+	allocator, err := allocatorNumber(options.Allocator)
+	if err != nil {
+		return SuperBlock{}, err
+	}
+
+	blockCount := options.Size / int64(options.BlockSize)
+	if blockCount > 1<<32-1 {
+		return SuperBlock{}, fmt.Errorf("%d blocks won't fit in 32 bit block numbers, use a bigger block size", blockCount)
+	}
+	physicalBlocks, cowMapBlocks := int(blockCount), 0
+	if options.CopyOnWrite {
+		//everything below is laid out in logical blocks, which have to leave room for the block map
+		logicalBlocks, mapBlocks := cowLayout(physicalBlocks, options.BlockSize)
+		blockCount, cowMapBlocks = int64(logicalBlocks), mapBlocks
+		options.NoJournal = true
+	}
+	//round the inodes up so the inode table fills its last block
+	inodesPerBlock := options.BlockSize / options.InodeSize
+	inodeCount := int(options.Size / int64(options.BytesPerInode))
+	if inodeCount < MIN_INODES {
+		inodeCount = MIN_INODES
+	}
+	inodeCount = (inodeCount + inodesPerBlock - 1) / inodesPerBlock * inodesPerBlock
+
+	sblock := SuperBlock{
+		Magic:            FS_MAGIC,
+		FormatVersion:    FORMAT_VERSION,
+		FeatureROCompat:  FEATURE_ROCOMPAT_BACKUP_SUPERBLOCKS,
+		BlockSize:        options.BlockSize,
+		BlockCount:       int(blockCount),
+		InodeCount:       inodeCount,
+		InodeSize:        options.InodeSize,
+		RootDirInode:     ROOT_DIR_INODE,
+		InodeBitmapStart: 1,
+		ReservedBlocks:   int(blockCount * int64(options.ReservedPercent) / 100),
+		ReservedUID:      options.ReservedUID,
+		Allocator:        allocator,
+	}
+	if !options.NoBlockGroups {
+		layoutBlockGroups(&sblock, inodeCount)
+		sblock.ReservedBlocks = sblock.BlockCount * options.ReservedPercent / 100 //the last group might have gone
+	}
+	if !options.FixedInodes {
+		sblock.FeatureIncompat |= FEATURE_INCOMPAT_DYNAMIC_INODES
+		sblock.InodesPerChunk = inodesPerChunk(sblock.BlockSize, sblock.InodeSize)
+		sblock.InodeChunkBase = sblock.InodeCount
+	}
+	if !options.LinearDirs {
+		sblock.FeatureIncompat |= FEATURE_INCOMPAT_DIR_INDEX
+	}
+	sblock.FreeBlockStart = sblock.InodeBitmapStart + bitmapBlocks(sblock.BlockSize, groupInodes(sblock))
+	sblock.INodeStart = sblock.FreeBlockStart + bitmapBlocks(sblock.BlockSize, min(sblock.BlockCount, groupEnd(sblock, 0)))
+	sblock.JournalStart = sblock.INodeStart + inodeTableBlocks(sblock)
+	if !options.NoJournal {
+		sblock.FeatureCompat |= FEATURE_COMPAT_JOURNAL
+		sblock.JournalBlocks = options.JournalBlocks
+		//with block groups the journal has to fit in the first group, leaving room for the root directory
+		room := groupEnd(sblock, 0) - sblock.JournalStart - 2
+		if sblock.JournalBlocks == 0 {
+			sblock.JournalBlocks = defaultJournalBlocks(sblock, room)
+			if sblock.JournalBlocks == 0 {
+				return SuperBlock{}, fmt.Errorf("%d bytes is too small, there is only room for a journal of %d blocks and that isn't enough for an operation", options.Size, room)
+			}
+		} else if blockGroupsEnabled(sblock) && sblock.JournalBlocks > room {
+			return SuperBlock{}, fmt.Errorf("a journal of %d blocks won't fit in the first block group, it has room for %d", sblock.JournalBlocks, room)
+		}
+		if _, err := journalRoom(sblock, 0, false, DATA_ORDERED); err != nil {
+			return SuperBlock{}, fmt.Errorf("a journal of %d blocks is too small: %w", sblock.JournalBlocks, err)
+		}
+	}
+	sblock.DataBlockStart = sblock.JournalStart + sblock.JournalBlocks
+	if sblock.DataBlockStart+1 >= groupEnd(sblock, 0) { //we need room for the root directory and the last backup
+		return SuperBlock{}, fmt.Errorf("%d bytes is too small, the metadata alone needs %d blocks", options.Size, sblock.DataBlockStart+1)
+	}
+	sblock.PhysicalBlocks = physicalBlocks
+	if options.CopyOnWrite {
+		sblock.FeatureIncompat |= FEATURE_INCOMPAT_COW
+		sblock.FeatureROCompat &^= FEATURE_ROCOMPAT_BACKUP_SUPERBLOCKS //backups would sit in the middle of the pool
+		sblock.CowMapStart = 1
+		sblock.CowMapBlocks = cowMapBlocks
+	}
+	copy(sblock.Label[:], options.Label)
+	if err := newUUID(&sblock.UUID); err != nil {
+		return SuperBlock{}, err
+	}
+	return sblock, nil
+}
+
+// newUUID fills in a random (version 4) UUID
+func newUUID(uuid *[16]byte) error {
+	if _, err := rand.Read(uuid[:]); err != nil {
+		return err
+	}
+	uuid[6] = uuid[6]&0x0f | 0x40
+	uuid[8] = uuid[8]&0x3f | 0x80
+	return nil
+}
+
+// UUIDString formats a UUID the usual 8-4-4-4-12 way
+func UUIDString(uuid [16]byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16])
+}
+
+// LabelString is the volume label without its zero padding
+func LabelString(sblock SuperBlock) string {
+	return strings.TrimRight(string(sblock.Label[:]), "\x00")
+}
+
+// Format makes a new empty file system on the device - this is our mkfs.
+// It only writes the metadata blocks, whatever was in the data blocks is left alone.
+func Format(device BlockDevice, options Options) error {
+	defer lockExclusive()()
+	sblock, err := computeLayout(device.Size(), options)
+	if err != nil {
+		return err
+	}
+	if err := writeDelayedWrites(); err != nil {
+		return fmt.Errorf("writing out what the mounted file system still had waiting: %w", err)
+	}
+	setDisk(device, sblock.BlockSize, 0, 0)
+	useDelayedLimit(0)
+	useAllocator(sblock, "") //can't fail, computeLayout already checked it
+	readOnly = false
+	dataMode = DATA_ORDERED
+	superBlockOffset = 0
+	lastMount = MountReport{}
+	operationCredits, _ = journalRoom(sblock, 0, false, DATA_ORDERED)
+	dropBitmapCache()
+	dropTransaction()
+	newInodeLocks(sblock)
+	newNameCaches(sblock)
+	cow = nil
+	if cowEnabled(sblock) {
+		//the whole format is one transaction, the first commit writes all of the map
+		cow = newCowState(sblock)
+		transactionDepth++
+		startTransaction(sblock)
+	}
+	writeBlock(sblock, 0, nil)
+	createInodeBitmap(sblock)
+	createFreeBlockBitmap(sblock)
+	createInodes(sblock)
+	if journalEnabled(sblock) {
+		createJournal(sblock)
+	}
+	writeSuperBlock(sblock) //the root directory code reads it back, so it has to be there first
+	createRootDir(sblock)
+	syncBitmaps()
+	if cow != nil {
+		commitTransaction()
+	}
+	syncDisk()
+	return nil
+}
+
+// Mount makes device the Disk that everything else works on
+func Mount(device BlockDevice) error {
+	return MountWithOptions(device, MountOptions{})
+}
+
+// checkFormatVersion only lets through the version we write, the layout of any other one is a guess
+func checkFormatVersion(version uint32) error {
+	if version > FORMAT_VERSION {
+		return fmt.Errorf("%w: version %d", ErrNewerFormat, version)
+	}
+	if version < FORMAT_VERSION {
+		return fmt.Errorf("%w: version %d", ErrOlderFormat, version)
+	}
+	return nil
+}
+
+// checkFeatures decides whether we know enough about the features in use to mount the file system
+func checkFeatures(sblock SuperBlock, options MountOptions) error {
+	if err := checkFormatVersion(sblock.FormatVersion); err != nil {
+		return err
+	}
+	if unknown := sblock.FeatureIncompat &^ SUPPORTED_FEATURE_INCOMPAT; unknown != 0 {
+		return fmt.Errorf("%w: incompatible features %#x", ErrIncompatibleFeature, unknown)
+	}
+	if unknown := sblock.FeatureROCompat &^ SUPPORTED_FEATURE_ROCOMPAT; unknown != 0 && !options.ReadOnly {
+		return fmt.Errorf("%w: read only compatible features %#x", ErrReadOnlyFeature, unknown)
+	}
+	//unknown compatible features are fine, that is the whole point of them
+	return nil
+}
+
+func MountWithOptions(device BlockDevice, options MountOptions) error {
+	defer lockExclusive()()
+	return mountDevice(device, options)
+}
+
+func mountDevice(device BlockDevice, options MountOptions) error {
+	if device.Size() < SUPERBLOCK_SIZE {
+		return fmt.Errorf("device is too small to hold a superblock")
+	}
+	if err := writeDelayedWrites(); err != nil {
+		return fmt.Errorf("writing out what the mounted file system still had waiting: %w", err)
+	}
+	flushCache() //we read the superblock straight off the device, it might be the one we have mounted
+	sblock, offset, err := loadSuperBlockForMount(device)
+	if err != nil {
+		return err
+	}
+	if err := checkFeatures(sblock, options); err != nil {
+		return err
+	}
+	if !isPowerOfTwo(sblock.BlockSize) || sblock.BlockSize < MIN_BLOCK_SIZE || sblock.BlockSize > MAX_BLOCK_SIZE {
+		return fmt.Errorf("superblock has a bad block size %d", sblock.BlockSize)
+	}
+	if !isPowerOfTwo(sblock.InodeSize) || sblock.InodeSize < INODE_RECORD_SIZE || sblock.InodeSize > sblock.BlockSize {
+		return fmt.Errorf("superblock has a bad inode size %d", sblock.InodeSize)
+	}
+	if int64(sblock.BlockCount)*int64(sblock.BlockSize) > device.Size() {
+		return fmt.Errorf("file system has %d blocks but the device only holds %d", sblock.BlockCount, device.Size()/int64(sblock.BlockSize))
+	}
+	if sblock.DataBlockStart >= sblock.BlockCount || sblock.RootDirInode <= 0 || sblock.RootDirInode >= sblock.InodeCount {
+		return fmt.Errorf("superblock layout %+v doesn't make sense", sblock)
+	}
+	if err := checkBlockGroups(sblock); err != nil {
+		return err
+	}
+	if err := checkInodeTable(sblock); err != nil {
+		return err
+	}
+	if journalEnabled(sblock) && (sblock.JournalBlocks < MIN_JOURNAL_BLOCKS || sblock.JournalStart+sblock.JournalBlocks > sblock.DataBlockStart) {
+		return fmt.Errorf("journal at block %d with %d blocks doesn't fit the layout", sblock.JournalStart, sblock.JournalBlocks)
+	}
+	if options.DataMode < DATA_ORDERED || options.DataMode > DATA_JOURNAL {
+		return fmt.Errorf("unknown data mode %d", options.DataMode)
+	}
+	if options.DataMode == DATA_JOURNAL && !journalEnabled(sblock) {
+		return fmt.Errorf("data journaling needs a file system with a journal")
+	}
+	if options.Snapshot != "" {
+		if !cowEnabled(sblock) {
+			return fmt.Errorf("snapshots need a copy on write file system")
+		}
+		options.ReadOnly = true
+	}
+	if err := useAllocator(sblock, options.Allocator); err != nil {
+		return err
+	}
+	setDisk(device, sblock.BlockSize, options.CacheBlocks, options.WriteBackInterval)
+	useDelayedLimit(options.DelayedBlocks)
+	readOnly = options.ReadOnly
+	dataMode = options.DataMode
+	superBlockOffset = offset
+	report := MountReport{BackupSuperBlock: int(offset / int64(sblock.BlockSize))}
+	dropBitmapCache()
+	dropTransaction()
+	newInodeLocks(sblock)
+	cow = nil
+	if cowEnabled(sblock) {
+		if err := mountCow(sblock); err != nil {
+			setDisk(nil, 0, 0, 0)
+			return err
+		}
+		if options.Snapshot != "" {
+			if err := mountSnapshot(options.Snapshot); err != nil {
+				setDisk(nil, 0, 0, 0)
+				return err
+			}
+			sblock = ReadSuperBlock()
+		}
+	}
+	operationCredits = 0
+	if journalEnabled(sblock) {
+		if options.ReadOnly && options.ReplayInMemory {
+			pending, err := replayInMemory(sblock)
+			if err != nil {
+				setDisk(nil, 0, 0, 0)
+				return err
+			}
+			if pending != nil {
+				setDisk(pending, sblock.BlockSize, options.CacheBlocks, options.WriteBackInterval)
+				report.PendingBlocks = len(pending.blocks)
+			}
+		} else {
+			replayed, err := mountJournal(sblock, options.ReadOnly)
+			if err != nil {
+				setDisk(nil, 0, 0, 0)
+				return err
+			}
+			report.ReplayedBlocks = replayed
+		}
+		sblock = ReadSuperBlock() //the replay might have changed it
+		if !options.ReadOnly {
+			//settings the journal can't cope with have to be changed before they are used, not halfway through an operation
+			if operationCredits, err = journalRoom(sblock, sblock.VersionsKept, trashEnabled(sblock), dataMode); err != nil {
+				setDisk(nil, 0, 0, 0)
+				return err
+			}
+		}
+	}
+	if offset != 0 && options.RepairSuperBlock && !options.ReadOnly {
+		writeSuperBlock(sblock) //puts the primary back and brings every backup in line with it
+	}
+	newNameCaches(sblock) //after the replay and the snapshot, so nothing cached comes from before them
+	loadBitmaps(sblock)
+	if !options.ReadOnly {
+		updateFreeCounts() //a backup or an old crash can leave the counts behind the bitmaps
+	}
+	RootFolder = getInodeFromDisk(sblock.RootDirInode)
+	lastMount = report
+	return nil
+}
@@ -0,0 +1,107 @@
+package FileSystem
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// TestFormatMountFsck formats with each of the options that change the layout, mounts what it made and
+// runs Fsck on it, empty and then with a directory and some files in it, before and after a remount
+func TestFormatMountFsck(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		change func(*Options)
+	}{
+		{"default", func(*Options) {}},
+		{"512", func(options *Options) { options.BlockSize = 512 }},
+		{"1024", func(options *Options) { options.BlockSize = 1024 }},
+		{"4096", func(options *Options) { options.BlockSize = 4096 }},
+		{"NoBlockGroups", func(options *Options) { options.NoBlockGroups = true }},
+		{"FixedInodes", func(options *Options) { options.FixedInodes = true }},
+		{"LinearDirs", func(options *Options) { options.LinearDirs = true }},
+		{"NoJournal", func(options *Options) { options.NoJournal = true }},
+		{"CopyOnWrite", func(options *Options) { options.CopyOnWrite = true }},
+		{"Reserved", func(options *Options) { options.ReservedPercent = 10 }},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			options := DefaultOptions()
+			options.Label = test.name
+			test.change(&options)
+			device := newTestFileSystem(t, 8<<20, options)
+			formatted := ReadSuperBlock()
+			if got := strings.TrimRight(string(formatted.Label[:]), "\x00"); got != test.name {
+				t.Fatalf("the label is %q", got)
+			}
+			checkFsck(t)
+			remount(t, device)
+			if sblock := ReadSuperBlock(); sblock != formatted {
+				t.Fatalf("the superblock changed on the way to the disk and back:\n%+v\n%+v", formatted, sblock)
+			}
+			checkFsck(t)
+			empty := Statfs()
+
+			_, dirNum := Open(CREATE, "dir", RootFolder)
+			_, dir := CreateDirectoryFile(formatted.RootDirInode, dirNum)
+			files := map[string]string{}
+			//a directory without an index is one block, so not too many
+			for num := 0; num < 25; num++ {
+				name := fmt.Sprint("file", num)
+				files[name] = strings.Repeat(name, num*50+1)
+				createTestFile(t, dir, name, files[name])
+			}
+			checkFsck(t)
+			remount(t, device)
+			checkFsck(t)
+			dir, _ = Open(READ, "dir", RootFolder)
+			for name, want := range files {
+				if got, _ := readTestFile(dir, name); got != want {
+					t.Fatalf("%s holds %d bytes starting %.20q, it should be %d bytes", name, len(got), got, len(want))
+				}
+			}
+			if stats := Statfs(); stats.FreeBlocks >= empty.FreeBlocks || stats.FreeInodes >= empty.FreeInodes {
+				t.Fatalf("Statfs says %+v with the files and %+v without", stats, empty)
+			}
+		})
+	}
+}
+
+// TestMountRejectsOtherVersions changes the format version in a fresh image and makes sure Mount says
+// which way it is off, both when the superblock is otherwise fine and when every copy of it has a
+// checksum that doesn't match, the way a superblock laid out by another version looks
+func TestMountRejectsOtherVersions(t *testing.T) {
+	for _, test := range []struct {
+		version uint32
+		want    error
+	}{
+		{FORMAT_VERSION - 1, ErrOlderFormat},
+		{FORMAT_VERSION + 1, ErrNewerFormat},
+	} {
+		image := formattedImage(t, 8<<20, DefaultOptions())
+		blockSize := decodeSuperBlock(image).BlockSize
+
+		resigned := NewMemDevice(int64(len(image)))
+		copy(resigned.data, image)
+		sblock := decodeSuperBlock(image)
+		sblock.FormatVersion = test.version
+		copy(resigned.data, encodeSuperBlock(sblock))
+		if err := Mount(resigned); !errors.Is(err, test.want) {
+			t.Fatalf("mounting version %d: %v", test.version, err)
+		}
+
+		copies := 0
+		for offset := 0; offset+SUPERBLOCK_SIZE <= len(image); offset += blockSize {
+			if superBlock := image[offset:]; byteOrder.Uint32(superBlock) == FS_MAGIC && superBlockChecksumOK(superBlock) {
+				byteOrder.PutUint32(superBlock[4:], test.version)
+				copies++
+			}
+		}
+		if copies < 2 {
+			t.Fatalf("only found %d copies of the superblock", copies)
+		}
+		if err := Mount(&MemDevice{data: image}); !errors.Is(err, test.want) {
+			t.Fatalf("mounting version %d without a good checksum: %v", test.version, err)
+		}
+	}
+}
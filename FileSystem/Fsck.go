@@ -0,0 +1,623 @@
+package FileSystem
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Fsck
+// Checks that the bitmaps, the inodes and the directory tree all agree with each other, and with
+// repair set fixes whatever doesn't. It goes in passes, each one trusting what the ones before it fixed:
+//  1. the block pointers of every valid inode - pointers outside the data blocks get dropped and a
+//     block claimed by two inodes gets copied so each of them has its own, unless they are both
+//     files sharing it because of CloneFile
+//  2. the directory tree from the root - '.' and '..' have to be right, entries have to point at
+//     valid inodes and a directory can only be linked from one place. A file's old versions are
+//     reached through its chain of PrevVersion pointers
+//  3. the bitmaps have to mark exactly what passes 1 and 2 found in use
+//  4. valid inodes the tree never reached get linked into lost+found as #<inode number>
+//  5. link counts have to match the number of entries pointing at each inode, and the free
+//     counts in the superblock have to match the bitmaps
+
+const LOST_AND_FOUND = "lost+found"
+
+// FsckReport is everything Fsck found
+type FsckReport struct {
+	Problems []string //one line for each thing that was wrong
+	Repaired bool     //true if the problems were fixed on Disk
+}
+
+func (report FsckReport) Clean() bool {
+	return len(report.Problems) == 0
+}
+
+type fsckState struct {
+	sblock  SuperBlock
+	repair  bool
+	report  *FsckReport
+	valid   []bool       //inode is marked IsValid
+	isDir   []bool       //inode is a valid directory
+	claims  []int        //number of pointers to each block, counted before anything gets fixed
+	owner   []int        //the inode each block ended up belonging to
+	shared  []bool       //block is file data, which cloned files are allowed to share
+	backups map[int]bool //blocks holding backup superblocks
+	reached []bool       //inode was found in the directory tree
+	version []bool       //some inode's PrevVersion points at this one
+	refs    []int        //number of directory entries pointing at each inode
+	reindex []int        //directories whose index has to be built again
+}
+
+func (fsck *fsckState) problem(format string, args ...interface{}) {
+	fsck.report.Problems = append(fsck.report.Problems, fmt.Sprintf(format, args...))
+}
+
+// Fsck checks the mounted file system, with repair set it fixes what it finds as well
+func Fsck(repair bool) (FsckReport, error) {
+	defer lockExclusive()()
+	report := FsckReport{}
+	if Disk == nil {
+		return report, fmt.Errorf("there is no file system mounted")
+	}
+	if repair && readOnly {
+		return report, fmt.Errorf("can't repair a file system that is mounted read only")
+	}
+	if err := writeDelayedWrites(); err != nil {
+		return report, err
+	}
+	sblock := ReadSuperBlock()
+	fsck := &fsckState{
+		sblock:  sblock,
+		repair:  repair,
+		report:  &report,
+		valid:   make([]bool, sblock.InodeCount),
+		isDir:   make([]bool, sblock.InodeCount),
+		claims:  make([]int, sblock.BlockCount),
+		owner:   make([]int, sblock.BlockCount),
+		shared:  make([]bool, sblock.BlockCount),
+		backups: map[int]bool{},
+		reached: make([]bool, sblock.InodeCount),
+		version: make([]bool, sblock.InodeCount),
+		refs:    make([]int, sblock.InodeCount),
+	}
+	for _, backup := range superBlockBackups(sblock) {
+		fsck.backups[backup] = true
+	}
+
+	fsck.checkBlockPointers()
+	root := getInodeFromDisk(sblock.RootDirInode)
+	if !root.IsValid || !root.IsDirectory {
+		fsck.problem("root inode %d is not a directory, can't check any further", sblock.RootDirInode)
+		return report, nil
+	}
+	fsck.walkFrom(sblock.RootDirInode, 0)
+	fsck.checkBitmaps()
+	if repair {
+		fsck.reindexDirectories()
+	}
+	fsck.checkOrphans()
+	if repair {
+		//lost+found and everything put in it changed the tree, so count the links again from scratch
+		fsck.reached = make([]bool, sblock.InodeCount)
+		fsck.refs = make([]int, sblock.InodeCount)
+		fsck.walkFrom(sblock.RootDirInode, 0)
+	}
+	fsck.checkLinkCounts()
+	fsck.checkFreeCounts()
+	if repair {
+		syncBitmaps()
+		blockRefs = nil //pass 1 might have changed who points at what
+		RootFolder = getInodeFromDisk(sblock.RootDirInode)
+		report.Repaired = !report.Clean()
+	}
+	return report, nil
+}
+
+// isDataBlock is true for blocks a file is allowed to point at
+func (fsck *fsckState) isDataBlock(blockNum int) bool {
+	return blockNum >= fsck.sblock.DataBlockStart && blockNum < fsck.sblock.BlockCount && !isMetadataBlock(fsck.sblock, blockNum) && !fsck.backups[blockNum]
+}
+
+// forEachBlockPointer calls visit with every block the inode points at, the indirect block first.
+// visit returns what the pointer should be instead, 0 drops it and the data blocks after it move up
+// to fill the gap. Changes to the indirect block are written when repairing, the inode is left to the caller.
+func (fsck *fsckState) forEachBlockPointer(inode *INode, visit func(blockNum int, isIndirect bool) int) {
+	dataBlocks := []int{}
+	for _, blockNum := range []int{inode.DirectBlock1, inode.DirectBlock2, inode.DirectBlock3} {
+		if blockNum != 0 {
+			dataBlocks = append(dataBlocks, blockNum)
+		}
+	}
+	oldIndirect := IndirectBlock{}
+	if inode.IndirectBlock != 0 {
+		if fsck.isDataBlock(inode.IndirectBlock) { //anything else isn't safe to read
+			oldIndirect = decodeIndirectBlock(readBlock(fsck.sblock, inode.IndirectBlock))
+			for _, blockNum := range oldIndirect {
+				if blockNum == 0 {
+					break
+				}
+				dataBlocks = append(dataBlocks, blockNum)
+			}
+		}
+		inode.IndirectBlock = visit(inode.IndirectBlock, true)
+	}
+
+	kept := []int{}
+	for _, blockNum := range dataBlocks {
+		if blockNum = visit(blockNum, false); blockNum != 0 {
+			kept = append(kept, blockNum)
+		}
+	}
+	kept = append(kept, 0, 0, 0)
+	inode.DirectBlock1, inode.DirectBlock2, inode.DirectBlock3 = kept[0], kept[1], kept[2]
+	if inode.IndirectBlock == 0 || !fsck.isDataBlock(inode.IndirectBlock) {
+		return //if there were blocks past the direct ones they went with the indirect block
+	}
+	newIndirect := make(IndirectBlock, fsck.sblock.BlockSize/BLOCK_POINTER_SIZE)
+	copy(newIndirect, kept[3:])
+	if fsck.repair && !slices.Equal(newIndirect, oldIndirect) {
+		writeBlock(fsck.sblock, inode.IndirectBlock, EncodeToBytes(newIndirect))
+	}
+}
+
+// takeFreeBlock finds a block no inode has claimed, or 0 if there isn't one
+func (fsck *fsckState) takeFreeBlock(newOwner int) int {
+	for blockNum := fsck.sblock.DataBlockStart; blockNum < fsck.sblock.BlockCount; blockNum++ {
+		if fsck.isDataBlock(blockNum) && fsck.claims[blockNum] == 0 && fsck.owner[blockNum] == 0 {
+			fsck.claims[blockNum] = 1
+			fsck.owner[blockNum] = newOwner
+			if fsck.repair {
+				ReadFreeBlockBitmap(fsck.sblock).Set(blockNum)
+			}
+			return blockNum
+		}
+	}
+	return 0
+}
+
+// pass 1 - every block can only belong to one inode and has to be a data block
+func (fsck *fsckState) checkBlockPointers() {
+	sblock := fsck.sblock
+	for inodeNum := 1; inodeNum < sblock.InodeCount; inodeNum++ {
+		inode := getInodeFromDisk(inodeNum)
+		if !inode.IsValid {
+			continue
+		}
+		fsck.valid[inodeNum] = true
+		fsck.isDir[inodeNum] = inode.IsDirectory
+		if inode.PrevVersion > 0 && inode.PrevVersion < sblock.InodeCount {
+			fsck.version[inode.PrevVersion] = true
+		}
+		//count the claims first so takeFreeBlock never hands out a block somebody further on is using
+		fsck.forEachBlockPointer(&inode, func(blockNum int, isIndirect bool) int {
+			if fsck.isDataBlock(blockNum) {
+				fsck.claims[blockNum]++
+			}
+			return blockNum
+		})
+	}
+	for inodeNum := 1; inodeNum < sblock.InodeCount; inodeNum++ {
+		if !fsck.valid[inodeNum] {
+			continue
+		}
+		inode := getInodeFromDisk(inodeNum)
+		before := inode
+		fsck.forEachBlockPointer(&inode, func(blockNum int, isIndirect bool) int {
+			if !fsck.isDataBlock(blockNum) {
+				fsck.problem("inode %d points at block %d which isn't a data block", inodeNum, blockNum)
+				return 0
+			}
+			sharable := sharedBlocksEnabled(sblock) && !isIndirect && !inode.IsDirectory
+			if fsck.owner[blockNum] != 0 && sharable && fsck.shared[blockNum] {
+				return blockNum //a clone and its original
+			}
+			if fsck.owner[blockNum] != 0 {
+				fsck.problem("block %d is used by both inode %d and inode %d", blockNum, fsck.owner[blockNum], inodeNum)
+				if !fsck.repair {
+					return blockNum
+				}
+				copyNum := fsck.takeFreeBlock(inodeNum)
+				if copyNum == 0 {
+					fsck.problem("no free block to copy block %d into, dropping it from inode %d", blockNum, inodeNum)
+					return 0
+				}
+				writeBlock(fsck.sblock, copyNum, readBlock(fsck.sblock, blockNum))
+				return copyNum
+			}
+			fsck.owner[blockNum] = inodeNum
+			fsck.shared[blockNum] = sharable
+			return blockNum
+		})
+		if fsck.repair && inode != before {
+			writeInodeToDisk(&inode, inodeNum, sblock)
+		}
+	}
+}
+
+// pass 2 - walk the directories under start, whose '..' should be parent
+func (fsck *fsckState) walkFrom(start int, parent int) {
+	type dirToCheck struct {
+		inodeNum int
+		parent   int
+	}
+	fsck.reached[start] = true
+	queue := []dirToCheck{{start, parent}}
+	for len(queue) > 0 {
+		dir := queue[0]
+		queue = queue[1:]
+		for _, child := range fsck.checkDirectory(dir.inodeNum, dir.parent) {
+			queue = append(queue, dirToCheck{child, dir.inodeNum})
+		}
+	}
+}
+
+// directoryBlocks is fileBlocks without trusting the pointers, pass 1 may not have fixed them
+func (fsck *fsckState) directoryBlocks(dir INode) []int {
+	blocks := []int{}
+	fsck.forEachBlockPointer(&dir, func(blockNum int, isIndirect bool) int {
+		if !isIndirect && fsck.isDataBlock(blockNum) {
+			blocks = append(blocks, blockNum)
+		}
+		return blockNum
+	})
+	return blocks
+}
+
+// checkDirectory checks the entries of one directory and returns the directories in it
+func (fsck *fsckState) checkDirectory(dirNum int, parent int) []int {
+	sblock := fsck.sblock
+	dir := getInodeFromDisk(dirNum)
+	blocks := fsck.directoryBlocks(dir)
+	if len(blocks) == 0 {
+		fsck.problem("directory %d has no blocks", dirNum)
+		if !fsck.repair {
+			return nil
+		}
+		if dir.DirectBlock1 = fsck.takeFreeBlock(dirNum); dir.DirectBlock1 == 0 {
+			fsck.problem("no free block to rebuild directory %d in", dirNum)
+			return nil
+		}
+		writeBlock(sblock, dir.DirectBlock1, nil)
+		dir.IsIndexed = false
+		writeInodeToDisk(&dir, dirNum, sblock)
+		blocks = []int{dir.DirectBlock1}
+	}
+
+	//the blocks with entries in, and the hashes that belong in each. An indexed directory only has
+	//'.' and '..' in its first block and the rest in the leaves of its index
+	scan := []indexLeaf{{block: 0, low: 0, high: 1 << 32}}
+	reindex := false
+	if !dir.IsIndexed {
+		for blockIndex := 1; blockIndex < len(blocks); blockIndex++ {
+			scan = append(scan, indexLeaf{block: blockIndex, low: 0, high: 1 << 32})
+		}
+	} else if leaves, err := indexLeaves(sblock, blocks); err != nil || !dirIndexEnabled(sblock) {
+		if err == nil {
+			err = fmt.Errorf("the file system doesn't have indexed directories")
+		}
+		fsck.problem("directory %d has a damaged index: %v", dirNum, err)
+		reindex = true
+		for _, blockIndex := range fsck.possibleLeaves(blocks) {
+			scan = append(scan, indexLeaf{block: blockIndex, low: 0, high: 1 << 32})
+		}
+	} else {
+		scan = append(scan, leaves...)
+	}
+
+	subdirs := []int{}
+	names := map[string]bool{}
+	for _, leaf := range scan {
+		blockIndex, blockNum := leaf.block, blocks[leaf.block]
+		entries := decodeDirectoryBlock(readBlock(sblock, blockNum))
+		changed := false
+		firstEntry := 0
+		if blockIndex == 0 {
+			if entries[0].Inode != dirNum || entryName(entries[0]) != "." {
+				fsck.problem("directory %d has a bad '.' entry", dirNum)
+				entries[0] = newDirectoryEntry(".", dirNum)
+				changed = true
+			}
+			if entries[1].Inode != parent || entryName(entries[1]) != ".." {
+				fsck.problem("directory %d has '..' pointing at %d instead of %d", dirNum, entries[1].Inode, parent)
+				entries[1] = newDirectoryEntry("..", parent)
+				changed = true
+			}
+			fsck.refs[dirNum]++
+			if parent != 0 {
+				fsck.refs[parent]++
+			}
+			firstEntry = 2
+		}
+		for entryNum := firstEntry; entryNum < len(entries); entryNum++ {
+			entry := entries[entryNum]
+			if !entryIsUsed(entry) {
+				continue
+			}
+			child := entry.Inode
+			if child <= 0 || child >= sblock.InodeCount || !fsck.valid[child] {
+				fsck.problem("directory %d has %q pointing at inode %d which isn't in use, removing it", dirNum, entryName(entry), child)
+				entries[entryNum] = DirectoryEntry{}
+				changed = true
+				continue
+			}
+			if names[entryName(entry)] {
+				fsck.problem("directory %d has more than one %q, removing the one pointing at inode %d", dirNum, entryName(entry), child)
+				entries[entryNum] = DirectoryEntry{}
+				changed = true
+				continue
+			}
+			names[entryName(entry)] = true
+			if fsck.isDir[child] {
+				if fsck.reached[child] {
+					fsck.problem("directory %d is linked from more than one place, removing %q from directory %d", child, entryName(entry), dirNum)
+					entries[entryNum] = DirectoryEntry{}
+					changed = true
+					continue
+				}
+				subdirs = append(subdirs, child)
+			}
+			firstVisit := !fsck.reached[child]
+			fsck.reached[child] = true
+			fsck.refs[child]++
+			if firstVisit && !fsck.isDir[child] {
+				fsck.checkVersions(child)
+			}
+			if hash := uint64(nameHash(entryName(entry))); dir.IsIndexed && !reindex && (blockIndex == 0 || hash < leaf.low || hash >= leaf.high) {
+				fsck.problem("%q is in the wrong block of directory %d's index", entryName(entry), dirNum)
+				reindex = true
+			}
+		}
+		if changed && fsck.repair {
+			writeBlock(sblock, blockNum, EncodeToBytes(entries))
+		}
+	}
+	if reindex && fsck.repair {
+		fsck.reindex = append(fsck.reindex, dirNum)
+	}
+	return subdirs
+}
+
+// possibleLeaves is every block of an indexed directory after the root that isn't an index node,
+// for when the index can't be trusted to say which are leaves
+func (fsck *fsckState) possibleLeaves(blocks []int) []int {
+	leaves := []int{}
+	for blockIndex := DIR_INDEX_ROOT + 1; blockIndex < len(blocks); blockIndex++ {
+		if _, isNode := decodeDirIndexNode(readBlock(fsck.sblock, blocks[blockIndex])); !isNode {
+			leaves = append(leaves, blockIndex)
+		}
+	}
+	return leaves
+}
+
+// pass 3 and a bit - directories with a damaged index get it built again from their entries, now that
+// the bitmaps are right and new blocks can come from the allocator
+func (fsck *fsckState) reindexDirectories() {
+	sblock := fsck.sblock
+	for _, dirNum := range fsck.reindex {
+		dir := getInodeFromDisk(dirNum)
+		blocks := fsck.directoryBlocks(dir)
+		entries := []DirectoryEntry{}
+		for _, blockIndex := range append([]int{0}, fsck.possibleLeaves(blocks)...) {
+			blockEntries := decodeDirectoryBlock(readBlock(sblock, blocks[blockIndex]))
+			if blockIndex == 0 {
+				blockEntries = blockEntries[2:]
+			}
+			for _, entry := range blockEntries {
+				if entryIsUsed(entry) {
+					entries = append(entries, entry)
+				}
+			}
+		}
+		for _, entry := range reindexDirectory(sblock, dirNum, entries) {
+			fsck.problem("no room for %q in directory %d once its index was rebuilt", entryName(entry), dirNum)
+			fsck.reached[entry.Inode] = false //so it goes in lost+found
+		}
+	}
+}
+
+// checkVersions follows a file's chain of old versions, which nothing else points at
+func (fsck *fsckState) checkVersions(fileNum int) {
+	for inodeNum := fileNum; ; {
+		inode := getInodeFromDisk(inodeNum)
+		next := inode.PrevVersion
+		if next == 0 {
+			return
+		}
+		if next < 0 || next >= fsck.sblock.InodeCount || !fsck.valid[next] || fsck.isDir[next] || fsck.reached[next] {
+			fsck.problem("inode %d says its previous version is inode %d which can't be one, cutting the history there", inodeNum, next)
+			if fsck.repair {
+				inode.PrevVersion = 0
+				writeInodeToDisk(&inode, inodeNum, fsck.sblock)
+			}
+			return
+		}
+		fsck.reached[next] = true
+		inodeNum = next
+	}
+}
+
+// summarize lists the first few block or inode numbers so one bad bitmap doesn't make thousands of lines
+func summarize(nums []int) string {
+	if len(nums) > 10 {
+		return fmt.Sprint(nums[:10]) + " ..."
+	}
+	return fmt.Sprint(nums)
+}
+
+// pass 3 - the bitmaps should mark exactly the metadata, the backups and the blocks and inodes in use
+func (fsck *fsckState) checkBitmaps() {
+	sblock := fsck.sblock
+	freeBlocks := ReadFreeBlockBitmap(sblock)
+	leaked, unmarked := []int{}, []int{}
+	for blockNum := 0; blockNum < sblock.BlockCount; blockNum++ {
+		used := isMetadataBlock(sblock, blockNum) || fsck.backups[blockNum] || fsck.owner[blockNum] != 0
+		if used && !freeBlocks.IsSet(blockNum) {
+			unmarked = append(unmarked, blockNum)
+			if fsck.repair {
+				freeBlocks.Set(blockNum)
+			}
+		} else if !used && freeBlocks.IsSet(blockNum) {
+			leaked = append(leaked, blockNum)
+			if fsck.repair {
+				freeDataBlock(sblock, blockNum)
+			}
+		}
+	}
+	if len(leaked) > 0 {
+		fsck.problem("%d blocks are marked in use but nothing owns them: %s", len(leaked), summarize(leaked))
+	}
+	if len(unmarked) > 0 {
+		fsck.problem("%d blocks are in use but marked free: %s", len(unmarked), summarize(unmarked))
+	}
+
+	inodes := ReadINodeBitmap(sblock)
+	leaked, unmarked = []int{}, []int{}
+	for inodeNum := 0; inodeNum < sblock.InodeCount; inodeNum++ {
+		used := inodeNum == 0 || fsck.valid[inodeNum] || isInodeHole(sblock, inodeNum) //a hole is always in use
+		if used && !inodes.IsSet(inodeNum) {
+			unmarked = append(unmarked, inodeNum)
+			if fsck.repair {
+				inodes.Set(inodeNum)
+			}
+		} else if !used && inodes.IsSet(inodeNum) {
+			leaked = append(leaked, inodeNum)
+			if fsck.repair {
+				inodes.Clear(inodeNum)
+			}
+		}
+	}
+	if len(leaked) > 0 {
+		fsck.problem("%d inodes are marked in use but aren't valid: %s", len(leaked), summarize(leaked))
+	}
+	if len(unmarked) > 0 {
+		fsck.problem("%d valid inodes are marked free: %s", len(unmarked), summarize(unmarked))
+	}
+	if fsck.repair {
+		syncBitmaps() //lost+found is made with the normal allocator, so the bitmaps have to be right first
+	}
+}
+
+// lostAndFound finds or makes lost+found in the root, the inode number is 0 if that can't be done
+func (fsck *fsckState) lostAndFound() (INode, int) {
+	sblock := fsck.sblock
+	root := getInodeFromDisk(sblock.RootDirInode)
+	lostFound, lostFoundNum := openFile(READ, LOST_AND_FOUND, root)
+	if lostFoundNum != 0 {
+		if !lostFound.IsValid || !lostFound.IsDirectory {
+			fsck.problem("%s isn't a directory", LOST_AND_FOUND)
+			return INode{}, 0
+		}
+		return lostFound, lostFoundNum
+	}
+	_, lostFoundNum = createNewInode(sblock, 0)
+	lostFound = getInodeFromDisk(lostFoundNum)
+	lostFound.LinksCount = 0 //addDirectoryEntry counts the link
+	writeInodeToDisk(&lostFound, lostFoundNum, sblock)
+	if !addDirectoryEntry(sblock, root, LOST_AND_FOUND, lostFoundNum) {
+		fsck.problem("the root directory is full, there is no room for %s", LOST_AND_FOUND)
+		ReadINodeBitmap(sblock).Clear(lostFoundNum)
+		lostFound.IsValid = false
+		writeInodeToDisk(&lostFound, lostFoundNum, sblock)
+		return INode{}, 0
+	}
+	dirBlock, lostFound := createDirectoryFile(sblock.RootDirInode, lostFoundNum)
+	if err := writeFile(&lostFound, lostFoundNum, EncodeToBytes(dirBlock), nil); err != nil {
+		fsck.problem("there is no room for %s: %v", LOST_AND_FOUND, err)
+		return INode{}, 0
+	}
+	fsck.valid[lostFoundNum] = true
+	fsck.isDir[lostFoundNum] = true
+	fsck.reached[lostFoundNum] = true
+	return lostFound, lostFoundNum
+}
+
+// pass 4 - anything valid the tree didn't reach gets put in lost+found, directories first so a
+// lost directory comes back with everything that was in it, then files so a lost file comes back
+// with its old versions, then any old versions whose file is gone
+func (fsck *fsckState) checkOrphans() {
+	sblock := fsck.sblock
+	lostFound, lostFoundNum := INode{}, 0
+	for pass := 0; pass < 3; pass++ {
+		wantDirs := pass == 0
+		for inodeNum := 1; inodeNum < sblock.InodeCount; inodeNum++ {
+			if !fsck.valid[inodeNum] || fsck.reached[inodeNum] || fsck.isDir[inodeNum] != wantDirs {
+				continue
+			}
+			if pass == 1 && fsck.version[inodeNum] {
+				continue //its file might still turn up
+			}
+			fsck.problem("inode %d isn't in any directory", inodeNum)
+			if !fsck.repair {
+				if wantDirs { //so the files in it don't get reported one by one as well
+					fsck.walkFrom(inodeNum, fsck.dotDot(inodeNum))
+				}
+				continue
+			}
+			if lostFoundNum == 0 {
+				if lostFound, lostFoundNum = fsck.lostAndFound(); lostFoundNum == 0 {
+					return
+				}
+			}
+			if !addDirectoryEntry(sblock, lostFound, fmt.Sprintf("#%d", inodeNum), inodeNum) {
+				fsck.problem("%s is full, inode %d is still lost", LOST_AND_FOUND, inodeNum)
+				continue
+			}
+			if wantDirs {
+				fsck.walkFrom(inodeNum, lostFoundNum) //fixes up its '..' and marks everything under it as found
+			} else {
+				fsck.reached[inodeNum] = true
+				fsck.checkVersions(inodeNum)
+			}
+			fsck.setFoundLinks(inodeNum)
+		}
+	}
+}
+
+// setFoundLinks gives an inode just linked into lost+found the link count it has there. addDirectoryEntry
+// added one to whatever it had, which counted the entry it lost as well. Its entry in lost+found is
+// the only one, a directory has its own '.' and the '..' of every directory in it as well, which
+// walkFrom has just counted
+func (fsck *fsckState) setFoundLinks(inodeNum int) {
+	inode := getInodeFromDisk(inodeNum)
+	inode.LinksCount = fsck.refs[inodeNum] + 1
+	writeInodeToDisk(&inode, inodeNum, fsck.sblock)
+}
+
+// dotDot is what a directory's '..' says its parent is
+func (fsck *fsckState) dotDot(dirNum int) int {
+	blocks := fsck.directoryBlocks(getInodeFromDisk(dirNum))
+	if len(blocks) == 0 {
+		return 0
+	}
+	return decodeDirectoryBlock(readBlock(fsck.sblock, blocks[0]))[1].Inode
+}
+
+// pass 5 - link counts and the superblock's free counts
+func (fsck *fsckState) checkLinkCounts() {
+	sblock := fsck.sblock
+	for inodeNum := 1; inodeNum < sblock.InodeCount; inodeNum++ {
+		if !fsck.valid[inodeNum] {
+			continue
+		}
+		inode := getInodeFromDisk(inodeNum)
+		if inode.LinksCount != fsck.refs[inodeNum] {
+			fsck.problem("inode %d has a link count of %d but %d entries point at it", inodeNum, inode.LinksCount, fsck.refs[inodeNum])
+			if fsck.repair {
+				inode.LinksCount = fsck.refs[inodeNum]
+				writeInodeToDisk(&inode, inodeNum, sblock)
+			}
+		}
+	}
+}
+
+func (fsck *fsckState) checkFreeCounts() {
+	sblock := ReadSuperBlock()
+	freeBlocks := freeBlockCount(sblock)
+	freeInodes := ReadINodeBitmap(sblock).CountFree()
+	if sblock.FreeBlocks != freeBlocks || sblock.FreeInodes != freeInodes {
+		fsck.problem("superblock says %d free blocks and %d free inodes but there are %d and %d",
+			sblock.FreeBlocks, sblock.FreeInodes, freeBlocks, freeInodes)
+		if fsck.repair {
+			updateFreeCounts()
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package FileSystem
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// TestFsckRelinksOrphans takes the entries for a file and a directory with a file in it out of the
+// root behind the file system's back. Fsck has to put both in lost+found with the link counts they
+// have there, without also reporting the counts addDirectoryEntry left them with, and a second Fsck
+// has to find nothing
+func TestFsckRelinksOrphans(t *testing.T) {
+	device := newTestFileSystem(t, 4<<20, DefaultOptions())
+	sblock := ReadSuperBlock()
+	fileNum := createTestFile(t, RootFolder, "file", "lost file")
+	_, dirNum := Open(CREATE, "dir", RootFolder)
+	_, dir := CreateDirectoryFile(sblock.RootDirInode, dirNum)
+	innerNum := createTestFile(t, dir, "inner", "lost with its directory")
+	root, _ := currentDirectory(RootFolder)
+	removeEntry(sblock, root, "file")
+	removeEntry(sblock, root, "dir")
+	remount(t, device)
+
+	report, err := Fsck(true)
+	if err != nil {
+		t.Fatalf("Fsck: %v", err)
+	}
+	for _, inodeNum := range []int{fileNum, dirNum} {
+		if !strings.Contains(strings.Join(report.Problems, "\n"), fmt.Sprintf("inode %d isn't in any directory", inodeNum)) {
+			t.Fatalf("Fsck didn't find inode %d was lost: %v", inodeNum, report.Problems)
+		}
+	}
+	for _, problem := range report.Problems {
+		for _, inodeNum := range []int{fileNum, dirNum, innerNum} {
+			if strings.HasPrefix(problem, fmt.Sprintf("inode %d has a link count", inodeNum)) {
+				t.Fatalf("Fsck complained about the link count it gave a relinked inode: %s", problem)
+			}
+		}
+	}
+	checkFsck(t)
+	remount(t, device)
+	checkFsck(t)
+	lostFound, _ := Open(READ, LOST_AND_FOUND, RootFolder)
+	if got, _ := readTestFile(lostFound, fmt.Sprint("#", fileNum)); got != "lost file" {
+		t.Fatalf("the lost file holds %q", got)
+	}
+	found, _ := Open(READ, fmt.Sprint("#", dirNum), lostFound)
+	if got, _ := readTestFile(found, "inner"); got != "lost with its directory" {
+		t.Fatalf("the file in the lost directory holds %q", got)
+	}
+	if links := getInodeFromDisk(dirNum).LinksCount; links != 2 {
+		t.Fatalf("the lost directory has %d links, its '.' and its entry make 2", links)
+	}
+}
+
+// TestFsckDuplicateNames gives the root two entries with the same name behind the file system's back,
+// which cutting long names short used to do. Fsck has to report it, keep the first and put the file
+// the second one pointed at in lost+found
+func TestFsckDuplicateNames(t *testing.T) {
+	device := newTestFileSystem(t, 4<<20, DefaultOptions())
+	sblock := ReadSuperBlock()
+	firstNum := createTestFile(t, RootFolder, "name", "first")
+	secondNum := createTestFile(t, RootFolder, "other", "second")
+	root, _ := currentDirectory(RootFolder)
+	entries := decodeDirectoryBlock(readBlock(sblock, root.DirectBlock1))
+	for entryNum, entry := range entries {
+		if entry.Inode == secondNum {
+			entries[entryNum] = newDirectoryEntry("name", secondNum)
+		}
+	}
+	writeBlock(sblock, root.DirectBlock1, EncodeToBytes(entries))
+	remount(t, device)
+
+	report, err := Fsck(true)
+	if err != nil {
+		t.Fatalf("Fsck: %v", err)
+	}
+	if !strings.Contains(strings.Join(report.Problems, "\n"), fmt.Sprintf("has more than one %q, removing the one pointing at inode %d", "name", secondNum)) {
+		t.Fatalf("Fsck didn't find the second entry for name: %v", report.Problems)
+	}
+	checkFsck(t)
+	remount(t, device)
+	checkFsck(t)
+	if got, inodeNum := readTestFile(RootFolder, "name"); inodeNum != firstNum || got != "first" {
+		t.Fatalf("name is inode %d holding %q, it should be inode %d", inodeNum, got, firstNum)
+	}
+	lostFound, _ := Open(READ, LOST_AND_FOUND, RootFolder)
+	if got, _ := readTestFile(lostFound, fmt.Sprint("#", secondNum)); got != "second" {
+		t.Fatalf("the file the second entry pointed at holds %q", got)
+	}
+}
+
+// TestFsckReadOnlyWithPendingJournal crashes while a transaction is in the journal and checks a read
+// only check can still be done: ReplayInMemory mounts it, sees the replayed blocks and Fsck finds it
+// clean, all without writing a byte, and a normal mount replays it afterwards
+func TestFsckReadOnlyWithPendingJournal(t *testing.T) {
+	image := formattedImage(t, 2<<20, DefaultOptions())
+	for limit := 1; ; limit++ {
+		device := newCrashDevice(image, limit)
+		if err := Mount(device); err != nil {
+			t.Fatalf("Mount: %v", err)
+		}
+		createTestFile(t, RootFolder, "file", "contents")
+		if err := Sync(); err != nil {
+			t.Fatalf("Sync: %v", err)
+		}
+		if limit > device.writes {
+			t.Fatalf("no crash point left a transaction to replay")
+		}
+		if err := MountWithOptions(device.persisted, MountOptions{ReadOnly: true}); !errors.Is(err, ErrNeedsRecovery) {
+			continue
+		}
+		before := append([]byte{}, device.persisted.data...)
+		if err := MountWithOptions(device.persisted, MountOptions{ReadOnly: true, ReplayInMemory: true}); err != nil {
+			t.Fatalf("read only mount replaying in memory: %v", err)
+		}
+		pending := LastMount().PendingBlocks
+		if pending == 0 || LastMount().ReplayedBlocks != 0 {
+			t.Fatalf("the mount says %+v", LastMount())
+		}
+		checkFsck(t)
+		if _, inodeNum := readTestFile(RootFolder, "file"); inodeNum == 0 {
+			t.Fatalf("the file the journal has isn't there")
+		}
+		if err := Sync(); err != nil {
+			t.Fatalf("Sync: %v", err)
+		}
+		if !bytes.Equal(before, device.persisted.data) {
+			t.Fatalf("a read only check changed the image")
+		}
+		if err := Mount(device.persisted); err != nil {
+			t.Fatalf("Mount: %v", err)
+		}
+		if LastMount().ReplayedBlocks != pending {
+			t.Fatalf("the replay after the check says %+v", LastMount())
+		}
+		checkFsck(t)
+		return
+	}
+}
@@ -0,0 +1,176 @@
+package FileSystem
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Inode cache
+// getInodeFromDisk keeps the inodes it decodes, so asking for the same inode again doesn't go back to
+// the inode table. Nothing has to remember to update it - whenever a block of the inode table gets
+// written, by writeInodeToDisk or anything else, the inodes in that block are dropped (see blockChanged).
+// An operation holds a reference to every inode it has locked, and those are never pushed out of the
+// cache while it works on them, the rest go least recently used first once there are too many.
+
+const DEFAULT_INODE_CACHE_SIZE = 1024
+
+type cachedInode struct {
+	inodeNum int
+	inode    INode
+	valid    bool //false when all we are keeping is the references
+	refs     int
+}
+
+type inodeCache struct {
+	lock     sync.Mutex
+	capacity int
+	inodes   map[int]*list.Element
+	lru      *list.List //most recently used at the front
+	//only here for the geometry, to work out which inodes a block of the inode table holds
+	sblock SuperBlock
+	//generation goes up whenever anything is dropped, a lookup that raced with a write doesn't keep
+	//what it read
+	generation uint64
+}
+
+// inodes is the inode cache for the mounted file system, nil while there isn't one
+var inodes *inodeCache
+
+// newNameCaches sets up empty inode and dentry caches for sblock's layout, only while holding
+// mountLock exclusively
+func newNameCaches(sblock SuperBlock) {
+	inodes = &inodeCache{
+		capacity: DEFAULT_INODE_CACHE_SIZE,
+		inodes:   map[int]*list.Element{},
+		lru:      list.New(),
+		sblock:   sblock,
+	}
+	dentries = newDentryCache(DEFAULT_DENTRY_CACHE_SIZE)
+}
+
+// dropNameCaches throws the caches away, for when the disk is changing under them
+func dropNameCaches() {
+	inodes = nil
+	dentries = nil
+}
+
+// blockChanged is called after a block is written, whatever the caches had from it is out of date
+func blockChanged(blockNum int) {
+	if inodes != nil {
+		inodes.dropBlock(blockNum)
+	}
+	if dentries != nil {
+		dentries.dropBlock(blockNum)
+	}
+}
+
+// lookup returns the cached inode, if we have it, and the generation to hand to add if we don't
+func (c *inodeCache) lookup(inodeNum int) (INode, bool, uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if element, ok := c.inodes[inodeNum]; ok && element.Value.(*cachedInode).valid {
+		c.lru.MoveToFront(element)
+		return element.Value.(*cachedInode).inode, true, c.generation
+	}
+	return INode{}, false, c.generation
+}
+
+// add keeps an inode that was read while the cache was at generation. If anything has been dropped
+// since, what was read might already be out of date, so it isn't kept
+func (c *inodeCache) add(inodeNum int, inode INode, generation uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if generation == c.generation {
+		c.setLocked(inodeNum, inode)
+	}
+}
+
+// set keeps an inode that has just been written, the caller holds inodeTableLock so it is the newest
+func (c *inodeCache) set(inodeNum int, inode INode) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.setLocked(inodeNum, inode)
+}
+
+func (c *inodeCache) setLocked(inodeNum int, inode INode) {
+	cached := c.entryLocked(inodeNum)
+	cached.inode = inode
+	cached.valid = true
+	c.shrinkLocked()
+}
+
+// entryLocked finds or makes the cache entry for an inode and moves it to the front
+func (c *inodeCache) entryLocked(inodeNum int) *cachedInode {
+	if element, ok := c.inodes[inodeNum]; ok {
+		c.lru.MoveToFront(element)
+		return element.Value.(*cachedInode)
+	}
+	cached := &cachedInode{inodeNum: inodeNum}
+	c.inodes[inodeNum] = c.lru.PushFront(cached)
+	return cached
+}
+
+// shrinkLocked pushes out the least recently used inodes nobody holds until we are down to capacity
+func (c *inodeCache) shrinkLocked() {
+	for element := c.lru.Back(); element != nil && c.lru.Len() > c.capacity; {
+		prev := element.Prev()
+		if element.Value.(*cachedInode).refs == 0 {
+			c.removeLocked(element)
+		}
+		element = prev
+	}
+}
+
+func (c *inodeCache) removeLocked(element *list.Element) {
+	c.lru.Remove(element)
+	delete(c.inodes, element.Value.(*cachedInode).inodeNum)
+}
+
+// hold takes a reference to each inode so they stay cached until release
+func (c *inodeCache) hold(inodeNums []int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, inodeNum := range inodeNums {
+		c.entryLocked(inodeNum).refs++
+	}
+}
+
+func (c *inodeCache) release(inodeNums []int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, inodeNum := range inodeNums {
+		if element, ok := c.inodes[inodeNum]; ok {
+			element.Value.(*cachedInode).refs--
+		}
+	}
+	c.shrinkLocked()
+}
+
+// setGeometry is for when the inode table grows
+func (c *inodeCache) setGeometry(sblock SuperBlock) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.sblock = sblock
+}
+
+// dropBlock forgets the inodes held in blockNum, if it is part of the inode table
+func (c *inodeCache) dropBlock(blockNum int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	first, ok := inodeTableBlock(c.sblock, blockNum)
+	if !ok {
+		return
+	}
+	c.generation++
+	for inodeNum := first; inodeNum < first+c.sblock.BlockSize/c.sblock.InodeSize; inodeNum++ {
+		element, ok := c.inodes[inodeNum]
+		if !ok {
+			continue
+		}
+		if cached := element.Value.(*cachedInode); cached.refs > 0 {
+			cached.valid = false //someone is holding it, keep the references
+		} else {
+			c.removeLocked(element)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package FileSystem
+
+import (
+	"container/list"
+	"testing"
+)
+
+// TestInodeCacheFollowsTableWrites checks a cached inode is served without going to the buffer
+// cache, and that writing its block of the inode table any way at all drops it
+func TestInodeCacheFollowsTableWrites(t *testing.T) {
+	newTestFileSystem(t, 2<<20, DefaultOptions())
+	sblock := ReadSuperBlock()
+	inodeNum := createTestFile(t, RootFolder, "file", "cached")
+	getInodeFromDisk(inodeNum)
+	before := BufferCacheStats()
+	inode := getInodeFromDisk(inodeNum)
+	if after := BufferCacheStats(); after.Hits != before.Hits || after.Misses != before.Misses {
+		t.Fatalf("a cached inode went to the buffer cache, %+v then %+v", before, after)
+	}
+
+	//change the inode straight in its block, the way a raw block write from anywhere would
+	inode.Version = 99
+	blockNum, offset := inodeLocation(sblock, inodeNum)
+	block := readBlock(sblock, blockNum)
+	copy(block[offset:offset+sblock.InodeSize], EncodeToBytes(&inode))
+	beginTransaction()
+	writeBlock(sblock, blockNum, block)
+	commitTransaction()
+	if got := getInodeFromDisk(inodeNum).Version; got != 99 {
+		t.Fatalf("after writing its block the inode reads back at version %d", got)
+	}
+}
+
+// TestInodeCacheKeepsHeldInodes fills a two inode cache past capacity and checks the least recently
+// used inode goes unless an operation is holding it, and that an inode read from before a drop
+// isn't kept
+func TestInodeCacheKeepsHeldInodes(t *testing.T) {
+	cache := &inodeCache{capacity: 2, inodes: map[int]*list.Element{}, lru: list.New()}
+	_, _, generation := cache.lookup(1)
+	cache.hold([]int{1})
+	cache.add(1, INode{Version: 1}, generation)
+	cache.add(2, INode{Version: 2}, generation)
+	cache.add(3, INode{Version: 3}, generation)
+	if _, ok, _ := cache.lookup(2); ok {
+		t.Fatalf("inode 2 was the least recently used one nobody held, it should have gone")
+	}
+	for _, inodeNum := range []int{1, 3} {
+		if inode, ok, _ := cache.lookup(inodeNum); !ok || inode.Version != inodeNum {
+			t.Fatalf("inode %d is %v %+v", inodeNum, ok, inode)
+		}
+	}
+	cache.release([]int{1})
+	cache.add(4, INode{Version: 4}, generation)
+	if _, ok, _ := cache.lookup(1); ok {
+		t.Fatalf("inode 1 stayed cached after it was released and pushed out")
+	}
+
+	_, _, stale := cache.lookup(5)
+	cache.generation++ //what a write to the inode table does
+	cache.add(5, INode{Version: 5}, stale)
+	if _, ok, _ := cache.lookup(5); ok {
+		t.Fatalf("kept an inode read before the table was written")
+	}
+}
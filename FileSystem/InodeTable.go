@@ -0,0 +1,196 @@
+package FileSystem
+
+import "fmt"
+
+// Growing inode table
+// The inode table used to be whatever size Format made it, and running out of inodes was the end of
+// the line however many free blocks there were. Now when the inode bitmap is full createNewInode grows
+// the table by another chunk: a run of free blocks holding a bitmap block for the chunk's inodes
+// followed by the inodes themselves, allocated near where the inode was wanted. InodeMap in the
+// superblock has where each chunk is, so there is room for INODE_MAP_SIZE of them. Chunks are never
+// given back.
+//
+// The numbers of the chunks' inodes can't depend on how many block groups there are, or a resize
+// would have to renumber them and everything that points at them. Format puts InodeChunkBase straight
+// after the inodes it made and keeps INODE_MAP_SIZE chunks' worth of numbers from there on for the
+// chunks. Groups a resize adds get numbers after all of those, groups it takes away leave their
+// numbers unused. Numbers below InodeCount that nothing backs - those, and the chunks not made yet
+// when there are groups after them - are holes (see inodeHoles): they stay in use in the inode bitmap
+// and read as invalid inodes.
+//
+// Everything that works out where an inode is goes through inodeLocation, which looks at the superblock
+// again for an inode past the end of the table it was given, in case the table has grown since the
+// caller read the superblock.
+
+const (
+	FEATURE_INCOMPAT_DYNAMIC_INODES uint32 = 1 << 2
+
+	INODE_MAP_SIZE     = 32 //chunks the inode table can grow by, the map has to fit in the superblock
+	INODE_CHUNK_BLOCKS = 64 //inode table blocks in a chunk, unless that is more than its bitmap block can cover
+)
+
+func dynamicInodesEnabled(sblock SuperBlock) bool {
+	return sblock.FeatureIncompat&FEATURE_INCOMPAT_DYNAMIC_INODES != 0
+}
+
+// inodesPerChunk is how many inodes Format puts in each chunk, always a whole number of words of bitmap
+// and blocks of inode table
+func inodesPerChunk(blockSize int, inodeSize int) int {
+	return min(INODE_CHUNK_BLOCKS*blockSize/inodeSize, blockSize*8)
+}
+
+// chunkReserve is how many inode numbers from InodeChunkBase on are kept for the chunks
+func chunkReserve(sblock SuperBlock) int {
+	if !dynamicInodesEnabled(sblock) {
+		return 0
+	}
+	return INODE_MAP_SIZE * sblock.InodesPerChunk
+}
+
+// inodeChunk is the chunk whose numbers inodeNum is one of, -1 if it isn't a chunk's. The chunk might
+// not have been made yet
+func inodeChunk(sblock SuperBlock, inodeNum int) int {
+	if !dynamicInodesEnabled(sblock) || inodeNum < sblock.InodeChunkBase || inodeNum >= sblock.InodeChunkBase+chunkReserve(sblock) {
+		return -1
+	}
+	return (inodeNum - sblock.InodeChunkBase) / sblock.InodesPerChunk
+}
+
+// inodeSpan is what InodeCount has to be, one more than the highest inode number there is
+func inodeSpan(sblock SuperBlock) int {
+	groupsEnd := groupInodeBase(sblock, groupCount(sblock)-1) + groupInodes(sblock)
+	if !dynamicInodesEnabled(sblock) {
+		return groupsEnd
+	}
+	return max(groupsEnd, sblock.InodeChunkBase+sblock.InodeChunks*sblock.InodesPerChunk)
+}
+
+// inodeHoles is the runs of numbers below InodeCount no inode has, each one from its start up to its
+// end: what a resize left between the groups and InodeChunkBase, and the chunks not made yet if there
+// are groups after them
+func inodeHoles(sblock SuperBlock) [][2]int {
+	if !dynamicInodesEnabled(sblock) || !blockGroupsEnabled(sblock) {
+		return nil
+	}
+	holes := [][2]int{}
+	base, groupsEnd := sblock.InodeChunkBase, groupCount(sblock)*sblock.InodesPerGroup
+	if groupsEnd < base {
+		holes = append(holes, [2]int{groupsEnd, base})
+	}
+	if groupsEnd > base && sblock.InodeChunks < INODE_MAP_SIZE {
+		holes = append(holes, [2]int{base + sblock.InodeChunks*sblock.InodesPerChunk, base + chunkReserve(sblock)})
+	}
+	return holes
+}
+
+// isInodeHole is true if no inode has the number inodeNum
+func isInodeHole(sblock SuperBlock, inodeNum int) bool {
+	for _, hole := range inodeHoles(sblock) {
+		if inodeNum >= hole[0] && inodeNum < hole[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// usableInodes is how many inodes there really are, InodeCount without the holes
+func usableInodes(sblock SuperBlock) int {
+	count := sblock.InodeCount
+	for _, hole := range inodeHoles(sblock) {
+		count -= hole[1] - hole[0]
+	}
+	return count
+}
+
+// reserveInodeHoles marks the holes in use in a freshly made or loaded inode bitmap
+func reserveInodeHoles(sblock SuperBlock, bitmap *Bitmap) {
+	for _, hole := range inodeHoles(sblock) {
+		bitmap.reserve(hole[0], hole[1])
+	}
+}
+
+// chunkTableBlocks is how many blocks of inodes each chunk has, not counting its bitmap block
+func chunkTableBlocks(sblock SuperBlock) int {
+	return sblock.InodesPerChunk * sblock.InodeSize / sblock.BlockSize
+}
+
+// maxInodes is the most inodes the file system can ever have
+func maxInodes(sblock SuperBlock) int {
+	if !dynamicInodesEnabled(sblock) {
+		return sblock.InodeCount
+	}
+	return max(sblock.InodeCount, sblock.InodeChunkBase+chunkReserve(sblock))
+}
+
+// inodeChunkBlock says which chunk a block belongs to, -1 if it isn't in any of them
+func inodeChunkBlock(sblock SuperBlock, blockNum int) int {
+	for chunk := 0; chunk < sblock.InodeChunks; chunk++ {
+		if blockNum >= sblock.InodeMap[chunk] && blockNum <= sblock.InodeMap[chunk]+chunkTableBlocks(sblock) {
+			return chunk
+		}
+	}
+	return -1
+}
+
+// chunkInodeLocation is inodeLocation for an inode in one of the chunks
+func chunkInodeLocation(sblock SuperBlock, inodeNum int) (int, int) {
+	inodesPerBlock := sblock.BlockSize / sblock.InodeSize
+	chunk, index := (inodeNum-sblock.InodeChunkBase)/sblock.InodesPerChunk, (inodeNum-sblock.InodeChunkBase)%sblock.InodesPerChunk
+	return sblock.InodeMap[chunk] + 1 + index/inodesPerBlock, index % inodesPerBlock * sblock.InodeSize
+}
+
+// growInodeTable adds a chunk to the inode table, in the block group of block near if there is room
+// there. It is false if the table can't grow any more or there isn't a long enough run of free blocks.
+// Whoever gets here second finds the inodes the first one made and doesn't make more
+func growInodeTable(near int) bool {
+	superBlockLock.Lock()
+	defer superBlockLock.Unlock()
+	sblock := ReadSuperBlock()
+	if !dynamicInodesEnabled(sblock) || sblock.InodeChunks >= INODE_MAP_SIZE {
+		return false
+	}
+	inodeBits := ReadINodeBitmap(sblock)
+	if inodeBits.CountFree() > 0 {
+		return true
+	}
+	start := allocateRunOf(sblock, near, 1+chunkTableBlocks(sblock))
+	if start < 0 {
+		return false
+	}
+	for blockNum := start; blockNum <= start+chunkTableBlocks(sblock); blockNum++ {
+		writeBlock(sblock, blockNum, nil) //an empty bitmap and a table of invalid inodes
+	}
+	chunk := sblock.InodeChunks
+	sblock.InodeMap[chunk] = start
+	sblock.InodeChunks++
+	sblock.InodeCount = inodeSpan(sblock)
+	writeSuperBlock(sblock)
+	inodeBits.addChunk(sblock.InodeChunkBase+chunk*sblock.InodesPerChunk, sblock.InodesPerChunk, start)
+	if inodes != nil {
+		inodes.setGeometry(sblock)
+	}
+	return true
+}
+
+// checkInodeTable makes sure the inode chunks in a superblock are somewhere sensible
+func checkInodeTable(sblock SuperBlock) error {
+	if !dynamicInodesEnabled(sblock) {
+		if sblock.InodeChunks != 0 {
+			return fmt.Errorf("the inode table has %d extra chunks but can't grow", sblock.InodeChunks)
+		}
+		return nil
+	}
+	if sblock.InodesPerChunk <= 0 || sblock.InodesPerChunk%bitsPerWord != 0 || sblock.InodesPerChunk > sblock.BlockSize*8 ||
+		sblock.InodesPerChunk*sblock.InodeSize%sblock.BlockSize != 0 || sblock.InodeChunks < 0 || sblock.InodeChunks > INODE_MAP_SIZE ||
+		sblock.InodeChunkBase <= sblock.RootDirInode || blockGroupsEnabled(sblock) && sblock.InodeChunkBase%sblock.InodesPerGroup != 0 ||
+		sblock.InodeCount != inodeSpan(sblock) {
+		return fmt.Errorf("inode table chunks of %d inodes from inode %d on don't fit %d inodes",
+			sblock.InodesPerChunk, sblock.InodeChunkBase, sblock.InodeCount)
+	}
+	for chunk := 0; chunk < sblock.InodeChunks; chunk++ {
+		if start := sblock.InodeMap[chunk]; start < sblock.DataBlockStart || start+chunkTableBlocks(sblock) >= sblock.BlockCount {
+			return fmt.Errorf("inode table chunk %d at block %d is off the end of the disk", chunk, start)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,583 @@
+package FileSystem
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"sync"
+)
+
+// Journal
+// Creating a file writes the inode bitmap, the inode and the directory block one after another, so
+// a crash in between used to leave them disagreeing. Now every metadata write an operation makes
+// goes into the running transaction instead of straight to Disk. When the operation finishes the
+// transaction gets committed: the new block contents go into the journal behind a descriptor, then
+// a commit block with a checksum of all of it. Only once the commit block is safely down do the
+// blocks get written to their real homes (the checkpoint), after which the journal header moves on
+// to the next sequence number. If we crash before the commit block is written the transaction
+// never happened, if we crash after it Mount finds the commit and writes the blocks again.
+// The journal only ever holds one transaction because we checkpoint straight after every commit.
+//
+// A transaction never gets split, that would lose the all or nothing. Every operation that changes
+// things reserves the most blocks it could put in the transaction (operationBlocks) before it locks
+// anything, and waits for the running transaction to commit if it hasn't got room for that many.
+// Format makes the journal big enough for an operation and changing the settings operationBlocks
+// depends on fails if the journal can't hold it any more. Operations that could touch any number
+// of blocks - emptying the trash, cutting back every file's versions, moving things out of the way
+// of a resize - are done as a series of small ones, each leaving everything consistent.
+//
+// What happens to file contents depends on the data mode picked at mount time:
+//   DATA_ORDERED   - the default. Data blocks are held until commit and written (and synced) before
+//                    the journal, so metadata never points at blocks that still hold old garbage
+//   DATA_WRITEBACK - data goes straight to Disk with no ordering at all, fastest but after a crash
+//                    a file can have the new size and the old contents
+//   DATA_JOURNAL   - data goes through the journal like metadata, so a Write is all or nothing
+
+const FEATURE_COMPAT_JOURNAL uint32 = 1 << 0
+
+const (
+	JOURNAL_MAGIC      = 0x4c4e524a //"JRNL"
+	JOURNAL_HEADER     = 1
+	JOURNAL_DESCRIPTOR = 2
+	JOURNAL_COMMIT     = 3
+
+	MIN_JOURNAL_BLOCKS = 32
+	MAX_JOURNAL_BLOCKS = 8192
+
+	JOURNAL_SLACK_BLOCKS = 32 //room on top of an operation for the bitmaps and backups of a file system grown bigger
+	JOURNAL_VERSIONS     = 16 //old versions of every file the default journal leaves room for
+)
+
+const (
+	DATA_ORDERED = iota
+	DATA_WRITEBACK
+	DATA_JOURNAL
+)
+
+var ErrNeedsRecovery = errors.New("journal has a transaction that needs replaying, mount read/write to recover it")
+
+// dataMode is how file contents are written, one of the DATA_ constants, set by Mount
+var dataMode int
+
+// transaction is what an operation has written but that isn't on Disk yet
+type transaction struct {
+	sblock    SuperBlock
+	blocks    map[int][]byte //block number to its new contents, these go through the journal
+	order     []int          //block numbers in the order they were first written
+	data      map[int][]byte //file contents held back in DATA_ORDERED mode
+	dataOrder []int
+	released  []int //physical blocks a copy on write commit can let go of once it is done
+	freed     []int //logical blocks the bitmap gave back, a copy on write commit unmaps them
+}
+
+// runningTransaction is nil unless an operation is in progress on a journaled file system.
+// Operations call other operations (Open calls createNewInode, fsck calls Write) so they nest, and
+// operations in other goroutines join the same transaction. transactionDepth counts how many are
+// in it and the last one out really commits. Both belong to transactionLock
+var runningTransaction *transaction
+var transactionDepth int
+
+// transactionCredits is how many blocks the operations in the running transaction have reserved,
+// it belongs to transactionLock too. transactionCommitted wakes up operations waiting for room
+var transactionCredits int
+var transactionCommitted = sync.NewCond(&transactionLock)
+
+// commitErr is why a commit couldn't be done, nil if they all have been. A copy on write commit that
+// can't find room leaves Disk as the last one did and the file system read only, and Sync reports
+// it. It belongs to transactionLock
+var commitErr error
+
+// operationCredits is what each operation reserves, operationBlocks for the settings in use. Mount,
+// Format and whatever changes the settings work it out, so it belongs to mountLock
+var operationCredits int
+
+func journalEnabled(sblock SuperBlock) bool {
+	return sblock.FeatureCompat&FEATURE_COMPAT_JOURNAL != 0 && sblock.JournalBlocks > 0
+}
+
+// descriptorBlocks is how many blocks a descriptor listing count block numbers takes up
+func descriptorBlocks(blockSize int, count int) int {
+	return (16 + count*4 + blockSize - 1) / blockSize
+}
+
+// transactionCapacity is the most blocks a transaction can hold - the header, the descriptor
+// and the commit block all have to fit in the journal alongside them
+func transactionCapacity(sblock SuperBlock) int {
+	capacity := sblock.JournalBlocks - 3
+	for capacity > 0 && 2+descriptorBlocks(sblock.BlockSize, capacity)+capacity > sblock.JournalBlocks {
+		capacity--
+	}
+	return capacity
+}
+
+// journalBlocksFor is how big a journal has to be for a transaction of count blocks
+func journalBlocksFor(blockSize int, count int) int {
+	return 2 + descriptorBlocks(blockSize, count) + count
+}
+
+// operationBlocks is the most blocks one operation can put in a transaction with versions old versions
+// kept, the trash on or off and data mode mode. An operation changes a handful of inodes - the file,
+// its directory, the trash and its index, the version it saves and the ones it drops - and each of
+// those is a block of the inode table and a block of the inode bitmap. Every directory it changes
+// can split a leaf and an index node on every level, the superblock can get written everywhere it
+// is kept, and the free block bitmap only changes where the blocks it allocates and frees are, which
+// is never more than a file's worth for each version it touches. A new inode table chunk gets zeroed
+// through the journal, the trash index is metadata and gets rewritten whole, and with DATA_JOURNAL
+// so does the file
+func operationBlocks(sblock SuperBlock, versions int, trash bool, mode int) int {
+	fileBlocks := maxFileBlocks(sblock) + 1 //and its indirect block
+	inodes := versions + 6
+	directoryBlocks := 2*DIR_INDEX_MAX_LEVELS + 6
+	blocks := 1 + len(superBlockBackups(sblock)) + 2*inodes + 3*directoryBlocks + 4
+	changed := (versions+3)*fileBlocks + 3*directoryBlocks
+	if dynamicInodesEnabled(sblock) {
+		blocks += 1 + chunkTableBlocks(sblock)
+		changed += 1 + chunkTableBlocks(sblock)
+	}
+	if trash {
+		blocks += fileBlocks
+		changed += 2 * fileBlocks
+	}
+	if mode == DATA_JOURNAL {
+		blocks += fileBlocks
+	}
+	bitmapBlocks, _ := freeBlockBitmapLayout(sblock)
+	return blocks + min(len(bitmapBlocks), changed)
+}
+
+// journalRoom is what each operation has to reserve with these settings, or an error if the journal
+// can't hold that many. Nothing needs reserving without a journal
+func journalRoom(sblock SuperBlock, versions int, trash bool, mode int) (int, error) {
+	if !journalEnabled(sblock) || cowEnabled(sblock) {
+		return 0, nil
+	}
+	need := operationBlocks(sblock, versions, trash, mode)
+	if capacity := transactionCapacity(sblock); need > capacity {
+		return 0, fmt.Errorf("the journal only has room for %d blocks and an operation can need %d", capacity, need)
+	}
+	return need, nil
+}
+
+// defaultJournalBlocks is a sixty-fourth of the disk, or more if that isn't enough for an operation.
+// If it takes no more than an eighth of the disk there is room for the trash, some versions and
+// DATA_JOURNAL as well, if no more than a quarter for the trash and the versions, and otherwise for
+// an operation with everything turned off. Settings the journal is too small for get refused when
+// they are asked for. It has to fit in room, and is 0 if not even the smallest will
+func defaultJournalBlocks(sblock SuperBlock, room int) int {
+	journalBlocks := min(max(sblock.BlockCount/64, MIN_JOURNAL_BLOCKS), MAX_JOURNAL_BLOCKS)
+	for _, size := range []struct {
+		versions int
+		trash    bool
+		mode     int
+		limit    int
+	}{
+		{JOURNAL_VERSIONS, true, DATA_JOURNAL, sblock.BlockCount / 8},
+		{JOURNAL_VERSIONS, true, DATA_ORDERED, sblock.BlockCount / 4},
+		{0, false, DATA_ORDERED, room},
+	} {
+		need := journalBlocksFor(sblock.BlockSize, operationBlocks(sblock, size.versions, size.trash, size.mode)+JOURNAL_SLACK_BLOCKS)
+		if need <= min(max(size.limit, journalBlocks), room) {
+			return min(max(journalBlocks, need), room)
+		}
+	}
+	return 0
+}
+
+// beginOperation starts an exported operation that changes things. It reserves room in the running
+// transaction for everything the operation could write, waiting for it to commit if there isn't that
+// much left, and then joins it. It has to come before the operation locks any inodes: whatever is
+// in the transaction might be waiting for them. endOperation finishes it
+func beginOperation() {
+	transactionLock.Lock()
+	defer transactionLock.Unlock()
+	for operationCredits > 0 && transactionDepth > 0 &&
+		transactionCredits+operationCredits > transactionCapacity(readSuperBlockLocked()) {
+		transactionCommitted.Wait()
+	}
+	transactionCredits += operationCredits
+	joinTransaction()
+}
+
+// endOperation finishes what beginOperation started. With the operation out of the way it is a good
+// time to see whether the trash needs emptying to make space
+func endOperation() {
+	commitTransaction()
+	purgeTrashForSpace(0)
+}
+
+// beginTransaction starts a transaction, or joins the one already running. Operations call it for
+// whatever they do inside an operation, or on their own when they have the file system to themselves
+func beginTransaction() {
+	transactionLock.Lock()
+	defer transactionLock.Unlock()
+	joinTransaction()
+}
+
+// joinTransaction is beginTransaction for when we already hold transactionLock
+func joinTransaction() {
+	transactionDepth++
+	if transactionDepth > 1 || readOnly {
+		return
+	}
+	startTransaction(readSuperBlockLocked())
+}
+
+// startTransaction makes the running transaction, if there is anything that needs one
+func startTransaction(sblock SuperBlock) {
+	if journalEnabled(sblock) || cow != nil {
+		runningTransaction = &transaction{sblock: sblock, blocks: map[int][]byte{}, data: map[int][]byte{}}
+	}
+}
+
+// commitTransaction ends the operation, committing the transaction if it was the last one in it.
+// Nothing can read or join while the commit is going on
+func commitTransaction() {
+	transactionLock.Lock()
+	defer transactionLock.Unlock()
+	transactionDepth--
+	if transactionDepth > 0 {
+		return
+	}
+	transactionCredits = 0
+	transactionCommitted.Broadcast()
+	if runningTransaction == nil {
+		return
+	}
+	running := runningTransaction
+	runningTransaction = nil
+	if cow != nil {
+		running.commitCowOrFail()
+		return
+	}
+	running.commit()
+}
+
+// lastCommitError is commitErr, for Sync
+func lastCommitError() error {
+	transactionLock.Lock()
+	defer transactionLock.Unlock()
+	return commitErr
+}
+
+// dropTransaction forgets anything in progress, used when Disk gets replaced underneath us
+func dropTransaction() {
+	runningTransaction = nil
+	transactionDepth = 0
+	transactionCredits = 0
+	commitErr = nil
+}
+
+// add puts a block in the transaction. Everything in it reserved room first, so running out means
+// operationBlocks is wrong - nothing of the transaction is on Disk yet, stopping leaves it as it was
+func (running *transaction) add(blockNum int, block []byte) {
+	if _, ok := running.blocks[blockNum]; !ok {
+		if cow == nil && len(running.order) >= transactionCapacity(running.sblock) {
+			log.Fatal("Transaction has outgrown the journal, ", len(running.order), " blocks")
+		}
+		running.order = append(running.order, blockNum)
+	}
+	running.blocks[blockNum] = block
+}
+
+// addData holds back a block of file contents until commit, for DATA_ORDERED
+func (running *transaction) addData(blockNum int, block []byte) {
+	if _, ok := running.data[blockNum]; !ok {
+		running.dataOrder = append(running.dataOrder, blockNum)
+	}
+	running.data[blockNum] = block
+	blockChanged(blockNum)
+}
+
+// forget drops the transaction's copy of a block that is about to be written some other way. A block
+// freed as metadata can come back as file contents in the same transaction, and the old metadata
+// mustn't hide the new contents from readBlock or get checkpointed over them
+func (running *transaction) forget(blockNum int) {
+	if _, ok := running.blocks[blockNum]; ok {
+		delete(running.blocks, blockNum)
+		running.order = removeBlockNum(running.order, blockNum)
+	}
+	if _, ok := running.data[blockNum]; ok {
+		delete(running.data, blockNum)
+		running.dataOrder = removeBlockNum(running.dataOrder, blockNum)
+	}
+}
+
+func removeBlockNum(blockNums []int, blockNum int) []int {
+	for num, other := range blockNums {
+		if other == blockNum {
+			return append(blockNums[:num], blockNums[num+1:]...)
+		}
+	}
+	return blockNums
+}
+
+// lookup returns the transaction's copy of a block, nil if the transaction hasn't written it
+func (running *transaction) lookup(blockNum int) []byte {
+	if block, ok := running.blocks[blockNum]; ok {
+		return append([]byte{}, block...)
+	}
+	if block, ok := running.data[blockNum]; ok {
+		return append([]byte{}, block...)
+	}
+	return nil
+}
+
+func journalBlockHeader(blockType uint32, sequence uint32, blockSize int) []byte {
+	block := make([]byte, blockSize)
+	byteOrder.PutUint32(block[0:], JOURNAL_MAGIC)
+	byteOrder.PutUint32(block[4:], blockType)
+	byteOrder.PutUint32(block[8:], sequence)
+	return block
+}
+
+func isJournalBlock(block []byte, blockType uint32, sequence uint32) bool {
+	return byteOrder.Uint32(block[0:]) == JOURNAL_MAGIC && byteOrder.Uint32(block[4:]) == blockType &&
+		byteOrder.Uint32(block[8:]) == sequence
+}
+
+// syncDisk writes back everything in the buffer cache and waits for the device to have it
+func syncDisk() {
+	flushCache()
+	if err := Disk.Sync(); err != nil {
+		log.Fatal("Unable to sync the disk: ", err)
+	}
+}
+
+// syncBlocks is syncDisk for just the listed blocks, for when nothing else in the cache has to be down
+// before them
+func syncBlocks(blockNums []int) {
+	cache.writeBackBlocks(blockNums)
+	if err := Disk.Sync(); err != nil {
+		log.Fatal("Unable to sync the disk: ", err)
+	}
+}
+
+// journalSequence is the sequence number the next transaction gets, from the journal header
+func journalSequence(sblock SuperBlock) (uint32, error) {
+	header := readBlockFromDisk(sblock, sblock.JournalStart) //only ever written straight to Disk
+	if byteOrder.Uint32(header[0:]) != JOURNAL_MAGIC || byteOrder.Uint32(header[4:]) != JOURNAL_HEADER {
+		return 0, fmt.Errorf("journal header at block %d is damaged", sblock.JournalStart)
+	}
+	return byteOrder.Uint32(header[8:]), nil
+}
+
+// commit writes the transaction to the journal and then checkpoints it. The whole cache gets written
+// back once, before anything goes in the journal: ordered data and whatever else was written straight
+// to the cache since the last commit (data with no transaction running, or in DATA_WRITEBACK) can be
+// pointed at by the metadata in the transaction, so it has to be down first. Blocks left dirty in the
+// cache are never lost by a commit, they just go to the device with it. After that only the journal
+// blocks and the checkpoint are written back
+func (running *transaction) commit() {
+	sblock := running.sblock
+	if freeBlockBitmap != nil {
+		defer freeBlockBitmap.releaseHeld() //only once the transaction that freed them is down
+	}
+	hadData := len(running.dataOrder) > 0
+	for _, blockNum := range running.dataOrder {
+		writeBlockToDisk(sblock, blockNum, running.data[blockNum])
+	}
+	running.data = map[int][]byte{}
+	running.dataOrder = nil
+	if len(running.order) == 0 {
+		if hadData {
+			syncDisk()
+		}
+		return
+	}
+	syncDisk()
+	sequence, err := journalSequence(sblock)
+	if err != nil {
+		log.Fatal(err)
+	}
+	numDescriptorBlocks := descriptorBlocks(sblock.BlockSize, len(running.order))
+	descriptor := make([]byte, numDescriptorBlocks*sblock.BlockSize)
+	copy(descriptor, journalBlockHeader(JOURNAL_DESCRIPTOR, sequence, sblock.BlockSize))
+	byteOrder.PutUint32(descriptor[12:], uint32(len(running.order)))
+	for num, blockNum := range running.order {
+		byteOrder.PutUint32(descriptor[16+num*4:], uint32(blockNum))
+	}
+	checksum := crc32.Checksum(descriptor, crcTable)
+	for num := 0; num < numDescriptorBlocks; num++ {
+		writeBlockToDisk(sblock, sblock.JournalStart+1+num, descriptor[num*sblock.BlockSize:(num+1)*sblock.BlockSize])
+	}
+	firstCopy := sblock.JournalStart + 1 + numDescriptorBlocks
+	journalBlocks := make([]int, 0, numDescriptorBlocks+len(running.order))
+	for num := 0; num < numDescriptorBlocks+len(running.order); num++ {
+		journalBlocks = append(journalBlocks, sblock.JournalStart+1+num)
+	}
+	for num, blockNum := range running.order {
+		checksum = crc32.Update(checksum, crcTable, running.blocks[blockNum])
+		writeBlockToDisk(sblock, firstCopy+num, running.blocks[blockNum])
+	}
+	syncBlocks(journalBlocks) //everything has to be in the journal before the commit block says it is
+	commitBlock := journalBlockHeader(JOURNAL_COMMIT, sequence, sblock.BlockSize)
+	byteOrder.PutUint32(commitBlock[12:], checksum)
+	writeBlockToDisk(sblock, firstCopy+len(running.order), commitBlock)
+	syncBlocks([]int{firstCopy + len(running.order)})
+
+	for _, blockNum := range running.order {
+		writeBlockToDisk(sblock, blockNum, running.blocks[blockNum])
+	}
+	syncBlocks(running.order) //and the checkpoint has to be down before the journal forgets the transaction
+	writeBlockToDisk(sblock, sblock.JournalStart, journalBlockHeader(JOURNAL_HEADER, sequence+1, sblock.BlockSize))
+	running.blocks = map[int][]byte{}
+	running.order = nil
+}
+
+// committedTransaction reads the transaction in the journal back, returning the block numbers and
+// their contents, or nothing if there isn't a complete committed one
+func committedTransaction(sblock SuperBlock) ([]int, [][]byte, error) {
+	sequence, err := journalSequence(sblock)
+	if err != nil {
+		return nil, nil, err
+	}
+	descriptor := readBlock(sblock, sblock.JournalStart+1)
+	if !isJournalBlock(descriptor, JOURNAL_DESCRIPTOR, sequence) {
+		return nil, nil, nil
+	}
+	count := int(byteOrder.Uint32(descriptor[12:]))
+	if count <= 0 || count > transactionCapacity(sblock) {
+		return nil, nil, nil
+	}
+	numDescriptorBlocks := descriptorBlocks(sblock.BlockSize, count)
+	for num := 1; num < numDescriptorBlocks; num++ {
+		descriptor = append(descriptor, readBlock(sblock, sblock.JournalStart+1+num)...)
+	}
+	checksum := crc32.Checksum(descriptor, crcTable)
+	firstCopy := sblock.JournalStart + 1 + numDescriptorBlocks
+	blockNums := make([]int, count)
+	blocks := make([][]byte, count)
+	for num := range blockNums {
+		blockNums[num] = int(byteOrder.Uint32(descriptor[16+num*4:]))
+		if blockNums[num] >= sblock.BlockCount {
+			return nil, nil, nil
+		}
+		blocks[num] = readBlock(sblock, firstCopy+num)
+		checksum = crc32.Update(checksum, crcTable, blocks[num])
+	}
+	commitBlock := readBlock(sblock, firstCopy+count)
+	if !isJournalBlock(commitBlock, JOURNAL_COMMIT, sequence) || byteOrder.Uint32(commitBlock[12:]) != checksum {
+		return nil, nil, nil //we crashed before the commit, so as far as anyone knows it never happened
+	}
+	return blockNums, blocks, nil
+}
+
+// journalNeedsRecovery is true if there is a committed transaction that may not have been checkpointed
+func journalNeedsRecovery(sblock SuperBlock) (bool, error) {
+	blockNums, _, err := committedTransaction(sblock)
+	return len(blockNums) > 0, err
+}
+
+// recoverJournal replays a committed transaction left behind by a crash and returns how many blocks
+// it had. Writing the blocks again is harmless if the checkpoint had actually finished, so there's no
+// need to work out how far it got
+func recoverJournal(sblock SuperBlock) (int, error) {
+	blockNums, blocks, err := committedTransaction(sblock)
+	if err != nil || len(blockNums) == 0 {
+		return 0, err
+	}
+	sequence, _ := journalSequence(sblock)
+	for num, blockNum := range blockNums {
+		writeBlockToDisk(sblock, blockNum, blocks[num])
+	}
+	syncDisk()
+	writeBlockToDisk(sblock, sblock.JournalStart, journalBlockHeader(JOURNAL_HEADER, sequence+1, sblock.BlockSize))
+	return len(blockNums), nil
+}
+
+// writeDataBlock writes file contents the way the data mode says to
+func writeDataBlock(sblock SuperBlock, blockNum int, data []byte) {
+	if cow != nil {
+		writeBlock(sblock, blockNum, data) //copy on write treats everything the same
+		return
+	}
+	transactionLock.Lock()
+	defer transactionLock.Unlock()
+	if runningTransaction == nil || dataMode == DATA_WRITEBACK {
+		if runningTransaction != nil {
+			runningTransaction.forget(blockNum)
+		}
+		writeBlockToDisk(sblock, blockNum, data)
+		return
+	}
+	if dataMode == DATA_JOURNAL {
+		writeBlockLocked(sblock, blockNum, data)
+		return
+	}
+	checkWritable()
+	if blockNum < 0 || blockNum >= sblock.BlockCount {
+		log.Fatal("Tried to write block ", blockNum, " which isn't on the disk")
+	}
+	block := make([]byte, sblock.BlockSize)
+	copy(block, data)
+	runningTransaction.forget(blockNum)
+	runningTransaction.addData(blockNum, block)
+}
+
+// freeDataBlock gives a block back to the free block bitmap. In DATA_ORDERED mode whatever gets
+// written into a block taken in the running transaction goes to Disk before the metadata that freed
+// it commits, and a crash in between would leave the old owner pointing at it. So the bitmap holds
+// on to it until the transaction commits, the journal does the same for metadata by keeping it in
+// the transaction
+func freeDataBlock(sblock SuperBlock, blockNum int) {
+	freeBlocks := ReadFreeBlockBitmap(sblock)
+	transactionLock.Lock()
+	defer transactionLock.Unlock()
+	if cow != nil {
+		freeBlocks.Clear(blockNum)
+		if runningTransaction != nil {
+			runningTransaction.freed = append(runningTransaction.freed, blockNum)
+			return
+		}
+		//like writeBlock, outside a transaction it gets one of its own
+		startTransaction(sblock)
+		running := runningTransaction
+		runningTransaction = nil
+		running.freed = append(running.freed, blockNum)
+		running.commitCowOrFail()
+		return
+	}
+	if runningTransaction != nil && dataMode == DATA_ORDERED {
+		freeBlocks.hold(blockNum)
+		return
+	}
+	freeBlocks.Clear(blockNum)
+}
+
+// mountJournal replays the journal if the last mount crashed, a read only mount can't so it refuses
+// (unless it asked for replayInMemory). It returns how many blocks got replayed
+func mountJournal(sblock SuperBlock, readOnly bool) (int, error) {
+	needsRecovery, err := journalNeedsRecovery(sblock)
+	if err != nil {
+		return 0, err
+	}
+	if !needsRecovery {
+		return 0, nil
+	}
+	if readOnly {
+		return 0, ErrNeedsRecovery
+	}
+	return recoverJournal(sblock)
+}
+
+// replayInMemory puts the transaction the journal still has to replay in front of Disk without writing
+// anything, for a read only look at a crashed file system. It is nil if there is nothing to replay
+func replayInMemory(sblock SuperBlock) (*replayDevice, error) {
+	blockNums, blocks, err := committedTransaction(sblock)
+	if err != nil || len(blockNums) == 0 {
+		return nil, err
+	}
+	pending := &replayDevice{BlockDevice: Disk, blockSize: sblock.BlockSize, blocks: map[int][]byte{}}
+	for num, blockNum := range blockNums {
+		pending.blocks[blockNum] = blocks[num]
+	}
+	return pending, nil
+}
+
+// createJournal writes an empty journal, stale blocks past the header don't matter because
+// they won't have the right sequence number
+func createJournal(sblock SuperBlock) {
+	writeBlock(sblock, sblock.JournalStart, journalBlockHeader(JOURNAL_HEADER, 1, sblock.BlockSize))
+	writeBlock(sblock, sblock.JournalStart+1, nil)
+}
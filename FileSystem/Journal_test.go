@@ -0,0 +1,316 @@
+package FileSystem
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// crashDevice is a MemDevice that stops keeping writes after the first limit of them, like the power
+// going out. Reads still see every write so the file system carries on none the wiser, persisted is
+// what would be left on the disk
+type crashDevice struct {
+	*MemDevice
+	lock      sync.Mutex
+	writes    int
+	limit     int
+	persisted *MemDevice
+}
+
+func newCrashDevice(image []byte, limit int) *crashDevice {
+	return &crashDevice{
+		MemDevice: &MemDevice{data: append([]byte{}, image...)},
+		limit:     limit,
+		persisted: &MemDevice{data: append([]byte{}, image...)},
+	}
+}
+
+func (device *crashDevice) WriteAt(p []byte, off int64) (int, error) {
+	device.lock.Lock()
+	device.writes++
+	keep := device.writes <= device.limit
+	device.lock.Unlock()
+	if keep {
+		device.persisted.WriteAt(p, off)
+	}
+	return device.MemDevice.WriteAt(p, off)
+}
+
+// crashTest runs workload against image, crashing it after every number of writes it does in turn,
+// and has check look at what each crash left once it has been mounted and passed Fsck
+func crashTest(t *testing.T, image []byte, mountOptions MountOptions, workload func(), check func(limit int)) {
+	t.Helper()
+	counter := newCrashDevice(image, 1<<30)
+	if err := MountWithOptions(counter, mountOptions); err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	workload()
+	if err := Sync(); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	for limit := 0; limit <= counter.writes; limit++ {
+		device := newCrashDevice(image, limit)
+		if err := MountWithOptions(device, mountOptions); err != nil {
+			t.Fatalf("Mount: %v", err)
+		}
+		workload()
+		if err := Sync(); err != nil {
+			t.Fatalf("Sync: %v", err)
+		}
+		if err := MountWithOptions(device.persisted, mountOptions); err != nil {
+			t.Fatalf("mounting what a crash after %d writes left: %v", limit, err)
+		}
+		report, err := Fsck(false)
+		if err != nil || !report.Clean() {
+			t.Fatalf("a crash after %d writes left %v %v", limit, report.Problems, err)
+		}
+		check(limit)
+	}
+}
+
+// TestJournalCrashReplay crashes a journaled file system after every write a few operations make.
+// Whatever the crash left has to mount, replaying the journal if it needs to, and pass Fsck. In the
+// default data mode a file being written over can end up with some of the new contents in its old
+// blocks, but never anything that wasn't written to it. Writes don't wait for their blocks, so each
+// one goes to the disk in its own operation
+func TestJournalCrashReplay(t *testing.T) {
+	image := formattedImage(t, 2<<20, DefaultOptions())
+	first, second := strings.Repeat("1", 2500), strings.Repeat("2", 6000)
+	workload := func() {
+		file, inodeNum := Open(CREATE, "file", RootFolder)
+		Write(&file, inodeNum, []byte(first))
+		Write(&file, inodeNum, []byte(second))
+		_, dirNum := Open(CREATE, "dir", RootFolder)
+		_, dir := CreateDirectoryFile(ReadSuperBlock().RootDirInode, dirNum)
+		createTestFile(t, dir, "inner", "inner")
+		UnlinkName("file", RootFolder)
+	}
+	replayed := 0
+	crashTest(t, image, MountOptions{DelayedBlocks: -1}, workload, func(limit int) {
+		if LastMount().ReplayedBlocks > 0 {
+			replayed++
+		}
+		if content, _ := readTestFile(RootFolder, "file"); strings.Trim(content, "12") != "" {
+			t.Fatalf("a crash after %d writes left the file holding %q", limit, content)
+		}
+	})
+	if replayed == 0 {
+		t.Fatalf("no crash left a transaction in the journal to replay")
+	}
+}
+
+// TestReadOnlyMountRefusesReplay makes sure a read only mount won't mount something the journal
+// still has to be replayed into, and a read/write one does replay it
+func TestReadOnlyMountRefusesReplay(t *testing.T) {
+	image := formattedImage(t, 2<<20, DefaultOptions())
+	for limit := 1; ; limit++ {
+		device := newCrashDevice(image, limit)
+		if err := Mount(device); err != nil {
+			t.Fatalf("Mount: %v", err)
+		}
+		createTestFile(t, RootFolder, "file", "contents")
+		if err := Sync(); err != nil {
+			t.Fatalf("Sync: %v", err)
+		}
+		if limit > device.writes {
+			t.Fatalf("no crash point left a transaction to replay")
+		}
+		if err := MountWithOptions(device.persisted, MountOptions{ReadOnly: true}); err == nil {
+			continue
+		} else if !errors.Is(err, ErrNeedsRecovery) {
+			t.Fatalf("read only Mount: %v", err)
+		}
+		if err := Mount(device.persisted); err != nil {
+			t.Fatalf("Mount: %v", err)
+		}
+		if LastMount().ReplayedBlocks == 0 {
+			t.Fatalf("the mount didn't replay anything")
+		}
+		checkFsck(t)
+		return
+	}
+}
+
+// TestJournalHoldsLargestOperation writes the biggest file there can be over and over with the
+// trash and versions on, then throws it away. An operation that outgrows the journal stops the
+// program, so getting to the end is the test
+func TestJournalHoldsLargestOperation(t *testing.T) {
+	for _, blockSize := range []int{512, 1024, 4096} {
+		t.Run(fmt.Sprint(blockSize), func(t *testing.T) {
+			options := DefaultOptions()
+			options.BlockSize = blockSize
+			device := newTestFileSystem(t, 64<<20, options)
+			if err := SetTrash(true); err != nil {
+				t.Fatal(err)
+			}
+			if err := SetVersionPolicy(JOURNAL_VERSIONS, 0); err != nil {
+				t.Fatal(err)
+			}
+			sblock := ReadSuperBlock()
+			content := strings.Repeat("x", maxFileBlocks(sblock)*sblock.BlockSize)
+			inodeNum := createTestFile(t, RootFolder, "big", content)
+			for round := 0; round < 3; round++ {
+				file := getInodeFromDisk(inodeNum)
+				Write(&file, inodeNum, []byte(content))
+			}
+			if err := UnlinkName("big", RootFolder); err != nil {
+				t.Fatal(err)
+			}
+			if err := EmptyTrash(); err != nil {
+				t.Fatal(err)
+			}
+			checkFsck(t)
+			remount(t, device)
+			checkFsck(t)
+		})
+	}
+}
+
+// TestJournalTooSmallForSettings asks for settings a small journal can't hold an operation with,
+// they have to be refused without changing anything
+func TestJournalTooSmallForSettings(t *testing.T) {
+	options := DefaultOptions()
+	options.Size = 8 << 20
+	sblock, err := computeLayout(options.Size, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	room, _ := journalRoom(sblock, 0, false, DATA_ORDERED)
+	options.JournalBlocks = journalBlocksFor(sblock.BlockSize, room)
+	newTestFileSystem(t, options.Size, options)
+	if err := SetTrash(true); err == nil {
+		t.Fatalf("turned the trash on with a journal of %d blocks", options.JournalBlocks)
+	}
+	if err := SetVersionPolicy(JOURNAL_VERSIONS, 0); err == nil {
+		t.Fatalf("kept %d versions with a journal of %d blocks", JOURNAL_VERSIONS, options.JournalBlocks)
+	}
+	if sblock := ReadSuperBlock(); sblock.TrashDir != 0 || sblock.VersionsKept != 0 {
+		t.Fatalf("the refused settings changed the superblock: trash %d, versions %d", sblock.TrashDir, sblock.VersionsKept)
+	}
+	createTestFile(t, RootFolder, "file", strings.Repeat("x", 100000))
+	checkFsck(t)
+
+	options = DefaultOptions()
+	options.JournalBlocks = MIN_JOURNAL_BLOCKS
+	if err := Format(NewMemDevice(8<<20), options); err == nil {
+		t.Fatalf("formatted with a journal of %d blocks, too small for an operation", MIN_JOURNAL_BLOCKS)
+	}
+}
+
+// TestDefaultJournalFitsSmallDisks formats disks from the smallest the default journal fits on up,
+// every one of them has to get a journal an operation fits in
+func TestDefaultJournalFitsSmallDisks(t *testing.T) {
+	for _, size := range []int64{1 << 20, 2 << 20, 4 << 20, 64 << 20} {
+		newTestFileSystem(t, size, DefaultOptions())
+		sblock := ReadSuperBlock()
+		if _, err := journalRoom(sblock, 0, false, DATA_ORDERED); err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		createTestFile(t, RootFolder, "file", strings.Repeat("x", 50000))
+		checkFsck(t)
+	}
+}
+
+// TestDataJournalCrash is TestJournalCrashReplay with DATA_JOURNAL, where the contents go through
+// the journal too, so a crash leaves a file holding all of what was written to it or all of what it
+// had before
+func TestDataJournalCrash(t *testing.T) {
+	image := formattedImage(t, 2<<20, DefaultOptions())
+	//Write doesn't cut a file short, so each one is longer than the last
+	first, second, third := strings.Repeat("1", 2500), strings.Repeat("2", 6000), strings.Repeat("3", 7000)
+	workload := func() {
+		file, inodeNum := Open(CREATE, "file", RootFolder)
+		Write(&file, inodeNum, []byte(first))
+		Write(&file, inodeNum, []byte(second))
+		Write(&file, inodeNum, []byte(third))
+	}
+	crashTest(t, image, MountOptions{DataMode: DATA_JOURNAL}, workload, func(limit int) {
+		if content, _ := readTestFile(RootFolder, "file"); content != "" && content != first && content != second && content != third {
+			t.Fatalf("a crash after %d writes left the file holding %d bytes starting %.20q", limit, len(content), content)
+		}
+	})
+}
+
+// TestOrderedDataWaitsForFreedBlocks deletes a file and writes a new one in the same transaction.
+// The new contents go to Disk before the transaction commits, so if they could land in the deleted
+// file's blocks a crash in between would leave it holding them. Without a crash the blocks are free
+// again once it has committed. Writes don't wait for their blocks, or the new one wouldn't have any
+// before the commit
+func TestOrderedDataWaitsForFreedBlocks(t *testing.T) {
+	device := NewMemDevice(2 << 20)
+	if err := Format(device, DefaultOptions()); err != nil {
+		t.Fatalf("Format: %v", err)
+	}
+	noDelay := MountOptions{DelayedBlocks: -1}
+	if err := MountWithOptions(device, noDelay); err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	blockSize := ReadSuperBlock().BlockSize
+	old := strings.Repeat("o", 3*blockSize)
+	oldNum := createTestFile(t, RootFolder, "old", old)
+	oldInode := getInodeFromDisk(oldNum)
+	oldBlocks := fileBlocks(ReadSuperBlock(), &oldInode)
+	if err := Sync(); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	image := append([]byte{}, device.data...)
+
+	workload := func() {
+		beginTransaction()
+		UnlinkName("old", RootFolder)
+		createTestFile(t, RootFolder, "new", strings.Repeat("n", 3*blockSize))
+		commitTransaction()
+	}
+	crashTest(t, image, noDelay, workload, func(limit int) {
+		if content, _ := readTestFile(RootFolder, "old"); content != "" && content != old {
+			t.Fatalf("a crash after %d writes left the deleted file holding %.20q", limit, content)
+		}
+	})
+
+	if err := MountWithOptions(&MemDevice{data: append([]byte{}, image...)}, noDelay); err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	workload()
+	_, newNum := readTestFile(RootFolder, "new")
+	newInode := getInodeFromDisk(newNum)
+	for _, blockNum := range fileBlocks(ReadSuperBlock(), &newInode) {
+		if slices.Contains(oldBlocks, blockNum) {
+			t.Fatalf("the new file got block %d the deleted one had", blockNum)
+		}
+	}
+	for _, blockNum := range oldBlocks {
+		if ReadFreeBlockBitmap(ReadSuperBlock()).IsSet(blockNum) {
+			t.Fatalf("block %d of the deleted file isn't free after the commit", blockNum)
+		}
+	}
+}
+
+// TestCommitKeepsDirtyBlocks writes a file in DATA_WRITEBACK, where its contents go straight to the
+// cache instead of into the transaction. The commit at the end of the write has to get them to the
+// device along with the metadata pointing at them, without anyone calling Sync, so what is on the
+// device straight after mounts with the file whole
+func TestCommitKeepsDirtyBlocks(t *testing.T) {
+	device := NewMemDevice(2 << 20)
+	if err := Format(device, DefaultOptions()); err != nil {
+		t.Fatalf("Format: %v", err)
+	}
+	if err := MountWithOptions(device, MountOptions{DataMode: DATA_WRITEBACK, DelayedBlocks: -1}); err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	content := strings.Repeat("w", 3*ReadSuperBlock().BlockSize+100)
+	createTestFile(t, RootFolder, "file", content)
+	if stats := BufferCacheStats(); stats.Dirty > 1 {
+		t.Fatalf("the commit left %d blocks dirty, only the journal header should be", stats.Dirty)
+	}
+
+	if err := Mount(&MemDevice{data: append([]byte{}, device.data...)}); err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	if got, _ := readTestFile(RootFolder, "file"); got != content {
+		t.Fatalf("after the commit the device has the file holding %d bytes starting %.20q", len(got), got)
+	}
+	checkFsck(t)
+}
@@ -0,0 +1,125 @@
+package FileSystem
+
+import (
+	"sort"
+	"sync"
+)
+
+// Locking
+// Everything can be called from more than one goroutine at once. Operations don't each get their own
+// transaction, they all join the one that is running, like handles in ext4's jbd2, and it commits
+// when the last one finishes. So two goroutines writing different files only wait for each other
+// for the moment it takes to allocate a block, update the inode table or put a block in the
+// transaction. The locks, in the order they have to be taken:
+//
+//  1. mountLock - every exported operation holds it shared. Mount, Format, Fsck and the
+//     operations that change the whole file system (snapshots, the trash and version settings,
+//     reserved blocks, emptying and restoring from the trash) hold it exclusively so they run
+//     on their own. So do Sync and Fsync, to wait for the running transaction to commit.
+//  2. inode locks - a reader/writer lock per inode. An operation works out every inode it is going
+//     to touch up front (the directory it changes, the file it writes) and locks them all before
+//     doing anything, in inode number order so two operations can never wait on each other. Once
+//     it has them it doesn't take any more, except by TryLock.
+//  3. superBlockLock, inodeTableLock, blockRefsLock - held just long enough to read, change and
+//     write back the superblock, one block of the inode table, or the reference counts.
+//  4. transactionLock - the running transaction, the copy on write block map and the superblock offset.
+//  5. the bitmap locks - inside each Bitmap, they never call out to anything else while held.
+//  6. the buffer cache lock - it only ever goes on to the device. The inode and dentry cache locks
+//     are down here too, they don't call anything while held.
+//
+// A bitmap flush holds the bitmap's flush lock around the whole write so flushes can't overtake
+// each other, that one sits between 3 and 4.
+//
+// The exported functions only take the locks and then call an unexported version that does the
+// work, anything in the package calls the unexported one so nothing gets locked twice.
+
+var mountLock sync.RWMutex
+
+// inodeLocks has a lock for every inode in the table, made by Format and Mount
+var inodeLocks []sync.RWMutex
+
+var (
+	superBlockLock  sync.Mutex
+	inodeTableLock  sync.Mutex
+	blockRefsLock   sync.Mutex
+	transactionLock sync.Mutex
+)
+
+// lockShared is for ordinary operations, it returns the unlock
+func lockShared() func() {
+	mountLock.RLock()
+	return mountLock.RUnlock
+}
+
+// lockExclusive is for operations that can't have anything else running at the same time
+func lockExclusive() func() {
+	mountLock.Lock()
+	return mountLock.Unlock
+}
+
+// newInodeLocks makes a lock for every inode, and every one the inode table could grow to have so
+// growing it doesn't have to move the locks. Only while holding mountLock exclusively
+func newInodeLocks(sblock SuperBlock) {
+	inodeLocks = make([]sync.RWMutex, maxInodes(sblock))
+}
+
+// lockInodes locks writers for writing and readers for reading, in inode number order, and returns
+// the unlock. An inode in both lists gets locked for writing. Numbers that aren't in the table are
+// skipped, the operation finds out they are bad on its own
+func lockInodes(writers []int, readers []int) func() {
+	write := map[int]bool{}
+	for _, inodeNum := range readers {
+		write[inodeNum] = false
+	}
+	for _, inodeNum := range writers {
+		write[inodeNum] = true
+	}
+	order := []int{}
+	for inodeNum := range write {
+		if inodeNum > 0 && inodeNum < len(inodeLocks) {
+			order = append(order, inodeNum)
+		}
+	}
+	sort.Ints(order)
+	held := inodes
+	if held != nil {
+		held.hold(order) //keep them cached while we work on them
+	}
+	for _, inodeNum := range order {
+		if write[inodeNum] {
+			inodeLocks[inodeNum].Lock()
+		} else {
+			inodeLocks[inodeNum].RLock()
+		}
+	}
+	return func() {
+		for num := len(order) - 1; num >= 0; num-- {
+			if write[order[num]] {
+				inodeLocks[order[num]].Unlock()
+			} else {
+				inodeLocks[order[num]].RUnlock()
+			}
+		}
+		if held != nil {
+			held.release(order)
+		}
+	}
+}
+
+// tryLockInode locks an inode for writing if nobody else has it, for when we already hold inode
+// locks and taking another in the wrong order could deadlock
+func tryLockInode(inodeNum int) bool {
+	return inodeNum > 0 && inodeNum < len(inodeLocks) && inodeLocks[inodeNum].TryLock()
+}
+
+func unlockInode(inodeNum int) {
+	inodeLocks[inodeNum].Unlock()
+}
+
+// directoryNum is the inode number of a directory, from its '.' entry
+func directoryNum(dir INode) int {
+	if !dir.IsValid || !dir.IsDirectory || dir.DirectBlock1 == 0 {
+		return 0
+	}
+	return lookupEntry(ReadSuperBlock(), dir.DirectBlock1, ".") //'.' is always the first entry
+}
@@ -0,0 +1,81 @@
+package FileSystem
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestConcurrentOperations has several goroutines creating, writing, reading and unlinking files in
+// the same directory at once, all of them writing one shared file as well, and then checks nothing
+// got lost or broken. There are few enough inodes that the inode table grows while they run. Run it
+// with -race
+func TestConcurrentOperations(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		setup func() error
+	}{
+		{"plain", func() error { return nil }},
+		{"trash", func() error { return SetTrash(true) }},
+		{"versions", func() error { return SetVersionPolicy(2, 0) }},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			options := DefaultOptions()
+			options.BytesPerInode = 64 << 10
+			device := newTestFileSystem(t, 8<<20, options)
+			if err := test.setup(); err != nil {
+				t.Fatal(err)
+			}
+			const workers, rounds = 8, 40
+			var wg sync.WaitGroup
+			for worker := 0; worker < workers; worker++ {
+				wg.Add(1)
+				go func(worker int) {
+					defer wg.Done()
+					for round := 0; round < rounds; round++ {
+						name := fmt.Sprintf("w%d-%d", worker, round)
+						file, inodeNum := Open(CREATE, name, RootFolder)
+						Write(&file, inodeNum, []byte(strings.Repeat(name, 10+round*20)))
+						shared, sharedNum := Open(CREATE, "shared", RootFolder)
+						Write(&shared, sharedNum, []byte(name))
+						if content, num := readTestFile(RootFolder, name); num != inodeNum || content != strings.Repeat(name, 10+round*20) {
+							t.Errorf("%s is inode %d holding %.20q after writing it as inode %d", name, num, content, inodeNum)
+							return
+						}
+						if round%2 == 1 {
+							if err := UnlinkName(fmt.Sprintf("w%d-%d", worker, round-1), RootFolder); err != nil {
+								t.Errorf("UnlinkName: %v", err)
+								return
+							}
+						}
+					}
+				}(worker)
+			}
+			wg.Wait()
+			if t.Failed() {
+				return
+			}
+			if ReadSuperBlock().InodeChunks == 0 {
+				t.Errorf("the inode table never grew")
+			}
+			checkFsck(t)
+			remount(t, device)
+			checkFsck(t)
+			for worker := 0; worker < workers; worker++ {
+				for round := 0; round < rounds; round++ {
+					name := fmt.Sprintf("w%d-%d", worker, round)
+					content, num := readTestFile(RootFolder, name)
+					if round%2 == 0 && num != 0 {
+						t.Errorf("%s is still there after being unlinked", name)
+					} else if round%2 == 1 && content != strings.Repeat(name, 10+round*20) {
+						t.Errorf("%s holds %.20q", name, content)
+					}
+				}
+			}
+			if content, _ := readTestFile(RootFolder, "shared"); !strings.HasPrefix(content, "w") {
+				t.Errorf("the shared file holds %.20q", content)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package FileSystem
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+)
+
+// Images written before the switch to encoding/binary used gob for every structure and had a fixed
+// geometry. These are the sizes that format used so we can find things in an old image.
+const (
+	GOB_BLOCK_SIZE = 1024
+	GOB_INODE_SIZE = 512
+	GOB_NUM_INODES = 256
+)
+
+// gobSuperBlock is what the superblock looked like back then
+type gobSuperBlock struct {
+	INodeStart       int
+	RootDirInode     int
+	FreeBlockStart   int
+	InodeBitmapStart int
+	DataBlockStart   int
+}
+
+type gobDirectoryBlock [32]DirectoryEntry
+
+type gobIndirectBlock [128]int
+
+func gobDecode(b []byte, val interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(b)).Decode(val)
+}
+
+// IsGobImage reports whether the device holds an image with a gob encoded superblock
+func IsGobImage(device BlockDevice) bool {
+	if device.Size() < GOB_BLOCK_SIZE {
+		return false
+	}
+	firstBlock := make([]byte, GOB_BLOCK_SIZE)
+	if _, err := device.ReadAt(firstBlock, 0); err != nil {
+		return false
+	}
+	oldSblock := gobSuperBlock{}
+	return gobDecode(firstBlock, &oldSblock) == nil && oldSblock.INodeStart > 0
+}
+
+// MigrateGobImage converts a gob encoded image to the binary format in place and leaves it mounted.
+// Data blocks don't move. The superblock, inodes, directory blocks and indirect blocks get re-encoded
+// and the old one-byte-per-bool bitmaps become packed bitmaps. The inode table moves right after the
+// new bitmaps and shrinks, the rest of the blocks the old metadata used are left marked as used.
+// Old images always have 1024 byte blocks and 256 inodes, so the migrated one does too.
+func MigrateGobImage(device BlockDevice) error {
+	defer lockExclusive()()
+	if err := writeDelayedWrites(); err != nil {
+		return fmt.Errorf("writing out what the mounted file system still had waiting: %w", err)
+	}
+	setDisk(device, GOB_BLOCK_SIZE, 0, 0)
+	dropBitmapCache()
+	blockCount := int(device.Size() / GOB_BLOCK_SIZE)
+	//this is just enough of a superblock for readBlock to work on the old image
+	oldGeometry := SuperBlock{BlockSize: GOB_BLOCK_SIZE, BlockCount: blockCount}
+	oldSblock := gobSuperBlock{}
+	if err := gobDecode(readBlock(oldGeometry, 0), &oldSblock); err != nil {
+		return fmt.Errorf("superblock is not gob encoded: %w", err)
+	}
+	oldInodeBlocks := GOB_NUM_INODES * GOB_INODE_SIZE / GOB_BLOCK_SIZE
+	if oldSblock.INodeStart+oldInodeBlocks > blockCount || oldSblock.DataBlockStart >= blockCount {
+		return fmt.Errorf("superblock %+v doesn't look like a gob image layout", oldSblock)
+	}
+	sblock := SuperBlock{
+		Magic:            FS_MAGIC,
+		FormatVersion:    FORMAT_VERSION,
+		BlockSize:        GOB_BLOCK_SIZE,
+		BlockCount:       blockCount,
+		InodeCount:       GOB_NUM_INODES,
+		InodeSize:        INODE_RECORD_SIZE,
+		RootDirInode:     oldSblock.RootDirInode,
+		InodeBitmapStart: 1,
+		DataBlockStart:   oldSblock.DataBlockStart,
+		FeatureIncompat:  FEATURE_INCOMPAT_DYNAMIC_INODES | FEATURE_INCOMPAT_DIR_INDEX, //no more running out at 256 inodes or 30 files a directory
+		InodesPerChunk:   inodesPerChunk(GOB_BLOCK_SIZE, INODE_RECORD_SIZE),
+		InodeChunkBase:   GOB_NUM_INODES,
+	}
+	sblock.FreeBlockStart = sblock.InodeBitmapStart + bitmapBlocks(sblock.BlockSize, sblock.InodeCount)
+	sblock.INodeStart = sblock.FreeBlockStart + bitmapBlocks(sblock.BlockSize, sblock.BlockCount)
+	if sblock.INodeStart+sblock.InodeCount*sblock.InodeSize/sblock.BlockSize > sblock.DataBlockStart {
+		return fmt.Errorf("new metadata won't fit before the old data blocks at %d", oldSblock.DataBlockStart)
+	}
+	if err := newUUID(&sblock.UUID); err != nil {
+		return err
+	}
+
+	//the old bitmaps were a byte per bool, grab them before the new layout overwrites them
+	oldInodeBitmap := readBlock(oldGeometry, oldSblock.InodeBitmapStart)
+	oldFreeBlocks := []byte{}
+	for block := oldSblock.FreeBlockStart; block < oldSblock.INodeStart; block++ {
+		oldFreeBlocks = append(oldFreeBlocks, readBlock(oldGeometry, block)...)
+	}
+
+	//first pull every inode out of the old table before we overwrite it
+	oldInodes := make([]INode, GOB_NUM_INODES)
+	for inodeNum := range oldInodes {
+		inodeBlock := readBlock(oldGeometry, oldSblock.INodeStart+inodeNum/(GOB_BLOCK_SIZE/GOB_INODE_SIZE))
+		inodeOffset := inodeNum % (GOB_BLOCK_SIZE / GOB_INODE_SIZE) * GOB_INODE_SIZE
+		if err := gobDecode(inodeBlock[inodeOffset:inodeOffset+GOB_INODE_SIZE], &oldInodes[inodeNum]); err != nil {
+			return fmt.Errorf("decoding inode %d: %w", inodeNum, err)
+		}
+	}
+
+	//directory and indirect blocks hang off the inodes, convert those next.
+	//The old inodes had no link count so count the directory entries as we go
+	links := make([]int, GOB_NUM_INODES)
+	for inodeNum, inode := range oldInodes {
+		if !inode.IsValid {
+			continue
+		}
+		if inode.IsDirectory && inode.DirectBlock1 != 0 {
+			oldDirBlock := gobDirectoryBlock{}
+			if err := gobDecode(readBlock(oldGeometry, inode.DirectBlock1), &oldDirBlock); err != nil {
+				return fmt.Errorf("decoding directory block %d of inode %d: %w", inode.DirectBlock1, inodeNum, err)
+			}
+			for _, entry := range oldDirBlock {
+				if entry.Inode > 0 && entry.Inode < GOB_NUM_INODES {
+					links[entry.Inode]++
+				}
+			}
+			writeBlock(sblock, inode.DirectBlock1, EncodeToBytes(DirectoryBlock(oldDirBlock[:])))
+		}
+		if inode.IndirectBlock != 0 {
+			oldIndirect := gobIndirectBlock{}
+			//the old Write could allocate an indirect block and never fill it in, so an undecodable one is just empty
+			_ = gobDecode(readBlock(oldGeometry, inode.IndirectBlock), &oldIndirect)
+			indirect := make(IndirectBlock, sblock.BlockSize/BLOCK_POINTER_SIZE)
+			copy(indirect, oldIndirect[:])
+			writeBlock(sblock, inode.IndirectBlock, EncodeToBytes(indirect))
+		}
+	}
+
+	//now wipe the old metadata and write the bitmaps and inodes back in the new layout
+	for block := 0; block < oldSblock.INodeStart+oldInodeBlocks; block++ {
+		writeBlock(sblock, block, nil)
+	}
+	createInodeBitmap(sblock)
+	for inodeNum := 0; inodeNum < GOB_NUM_INODES; inodeNum++ {
+		if oldInodeBitmap[inodeNum] != 0 {
+			inodeBitmap.Set(inodeNum)
+		}
+	}
+	createFreeBlockBitmap(sblock)
+	for blockNum, used := range oldFreeBlocks {
+		if used != 0 && blockNum < sblock.BlockCount {
+			freeBlockBitmap.Set(blockNum)
+		}
+	}
+	for inodeNum := range oldInodes {
+		oldInodes[inodeNum].LinksCount = links[inodeNum]
+		writeInodeToDisk(&oldInodes[inodeNum], inodeNum, sblock)
+	}
+	//old images might already have data where the backup superblocks go, if so they just don't get backups
+	enableSuperBlockBackups(&sblock)
+	writeSuperBlock(sblock)
+	syncBitmaps()
+	return mountDevice(device, MountOptions{})
+}
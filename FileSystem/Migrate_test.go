@@ -0,0 +1,121 @@
+package FileSystem
+
+import (
+	"bytes"
+	"encoding/gob"
+	"strings"
+	"testing"
+)
+
+// gobINode is the inode the way the gob format had it, without the fields added since
+type gobINode struct {
+	IsValid        bool
+	IsDirectory    bool
+	Version        int
+	DirectBlock1   int
+	DirectBlock2   int
+	DirectBlock3   int
+	IndirectBlock  int
+	CreateTime     int64
+	LastModifyTime int64
+}
+
+// gobEncode is EncodeToBytes as it was before the binary format
+func gobEncode(t *testing.T, val interface{}) []byte {
+	t.Helper()
+	buf := bytes.Buffer{}
+	if err := gob.NewEncoder(&buf).Encode(val); err != nil {
+		t.Fatalf("gob encoding %T: %v", val, err)
+	}
+	return buf.Bytes()
+}
+
+// TestMigrateGobImage lays out an image the way the gob format did - a byte per bool for the bitmaps,
+// 512 byte inode slots and gob encoded directory and indirect blocks - with a small file and one that
+// needs its indirect block, migrates it and checks both read back and the result is clean
+func TestMigrateGobImage(t *testing.T) {
+	const blockCount = 2048
+	device := NewMemDevice(blockCount * GOB_BLOCK_SIZE)
+	writeAt := func(blockNum int, data []byte) {
+		if len(data) > GOB_BLOCK_SIZE {
+			t.Fatalf("%d bytes won't fit in block %d", len(data), blockNum)
+		}
+		if _, err := device.WriteAt(data, int64(blockNum)*GOB_BLOCK_SIZE); err != nil {
+			t.Fatalf("writing block %d: %v", blockNum, err)
+		}
+	}
+	oldSblock := gobSuperBlock{INodeStart: 8, RootDirInode: 1, FreeBlockStart: 2, InodeBitmapStart: 1, DataBlockStart: 140}
+	writeAt(0, gobEncode(t, oldSblock))
+
+	small := "hello from the gob days"
+	big := strings.Repeat("0123456789abcdef", 4*GOB_BLOCK_SIZE/16+8) //four blocks and a bit, so five
+	inodes := make([]gobINode, GOB_NUM_INODES)
+	inodes[1] = gobINode{IsValid: true, IsDirectory: true, DirectBlock1: 141}
+	inodes[2] = gobINode{IsValid: true, DirectBlock1: 142}
+	inodes[3] = gobINode{IsValid: true, DirectBlock1: 143, DirectBlock2: 144, DirectBlock3: 145, IndirectBlock: 146}
+	bigBlocks := []int{143, 144, 145, 147, 148}
+	for inodeNum, inode := range inodes {
+		slot := make([]byte, GOB_INODE_SIZE)
+		copy(slot, gobEncode(t, inode))
+		blockNum := oldSblock.INodeStart + inodeNum/(GOB_BLOCK_SIZE/GOB_INODE_SIZE)
+		if _, err := device.WriteAt(slot, int64(blockNum)*GOB_BLOCK_SIZE+int64(inodeNum%(GOB_BLOCK_SIZE/GOB_INODE_SIZE)*GOB_INODE_SIZE)); err != nil {
+			t.Fatalf("writing inode %d: %v", inodeNum, err)
+		}
+	}
+	inodeBitmap := make([]byte, GOB_BLOCK_SIZE)
+	inodeBitmap[1], inodeBitmap[2], inodeBitmap[3] = 1, 1, 1
+	writeAt(oldSblock.InodeBitmapStart, inodeBitmap)
+	freeBlocks := make([]byte, (oldSblock.INodeStart-oldSblock.FreeBlockStart)*GOB_BLOCK_SIZE)
+	for blockNum := 141; blockNum <= 148; blockNum++ {
+		freeBlocks[blockNum] = 1
+	}
+	for num := 0; num < oldSblock.INodeStart-oldSblock.FreeBlockStart; num++ {
+		writeAt(oldSblock.FreeBlockStart+num, freeBlocks[num*GOB_BLOCK_SIZE:(num+1)*GOB_BLOCK_SIZE])
+	}
+	rootDir := gobDirectoryBlock{}
+	for num, entry := range []DirectoryEntry{newDirectoryEntry(".", 1), newDirectoryEntry("..", 0),
+		newDirectoryEntry("small", 2), newDirectoryEntry("big", 3)} {
+		rootDir[num] = entry
+	}
+	writeAt(141, gobEncode(t, rootDir))
+	writeAt(142, []byte(small))
+	for num, blockNum := range bigBlocks {
+		writeAt(blockNum, []byte(big[num*GOB_BLOCK_SIZE:min((num+1)*GOB_BLOCK_SIZE, len(big))]))
+	}
+	writeAt(146, gobEncode(t, gobIndirectBlock{147, 148}))
+
+	if !IsGobImage(device) {
+		t.Fatalf("the image isn't recognised as a gob image")
+	}
+	if err := MigrateGobImage(device); err != nil {
+		t.Fatalf("MigrateGobImage: %v", err)
+	}
+	if IsGobImage(device) {
+		t.Fatalf("the migrated image still looks like a gob image")
+	}
+	check := func() {
+		t.Helper()
+		if got, _ := readTestFile(RootFolder, "small"); got != small {
+			t.Fatalf("small holds %q", got)
+		}
+		if got, _ := readTestFile(RootFolder, "big"); got != big {
+			t.Fatalf("big holds %d bytes, it should be %d", len(got), len(big))
+		}
+		for inodeNum, want := range map[int]int{1: 1, 2: 1, 3: 1} {
+			if links := getInodeFromDisk(inodeNum).LinksCount; links != want {
+				t.Fatalf("inode %d has %d links, it should have %d", inodeNum, links, want)
+			}
+		}
+		checkFsck(t)
+	}
+	check()
+	remount(t, device)
+	check()
+	//and it is an ordinary file system from here on
+	createTestFile(t, RootFolder, "new", "made after the migration")
+	remount(t, device)
+	if got, _ := readTestFile(RootFolder, "new"); got != "made after the migration" {
+		t.Fatalf("new holds %q", got)
+	}
+	checkFsck(t)
+}
@@ -0,0 +1,84 @@
+package FileSystem
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Reserved blocks
+// Once the disk is full nothing can be written, not even the fixes that would free up space again.
+// So like ext2 we hold back a slice of the blocks that only one privileged uid is allowed to use.
+// There are no real users in here, whoever is calling in says who they are with SetUID.
+
+// currentUID is who the file system thinks it is working for, root until someone says otherwise
+var currentUID atomic.Int64
+
+// SetUID changes the user the following operations are done as. There is only one for the whole
+// file system, not one per goroutine
+func SetUID(uid int) {
+	currentUID.Store(int64(uid))
+}
+
+// reservedBlocks is how many free blocks Writes in progress have made sure of and not allocated yet,
+// it belongs to transactionLock
+var reservedBlocks int
+
+// keptBlocks is how many free blocks the allocator has to leave alone for the current uid: the
+// reserved blocks if they aren't theirs, and the ones snapshots are holding on to
+func keptBlocks(sblock SuperBlock) int {
+	keep := snapshotHeldBlocks()
+	if int(currentUID.Load()) != sblock.ReservedUID {
+		keep += sblock.ReservedBlocks
+	}
+	return keep
+}
+
+// reserveBlocks makes sure count blocks can be allocated on top of what other Writes are about to,
+// or says ErrNoSpace. The caller gives them back with unreserveBlocks once it has allocated them
+func reserveBlocks(sblock SuperBlock, count int) error {
+	if count == 0 {
+		return nil
+	}
+	available := ReadFreeBlockBitmap(sblock).countClaimable() - keptBlocks(sblock)
+	transactionLock.Lock()
+	defer transactionLock.Unlock()
+	if available-reservedBlocks < count {
+		return fmt.Errorf("%w: %d blocks are needed and %d are free", ErrNoSpace, count, max(available-reservedBlocks, 0))
+	}
+	reservedBlocks += count
+	return nil
+}
+
+func unreserveBlocks(count int) {
+	transactionLock.Lock()
+	defer transactionLock.Unlock()
+	reservedBlocks -= count
+}
+
+// reservedFor is how many blocks are reserved for Writes right now, most of them for delayed writes
+func reservedFor() int {
+	transactionLock.Lock()
+	defer transactionLock.Unlock()
+	return reservedBlocks
+}
+
+// SetReservedBlocks changes how many blocks are held back and for whom, like tune2fs -m and -u
+func SetReservedBlocks(percent int, uid int) error {
+	if percent < 0 || percent > MAX_RESERVED_PERCENT {
+		return fmt.Errorf("reserved percent %d must be from 0 to %d", percent, MAX_RESERVED_PERCENT)
+	}
+	if uid < 0 {
+		return fmt.Errorf("reserved uid %d can't be negative", uid)
+	}
+	defer lockExclusive()()
+	if readOnly {
+		return fmt.Errorf("file system is mounted read only")
+	}
+	beginTransaction()
+	defer commitTransaction()
+	sblock := ReadSuperBlock()
+	sblock.ReservedBlocks = sblock.BlockCount * percent / 100
+	sblock.ReservedUID = uid
+	writeSuperBlock(sblock)
+	return nil
+}
@@ -0,0 +1,583 @@
+package FileSystem
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+)
+
+// Resizing
+// Resize changes how many blocks the file system has, like resize2fs, making the device bigger or
+// smaller to match if it is a ResizableDevice. Growing adds block groups (or, without block groups,
+// more of the free block bitmap, as far as the room left for it at format time goes). Shrinking has
+// to get everything out of the blocks being cut off first: with block groups the inodes in the groups
+// that go get new numbers in the groups that stay, then every block still in use past the new end is
+// copied somewhere below it and the files are pointed at the copies, one file per transaction.
+//
+// Switching to the new size can't go through the journal - a transaction only knows about the blocks
+// the old superblock has - so it is done in an order a crash can't hurt: the new groups' inode tables
+// and the new bitmaps go down first, then the new superblock. The old superblock is happy with the new
+// bitmaps: growing only adds bits past its end, and shrinking only drops bits for blocks that were
+// emptied out first. A backup superblock that isn't one any more stays marked in use until the new
+// superblock is down.
+
+// ErrResizeLimit is what Resize returns for a file system without block groups asked to grow past
+// the blocks its free block bitmap has room for
+var ErrResizeLimit = errors.New("the free block bitmap has no room for that many blocks")
+
+// Resize makes the file system newBlockCount blocks long. Copy on write file systems can't be resized
+// at all, and one without block groups can't grow past the blocks its free block bitmap has room for:
+// the bitmap got just enough whole blocks at format time for the size it was then, so that is a size
+// rounded up to the next BlockSize*8 blocks. Past that it returns ErrResizeLimit.
+// Shrinking a file system with block groups gives the inodes in the groups that go new numbers, so
+// an inode number (or an INode copy) anyone got before the Resize can be stale afterwards, pointing
+// at nothing or at some other file. Open the files again by name once it is done
+func Resize(newBlockCount int) error {
+	defer lockExclusive()()
+	if Disk == nil {
+		return fmt.Errorf("there is no file system mounted")
+	}
+	if readOnly {
+		return fmt.Errorf("file system is mounted read only")
+	}
+	if cow != nil {
+		return fmt.Errorf("copy on write file systems can't be resized")
+	}
+	if err := writeDelayedWrites(); err != nil {
+		return err
+	}
+	sblock := ReadSuperBlock()
+	resized, err := resizedLayout(sblock, newBlockCount)
+	if err != nil {
+		return err
+	}
+	if newBlockCount == sblock.BlockCount {
+		return nil
+	}
+	//more groups means more bitmap blocks and backups an operation can write
+	credits, err := journalRoom(resized, resized.VersionsKept, trashEnabled(resized), dataMode)
+	if err != nil {
+		return fmt.Errorf("can't make the file system %d blocks: %w", newBlockCount, err)
+	}
+	size := int64(newBlockCount) * int64(sblock.BlockSize)
+	_, resizable := Disk.(ResizableDevice)
+	if !resizable && size > Disk.Size() {
+		return fmt.Errorf("the device only has room for %d blocks and can't be made bigger", Disk.Size()/int64(sblock.BlockSize))
+	}
+
+	shrinking := newBlockCount < sblock.BlockCount
+	if shrinking {
+		if err := checkShrink(sblock, resized); err != nil {
+			return err
+		}
+		if err := evacuateInodeChunks(sblock, resized); err != nil {
+			return err
+		}
+		if err := evacuateInodes(ReadSuperBlock(), resized); err != nil {
+			return err
+		}
+		sblock = ReadSuperBlock() //the inode chunks and the trash directory might have moved
+		resized, _ = resizedLayout(sblock, newBlockCount)
+		evacuateBlocks(sblock, resized)
+	} else if size > Disk.Size() {
+		if err := cache.truncate(size); err != nil {
+			return err
+		}
+	}
+	switchLayout(sblock, resized)
+	if shrinking && resizable {
+		if err := cache.truncate(size); err != nil {
+			return err
+		}
+	}
+	blockRefsLock.Lock()
+	blockRefs = nil //they get counted again the next time they are needed
+	blockRefsLock.Unlock()
+	operationCredits = credits
+	newInodeLocks(resized)
+	newNameCaches(resized)
+	RootFolder = getInodeFromDisk(resized.RootDirInode)
+	return nil
+}
+
+// resizedLayout is sblock with blockCount blocks, or why it can't have that many
+func resizedLayout(sblock SuperBlock, blockCount int) (SuperBlock, error) {
+	if blockCount > 1<<32-1 {
+		return SuperBlock{}, fmt.Errorf("%d blocks won't fit in 32 bit block numbers", blockCount)
+	}
+	if blockCount < sblock.DataBlockStart+2 { //the root directory and the last backup
+		return SuperBlock{}, fmt.Errorf("%d blocks is too small, the metadata alone needs %d", blockCount, sblock.DataBlockStart+1)
+	}
+	resized := sblock
+	resized.BlockCount = blockCount
+	resized.PhysicalBlocks = blockCount
+	resized.ReservedBlocks = int(int64(sblock.ReservedBlocks) * int64(blockCount) / int64(sblock.BlockCount))
+	if !blockGroupsEnabled(sblock) {
+		//the free block bitmap got just enough blocks for the size it was formatted at
+		if room := (sblock.INodeStart - sblock.FreeBlockStart) * sblock.BlockSize * 8; blockCount > room {
+			return SuperBlock{}, fmt.Errorf("%w: without block groups it only has room for %d blocks, it was sized when the file system was formatted",
+				ErrResizeLimit, room)
+		}
+		return resized, nil
+	}
+	resized.InodeCount = inodeSpan(resized)
+	if last := groupCount(resized) - 1; last > 0 {
+		needed := groupDataStart(resized, last) - groupStart(resized, last) + 2
+		if lastBlocks := blockCount - groupStart(resized, last); lastBlocks < needed {
+			return SuperBlock{}, fmt.Errorf("the last block group would only have %d blocks, it needs at least %d - try %d or %d blocks",
+				lastBlocks, needed, groupStart(resized, last), groupStart(resized, last)+needed)
+		}
+	}
+	return resized, nil
+}
+
+// shrinkLimit is the first block the shrunk file system can't use for data: its end, or its last
+// block if that is going to hold a backup superblock
+func shrinkLimit(resized SuperBlock) int {
+	backups := superBlockBackups(resized)
+	if len(backups) > 0 && backups[len(backups)-1] == resized.BlockCount-1 {
+		return resized.BlockCount - 1
+	}
+	return resized.BlockCount
+}
+
+// blockPointers is every block an inode points at, its indirect block included
+func blockPointers(sblock SuperBlock, inode *INode) []int {
+	pointers := []int{}
+	for _, blockNum := range []int{inode.DirectBlock1, inode.DirectBlock2, inode.DirectBlock3, inode.IndirectBlock} {
+		if blockNum != 0 {
+			pointers = append(pointers, blockNum)
+		}
+	}
+	if inode.IndirectBlock != 0 {
+		for _, blockNum := range decodeIndirectBlock(readBlock(sblock, inode.IndirectBlock)) {
+			if blockNum != 0 {
+				pointers = append(pointers, blockNum)
+			}
+		}
+	}
+	return pointers
+}
+
+// goneInodes is the runs of inode numbers sblock has and resized doesn't, from the start of each up
+// to its end: the inodes of the groups being taken away. The chunks' numbers never go
+func goneInodes(sblock SuperBlock, resized SuperBlock) [][2]int {
+	gone := [][2]int{}
+	for group := groupCount(resized); group < groupCount(sblock); group++ {
+		first := groupInodeBase(sblock, group)
+		gone = append(gone, [2]int{first, first + groupInodes(sblock)})
+	}
+	return gone
+}
+
+// goneRunEnd is the end of the run in gone inodeNum is in, -1 if it isn't in one
+func goneRunEnd(gone [][2]int, inodeNum int) int {
+	for _, run := range gone {
+		if inodeNum >= run[0] && inodeNum < run[1] {
+			return run[1]
+		}
+	}
+	return -1
+}
+
+// claimKeptInode claims the first free inode number that isn't going, -1 if there isn't one
+func claimKeptInode(inodeBits *Bitmap, start int, gone [][2]int) int {
+	for inodeNum := inodeBits.FindFree(start); inodeNum >= 0; inodeNum = inodeBits.FindFree(inodeNum) {
+		end := goneRunEnd(gone, inodeNum)
+		if end < 0 {
+			inodeBits.Set(inodeNum)
+			return inodeNum
+		}
+		inodeNum = end
+	}
+	return -1
+}
+
+// checkShrink makes sure everything past the new end has somewhere to go before anything moves
+func checkShrink(sblock SuperBlock, resized SuperBlock) error {
+	inodeBits := ReadINodeBitmap(sblock)
+	moving, free := 0, inodeBits.CountFree()
+	for _, run := range goneInodes(sblock, resized) {
+		used := inodeBits.countRange(run[0], run[1])
+		moving += used
+		free -= run[1] - run[0] - used
+	}
+	if moving > free {
+		return fmt.Errorf("%d inodes would have to move out of the block groups being removed but only %d are free", moving, free)
+	}
+	limit := shrinkLimit(resized)
+	inUse := map[int]bool{}
+	for inodeNum := 1; inodeNum < sblock.InodeCount; inodeNum++ {
+		inode := getInodeFromDisk(inodeNum)
+		if !inode.IsValid {
+			continue
+		}
+		for _, blockNum := range blockPointers(sblock, &inode) {
+			if blockNum >= limit {
+				inUse[blockNum] = true
+			}
+		}
+	}
+	for chunk := 0; chunk < sblock.InodeChunks; chunk++ {
+		for blockNum := sblock.InodeMap[chunk]; blockNum <= sblock.InodeMap[chunk]+chunkTableBlocks(sblock); blockNum++ {
+			if blockNum >= limit {
+				inUse[blockNum] = true
+			}
+		}
+	}
+	if free := limit - ReadFreeBlockBitmap(sblock).countRange(0, limit); len(inUse) > free {
+		return fmt.Errorf("%d blocks past the new end are in use but only %d are free before it", len(inUse), free)
+	}
+	return nil
+}
+
+// evacuateInodeChunks moves the inode table chunks that reach past the end of resized to runs of free
+// blocks before it, a chunk at a time. It gives up if there isn't a long enough run
+func evacuateInodeChunks(sblock SuperBlock, resized SuperBlock) error {
+	limit := shrinkLimit(resized)
+	length := 1 + chunkTableBlocks(sblock)
+	moved := false
+	syncBitmaps() //the chunks' bitmap blocks get copied as they are on Disk
+	for chunk := 0; chunk < sblock.InodeChunks; chunk++ {
+		oldStart := sblock.InodeMap[chunk]
+		if oldStart+length <= limit {
+			continue
+		}
+		freeBlocks := ReadFreeBlockBitmap(sblock)
+		start, count := freeBlocks.allocateRun(firstFit{}, sblock.DataBlockStart, length, 0)
+		if count != length || start+length > limit {
+			for blockNum := start; blockNum < start+count; blockNum++ {
+				freeBlocks.Clear(blockNum)
+			}
+			return fmt.Errorf("there isn't a run of %d free blocks before the new end to move inode table chunk %d to", length, chunk)
+		}
+		beginTransaction()
+		for num := 0; num < length; num++ {
+			writeBlock(sblock, start+num, readBlock(sblock, oldStart+num))
+		}
+		sblock.InodeMap[chunk] = start
+		writeSuperBlock(sblock)
+		for blockNum := oldStart; blockNum < oldStart+length; blockNum++ {
+			if blockNum != limit || limit == resized.BlockCount {
+				freeBlocks.Clear(blockNum)
+			}
+		}
+		syncBitmaps()
+		commitTransaction()
+		moved = true
+	}
+	if moved {
+		inodeBitmap = nil //its blocks have moved
+		ReadINodeBitmap(sblock)
+		inodes.setGeometry(sblock)
+	}
+	return nil
+}
+
+// evacuateInodes gives every inode in the groups resized takes away a free number in the ones it
+// keeps, an inode per transaction, and fixes up everything that refers to it by number: directory
+// entries (its own '.' and its children's '..' included), the newer version it is the PrevVersion of
+// and the trash. Who refers to what gets worked out once up front, and if moving an inode would take
+// more blocks than a transaction can hold it gives up before moving any
+func evacuateInodes(sblock SuperBlock, resized SuperBlock) error {
+	inodeBits := ReadINodeBitmap(sblock)
+	gone := goneInodes(sblock, resized)
+	moving := []int{}
+	for _, run := range gone {
+		for inodeNum := run[0]; inodeNum < run[1]; inodeNum++ {
+			if inodeBits.IsSet(inodeNum) {
+				moving = append(moving, inodeNum)
+			}
+		}
+	}
+	if len(moving) == 0 {
+		return nil
+	}
+	dirs := map[int][]int{} //inode number to the directories with an entry for it
+	newer := map[int]int{}  //old version to the inode it is the PrevVersion of
+	for inodeNum := 1; inodeNum < sblock.InodeCount; inodeNum++ {
+		inode := getInodeFromDisk(inodeNum)
+		if !inode.IsValid {
+			continue
+		}
+		if goneRunEnd(gone, inode.PrevVersion) >= 0 {
+			newer[inode.PrevVersion] = inodeNum
+		}
+		if !inode.IsDirectory {
+			continue
+		}
+		for _, blockNum := range entryBlocks(sblock, inode) {
+			for _, entry := range decodeDirectoryBlock(readBlock(sblock, blockNum)) {
+				if entryIsUsed(entry) && goneRunEnd(gone, entry.Inode) >= 0 && !slices.Contains(dirs[entry.Inode], inodeNum) {
+					dirs[entry.Inode] = append(dirs[entry.Inode], inodeNum)
+				}
+			}
+		}
+	}
+	trashed := map[int]bool{}
+	if trashEnabled(sblock) {
+		for _, record := range readTrashRecords(sblock) {
+			trashed[record.inodeNum] = true
+		}
+	}
+	for _, inodeNum := range moving {
+		if !journalEnabled(sblock) {
+			break
+		}
+		if need := inodeMoveBlocks(sblock, len(dirs[inodeNum]), trashed[inodeNum]); need > transactionCapacity(sblock) {
+			return fmt.Errorf("inode %d has %d directories with entries for it, moving it needs %d blocks and a transaction only holds %d",
+				inodeNum, len(dirs[inodeNum]), need, transactionCapacity(sblock))
+		}
+	}
+
+	renumbered := map[int]int{}
+	current := func(inodeNum int) int {
+		if newNum, ok := renumbered[inodeNum]; ok {
+			return newNum
+		}
+		return inodeNum
+	}
+	for _, inodeNum := range moving {
+		beginTransaction()
+		newNum := claimKeptInode(inodeBits, sblock.RootDirInode, gone)
+		if newNum < 0 {
+			log.Fatal("Ran out of inodes moving them out of the way of a resize")
+		}
+		renumbered[inodeNum] = newNum
+		moveInode(inodeNum, newNum, dirs[inodeNum], current)
+		if version, ok := newer[inodeNum]; ok {
+			newerInode := getInodeFromDisk(current(version))
+			newerInode.PrevVersion = newNum
+			writeInodeToDisk(&newerInode, current(version), sblock)
+		}
+		if trashed[inodeNum] {
+			records := readTrashRecords(ReadSuperBlock())
+			for num, record := range records {
+				if record.inodeNum == inodeNum {
+					records[num].inodeNum = newNum
+				}
+			}
+			writeTrashRecords(ReadSuperBlock(), records)
+		}
+		syncBitmaps()
+		commitTransaction()
+	}
+	return nil
+}
+
+// inodeMoveBlocks is the most blocks moving an inode with refs directories pointing at it puts in its
+// transaction: a block of the inode table for its old number, its new one and its newer version, the
+// inode bitmap for both, the superblock everywhere if it is the trash directory and a block of every
+// directory. Something in the trash also goes in again under its new name and gets its record changed
+func inodeMoveBlocks(sblock SuperBlock, refs int, trashed bool) int {
+	blocks := 5 + 1 + len(superBlockBackups(sblock)) + refs
+	if trashed {
+		fileBlocks := maxFileBlocks(sblock) + 1
+		directoryBlocks := 2*DIR_INDEX_MAX_LEVELS + 6
+		bitmapBlocks, _ := freeBlockBitmapLayout(sblock)
+		blocks += directoryBlocks + fileBlocks + 1 + min(len(bitmapBlocks), 2*fileBlocks+directoryBlocks)
+	}
+	return blocks
+}
+
+// moveInode copies inodeNum to newNum and points every entry for it in dirs at the new number, current
+// says where a directory is now if it has moved already. The caller has a transaction going
+func moveInode(inodeNum int, newNum int, dirs []int, current func(int) int) {
+	sblock := ReadSuperBlock()
+	inode := getInodeFromDisk(inodeNum)
+	writeInodeToDisk(&inode, newNum, sblock)
+	writeInodeToDisk(&INode{}, inodeNum, sblock)
+	ReadINodeBitmap(sblock).Clear(inodeNum)
+	if inodeNum == sblock.TrashDir {
+		sblock.TrashDir = newNum
+		writeSuperBlock(sblock)
+	}
+	for _, dirNum := range dirs {
+		dirNum = current(dirNum)
+		dir := getInodeFromDisk(dirNum)
+		renamed := false
+		for _, blockNum := range entryBlocks(sblock, dir) {
+			entries := decodeDirectoryBlock(readBlock(sblock, blockNum))
+			changed := false
+			for entryNum, entry := range entries {
+				if !entryIsUsed(entry) || entry.Inode != inodeNum {
+					continue
+				}
+				entries[entryNum].Inode = newNum
+				renamed = renamed || dirNum == sblock.TrashDir && entryName(entry) == strconv.Itoa(inodeNum)
+				changed = true
+			}
+			if changed {
+				writeBlock(sblock, blockNum, EncodeToBytes(entries))
+			}
+		}
+		//the trash names things by number, and a new name can belong in a different leaf of an indexed
+		//directory, so it goes in again
+		if renamed {
+			removeEntry(sblock, dir, strconv.Itoa(inodeNum))
+			if !addEntry(sblock, &dir, dirNum, strconv.Itoa(newNum), newNum) {
+				log.Fatal("No room in the trash for inode ", newNum, " under its new number")
+			}
+		}
+	}
+}
+
+// evacuateBlocks copies every block in use past the end of resized to a free one before it and
+// points the files at the copies. Blocks shared between files only get copied once
+func evacuateBlocks(sblock SuperBlock, resized SuperBlock) {
+	limit := shrinkLimit(resized)
+	freeBlocks := ReadFreeBlockBitmap(sblock)
+	if limit < resized.BlockCount {
+		freeBlocks.Set(limit) //it is going to be the last backup, nothing new goes in it
+	}
+	moved := map[int]int{}
+	for inodeNum := 1; inodeNum < sblock.InodeCount; inodeNum++ {
+		inode := getInodeFromDisk(inodeNum)
+		if !inode.IsValid {
+			continue
+		}
+		for _, blockNum := range blockPointers(sblock, &inode) {
+			if blockNum >= limit {
+				moveInodeBlocks(sblock, inodeNum, limit, moved)
+				break
+			}
+		}
+	}
+	//the old copies only matter to the old size, if we crash before the new one is down
+	gone := []int{}
+	for blockNum := range moved {
+		if blockNum >= resized.BlockCount {
+			gone = append(gone, blockNum)
+		}
+	}
+	batch := moveBatch(sblock)
+	for start := 0; start < len(gone); start += batch {
+		beginTransaction()
+		for _, blockNum := range gone[start:min(start+batch, len(gone))] {
+			freeBlocks.Clear(blockNum)
+		}
+		syncBitmaps()
+		commitTransaction()
+	}
+}
+
+// moveBatch is how many blocks moveInodeBlocks moves in a transaction. Each one can be a copy in the
+// journal and a block of the free block bitmap, and the inode, its indirect block and the superblock
+// go in as well
+func moveBatch(sblock SuperBlock) int {
+	batch := maxFileBlocks(sblock) + 1 //all of a file's
+	if journalEnabled(sblock) {
+		batch = min(batch, max(1, (transactionCapacity(sblock)-3-len(superBlockBackups(sblock)))/2))
+	}
+	return batch
+}
+
+// moveInodeBlocks moves one inode's blocks from limit on to blocks before it, moved has where every
+// block has gone so far. It takes a transaction for each moveBatch blocks
+func moveInodeBlocks(sblock SuperBlock, inodeNum int, limit int, moved map[int]int) {
+	for !moveSomeInodeBlocks(sblock, inodeNum, limit, moved, moveBatch(sblock)) {
+	}
+}
+
+// moveSomeInodeBlocks moves up to batch of an inode's blocks and points the inode at them. It is true
+// once there are none left to move
+func moveSomeInodeBlocks(sblock SuperBlock, inodeNum int, limit int, moved map[int]int, batch int) bool {
+	beginTransaction()
+	defer commitTransaction()
+	inode := getInodeFromDisk(inodeNum)
+	done := true
+	move := func(blockNum int, data bool) int {
+		if blockNum < limit {
+			return blockNum
+		}
+		if newNum, ok := moved[blockNum]; ok {
+			return newNum
+		}
+		if batch == 0 {
+			done = false //next time
+			return blockNum
+		}
+		batch--
+		newNum := ReadFreeBlockBitmap(sblock).claim(sblock.DataBlockStart, 0)
+		if newNum < 0 || newNum >= limit {
+			log.Fatal("Ran out of blocks moving them out of the way of a resize")
+		}
+		if data {
+			writeDataBlock(sblock, newNum, readBlock(sblock, blockNum))
+		} else {
+			writeBlock(sblock, newNum, readBlock(sblock, blockNum))
+		}
+		moved[blockNum] = newNum
+		return newNum
+	}
+	isData := !inode.IsDirectory //a directory's block is metadata
+	inode.DirectBlock1 = move(inode.DirectBlock1, isData)
+	inode.DirectBlock2 = move(inode.DirectBlock2, isData)
+	inode.DirectBlock3 = move(inode.DirectBlock3, isData)
+	if inode.IndirectBlock != 0 {
+		indirect := decodeIndirectBlock(readBlock(sblock, inode.IndirectBlock))
+		for num, blockNum := range indirect {
+			if blockNum != 0 {
+				indirect[num] = move(blockNum, isData)
+			}
+		}
+		inode.IndirectBlock = move(inode.IndirectBlock, false)
+		writeBlock(sblock, inode.IndirectBlock, EncodeToBytes(indirect))
+	}
+	writeInodeToDisk(&inode, inodeNum, sblock)
+	syncBitmaps()
+	return done
+}
+
+// switchLayout puts down the bitmaps and superblock for resized, everything past its end has to be
+// out of use already. See the top of the file for why it goes in this order
+func switchLayout(sblock SuperBlock, resized SuperBlock) {
+	syncBitmaps()
+	oldBlocks, oldInodes := ReadFreeBlockBitmap(sblock), ReadINodeBitmap(sblock)
+	backups := map[int]bool{}
+	for _, blockNum := range superBlockBackups(resized) {
+		backups[blockNum] = true
+	}
+	blocks, starts := freeBlockBitmapLayout(resized)
+	freeBlocks := newBitmap(resized, resized.BlockCount, blocks, starts)
+	for blockNum := 0; blockNum < resized.BlockCount; blockNum++ {
+		if blockNum < sblock.BlockCount && oldBlocks.IsSet(blockNum) || isMetadataBlock(resized, blockNum) || backups[blockNum] {
+			freeBlocks.Set(blockNum)
+		}
+	}
+	stale := []int{}
+	for _, blockNum := range superBlockBackups(sblock) {
+		if blockNum < resized.BlockCount && !backups[blockNum] && !isMetadataBlock(resized, blockNum) {
+			stale = append(stale, blockNum)
+		}
+	}
+	blocks, starts = inodeBitmapLayout(resized)
+	inodeBits := newBitmap(resized, resized.InodeCount, blocks, starts)
+	for inodeNum := 0; inodeNum < min(sblock.InodeCount, resized.InodeCount); inodeNum++ {
+		//a hole that is a group again starts out empty
+		if oldInodes.IsSet(inodeNum) && !isInodeHole(sblock, inodeNum) {
+			inodeBits.Set(inodeNum)
+		}
+	}
+	reserveInodeHoles(resized, inodeBits)
+
+	for group := groupCount(sblock); group < groupCount(resized); group++ {
+		for blockNum := groupInodeTable(resized, group); blockNum < groupDataStart(resized, group); blockNum++ {
+			writeBlock(resized, blockNum, nil)
+		}
+	}
+	freeBlockBitmap, inodeBitmap = freeBlocks, inodeBits
+	freeBlocks.flush()
+	inodeBits.flush()
+	syncDisk()
+	resized.FreeBlocks, resized.FreeInodes = freeBlocks.CountFree(), inodeBits.CountFree()
+	writeSuperBlock(resized)
+	syncDisk()
+	for _, blockNum := range stale {
+		freeBlocks.Clear(blockNum)
+	}
+	syncBitmaps()
+	syncDisk()
+}
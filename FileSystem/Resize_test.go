@@ -0,0 +1,332 @@
+package FileSystem
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// checkTestFiles makes sure every file in files is in the root directory with its own contents and
+// the inode number it was made with
+func checkTestFiles(t *testing.T, files map[string]int) {
+	t.Helper()
+	for name, inodeNum := range files {
+		content, num := readTestFile(RootFolder, name)
+		if num != inodeNum || content != strings.Repeat(name, 20) {
+			t.Fatalf("%s is inode %d holding %.20q, it should be inode %d", name, num, content, inodeNum)
+		}
+	}
+}
+
+// fillInodeTable makes files in the root directory until the inode table has grown a chunk, and a
+// few more so the chunk has some in it
+func fillInodeTable(t *testing.T, files map[string]int) {
+	t.Helper()
+	for num := len(files); ReadSuperBlock().InodeChunks == 0 || num%50 != 0; num++ {
+		name := fmt.Sprint("f", num)
+		files[name] = createTestFile(t, RootFolder, name, strings.Repeat(name, 20))
+	}
+}
+
+func TestResizeWithInodeChunks(t *testing.T) {
+	device := newTestFileSystem(t, 8<<20, DefaultOptions())
+	formatted := ReadSuperBlock()
+	files := map[string]int{}
+	fillInodeTable(t, files)
+	made := len(files)
+
+	if err := Resize(2 * formatted.BlockCount); err != nil {
+		t.Fatalf("growing a file system with inode chunks: %v", err)
+	}
+	grown := ReadSuperBlock()
+	if groupCount(grown) != 2*groupCount(formatted) {
+		t.Fatalf("%d block groups after doubling %d", groupCount(grown), groupCount(formatted))
+	}
+	checkTestFiles(t, files)
+	checkFsck(t)
+	if stats := Statfs(); stats.TotalInodes != groupCount(grown)*grown.InodesPerGroup+grown.InodeChunks*grown.InodesPerChunk {
+		t.Fatalf("Statfs says there are %d inodes, the holes have been counted", stats.TotalInodes)
+	}
+	//the new group's inodes get used, and have to move out again when it goes
+	for num := 0; num < grown.InodesPerGroup/2; num++ {
+		name := fmt.Sprint("g", num)
+		files[name] = createTestFile(t, RootFolder, name, strings.Repeat(name, 20))
+	}
+	remount(t, device)
+	checkTestFiles(t, files)
+	checkFsck(t)
+
+	//make room in the groups that stay for the inodes that have to move
+	for num := 0; num < made; num += 3 {
+		name := fmt.Sprint("f", num)
+		if err := UnlinkName(name, RootFolder); err != nil {
+			t.Fatalf("UnlinkName %s: %v", name, err)
+		}
+		delete(files, name)
+	}
+	if err := Resize(formatted.BlockCount); err != nil {
+		t.Fatalf("shrinking it back: %v", err)
+	}
+	moved := currentNumbers(t, files)
+	for name, inodeNum := range files {
+		if strings.HasPrefix(name, "f") && moved[name] != inodeNum {
+			t.Fatalf("%s was inode %d and is %d now, only the inodes of the group taken away should move", name, inodeNum, moved[name])
+		}
+	}
+	files = moved
+	checkTestFiles(t, files)
+	checkFsck(t)
+	remount(t, device)
+	checkTestFiles(t, files)
+	checkFsck(t)
+}
+
+// TestResizeBelowFormattedGroups takes away groups Format made, which leaves a hole in the inode
+// numbers before the chunks, and then grows into them again
+func TestResizeBelowFormattedGroups(t *testing.T) {
+	options := DefaultOptions()
+	options.BytesPerInode = 64 << 10
+	device := newTestFileSystem(t, 24<<20, options)
+	formatted := ReadSuperBlock()
+	files := map[string]int{}
+	fillInodeTable(t, files)
+	for name := range files {
+		if len(files) > formatted.InodesPerGroup {
+			if err := UnlinkName(name, RootFolder); err != nil {
+				t.Fatalf("UnlinkName %s: %v", name, err)
+			}
+			delete(files, name)
+		}
+	}
+
+	if err := Resize(formatted.BlocksPerGroup); err != nil {
+		t.Fatalf("shrinking to one block group: %v", err)
+	}
+	files = currentNumbers(t, files)
+	checkTestFiles(t, files)
+	checkFsck(t)
+	shrunk := ReadSuperBlock()
+	if holes := inodeHoles(shrunk); len(holes) != 1 || holes[0] != [2]int{shrunk.InodesPerGroup, formatted.InodeChunkBase} {
+		t.Fatalf("the inode holes are %v after taking away groups 1 and 2", holes)
+	}
+	remount(t, device)
+	checkFsck(t)
+
+	if err := Resize(formatted.BlockCount); err != nil {
+		t.Fatalf("growing back: %v", err)
+	}
+	for num := 0; num < 2*formatted.InodesPerGroup; num++ {
+		name := fmt.Sprint("g", num)
+		files[name] = createTestFile(t, RootFolder, name, strings.Repeat(name, 20))
+	}
+	checkTestFiles(t, files)
+	checkFsck(t)
+	remount(t, device)
+	checkTestFiles(t, files)
+	checkFsck(t)
+	if grown := ReadSuperBlock(); grown.InodeCount != formatted.InodeChunkBase+grown.InodeChunks*grown.InodesPerChunk {
+		t.Fatalf("the inode table is %d inodes after growing back, it should be where it started", grown.InodeCount)
+	}
+}
+
+// currentNumbers is files with the inode numbers they have now, after a shrink moved some of them
+func currentNumbers(t *testing.T, files map[string]int) map[string]int {
+	t.Helper()
+	current := map[string]int{}
+	for name := range files {
+		_, inodeNum := readTestFile(RootFolder, name)
+		if inodeNum == 0 {
+			t.Fatalf("%s has gone", name)
+		}
+		current[name] = inodeNum
+	}
+	return current
+}
+
+// liveFile is a file a resize test made and what it should hold
+type liveFile struct {
+	dir     string //"" for the root directory
+	content string
+}
+
+// liveDir is the directory a liveFile is in, looked up again every time because shrinking can
+// give it a new inode number
+func liveDir(t *testing.T, name string) INode {
+	t.Helper()
+	if name == "" {
+		return RootFolder
+	}
+	dir, dirNum := Open(READ, name, RootFolder)
+	if dirNum == 0 {
+		t.Fatalf("directory %s has gone", name)
+	}
+	return dir
+}
+
+// checkLiveFiles makes sure every file in files is there holding what it should
+func checkLiveFiles(t *testing.T, files map[string]liveFile) {
+	t.Helper()
+	for name, file := range files {
+		if content, _ := readTestFile(liveDir(t, file.dir), name); content != file.content {
+			t.Fatalf("%s holds %d bytes starting %.20q, it should be %d bytes", name, len(content), content, len(file.content))
+		}
+	}
+}
+
+// highestBlock is the highest block any of files uses
+func highestBlock(t *testing.T, files map[string]liveFile) int {
+	t.Helper()
+	sblock := ReadSuperBlock()
+	highest := 0
+	for name, file := range files {
+		_, inodeNum := readTestFile(liveDir(t, file.dir), name)
+		inode := getInodeFromDisk(inodeNum)
+		for _, blockNum := range blockPointers(sblock, &inode) {
+			highest = max(highest, blockNum)
+		}
+	}
+	return highest
+}
+
+// fillLiveFiles makes files of different sizes in the root directory and in sub until less than
+// free blocks are left, some of them clones of others so there are shared blocks to move
+func fillLiveFiles(t *testing.T, files map[string]liveFile, prefix string, free int) {
+	t.Helper()
+	sblock := ReadSuperBlock()
+	for num := 0; Statfs().FreeBlocks > free; num++ {
+		name := fmt.Sprint(prefix, num)
+		file := liveFile{content: strings.Repeat(name+"-", (num%7*sblock.BlockSize+300)/(len(name)+1))}
+		if num%3 == 1 {
+			file.dir = "sub"
+		}
+		inodeNum := createTestFile(t, liveDir(t, file.dir), name, file.content)
+		files[name] = file
+		if num%10 == 5 {
+			if _, _, err := CloneFile(inodeNum, name+"c", liveDir(t, file.dir)); err != nil {
+				t.Fatalf("CloneFile: %v", err)
+			}
+			files[name+"c"] = file
+		}
+	}
+}
+
+// TestResizeWithLiveData shrinks a file system that has files, clones, a subdirectory and things in
+// the trash in the part being taken away, with and without block groups, and grows it again. Every
+// file has to keep its contents through the shrink, the grow and a remount after each
+func TestResizeWithLiveData(t *testing.T) {
+	for _, noGroups := range []bool{false, true} {
+		t.Run(fmt.Sprint("NoBlockGroups=", noGroups), func(t *testing.T) {
+			options := DefaultOptions()
+			options.NoBlockGroups = noGroups
+			device := newTestFileSystem(t, 8<<20, options)
+			formatted := ReadSuperBlock()
+			if err := SetTrash(true); err != nil {
+				t.Fatal(err)
+			}
+			_, subNum := Open(CREATE, "sub", RootFolder)
+			CreateDirectoryFile(formatted.RootDirInode, subNum)
+			files := map[string]liveFile{}
+			fillLiveFiles(t, files, "f", formatted.BlockCount/4)
+
+			half := formatted.BlockCount / 2
+			if err := Resize(half); err == nil {
+				t.Fatalf("shrank a file system three quarters full to half its size")
+			}
+			if sblock := ReadSuperBlock(); sblock.BlockCount != formatted.BlockCount {
+				t.Fatalf("the refused shrink left %d blocks", sblock.BlockCount)
+			}
+			checkLiveFiles(t, files)
+			checkFsck(t)
+
+			//every other file goes and the trash is emptied, then a few more go into it and stay there. What is
+			//left is spread over the whole disk
+			num := 0
+			for name, file := range files {
+				if num++; num%2 == 0 {
+					if err := UnlinkName(name, liveDir(t, file.dir)); err != nil {
+						t.Fatalf("UnlinkName %s: %v", name, err)
+					}
+					delete(files, name)
+				}
+			}
+			if err := EmptyTrash(); err != nil {
+				t.Fatal(err)
+			}
+			for name, file := range files {
+				if num++; num%5 == 0 {
+					if err := UnlinkName(name, liveDir(t, file.dir)); err != nil {
+						t.Fatalf("UnlinkName %s: %v", name, err)
+					}
+					delete(files, name)
+				}
+			}
+			if highest := highestBlock(t, files); highest < half {
+				t.Fatalf("the highest block in use is %d, nothing has to move to shrink to %d", highest, half)
+			}
+
+			if err := Resize(half); err != nil {
+				t.Fatalf("shrinking to %d blocks: %v", half, err)
+			}
+			if highest := highestBlock(t, files); highest >= half {
+				t.Fatalf("block %d is still in use after shrinking to %d", highest, half)
+			}
+			checkLiveFiles(t, files)
+			checkFsck(t)
+			remount(t, device)
+			checkLiveFiles(t, files)
+			checkFsck(t)
+			if trash, err := ListTrash(); err != nil || len(trash) == 0 {
+				t.Fatalf("the trash is %v %v after shrinking, it should still have things in it", trash, err)
+			}
+
+			if err := Resize(formatted.BlockCount); err != nil {
+				t.Fatalf("growing back to %d blocks: %v", formatted.BlockCount, err)
+			}
+			fillLiveFiles(t, files, "g", formatted.BlockCount/4)
+			if highest := highestBlock(t, files); highest < half {
+				t.Fatalf("nothing got put in the blocks the grow added")
+			}
+			checkLiveFiles(t, files)
+			checkFsck(t)
+			remount(t, device)
+			checkLiveFiles(t, files)
+			checkFsck(t)
+		})
+	}
+}
+
+// TestResizeWithoutBlockGroupsLimit grows a file system without block groups as far as its free
+// block bitmap goes, one block further has to be ErrResizeLimit and leave it as it was
+func TestResizeWithoutBlockGroupsLimit(t *testing.T) {
+	options := DefaultOptions()
+	options.NoBlockGroups = true
+	device := newTestFileSystem(t, 2<<20, options)
+	formatted := ReadSuperBlock()
+	room := (formatted.INodeStart - formatted.FreeBlockStart) * formatted.BlockSize * 8
+	if room <= formatted.BlockCount {
+		t.Fatalf("a %d block file system has bitmap room for %d blocks, nothing to grow into", formatted.BlockCount, room)
+	}
+	content := strings.Repeat("r", 5*formatted.BlockSize)
+	createTestFile(t, RootFolder, "file", content)
+
+	err := Resize(room + 1)
+	if !errors.Is(err, ErrResizeLimit) || !strings.Contains(err.Error(), fmt.Sprint(room, " blocks")) {
+		t.Fatalf("growing past the bitmap gave %v", err)
+	}
+	if sblock := ReadSuperBlock(); sblock.BlockCount != formatted.BlockCount || device.Size() != int64(formatted.BlockCount*formatted.BlockSize) {
+		t.Fatalf("the refused grow left %d blocks on a %d byte device", sblock.BlockCount, device.Size())
+	}
+
+	if err := Resize(room); err != nil {
+		t.Fatalf("growing to fill the bitmap: %v", err)
+	}
+	remount(t, device)
+	if stats := Statfs(); stats.TotalBlocks != room {
+		t.Fatalf("grown to %d blocks Statfs says %+v", room, stats)
+	}
+	if got, _ := readTestFile(RootFolder, "file"); got != content {
+		t.Fatalf("the file holds %.10q... after growing", got)
+	}
+	checkFsck(t)
+}
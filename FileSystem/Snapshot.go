@@ -0,0 +1,333 @@
+package FileSystem
+
+import (
+	"fmt"
+	"time"
+)
+
+// Snapshots
+// On a copy on write file system everything there is to know about the file system is the block map
+// plus the superblock, and the blocks the map points at never get overwritten. So a snapshot is
+// just a saved copy of the two. Saving the map bumps the reference count of every block it points
+// at, which stops the allocator handing them out again even after the live file system has moved on,
+// and the blocks are only really freed once the last map pointing at them is gone.
+//
+// The snapshots are listed in a table block the superblock points at. Creating or deleting one
+// writes a new table and switches the superblock over to it in the same commit as everything else,
+// so a crash leaves either the old list or the new one.
+//
+// The blocks only snapshots are holding on to aren't free, but the free block bitmap is about logical
+// blocks and can't see them. So they come off the free count in the superblock and the allocator
+// leaves that many alone (see cowState.held), and deleting the snapshot gives them back.
+
+const (
+	SNAPSHOT_TABLE_MAGIC  = 0x50414e53 //"SNAP"
+	SNAPSHOT_HEADER_MAGIC = 0x44485053 //"SPHD"
+	SNAPSHOT_NAME_LENGTH  = 32
+	MAX_SNAPSHOTS         = 64
+
+	snapshotHeaderFixedSize = 4 + SNAPSHOT_NAME_LENGTH + 8 + SUPERBLOCK_SIZE + 4
+)
+
+// SnapshotInfo describes a snapshot for ListSnapshots
+type SnapshotInfo struct {
+	Name       string
+	Created    time.Time
+	UsedBlocks int //blocks the file system was using when the snapshot was taken
+	UsedInodes int
+}
+
+// snapshot is everything read back from a snapshot's header
+type snapshot struct {
+	header      int //physical block of the header
+	name        string
+	created     int64
+	sblock      SuperBlock
+	indexBlocks []int
+	mapBlocks   []int
+	blockMap    []int
+}
+
+// ownBlocks are the physical blocks that belong to the snapshot itself rather than the file system in it
+func (snap *snapshot) ownBlocks() []int {
+	own := append([]int{snap.header}, snap.indexBlocks...)
+	return append(own, snap.mapBlocks...)
+}
+
+func (snap *snapshot) info() SnapshotInfo {
+	return SnapshotInfo{
+		Name:       snap.name,
+		Created:    time.Unix(snap.created, 0),
+		UsedBlocks: snap.sblock.BlockCount - snap.sblock.FreeBlocks,
+		UsedInodes: usableInodes(snap.sblock) - snap.sblock.FreeInodes,
+	}
+}
+
+func (state *cowState) readSnapshotTable(tableBlock int) ([]int, error) {
+	if !state.inPool(tableBlock) {
+		return nil, fmt.Errorf("snapshot table at %d isn't in the pool", tableBlock)
+	}
+	block := state.readPhysical(tableBlock)
+	count := int(byteOrder.Uint32(block[4:]))
+	if byteOrder.Uint32(block[0:]) != SNAPSHOT_TABLE_MAGIC || count > MAX_SNAPSHOTS || 8+count*BLOCK_POINTER_SIZE > len(block) {
+		return nil, fmt.Errorf("snapshot table at %d is damaged", tableBlock)
+	}
+	return decodeIndirectBlock(block[8 : 8+count*BLOCK_POINTER_SIZE]), nil
+}
+
+// writeSnapshotTable puts a new table in a fresh block, no snapshots at all is table 0
+func (state *cowState) writeSnapshotTable(headers []int) int {
+	if len(headers) == 0 {
+		return 0
+	}
+	block := make([]byte, state.blockSize)
+	byteOrder.PutUint32(block[0:], SNAPSHOT_TABLE_MAGIC)
+	byteOrder.PutUint32(block[4:], uint32(len(headers)))
+	copy(block[8:], EncodeToBytes(IndirectBlock(headers)))
+	tableBlock, _ := state.allocate() //the caller made sure there was room
+	state.writePhysical(tableBlock, block)
+	return tableBlock
+}
+
+// readSnapshot reads a snapshot's header and its whole copy of the block map
+func (state *cowState) readSnapshot(header int, logicalBlocks int) (*snapshot, error) {
+	damaged := fmt.Errorf("snapshot header at %d is damaged", header)
+	if !state.inPool(header) {
+		return nil, damaged
+	}
+	block := state.readPhysical(header)
+	if byteOrder.Uint32(block[0:]) != SNAPSHOT_HEADER_MAGIC || !superBlockChecksumOK(block[44:44+SUPERBLOCK_SIZE]) {
+		return nil, damaged
+	}
+	snap := &snapshot{
+		header:  header,
+		name:    string(trimZeros(block[4 : 4+SNAPSHOT_NAME_LENGTH])),
+		created: int64(byteOrder.Uint64(block[36:])),
+		sblock:  decodeSuperBlock(block[44 : 44+SUPERBLOCK_SIZE]),
+	}
+	count := int(byteOrder.Uint32(block[snapshotHeaderFixedSize-4:]))
+	if snapshotHeaderFixedSize+count*BLOCK_POINTER_SIZE > len(block) {
+		return nil, damaged
+	}
+	snap.indexBlocks = decodeIndirectBlock(block[snapshotHeaderFixedSize : snapshotHeaderFixedSize+count*BLOCK_POINTER_SIZE])
+	for _, indexBlock := range snap.indexBlocks {
+		if !state.inPool(indexBlock) {
+			return nil, damaged
+		}
+		for _, mapBlock := range decodeIndirectBlock(state.readPhysical(indexBlock)) {
+			if len(snap.mapBlocks) < state.mapBlocks {
+				snap.mapBlocks = append(snap.mapBlocks, mapBlock)
+			}
+		}
+	}
+	if len(snap.mapBlocks) != state.mapBlocks {
+		return nil, damaged
+	}
+	snap.blockMap = make([]int, 0, logicalBlocks)
+	for _, mapBlock := range snap.mapBlocks {
+		if !state.inPool(mapBlock) {
+			return nil, damaged
+		}
+		for _, physicalNum := range decodeIndirectBlock(state.readPhysical(mapBlock)) {
+			if len(snap.blockMap) == logicalBlocks {
+				break
+			}
+			if physicalNum != 0 && !state.inPool(physicalNum) {
+				return nil, damaged
+			}
+			snap.blockMap = append(snap.blockMap, physicalNum)
+		}
+	}
+	return snap, nil
+}
+
+// trimZeros cuts the zero padding off the end of a fixed size name
+func trimZeros(b []byte) []byte {
+	for len(b) > 0 && b[len(b)-1] == 0 {
+		b = b[:len(b)-1]
+	}
+	return b
+}
+
+// liveSuperBlock is the superblock of the live file system, even when a snapshot is mounted
+func liveSuperBlock() SuperBlock {
+	if cow != nil && cow.snapshot != nil {
+		return decodeSuperBlock(cow.readPhysical(0))
+	}
+	return ReadSuperBlock()
+}
+
+// loadSnapshots reads every snapshot in the table
+func loadSnapshots(sblock SuperBlock) ([]*snapshot, error) {
+	if sblock.SnapshotTable == 0 {
+		return nil, nil
+	}
+	table, err := cow.readSnapshotTable(sblock.SnapshotTable)
+	if err != nil {
+		return nil, err
+	}
+	snaps := []*snapshot{}
+	for _, header := range table {
+		snap, err := cow.readSnapshot(header, sblock.BlockCount)
+		if err != nil {
+			return nil, err
+		}
+		snaps = append(snaps, snap)
+	}
+	return snaps, nil
+}
+
+func findSnapshot(snaps []*snapshot, name string) int {
+	for num, snap := range snaps {
+		if snap.name == name {
+			return num
+		}
+	}
+	return -1
+}
+
+// checkSnapshotsWritable is what has to be true before the list of snapshots can change
+func checkSnapshotsWritable() error {
+	transactionLock.Lock()
+	defer transactionLock.Unlock()
+	if cow == nil {
+		return fmt.Errorf("snapshots need a copy on write file system")
+	}
+	if readOnly {
+		return fmt.Errorf("file system is mounted read only")
+	}
+	if transactionDepth > 0 {
+		return fmt.Errorf("can't change snapshots in the middle of another operation")
+	}
+	return nil
+}
+
+// CreateSnapshot saves the file system as it is right now under name
+func CreateSnapshot(name string) error {
+	defer lockExclusive()()
+	if err := checkSnapshotsWritable(); err != nil {
+		return err
+	}
+	if name == "" || len(name) > SNAPSHOT_NAME_LENGTH {
+		return fmt.Errorf("snapshot name %q must be 1 to %d bytes", name, SNAPSHOT_NAME_LENGTH)
+	}
+	sblock := ReadSuperBlock()
+	snaps, err := loadSnapshots(sblock)
+	if err != nil {
+		return err
+	}
+	if findSnapshot(snaps, name) >= 0 {
+		return fmt.Errorf("there is already a snapshot called %q", name)
+	}
+	if len(snaps) >= MAX_SNAPSHOTS {
+		return fmt.Errorf("there can only be %d snapshots", MAX_SNAPSHOTS)
+	}
+	perBlock := cow.entriesPerMapBlock()
+	indexCount := (cow.mapBlocks + perBlock - 1) / perBlock
+	if snapshotHeaderFixedSize+indexCount*BLOCK_POINTER_SIZE > cow.blockSize {
+		return fmt.Errorf("block map is too big for a snapshot header to find")
+	}
+
+	//the snapshot's own blocks and the new table, plus the spare blocks the commit might want
+	if need := cow.mapBlocks + indexCount + 2; cow.free < need+COW_SPARE_BLOCKS {
+		return fmt.Errorf("%w: a snapshot needs %d blocks and the copy on write pool has %d free", ErrNoSpace, need, max(cow.free-COW_SPARE_BLOCKS, 0))
+	}
+
+	beginTransaction()
+	defer commitTransaction()
+	//nothing is running, so the map in memory is exactly what the last commit left on Disk
+	cow.reference(cow.blockMap)
+	mapBlocks := make(IndirectBlock, indexCount*perBlock)
+	for mapBlock := 0; mapBlock < cow.mapBlocks; mapBlock++ {
+		mapBlocks[mapBlock], _ = cow.allocate()
+		cow.writePhysical(mapBlocks[mapBlock], cow.encodeMapBlock(cow.blockMap, mapBlock))
+	}
+	header := make([]byte, cow.blockSize)
+	byteOrder.PutUint32(header[0:], SNAPSHOT_HEADER_MAGIC)
+	copy(header[4:4+SNAPSHOT_NAME_LENGTH], name)
+	byteOrder.PutUint64(header[36:], uint64(time.Now().Unix()))
+	copy(header[44:], EncodeToBytes(sblock))
+	byteOrder.PutUint32(header[snapshotHeaderFixedSize-4:], uint32(indexCount))
+	for indexNum := 0; indexNum < indexCount; indexNum++ {
+		indexBlock, _ := cow.allocate()
+		cow.writePhysical(indexBlock, EncodeToBytes(mapBlocks[indexNum*perBlock:(indexNum+1)*perBlock]))
+		byteOrder.PutUint32(header[snapshotHeaderFixedSize+indexNum*BLOCK_POINTER_SIZE:], uint32(indexBlock))
+	}
+	headerBlock, _ := cow.allocate()
+	cow.writePhysical(headerBlock, header)
+
+	headers := []int{}
+	for _, snap := range snaps {
+		headers = append(headers, snap.header)
+	}
+	runningTransaction.released = append(runningTransaction.released, sblock.SnapshotTable)
+	sblock.SnapshotTable = cow.writeSnapshotTable(append(headers, headerBlock))
+	writeSuperBlock(sblock) //committing this is what makes the snapshot exist
+	return nil
+}
+
+// ListSnapshots lists the snapshots oldest first
+func ListSnapshots() ([]SnapshotInfo, error) {
+	defer lockShared()()
+	if cow == nil {
+		return nil, fmt.Errorf("snapshots need a copy on write file system")
+	}
+	snaps, err := loadSnapshots(liveSuperBlock())
+	if err != nil {
+		return nil, err
+	}
+	infos := []SnapshotInfo{}
+	for _, snap := range snaps {
+		infos = append(infos, snap.info())
+	}
+	return infos, nil
+}
+
+// DeleteSnapshot forgets a snapshot, any blocks only it was holding on to are free again afterwards
+func DeleteSnapshot(name string) error {
+	defer lockExclusive()()
+	if err := checkSnapshotsWritable(); err != nil {
+		return err
+	}
+	sblock := ReadSuperBlock()
+	snaps, err := loadSnapshots(sblock)
+	if err != nil {
+		return err
+	}
+	doomed := findSnapshot(snaps, name)
+	if doomed < 0 {
+		return fmt.Errorf("there is no snapshot called %q", name)
+	}
+	if cow.free == 0 {
+		return fmt.Errorf("%w: there isn't a block free for the new snapshot table", ErrNoSpace) //the spare blocks are for this sort of thing
+	}
+	beginTransaction()
+	defer commitTransaction()
+	headers := []int{}
+	for num, snap := range snaps {
+		if num != doomed {
+			headers = append(headers, snap.header)
+		}
+	}
+	//the old table and the snapshot stay put until the new table is committed
+	released := append([]int{sblock.SnapshotTable}, snaps[doomed].ownBlocks()...)
+	runningTransaction.released = append(append(runningTransaction.released, released...), snaps[doomed].blockMap...)
+	sblock.SnapshotTable = cow.writeSnapshotTable(headers)
+	writeSuperBlock(sblock)
+	return nil
+}
+
+// mountSnapshot swaps the live map for a snapshot's, Mount has already loaded the live one
+func mountSnapshot(name string) error {
+	snaps, err := loadSnapshots(ReadSuperBlock())
+	if err != nil {
+		return err
+	}
+	num := findSnapshot(snaps, name)
+	if num < 0 {
+		return fmt.Errorf("there is no snapshot called %q", name)
+	}
+	cow.blockMap = snaps[num].blockMap
+	cow.snapshot = &snaps[num].sblock
+	return nil
+}
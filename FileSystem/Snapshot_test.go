@@ -0,0 +1,138 @@
+package FileSystem
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func newCowTestFileSystem(t *testing.T, size int64) *MemDevice {
+	t.Helper()
+	options := DefaultOptions()
+	options.CopyOnWrite = true
+	return newTestFileSystem(t, size, options)
+}
+
+// TestSnapshotReadBack takes a snapshot, changes the file system and checks mounting the snapshot
+// still shows it as it was and can't be written, while the live file system has the changes
+func TestSnapshotReadBack(t *testing.T) {
+	device := newCowTestFileSystem(t, 2<<20)
+	createTestFile(t, RootFolder, "file", "before the snapshot")
+	createTestFile(t, RootFolder, "doomed", "deleted after the snapshot")
+	if err := CreateSnapshot("first"); err != nil {
+		t.Fatalf("CreateSnapshot: %v", err)
+	}
+	createTestFile(t, RootFolder, "file", "after the snapshot")
+	UnlinkName("doomed", RootFolder)
+	createTestFile(t, RootFolder, "new", "only in the live file system")
+	if err := CreateSnapshot("first"); err == nil {
+		t.Fatalf("made a second snapshot called first")
+	}
+	if err := CreateSnapshot("second"); err != nil {
+		t.Fatalf("CreateSnapshot: %v", err)
+	}
+
+	snaps, err := ListSnapshots()
+	if err != nil {
+		t.Fatalf("ListSnapshots: %v", err)
+	}
+	if len(snaps) != 2 || snaps[0].Name != "first" || snaps[1].Name != "second" || snaps[1].UsedInodes != snaps[0].UsedInodes {
+		t.Fatalf("ListSnapshots says %+v", snaps)
+	}
+
+	if err := MountWithOptions(device, MountOptions{Snapshot: "first"}); err != nil {
+		t.Fatalf("mounting the snapshot: %v", err)
+	}
+	for name, want := range map[string]string{"file": "before the snapshot", "doomed": "deleted after the snapshot", "new": ""} {
+		if got, _ := readTestFile(RootFolder, name); got != want {
+			t.Fatalf("%s holds %q in the snapshot", name, got)
+		}
+	}
+	if file, inodeNum := Open(READ, "file", RootFolder); Write(&file, inodeNum, []byte("changed")) == nil {
+		t.Fatalf("wrote to a file in a snapshot")
+	}
+	if snaps, err := ListSnapshots(); err != nil || len(snaps) != 2 {
+		t.Fatalf("ListSnapshots from inside a snapshot says %v %v", snaps, err)
+	}
+	if err := MountWithOptions(device, MountOptions{Snapshot: "nothing"}); err == nil {
+		t.Fatalf("mounted a snapshot that doesn't exist")
+	}
+
+	if err := Mount(device); err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+	for name, want := range map[string]string{"file": "after the snapshot", "doomed": "", "new": "only in the live file system"} {
+		if got, _ := readTestFile(RootFolder, name); got != want {
+			t.Fatalf("%s holds %q in the live file system", name, got)
+		}
+	}
+	checkFsck(t)
+}
+
+// TestSnapshotHeldBlocks checks the blocks a snapshot keeps after the live file system has let go
+// of them come off the free count and the allocator, so filling up gets ErrNoSpace while Statfs
+// agrees there is nothing left, and deleting the snapshot gives them all back
+func TestSnapshotHeldBlocks(t *testing.T) {
+	device := newCowTestFileSystem(t, 2<<20)
+	blockSize := ReadSuperBlock().BlockSize
+	big := strings.Repeat("s", 200*blockSize)
+	createTestFile(t, RootFolder, "big", big)
+	before := Statfs()
+	if err := CreateSnapshot("snap"); err != nil {
+		t.Fatalf("CreateSnapshot: %v", err)
+	}
+	//the snapshot's copy of the map is all the snapshot costs while it shares everything
+	if taken := before.FreeBlocks - Statfs().FreeBlocks; taken <= 0 || taken > 2*cow.mapBlocks+4 {
+		t.Fatalf("taking a snapshot took %d blocks", taken)
+	}
+	afterSnapshot := Statfs()
+	UnlinkName("big", RootFolder)
+	//and the old copies of the directory, inode and bitmap blocks it changed are the snapshot's now
+	afterUnlink := Statfs()
+	if freed := afterUnlink.FreeBlocks - afterSnapshot.FreeBlocks; freed > 0 || freed < -8 {
+		t.Fatalf("deleting a file the snapshot still has freed %d blocks", freed)
+	}
+	remount(t, device)
+	if Statfs() != afterUnlink {
+		t.Fatalf("Statfs says %+v after a remount, it was %+v", Statfs(), afterUnlink)
+	}
+	checkFsck(t)
+
+	chunk := strings.Repeat("f", 100*blockSize)
+	var err error
+	for num := 0; err == nil; num++ {
+		file, inodeNum := Open(CREATE, fmt.Sprint("fill", num), RootFolder)
+		err = Write(&file, inodeNum, []byte(chunk))
+		if num > 100 {
+			t.Fatalf("still writing with %+v", Statfs())
+		}
+	}
+	if !errors.Is(err, ErrNoSpace) {
+		t.Fatalf("filling up with a snapshot: %v", err)
+	}
+	if free := Statfs().FreeBlocks; free >= 100+COW_SPARE_BLOCKS {
+		t.Fatalf("Write said ErrNoSpace with %d blocks free", free)
+	}
+	checkFsck(t)
+
+	full := Statfs()
+	if err := DeleteSnapshot("snap"); err != nil {
+		t.Fatalf("DeleteSnapshot: %v", err)
+	}
+	if freed := Statfs().FreeBlocks - full.FreeBlocks; freed < 200 {
+		t.Fatalf("deleting the snapshot only freed %d blocks", freed)
+	}
+	if snaps, err := ListSnapshots(); err != nil || len(snaps) != 0 {
+		t.Fatalf("ListSnapshots after deleting the only one says %v %v", snaps, err)
+	}
+	if err := DeleteSnapshot("snap"); err == nil {
+		t.Fatalf("deleted a snapshot twice")
+	}
+	createTestFile(t, RootFolder, "room", chunk)
+	remount(t, device)
+	if got, _ := readTestFile(RootFolder, "room"); got != chunk {
+		t.Fatalf("the file written after deleting the snapshot holds %d bytes", len(got))
+	}
+	checkFsck(t)
+}
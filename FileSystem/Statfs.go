@@ -0,0 +1,34 @@
+package FileSystem
+
+// FileSystemStats is everything df needs to know, all counts are in blocks or inodes
+type FileSystemStats struct {
+	BlockSize       int
+	TotalBlocks     int
+	FreeBlocks      int //blocks nobody is using or has reserved for a Write (see DelayedAlloc.go)
+	AvailableBlocks int //free blocks an ordinary user can still get, FreeBlocks minus ReservedBlocks
+	ReservedBlocks  int //blocks only ReservedUID can have
+	ReservedUID     int
+	TotalInodes     int
+	FreeInodes      int
+}
+
+// Statfs reports how full the mounted file system is straight from the counters in the superblock,
+// so nothing has to walk the bitmaps
+func Statfs() FileSystemStats {
+	defer lockShared()()
+	sblock := ReadSuperBlock()
+	stats := FileSystemStats{
+		BlockSize:      sblock.BlockSize,
+		TotalBlocks:    sblock.BlockCount,
+		FreeBlocks:     max(sblock.FreeBlocks-reservedFor(), 0),
+		ReservedBlocks: sblock.ReservedBlocks,
+		ReservedUID:    sblock.ReservedUID,
+		TotalInodes:    usableInodes(sblock),
+		FreeInodes:     sblock.FreeInodes,
+	}
+	stats.AvailableBlocks = stats.FreeBlocks - stats.ReservedBlocks
+	if stats.AvailableBlocks < 0 {
+		stats.AvailableBlocks = 0
+	}
+	return stats
+}
@@ -0,0 +1,90 @@
+package FileSystem
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// TestStatfsFollowsWritesAndUnlinks checks the counters Statfs reads from the superblock go down as a
+// file is made and written and back up when it is unlinked, agree with the bitmaps all the way (the
+// blocks reserved for a delayed write count as used), and come back the same after a remount
+func TestStatfsFollowsWritesAndUnlinks(t *testing.T) {
+	device := newTestFileSystem(t, 4<<20, DefaultOptions())
+	sblock := ReadSuperBlock()
+	agree := func(stats FileSystemStats) {
+		t.Helper()
+		if free := ReadFreeBlockBitmap(sblock).CountFree() - reservedFor(); stats.FreeBlocks != free {
+			t.Fatalf("Statfs says %d free blocks, the bitmap %d", stats.FreeBlocks, free)
+		}
+		if free := ReadINodeBitmap(sblock).CountFree(); stats.FreeInodes != free {
+			t.Fatalf("Statfs says %d free inodes, the bitmap %d", stats.FreeInodes, free)
+		}
+	}
+	empty := Statfs()
+	agree(empty)
+	if empty.TotalBlocks != sblock.BlockCount || empty.BlockSize != sblock.BlockSize || empty.FreeInodes != empty.TotalInodes-2 {
+		t.Fatalf("an empty file system says %+v", empty)
+	}
+
+	inodeNum := createTestFile(t, RootFolder, "file", strings.Repeat("x", 3*sblock.BlockSize))
+	written := Statfs()
+	agree(written)
+	if written.FreeBlocks != empty.FreeBlocks-3 || written.FreeInodes != empty.FreeInodes-1 {
+		t.Fatalf("a three block file took %d blocks and %d inodes", empty.FreeBlocks-written.FreeBlocks, empty.FreeInodes-written.FreeInodes)
+	}
+	remount(t, device)
+	if Statfs() != written {
+		t.Fatalf("Statfs says %+v after a remount, it was %+v", Statfs(), written)
+	}
+
+	Unlink(inodeNum, RootFolder)
+	agree(Statfs())
+	if Statfs() != empty {
+		t.Fatalf("Statfs says %+v after the unlink, it was %+v empty", Statfs(), empty)
+	}
+}
+
+// TestStatfsReservedBlocks fills a file system with reserved blocks as the privileged uid, past what
+// an ordinary user could have, and checks AvailableBlocks leaves the reserve out and never goes
+// below zero, and that SetReservedBlocks changes it
+func TestStatfsReservedBlocks(t *testing.T) {
+	options := DefaultOptions()
+	options.ReservedPercent = 10
+	options.ReservedUID = 7
+	device := newTestFileSystem(t, 1<<20, options)
+	t.Cleanup(func() { SetUID(0) })
+	sblock := ReadSuperBlock()
+	stats := Statfs()
+	if stats.ReservedBlocks != sblock.BlockCount/10 || stats.ReservedUID != 7 ||
+		stats.AvailableBlocks != stats.FreeBlocks-stats.ReservedBlocks {
+		t.Fatalf("a fresh file system with 10%% reserved says %+v", stats)
+	}
+
+	SetUID(7)
+	chunk := strings.Repeat("r", 50*sblock.BlockSize)
+	for num := 0; Statfs().AvailableBlocks > 0; num++ {
+		createTestFile(t, RootFolder, fmt.Sprint("file", num), chunk)
+	}
+	createTestFile(t, RootFolder, "reserved", chunk[:5*sblock.BlockSize]) //only uid 7 could have this
+	stats = Statfs()
+	if stats.AvailableBlocks != 0 || stats.FreeBlocks >= stats.ReservedBlocks {
+		t.Fatalf("filling past the reserve as uid 7 left %+v", stats)
+	}
+	remount(t, device)
+	if Statfs() != stats {
+		t.Fatalf("Statfs says %+v after a remount, it was %+v", Statfs(), stats)
+	}
+	checkFsck(t)
+
+	SetUID(0)
+	if err := SetReservedBlocks(0, 0); err != nil {
+		t.Fatalf("SetReservedBlocks: %v", err)
+	}
+	if stats := Statfs(); stats.ReservedBlocks != 0 || stats.AvailableBlocks != stats.FreeBlocks {
+		t.Fatalf("nothing reserved says %+v", stats)
+	}
+	if err := SetReservedBlocks(MAX_RESERVED_PERCENT+1, 0); err == nil {
+		t.Fatalf("SetReservedBlocks let %d%% through", MAX_RESERVED_PERCENT+1)
+	}
+}
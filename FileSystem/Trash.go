@@ -0,0 +1,489 @@
+package FileSystem
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Trash
+// With the trash turned on Unlink doesn't delete anything, it moves the entry into the .trash
+// directory in the root under the inode number, so names can't clash, and writes down where it came
+// from and when in the trash index file. Restore moves it back, EmptyTrash deletes it all for real,
+// and so does Unlink on something that is already in the trash. When the disk gets low on space
+// the oldest things in the trash get deleted first, and so do they when the trash directory fills up.
+//
+// The lock on the trash directory's inode covers the index file as well. Purging happens between
+// operations, a piece at a time: each transaction deletes one file or empty directory from the oldest
+// tree, so however big the tree is nothing outgrows the journal and a crash leaves a smaller tree
+// still in the trash. It only ever tries the locks and leaves the trash alone if someone else has it.
+
+const (
+	TRASH_DIR_NAME          = ".trash"
+	TRASH_INDEX_NAME        = ".trashinfo" //lives in the trash directory
+	TRASH_RECORD_SIZE       = 128
+	TRASH_PATH_LENGTH       = 96
+	TRASH_LOW_SPACE_PERCENT = 5 //purge the trash once free blocks are within this much of the reserved ones
+)
+
+// TrashEntry is one thing in the trash
+type TrashEntry struct {
+	InodeNum int
+	Path     string //where it was deleted from
+	Deleted  time.Time
+}
+
+type trashRecord struct {
+	inodeNum   int
+	deleted    int64
+	name       string
+	parentPath string
+}
+
+func trashEnabled(sblock SuperBlock) bool {
+	return sblock.TrashDir != 0
+}
+
+// trashLowSpace is how many free blocks above the reserved ones count as running low
+func trashLowSpace(sblock SuperBlock) int {
+	return sblock.BlockCount * TRASH_LOW_SPACE_PERCENT / 100
+}
+
+// inTrash is true if dir is the trash directory
+func inTrash(sblock SuperBlock, dir INode) bool {
+	return dir.DirectBlock1 == getInodeFromDisk(sblock.TrashDir).DirectBlock1
+}
+
+func encodeTrashRecords(records []trashRecord) []byte {
+	b := make([]byte, len(records)*TRASH_RECORD_SIZE)
+	for num, record := range records {
+		recordBytes := b[num*TRASH_RECORD_SIZE:]
+		byteOrder.PutUint32(recordBytes[0:], uint32(record.inodeNum))
+		byteOrder.PutUint64(recordBytes[4:], uint64(record.deleted))
+		copy(recordBytes[12:32], record.name)
+		copy(recordBytes[32:32+TRASH_PATH_LENGTH], record.parentPath)
+	}
+	return b
+}
+
+func decodeTrashRecords(b []byte) []trashRecord {
+	records := []trashRecord{}
+	for start := 0; start+TRASH_RECORD_SIZE <= len(b); start += TRASH_RECORD_SIZE {
+		recordBytes := b[start:]
+		inodeNum := int(byteOrder.Uint32(recordBytes[0:]))
+		if inodeNum == 0 {
+			break
+		}
+		records = append(records, trashRecord{
+			inodeNum:   inodeNum,
+			deleted:    int64(byteOrder.Uint64(recordBytes[4:])),
+			name:       string(trimZeros(recordBytes[12:32])),
+			parentPath: string(trimZeros(recordBytes[32 : 32+TRASH_PATH_LENGTH])),
+		})
+	}
+	return records
+}
+
+// trashIndex finds the index file, making a new one if it has gone missing
+func trashIndex(sblock SuperBlock) (INode, int) {
+	trash := getInodeFromDisk(sblock.TrashDir)
+	index, indexNum := openFile(READ, TRASH_INDEX_NAME, trash)
+	if indexNum == 0 {
+		index, indexNum = openFile(CREATE, TRASH_INDEX_NAME, trash)
+	}
+	return index, indexNum
+}
+
+// readTrashRecords reads the trash index, oldest first
+func readTrashRecords(sblock SuperBlock) []trashRecord {
+	index, _ := trashIndex(sblock)
+	contents := []byte{}
+	for _, blockNum := range fileBlocks(sblock, &index) {
+		contents = append(contents, readBlock(sblock, blockNum)...)
+	}
+	records := decodeTrashRecords(contents)
+	sort.SliceStable(records, func(i, j int) bool { return records[i].deleted < records[j].deleted })
+	return records
+}
+
+// writeTrashRecords replaces the trash index. It doesn't go through Write, the index has no business
+// keeping old versions of itself
+func writeTrashRecords(sblock SuperBlock, records []trashRecord) {
+	index, indexNum := trashIndex(sblock)
+	freeFileBlocks(sblock, &index)
+	contents := encodeTrashRecords(records)
+	blocks := placeFileBlocks(sblock, &index, indexNum, (len(contents)+sblock.BlockSize-1)/sblock.BlockSize, keptBlocks(sblock))
+	for block, blockNum := range blocks {
+		blockEnd := min(sblock.BlockSize*(block+1), len(contents))
+		writeBlock(sblock, blockNum, contents[sblock.BlockSize*block:blockEnd])
+	}
+	index.LastModifyTime = time.Now().Unix()
+	writeInodeToDisk(&index, indexNum, sblock)
+}
+
+// pathOf is the path of a directory from the root, or "" if it can't be worked out
+func pathOf(sblock SuperBlock, dirNum int) string {
+	names := []string{}
+	for steps := 0; dirNum != sblock.RootDirInode; steps++ {
+		dir := getInodeFromDisk(dirNum)
+		if steps >= sblock.InodeCount || !dir.IsValid || !dir.IsDirectory {
+			return "" //went round in a circle or fell off the tree
+		}
+		parentNum := decodeDirectoryBlock(readBlock(sblock, dir.DirectBlock1))[1].Inode
+		parent := getInodeFromDisk(parentNum)
+		if !parent.IsValid || !parent.IsDirectory {
+			return ""
+		}
+		name := entryNameOf(sblock, parent, dirNum)
+		if name == "" {
+			return ""
+		}
+		names = append([]string{name}, names...)
+		dirNum = parentNum
+	}
+	return "/" + strings.Join(names, "/")
+}
+
+// lookupDirectory follows a path from the root to a directory
+func lookupDirectory(sblock SuperBlock, path string) (INode, int, error) {
+	dir, dirNum := getInodeFromDisk(sblock.RootDirInode), sblock.RootDirInode
+	for _, name := range strings.Split(path, "/") {
+		if name == "" {
+			continue
+		}
+		if dir, dirNum = openFile(READ, name, dir); dirNum == 0 || !dir.IsValid || !dir.IsDirectory {
+			return INode{}, 0, fmt.Errorf("directory %s doesn't exist any more", path)
+		}
+	}
+	return dir, dirNum, nil
+}
+
+// setDotDot points a directory's '..' at a new parent, the caller sorts out the link counts
+func setDotDot(sblock SuperBlock, dirNum int, parentNum int) {
+	dir := getInodeFromDisk(dirNum)
+	entries := decodeDirectoryBlock(readBlock(sblock, dir.DirectBlock1))
+	entries[1].Inode = parentNum
+	writeBlock(sblock, dir.DirectBlock1, EncodeToBytes(entries))
+}
+
+// moveEntry takes the entry fromName for inodeNum out of one directory and puts it in another as name
+func moveEntry(sblock SuperBlock, inodeNum int, fromDir INode, fromName string, toDir INode, toNum int, name string) error {
+	fromDir, fromNum := currentDirectory(fromDir)
+	if findEntry(sblock, fromDir, fromName) != inodeNum {
+		return fmt.Errorf("inode %d isn't in directory %d", inodeNum, fromNum)
+	}
+	if !addDirectoryEntry(sblock, toDir, name, inodeNum) {
+		return fmt.Errorf("directory %d is full", toNum)
+	}
+	removeEntry(sblock, fromDir, fromName)
+	adjustLinks(sblock, inodeNum, -1)
+	if getInodeFromDisk(inodeNum).IsDirectory {
+		setDotDot(sblock, inodeNum, toNum)
+		adjustLinks(sblock, fromNum, -1)
+		adjustLinks(sblock, toNum, 1)
+	}
+	return nil
+}
+
+// removeDeepest deletes for real the deepest thing under the entry called name in dir: the entry itself
+// if it is a file or an empty directory, otherwise the first such thing further down. It is true if
+// it was the entry itself
+func removeDeepest(sblock SuperBlock, dir INode, name string, inodeNum int) bool {
+	for depth := 0; ; depth++ {
+		inode := getInodeFromDisk(inodeNum)
+		entries := []DirectoryEntry{}
+		if inode.IsValid && inode.IsDirectory {
+			entries = directoryEntries(sblock, inode)
+		}
+		if len(entries) == 0 {
+			unlinkEntry(sblock, inodeNum, name, dir)
+			return depth == 0
+		}
+		dir, name, inodeNum = inode, entryName(entries[0]), entries[0].Inode
+	}
+}
+
+// tryLockTree locks an inode and, if it is a directory, everything in it, as long as nobody else has
+// any of them. It returns the unlock
+func tryLockTree(sblock SuperBlock, inodeNum int) (func(), bool) {
+	locked := []int{}
+	unlock := func() {
+		for _, lockedNum := range locked {
+			unlockInode(lockedNum)
+		}
+	}
+	var lockTree func(inodeNum int) bool
+	lockTree = func(inodeNum int) bool {
+		if !tryLockInode(inodeNum) {
+			return false //this also stops us going round in circles on a broken tree
+		}
+		locked = append(locked, inodeNum)
+		inode := getInodeFromDisk(inodeNum)
+		if !inode.IsValid || !inode.IsDirectory {
+			return true
+		}
+		for _, entry := range directoryEntries(sblock, inode) {
+			if !lockTree(entry.Inode) {
+				return false
+			}
+		}
+		return true
+	}
+	if !lockTree(inodeNum) {
+		unlock()
+		return nil, false
+	}
+	return unlock, true
+}
+
+// maxTrashRecords is how many records fit in the index file
+func maxTrashRecords(sblock SuperBlock) int {
+	return maxFileBlocks(sblock) * sblock.BlockSize / TRASH_RECORD_SIZE
+}
+
+// trashHasRoom is true if the trash has an entry and a record free for inodeNum, the caller has the
+// trash directory locked. It only reads, a missing index just means there are no records
+func trashHasRoom(sblock SuperBlock, inodeNum int) bool {
+	trash := getInodeFromDisk(sblock.TrashDir)
+	if !hasRoomFor(sblock, trash, strconv.Itoa(inodeNum)) {
+		return false
+	}
+	_, indexNum := openFile(READ, TRASH_INDEX_NAME, trash)
+	return indexNum == 0 || len(readTrashRecords(sblock)) < maxTrashRecords(sblock)
+}
+
+// makeRoomInTrash purges the oldest things in the trash until there is room for inodeNum. Unlink does
+// it before it starts, the purging can't go inside its transaction
+func makeRoomInTrash(inodeNum int) {
+	//the file is going in as it is on Disk, so whatever is waiting to be written to it goes first
+	if err := flushDelayed(inodeNum); err != nil {
+		log.Fatal("Unable to write out inode ", inodeNum, " before moving it to the trash: ", err)
+	}
+	for {
+		sblock := ReadSuperBlock()
+		if !trashEnabled(sblock) {
+			return
+		}
+		unlock := lockInodes(nil, []int{sblock.TrashDir})
+		room := trashHasRoom(sblock, inodeNum)
+		unlock()
+		if room || !purgeOldest() {
+			return
+		}
+	}
+}
+
+// moveToTrash is what Unlink does when the trash is on with the entry called name, Unlink has the
+// trash directory locked. If someone filled the trash up again since makeRoomInTrash it gets deleted
+// for real
+func moveToTrash(sblock SuperBlock, inodeNum int, name string, parentDir INode) {
+	if !trashHasRoom(sblock, inodeNum) {
+		unlinkEntry(sblock, inodeNum, name, parentDir)
+		return
+	}
+	trashName := strconv.Itoa(inodeNum)
+	records := readTrashRecords(sblock)
+	parentPath := pathOf(sblock, directoryNum(parentDir))
+	if len(parentPath) > TRASH_PATH_LENGTH {
+		parentPath = "" //Restore will put it in the root instead
+	}
+	trash := getInodeFromDisk(sblock.TrashDir)
+	if err := moveEntry(sblock, inodeNum, parentDir, name, trash, sblock.TrashDir, trashName); err != nil {
+		log.Fatal("Unable to move inode ", inodeNum, " to the trash: ", err)
+	}
+	records = append(records, trashRecord{inodeNum: inodeNum, deleted: time.Now().Unix(), name: name, parentPath: parentPath})
+	writeTrashRecords(sblock, records)
+	syncBitmaps()
+}
+
+// purgeOldest takes a piece out of the oldest thing in the trash nobody is using (see removeDeepest),
+// and its record as well once the piece is the thing itself. It is its own operation, the caller can't
+// be in one. False if there was nothing it could purge
+func purgeOldest() bool {
+	beginOperation()
+	defer commitTransaction()
+	sblock := ReadSuperBlock()
+	if readOnly || !trashEnabled(sblock) || !tryLockInode(sblock.TrashDir) {
+		return false
+	}
+	defer unlockInode(sblock.TrashDir)
+	records := readTrashRecords(sblock)
+	for num, record := range records {
+		unlock, ok := tryLockTree(sblock, record.inodeNum)
+		if !ok {
+			continue //someone is still using it, it can go next time
+		}
+		defer unlock()
+		if removeDeepest(sblock, getInodeFromDisk(sblock.TrashDir), strconv.Itoa(record.inodeNum), record.inodeNum) {
+			writeTrashRecords(sblock, append(records[:num:num], records[num+1:]...))
+		}
+		syncBitmaps()
+		return true
+	}
+	return false
+}
+
+// purgeTrashForSpace throws out the oldest things in the trash until there is room for count blocks
+// and enough free space on top. It goes between operations, never inside one
+func purgeTrashForSpace(count int) {
+	for {
+		sblock := ReadSuperBlock()
+		if readOnly || !trashEnabled(sblock) ||
+			ReadFreeBlockBitmap(sblock).CountFree()-reservedFor() > count+sblock.ReservedBlocks+trashLowSpace(sblock) || !purgeOldest() {
+			return
+		}
+	}
+}
+
+// lockTrash locks the trash directory, if there is one, and returns the unlock
+func lockTrash() func() {
+	return lockInodes([]int{ReadSuperBlock().TrashDir}, nil)
+}
+
+// SetTrash turns the trash on or off. Turning it off empties it
+func SetTrash(enabled bool) error {
+	defer lockExclusive()()
+	if readOnly {
+		return fmt.Errorf("file system is mounted read only")
+	}
+	sblock := ReadSuperBlock()
+	if trashEnabled(sblock) == enabled {
+		return nil
+	}
+	if !enabled {
+		return disableTrash()
+	}
+	root := getInodeFromDisk(sblock.RootDirInode)
+	if _, existing := openFile(READ, TRASH_DIR_NAME, root); existing != 0 {
+		return fmt.Errorf("there is already something called %s in the root directory", TRASH_DIR_NAME)
+	}
+	if !hasRoomFor(sblock, root, TRASH_DIR_NAME) {
+		return fmt.Errorf("the root directory is full, there is no room for %s", TRASH_DIR_NAME)
+	}
+	credits, err := journalRoom(sblock, sblock.VersionsKept, true, dataMode)
+	if err != nil {
+		return fmt.Errorf("can't turn the trash on: %w", err)
+	}
+	beginTransaction()
+	defer commitTransaction()
+	_, trashNum := openFile(CREATE, TRASH_DIR_NAME, root)
+	_, trash := createDirectoryFile(sblock.RootDirInode, trashNum)
+	openFile(CREATE, TRASH_INDEX_NAME, trash)
+	sblock = ReadSuperBlock()
+	sblock.TrashDir = trashNum
+	writeSuperBlock(sblock)
+	operationCredits = credits
+	return nil
+}
+
+// disableTrash empties the trash and then takes the directory away, the index and anything that somehow
+// got in without a record go a piece at a time like the rest
+func disableTrash() error {
+	if err := emptyTrash(); err != nil {
+		return err
+	}
+	for {
+		beginTransaction()
+		sblock := ReadSuperBlock()
+		trash := getInodeFromDisk(sblock.TrashDir)
+		if entries := directoryEntries(sblock, trash); len(entries) > 0 {
+			removeDeepest(sblock, trash, entryName(entries[0]), entries[0].Inode)
+			syncBitmaps()
+			commitTransaction()
+			continue
+		}
+		trashNum := sblock.TrashDir
+		sblock.TrashDir = 0
+		writeSuperBlock(sblock)
+		unlinkEntry(sblock, trashNum, TRASH_DIR_NAME, getInodeFromDisk(sblock.RootDirInode))
+		commitTransaction()
+		operationCredits, _ = journalRoom(sblock, sblock.VersionsKept, false, dataMode) //less than with it on
+		return nil
+	}
+}
+
+// ListTrash lists what is in the trash, oldest first
+func ListTrash() ([]TrashEntry, error) {
+	defer lockShared()()
+	if Disk == nil {
+		return nil, fmt.Errorf("there is no file system mounted")
+	}
+	sblock := ReadSuperBlock()
+	if !trashEnabled(sblock) {
+		return nil, fmt.Errorf("the trash is turned off")
+	}
+	defer lockInodes(nil, []int{sblock.TrashDir})()
+	trash := getInodeFromDisk(sblock.TrashDir)
+	_, indexNum := openFile(READ, TRASH_INDEX_NAME, trash)
+	if indexNum == 0 {
+		return []TrashEntry{}, nil //can't make one if we are read only, and it would be empty anyway
+	}
+	entries := []TrashEntry{}
+	for _, record := range readTrashRecords(sblock) {
+		entries = append(entries, TrashEntry{
+			InodeNum: record.inodeNum,
+			Path:     strings.TrimSuffix(record.parentPath, "/") + "/" + record.name,
+			Deleted:  time.Unix(record.deleted, 0),
+		})
+	}
+	return entries, nil
+}
+
+// Restore puts something back where it was deleted from. If the path was too long to remember it
+// goes in the root directory
+func Restore(inodeNum int) error {
+	defer lockExclusive()()
+	if readOnly {
+		return fmt.Errorf("file system is mounted read only")
+	}
+	sblock := ReadSuperBlock()
+	if !trashEnabled(sblock) {
+		return fmt.Errorf("the trash is turned off")
+	}
+	defer lockTrash()()
+	beginTransaction()
+	defer commitTransaction()
+	records := readTrashRecords(sblock)
+	for num, record := range records {
+		if record.inodeNum != inodeNum {
+			continue
+		}
+		dir, dirNum, err := lookupDirectory(sblock, record.parentPath)
+		if err != nil {
+			return err
+		}
+		if _, existing := openFile(READ, record.name, dir); existing != 0 {
+			return fmt.Errorf("can't restore %s, something else has that name now", strings.TrimSuffix(record.parentPath, "/")+"/"+record.name)
+		}
+		if err := moveEntry(sblock, inodeNum, getInodeFromDisk(sblock.TrashDir), strconv.Itoa(inodeNum), dir, dirNum, record.name); err != nil {
+			return err
+		}
+		writeTrashRecords(sblock, append(records[:num:num], records[num+1:]...))
+		syncBitmaps()
+		return nil
+	}
+	return fmt.Errorf("inode %d isn't in the trash", inodeNum)
+}
+
+// EmptyTrash deletes everything in the trash for real
+func EmptyTrash() error {
+	defer lockExclusive()()
+	return emptyTrash()
+}
+
+// emptyTrash is EmptyTrash for when we already have the file system to ourselves. Nobody else is
+// using anything, so purgeOldest never has to skip something
+func emptyTrash() error {
+	if readOnly {
+		return fmt.Errorf("file system is mounted read only")
+	}
+	if !trashEnabled(ReadSuperBlock()) {
+		return fmt.Errorf("the trash is turned off")
+	}
+	for purgeOldest() {
+	}
+	return nil
+}
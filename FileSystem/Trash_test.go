@@ -0,0 +1,124 @@
+package FileSystem
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// trashPaths is the Path of everything in the trash, oldest first
+func trashPaths(t *testing.T) []string {
+	t.Helper()
+	trash, err := ListTrash()
+	if err != nil {
+		t.Fatalf("ListTrash: %v", err)
+	}
+	paths := []string{}
+	for _, entry := range trash {
+		paths = append(paths, entry.Path)
+	}
+	return paths
+}
+
+// TestTrashRestoreAndPurge puts a file and a directory with things in it in the trash, restores them,
+// puts them back in the trash and fills the disk until it has to give blocks back. The oldest go first
+func TestTrashRestoreAndPurge(t *testing.T) {
+	device := newTestFileSystem(t, 4<<20, DefaultOptions())
+	if err := SetTrash(true); err != nil {
+		t.Fatal(err)
+	}
+	sblock := ReadSuperBlock()
+	innerContent := strings.Repeat("i", 40*sblock.BlockSize) //more than a fill file, so purging it is enough
+	_, dirNum := Open(CREATE, "dir", RootFolder)
+	_, dir := CreateDirectoryFile(sblock.RootDirInode, dirNum)
+	inner := createTestFile(t, dir, "inner", innerContent)
+	file := createTestFile(t, dir, "file", "file")
+	free := Statfs().FreeBlocks
+
+	if err := UnlinkName("file", dir); err != nil {
+		t.Fatalf("UnlinkName file: %v", err)
+	}
+	if err := UnlinkName("dir", RootFolder); err != nil {
+		t.Fatalf("UnlinkName dir: %v", err)
+	}
+	if paths := trashPaths(t); fmt.Sprint(paths) != "[/dir/file /dir]" {
+		t.Fatalf("the trash has %v in it", paths)
+	}
+	if Statfs().FreeBlocks > free {
+		t.Fatalf("putting things in the trash freed blocks")
+	}
+	checkFsck(t)
+	remount(t, device)
+	checkFsck(t)
+
+	//dir has to come back before file can go back in it
+	if err := Restore(file); err == nil {
+		t.Fatalf("restored a file into a directory that is in the trash")
+	}
+	if err := Restore(dirNum); err != nil {
+		t.Fatalf("Restore dir: %v", err)
+	}
+	if err := Restore(file); err != nil {
+		t.Fatalf("Restore file: %v", err)
+	}
+	dir, _ = Open(READ, "dir", RootFolder)
+	if content, num := readTestFile(dir, "inner"); num != inner || content != innerContent {
+		t.Fatalf("inner came back as inode %d holding %.20q", num, content)
+	}
+	if content, num := readTestFile(dir, "file"); num != file || content != "file" {
+		t.Fatalf("file came back as inode %d holding %q", num, content)
+	}
+	if paths := trashPaths(t); len(paths) != 0 {
+		t.Fatalf("the trash still has %v in it", paths)
+	}
+	checkFsck(t)
+
+	//now the trash is all that stands between the disk and full, so it has to give way
+	if err := UnlinkName("dir", RootFolder); err != nil {
+		t.Fatalf("UnlinkName dir: %v", err)
+	}
+	createTestFile(t, RootFolder, "small", "small")
+	if err := UnlinkName("small", RootFolder); err != nil {
+		t.Fatalf("UnlinkName small: %v", err)
+	}
+	for num := 0; getInodeFromDisk(inner).IsValid; num++ {
+		if Statfs().AvailableBlocks < 25 { //too few for another fill file and its indirect block
+			t.Fatalf("the disk filled up and the trash still has %v in it", trashPaths(t))
+		}
+		createTestFile(t, RootFolder, fmt.Sprint("fill", num), strings.Repeat("x", 20*sblock.BlockSize))
+	}
+	if paths := trashPaths(t); len(paths) == 0 || paths[len(paths)-1] != "/small" {
+		t.Fatalf("the trash has %v in it after running low on space, the oldest should have gone", paths)
+	}
+	checkFsck(t)
+	remount(t, device)
+	checkFsck(t)
+	if err := EmptyTrash(); err != nil {
+		t.Fatal(err)
+	}
+	if paths := trashPaths(t); len(paths) != 0 {
+		t.Fatalf("the trash has %v in it after emptying it", paths)
+	}
+	checkFsck(t)
+}
+
+// TestTrashRestoreNameTaken restores a file from the root whose name has been taken since, the error
+// has to name it by its path
+func TestTrashRestoreNameTaken(t *testing.T) {
+	newTestFileSystem(t, 2<<20, DefaultOptions())
+	if err := SetTrash(true); err != nil {
+		t.Fatal(err)
+	}
+	old := createTestFile(t, RootFolder, "file", "old")
+	if err := UnlinkName("file", RootFolder); err != nil {
+		t.Fatalf("UnlinkName: %v", err)
+	}
+	createTestFile(t, RootFolder, "file", "new")
+	if err := Restore(old); err == nil || !strings.Contains(err.Error(), "restore /file,") {
+		t.Fatalf("restoring over a new file gave %v", err)
+	}
+	if content, _ := readTestFile(RootFolder, "file"); content != "new" {
+		t.Fatalf("file holds %q after the refused restore", content)
+	}
+	checkFsck(t)
+}
@@ -0,0 +1,205 @@
+package FileSystem
+
+import (
+	"fmt"
+	"time"
+)
+
+// Version history
+// Every Write bumps the file's Version. With VersionsKept set, Write first saves what was on Disk as
+// an old version: a hidden inode that isn't in any directory, sharing the data blocks with the file
+// the same way CloneFile does, so keeping a version only costs the blocks the new Write changes.
+// The file's PrevVersion points at its newest old version, which points at the one before, and so on.
+// After every Write the chain gets cut back to VersionsKept versions, dropping any older than
+// VersionMaxAge seconds on the way, and the blocks only the dropped versions were using are freed.
+
+// FileVersion describes one old version of a file
+type FileVersion struct {
+	Version  int
+	Modified time.Time //when this version was written
+}
+
+// SetVersionPolicy sets how many old versions Write keeps of each file and for how long, 0 versions
+// turns it off and 0 maxAge keeps them however old they are. Versions the new policy doesn't allow
+// are dropped straight away, a file at a time, before the new policy is written down. A crash in
+// between leaves some files with fewer versions than the old policy allows, never more than the new one
+func SetVersionPolicy(maxVersions int, maxAge time.Duration) error {
+	if maxVersions < 0 || maxAge < 0 {
+		return fmt.Errorf("version policy can't be negative")
+	}
+	defer lockExclusive()()
+	if readOnly {
+		return fmt.Errorf("file system is mounted read only")
+	}
+	if err := writeDelayedWrites(); err != nil { //writes don't wait while versions are kept
+		return err
+	}
+	sblock := ReadSuperBlock()
+	credits, err := journalRoom(sblock, maxVersions, trashEnabled(sblock), dataMode)
+	if err != nil {
+		return fmt.Errorf("can't keep %d versions: %w", maxVersions, err)
+	}
+	policy := sblock
+	policy.VersionsKept = maxVersions
+	policy.VersionMaxAge = int(maxAge / time.Second)
+	for inodeNum := 1; inodeNum < sblock.InodeCount; inodeNum++ {
+		inode := getInodeFromDisk(inodeNum)
+		//old versions have no links, only the files themselves get pruned
+		if inode.IsValid && !inode.IsDirectory && inode.LinksCount > 0 && inode.PrevVersion != 0 {
+			beginTransaction()
+			pruneVersions(policy, &inode)
+			writeInodeToDisk(&inode, inodeNum, sblock)
+			syncBitmaps()
+			commitTransaction()
+		}
+	}
+	beginTransaction()
+	defer commitTransaction()
+	sblock = ReadSuperBlock()
+	sblock.VersionsKept = policy.VersionsKept
+	sblock.VersionMaxAge = policy.VersionMaxAge
+	writeSuperBlock(sblock)
+	operationCredits = credits
+	return nil
+}
+
+// saveVersion copies current into a new hidden inode, sharing its blocks, and returns the inode number
+func saveVersion(sblock SuperBlock, current *INode) int {
+	version, versionNum := createNewInode(sblock, current.DirectBlock1)
+	version.LinksCount = 0 //no directory points at an old version
+	version.Version = current.Version
+	version.CreateTime = current.CreateTime
+	version.LastModifyTime = current.LastModifyTime
+	version.PrevVersion = current.PrevVersion
+	shareFileBlocks(sblock, current, &version)
+	writeInodeToDisk(&version, versionNum, sblock)
+	return versionNum
+}
+
+// pruneVersions cuts file's chain of old versions back to what the policy allows. The caller writes file
+func pruneVersions(sblock SuperBlock, file *INode) {
+	oldest := time.Now().Unix() - int64(sblock.VersionMaxAge)
+	kept := 0
+	prev := file
+	prevNum := 0
+	for versionNum := file.PrevVersion; versionNum != 0; {
+		version := getInodeFromDisk(versionNum)
+		if kept >= sblock.VersionsKept || (sblock.VersionMaxAge > 0 && version.LastModifyTime < oldest) {
+			prev.PrevVersion = 0
+			if prevNum != 0 {
+				writeInodeToDisk(prev, prevNum, sblock)
+			}
+			freeVersions(sblock, versionNum)
+			return
+		}
+		kept++
+		prev, prevNum = &version, versionNum
+		versionNum = version.PrevVersion
+	}
+}
+
+// freeVersions frees the version inode versionNum and every version older than it
+func freeVersions(sblock SuperBlock, versionNum int) {
+	for versionNum != 0 {
+		version := getInodeFromDisk(versionNum)
+		next := version.PrevVersion
+		freeFileBlocks(sblock, &version)
+		version.IsValid = false
+		version.PrevVersion = 0
+		writeInodeToDisk(&version, versionNum, sblock)
+		ReadINodeBitmap(sblock).Clear(versionNum)
+		versionNum = next
+	}
+}
+
+// versionedFile checks inodeNum is a file and returns it
+func versionedFile(inodeNum int) (INode, error) {
+	if Disk == nil {
+		return INode{}, fmt.Errorf("there is no file system mounted")
+	}
+	sblock := ReadSuperBlock()
+	if inodeNum <= 0 || inodeNum >= sblock.InodeCount {
+		return INode{}, fmt.Errorf("inode %d doesn't exist", inodeNum)
+	}
+	file := getInodeFromDisk(inodeNum)
+	if !file.IsValid || file.IsDirectory {
+		return INode{}, fmt.Errorf("inode %d isn't a file", inodeNum)
+	}
+	return file, nil
+}
+
+// findVersion returns the inode holding the given version of the file
+func findVersion(inodeNum int, versionWanted int) (INode, error) {
+	file, err := versionedFile(inodeNum)
+	if err != nil {
+		return INode{}, err
+	}
+	for versionNum := file.PrevVersion; versionNum != 0; {
+		version := getInodeFromDisk(versionNum)
+		if version.Version == versionWanted {
+			return version, nil
+		}
+		versionNum = version.PrevVersion
+	}
+	return INode{}, fmt.Errorf("inode %d has no version %d", inodeNum, versionWanted)
+}
+
+// ListVersions lists the old versions kept of a file, newest first. The file's current version is
+// its INode.Version and isn't in the list
+func ListVersions(inodeNum int) ([]FileVersion, error) {
+	defer lockShared()()
+	defer lockInodes(nil, []int{inodeNum})()
+	file, err := versionedFile(inodeNum)
+	if err != nil {
+		return nil, err
+	}
+	versions := []FileVersion{}
+	for versionNum := file.PrevVersion; versionNum != 0; {
+		version := getInodeFromDisk(versionNum)
+		versions = append(versions, FileVersion{Version: version.Version, Modified: time.Unix(version.LastModifyTime, 0)})
+		versionNum = version.PrevVersion
+	}
+	return versions, nil
+}
+
+// ReadVersion is Read for an old version of a file
+func ReadVersion(inodeNum int, version int) (string, error) {
+	defer lockShared()()
+	defer lockInodes(nil, []int{inodeNum})()
+	old, err := findVersion(inodeNum, version)
+	if err != nil {
+		return "", err
+	}
+	return readFile(&old), nil
+}
+
+// RestoreVersion makes an old version the file's contents again. It is a new version as far as the
+// history goes, so what the file had before is kept as well if the policy says to
+func RestoreVersion(inodeNum int, version int) error {
+	defer lockShared()()
+	beginOperation()
+	defer endOperation()
+	defer lockInodes([]int{inodeNum}, nil)()
+	if readOnly {
+		return fmt.Errorf("file system is mounted read only")
+	}
+	old, err := findVersion(inodeNum, version)
+	if err != nil {
+		return err
+	}
+	beginTransaction()
+	defer commitTransaction()
+	sblock := ReadSuperBlock()
+	file := getInodeFromDisk(inodeNum)
+	if sblock.VersionsKept > 0 && file.DirectBlock1 != 0 {
+		file.PrevVersion = saveVersion(sblock, &file)
+	}
+	freeFileBlocks(sblock, &file)
+	shareFileBlocks(sblock, &old, &file)
+	file.Version++
+	file.LastModifyTime = time.Now().Unix()
+	pruneVersions(sblock, &file)
+	writeInodeToDisk(&file, inodeNum, sblock)
+	syncBitmaps()
+	return nil
+}
@@ -0,0 +1,81 @@
+package FileSystem
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestVersionHistory keeps two old versions of a file that runs into its indirect block, reads and
+// restores them, and then turns versions off. The old versions share what they can with the file,
+// and once they are dropped their blocks have to be free again
+func TestVersionHistory(t *testing.T) {
+	device := newTestFileSystem(t, 4<<20, DefaultOptions())
+	blockSize := ReadSuperBlock().BlockSize
+	if err := SetVersionPolicy(2, 0); err != nil {
+		t.Fatalf("SetVersionPolicy: %v", err)
+	}
+	contents := map[int]string{}
+	inodeNum := createTestFile(t, RootFolder, "file", "")
+	free := Statfs().FreeBlocks
+	for version, fill := range []string{"1", "2", "3", "4"} {
+		contents[version+2] = strings.Repeat(fill, 5*blockSize)
+		file := getInodeFromDisk(inodeNum)
+		if err := Write(&file, inodeNum, []byte(contents[version+2])); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	file := getInodeFromDisk(inodeNum)
+	if file.Version != 5 {
+		t.Fatalf("five writes left the file at version %d", file.Version)
+	}
+
+	checkVersions := func(want ...int) {
+		t.Helper()
+		versions, err := ListVersions(inodeNum)
+		if err != nil {
+			t.Fatalf("ListVersions: %v", err)
+		}
+		if len(versions) != len(want) {
+			t.Fatalf("ListVersions says %+v, wanted versions %v", versions, want)
+		}
+		for num, version := range versions {
+			if version.Version != want[num] {
+				t.Fatalf("ListVersions says %+v, wanted versions %v", versions, want)
+			}
+			if got, err := ReadVersion(inodeNum, version.Version); err != nil || strings.TrimRight(got, "\x00") != contents[version.Version] {
+				t.Fatalf("version %d holds %.10q... %v", version.Version, got, err)
+			}
+		}
+	}
+	checkVersions(4, 3)
+	if _, err := ReadVersion(inodeNum, 2); err == nil {
+		t.Fatalf("read version 2, the policy should have dropped it")
+	}
+	if err := RestoreVersion(inodeNum, 2); err == nil {
+		t.Fatalf("restored version 2, the policy should have dropped it")
+	}
+
+	if err := RestoreVersion(inodeNum, 3); err != nil {
+		t.Fatalf("RestoreVersion: %v", err)
+	}
+	contents[6] = contents[3]
+	if got, _ := readTestFile(RootFolder, "file"); got != contents[3] {
+		t.Fatalf("the restored file holds %.10q...", got)
+	}
+	checkVersions(5, 4)
+	checkFsck(t)
+	remount(t, device)
+	checkVersions(5, 4)
+	if got := getInodeFromDisk(inodeNum).Version; got != 6 {
+		t.Fatalf("the restore left the file at version %d", got)
+	}
+
+	if err := SetVersionPolicy(0, 0); err != nil {
+		t.Fatalf("SetVersionPolicy: %v", err)
+	}
+	checkVersions()
+	if used := free - Statfs().FreeBlocks; used != 6 {
+		t.Fatalf("with no versions kept a five block file is taking %d blocks", used)
+	}
+	checkFsck(t)
+}
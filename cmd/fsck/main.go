@@ -0,0 +1,69 @@
+package main
+
+import (
+	"Project2Demo/FileSystem"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// fsck checks an image and with -y fixes it, the exit codes are the same as e2fsck's:
+// 0 nothing wrong, 1 problems were fixed, 4 problems were left alone, 8 couldn't check at all
+// usage: fsck [-y] disk.img
+func main() {
+	repair := flag.Bool("y", false, "fix the problems instead of just reporting them")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: fsck [-y] <image>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(8)
+	}
+	device, err := FileSystem.OpenFileDevice(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't open image:", err)
+		os.Exit(8)
+	}
+	defer device.Close()
+	//without -y nothing gets written, so a journal that needs replaying is only replayed in memory
+	options := FileSystem.MountOptions{ReadOnly: !*repair, ReplayInMemory: !*repair, RepairSuperBlock: *repair}
+	if err := FileSystem.MountWithOptions(device, options); err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't mount image:", err)
+		os.Exit(8)
+	}
+	if backup := FileSystem.LastMount().BackupSuperBlock; backup != 0 {
+		fmt.Println("Primary superblock is damaged, using the backup at block", backup)
+	}
+	if replayed := FileSystem.LastMount().ReplayedBlocks; replayed != 0 {
+		fmt.Println("Replayed", replayed, "blocks from the journal")
+	}
+	if pending := FileSystem.LastMount().PendingBlocks; pending != 0 {
+		fmt.Println("Journal still has", pending, "blocks to replay, checking as if they had been")
+	}
+	report, err := FileSystem.Fsck(*repair)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "fsck failed:", err)
+		os.Exit(8)
+	}
+	if err := FileSystem.Sync(); err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't write the image back:", err)
+		os.Exit(8)
+	}
+	for _, problem := range report.Problems {
+		fmt.Println(problem)
+	}
+	stats := FileSystem.Statfs()
+	fmt.Printf("%s: %d/%d inodes, %d/%d blocks\n", flag.Arg(0), stats.TotalInodes-stats.FreeInodes, stats.TotalInodes,
+		stats.TotalBlocks-stats.FreeBlocks, stats.TotalBlocks)
+	switch {
+	case report.Clean():
+		os.Exit(0)
+	case report.Repaired:
+		fmt.Println("***** FILE SYSTEM WAS MODIFIED *****")
+		os.Exit(1)
+	default:
+		os.Exit(4)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"Project2Demo/FileSystem"
+	"fmt"
+	"os"
+)
+
+// fsdefrag moves the files in an image into contiguous runs of blocks, every file if no paths are given
+// usage: fsdefrag disk.img [path...]
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, "usage: fsdefrag <image> [path...]")
+		os.Exit(2)
+	}
+	device, err := FileSystem.OpenFileDevice(os.Args[1])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't open image:", err)
+		os.Exit(1)
+	}
+	defer device.Close()
+	if err := FileSystem.Mount(device); err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't mount image:", err)
+		os.Exit(1)
+	}
+	failed := false
+	if len(os.Args) == 2 {
+		report, err := FileSystem.DefragmentAll()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Couldn't defragment:", err)
+			os.Exit(1)
+		}
+		printReport(os.Args[1], report)
+	}
+	for _, path := range os.Args[2:] {
+		report, err := FileSystem.Defragment(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't defragment %s: %v\n", path, err)
+			failed = true
+			continue
+		}
+		printReport(path, report)
+	}
+	if err := FileSystem.Sync(); err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't write the image back:", err)
+		os.Exit(1)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func printReport(name string, report FileSystem.DefragReport) {
+	fmt.Printf("%s: fragmentation %.1f -> %.1f, moved %d of %d files (%d blocks), %d couldn't be moved\n", name,
+		report.ScoreBefore, report.ScoreAfter, report.FilesMoved, report.Files, report.BlocksMoved, report.Skipped)
+}
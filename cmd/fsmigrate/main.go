@@ -0,0 +1,40 @@
+package main
+
+import (
+	"Project2Demo/FileSystem"
+	"fmt"
+	"log"
+	"os"
+)
+
+// fsmigrate converts an image written with the old gob encoding into the binary format
+// usage: fsmigrate old.img new.img
+func main() {
+	if len(os.Args) != 3 {
+		fmt.Fprintln(os.Stderr, "usage: fsmigrate <gob image> <output image>")
+		os.Exit(2)
+	}
+	oldImage, err := os.ReadFile(os.Args[1])
+	if err != nil {
+		log.Fatal("Couldn't read image: ", err)
+	}
+	//work on a copy so a failed migration doesn't wreck the original
+	if err := os.WriteFile(os.Args[2], oldImage, 0644); err != nil {
+		log.Fatal("Couldn't write output image: ", err)
+	}
+	device, err := FileSystem.OpenFileDevice(os.Args[2])
+	if err != nil {
+		log.Fatal("Couldn't open output image: ", err)
+	}
+	defer device.Close()
+	if !FileSystem.IsGobImage(device) {
+		log.Fatal(os.Args[1], " is not a gob encoded image, nothing to migrate")
+	}
+	if err := FileSystem.MigrateGobImage(device); err != nil {
+		log.Fatal("Migration failed: ", err)
+	}
+	if err := FileSystem.Sync(); err != nil {
+		log.Fatal("Couldn't write the image back: ", err)
+	}
+	fmt.Println("migrated", os.Args[1], "to", os.Args[2])
+}
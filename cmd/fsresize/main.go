@@ -0,0 +1,48 @@
+package main
+
+import (
+	"Project2Demo/FileSystem"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// fsresize makes the file system in an image bigger or smaller, the image file changes size to match
+// usage: fsresize disk.img blocks
+// Copy on write file systems can't be resized, and one made without block groups can only grow as far
+// as its free block bitmap has room for, which was fixed when it was formatted (see FileSystem.Resize)
+func main() {
+	if len(os.Args) != 3 {
+		fmt.Fprintln(os.Stderr, "usage: fsresize <image> <blocks>")
+		fmt.Fprintln(os.Stderr, "copy on write file systems can't be resized, and without block groups a file system can't")
+		fmt.Fprintln(os.Stderr, "grow past what its free block bitmap had room for when it was formatted")
+		os.Exit(2)
+	}
+	blocks, err := strconv.Atoi(os.Args[2])
+	if err != nil || blocks <= 0 {
+		fmt.Fprintln(os.Stderr, "Block count has to be a positive number:", os.Args[2])
+		os.Exit(2)
+	}
+	device, err := FileSystem.OpenFileDevice(os.Args[1])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't open image:", err)
+		os.Exit(1)
+	}
+	defer device.Close()
+	if err := FileSystem.Mount(device); err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't mount image:", err)
+		os.Exit(1)
+	}
+	before, inodesBefore := FileSystem.ReadSuperBlock(), FileSystem.Statfs().TotalInodes
+	if err := FileSystem.Resize(blocks); err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't resize:", err)
+		os.Exit(1)
+	}
+	if err := FileSystem.Sync(); err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't write the image back:", err)
+		os.Exit(1)
+	}
+	after, inodesAfter := FileSystem.ReadSuperBlock(), FileSystem.Statfs().TotalInodes
+	fmt.Printf("%s: %d -> %d blocks, %d -> %d inodes, %d blocks free\n", os.Args[1],
+		before.BlockCount, after.BlockCount, inodesBefore, inodesAfter, after.FreeBlocks)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"Project2Demo/FileSystem"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// mkfs makes a new file system in an image. With a size the image is created (or cut) to that size first,
+// without one the existing image is used as it is
+// usage: mkfs [options] disk.img [size]
+func main() {
+	defaults := FileSystem.DefaultOptions()
+	options := FileSystem.Options{}
+	flag.IntVar(&options.BlockSize, "b", defaults.BlockSize, "block size in bytes")
+	flag.IntVar(&options.BytesPerInode, "i", defaults.BytesPerInode, "bytes of disk for every inode")
+	flag.IntVar(&options.InodeSize, "I", defaults.InodeSize, "bytes per inode in the inode table")
+	flag.StringVar(&options.Label, "L", "", "volume label")
+	flag.IntVar(&options.ReservedPercent, "m", defaults.ReservedPercent, "percent of the blocks reserved for the -u uid")
+	flag.IntVar(&options.ReservedUID, "u", 0, "uid the reserved blocks are for")
+	flag.IntVar(&options.JournalBlocks, "J", 0, "journal size in blocks, 0 picks one from the size of the disk")
+	flag.BoolVar(&options.NoJournal, "no-journal", false, "leave the journal out")
+	flag.BoolVar(&options.CopyOnWrite, "cow", false, "make a copy on write file system instead of a journaled one")
+	flag.BoolVar(&options.NoBlockGroups, "no-groups", false, "one set of bitmaps and one inode table instead of block groups")
+	flag.BoolVar(&options.FixedInodes, "fixed-inodes", false, "the inode table never grows")
+	flag.BoolVar(&options.LinearDirs, "linear-dirs", false, "directories never get a hash tree index")
+	flag.StringVar(&options.Allocator, "a", "", "block allocator, one of "+strings.Join(FileSystem.Allocators(), ", "))
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: mkfs [options] <image> [size[K|M|G]]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 || flag.NArg() > 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	var device *FileSystem.FileDevice
+	var err error
+	if flag.NArg() == 2 {
+		size, ok := parseSize(flag.Arg(1))
+		if !ok {
+			fmt.Fprintln(os.Stderr, "Size has to be a positive number of bytes, with K, M or G on the end for more:", flag.Arg(1))
+			os.Exit(2)
+		}
+		device, err = FileSystem.CreateFileDevice(flag.Arg(0), size)
+	} else {
+		device, err = FileSystem.OpenFileDevice(flag.Arg(0))
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't open image:", err)
+		os.Exit(1)
+	}
+	defer device.Close()
+	if err := FileSystem.Format(device, options); err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't format:", err)
+		os.Exit(1)
+	}
+	if err := FileSystem.Mount(device); err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't mount what we made:", err)
+		os.Exit(1)
+	}
+	sblock := FileSystem.ReadSuperBlock()
+	stats := FileSystem.Statfs()
+	if err := FileSystem.Sync(); err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't write the image back:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s: %d blocks of %d bytes, %d inodes, %d blocks free, %d reserved for uid %d\n", flag.Arg(0),
+		stats.TotalBlocks, stats.BlockSize, stats.TotalInodes, stats.FreeBlocks, stats.ReservedBlocks, stats.ReservedUID)
+	fmt.Printf("UUID %s, label %q\n", FileSystem.UUIDString(sblock.UUID), FileSystem.LabelString(sblock))
+}
+
+// parseSize reads a byte count with an optional K, M or G on the end
+func parseSize(arg string) (int64, bool) {
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(arg, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(arg, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(arg, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier != 1 {
+		arg = arg[:len(arg)-1]
+	}
+	size, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || size <= 0 {
+		return 0, false
+	}
+	return size * multiplier, true
+}